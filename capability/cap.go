@@ -16,15 +16,20 @@ var (
 	Batch            = Cap{Name: "batch"}
 	CapNotify        = Cap{Name: "cap-notify"}
 	EchoMessage      = Cap{Name: "echo-message"}
+	ChannelRename    = Cap{Name: "draft/channel-rename"}
+	MessageRedaction = Cap{Name: "draft/message-redaction"}
+	Metadata         = Cap{Name: "draft/metadata-2"}
+	Multiline        = Cap{Name: "draft/multiline"}
+	ReadMarker       = Cap{Name: "draft/read-marker"}
 	ExtendedJoin     = Cap{Name: "extended-join"}
 	ExtendedMonitor  = Cap{Name: "extended-monitor"}
 	InviteNotify     = Cap{Name: "invite-notify"}
 	LabeledResponses = Cap{Name: "labeled-response"}
 	MessageTags      = Cap{Name: "message-tags"}
 	MultiPrefix      = Cap{Name: "multi-prefix"}
-	SASL             = Cap{Name: "sasl", Value: "PLAIN,EXTERNAL,SCRAM-SHA-256"}
+	SASL             = Cap{Name: "sasl"}
 	ServerTime       = Cap{Name: "server-time"}
 	Setname          = Cap{Name: "setname"}
-	STS              = Cap{Name: "sts", Value: "port=%s,duration=%.f"}
+	STS              = Cap{Name: "sts"}
 	UserhostInNames  = Cap{Name: "userhost-in-names"}
 )
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/metadata"
 	"github.com/mitchr/gossip/scan/mode"
 	"github.com/mitchr/gossip/scan/msg"
 	"github.com/mitchr/gossip/scan/wild"
@@ -23,9 +24,11 @@ const (
 )
 
 type Channel struct {
-	// Name is case-insensitive, stored internally in lower-case
+	// Name is case-insensitive, stored internally in lower-case. Once
+	// the channel is in use, it is only changed by Rename.
 	Name     string
 	ChanType ChanType
+	nameLock sync.RWMutex
 
 	CreatedAt time.Time
 
@@ -45,9 +48,24 @@ type Channel struct {
 	Protected    bool
 	NoExternal   bool
 
+	// only clients that have authenticated with SASL may join
+	RegisteredOnly bool
+
+	// JoinLimit is the number of clients that can join the channel
+	// within JoinPeriod (+j). A JoinLimit of 0 disables throttling.
+	JoinLimit  int
+	JoinPeriod time.Duration
+
+	// MaxList is the maximum number of entries that the b, e, and I
+	// lists can each hold. A MaxList of 0 means the lists are unbounded.
+	MaxList int
+
 	// Invited is a list of client nicks who have been INVITEd
 	Invited []string
 
+	// key/value pairs set on the channel by its operators
+	Metadata metadata.Store
+
 	// map of Nick to undelying client
 	Members     map[string]*Member
 	membersLock sync.RWMutex
@@ -64,9 +82,20 @@ func New(name string, t ChanType) *Channel {
 }
 
 func (c *Channel) String() string {
+	c.nameLock.RLock()
+	defer c.nameLock.RUnlock()
+
 	return string(c.ChanType) + c.Name
 }
 
+// Rename gives the channel a new name, not including its ChanType
+func (c *Channel) Rename(name string) {
+	c.nameLock.Lock()
+	defer c.nameLock.Unlock()
+
+	c.Name = name
+}
+
 func (c *Channel) Len() int {
 	c.membersLock.RLock()
 	defer c.membersLock.RUnlock()
@@ -147,6 +176,13 @@ func (c *Channel) Modes() (modestr string, params []string) {
 	if c.NoExternal {
 		modestr += "n"
 	}
+	if c.RegisteredOnly {
+		modestr += "R"
+	}
+	if c.JoinLimit != 0 {
+		modestr += "j"
+		params = append(params, fmt.Sprintf("%d:%.f", c.JoinLimit, c.JoinPeriod.Seconds()))
+	}
 	return
 }
 
@@ -191,6 +227,7 @@ var (
 	ErrLimitReached = errors.New("ERR_CHANNELISFULL")
 	ErrNotInvited   = errors.New("ERR_INVITEONLYCHAN")
 	ErrBanned       = errors.New("ERR_BANNEDFROMCHAN")
+	ErrNeedAccount  = errors.New("ERR_NEEDREGGEDNICK")
 )
 
 // Admit adds a client to this channel. A client c is admitted to enter
@@ -201,6 +238,7 @@ var (
 //  4. if they have not been given an INVITE, their nickmask is in the inviteException list
 //  5. their nickmask is not included in the banlist
 //  6. if they are in the banlist, they are in the except list
+//  7. if this channel is registered only, the client has authenticated
 func (ch *Channel) Admit(c *client.Client, key string) error {
 	if ch.Key != key {
 		return ErrKeyMissing
@@ -208,6 +246,9 @@ func (ch *Channel) Admit(c *client.Client, key string) error {
 	if ch.Len() >= ch.Limit {
 		return ErrLimitReached
 	}
+	if ch.RegisteredOnly && !c.IsAuthenticated {
+		return ErrNeedAccount
+	}
 
 	if ch.Invite {
 		for _, v := range ch.InviteExcept {
@@ -247,6 +288,8 @@ var (
 	ErrNotInChan      = errors.New("")
 	ErrUnknownMode    = errors.New("")
 	ErrInvalidKey     = errors.New("")
+	ErrInvalidParam   = errors.New("")
+	ErrListFull       = errors.New("")
 )
 
 // ApplyMode applies the given mode to the channel. It does not
@@ -261,12 +304,20 @@ func (c *Channel) ApplyMode(m mode.Mode) error {
 				return fmt.Errorf("%w+k", ErrInvalidKey)
 			}
 		}
+		if m.ModeChar == 'j' && m.Type == mode.Add {
+			if _, _, ok := ParseJoinThrottle(m.Param); !ok {
+				return fmt.Errorf("%w%s", ErrInvalidParam, m.Param)
+			}
+		}
 
 		if (p.addConsumes && m.Type == mode.Add) || (p.remConsumes && m.Type == mode.Remove) {
 			if m.Param == "" { // mode should have a param but doesn't
 				return fmt.Errorf(":%w%s", ErrNeedMoreParams, m)
 			}
 		}
+		if p.canList && m.Type == mode.Add && c.MaxList != 0 && len(c.list(m.ModeChar)) >= c.MaxList {
+			return fmt.Errorf("%w%s", ErrListFull, m.Param)
+		}
 		p.apply(c, m.Param, m.Type == mode.Add)
 	} else if _, ok := memberLetter[m.ModeChar]; ok { // should apply this prefix to a member, not the channel
 		// all user MODE changes should have a param
@@ -289,6 +340,37 @@ func (c *Channel) ApplyMode(m mode.Mode) error {
 	return nil
 }
 
+// ParseJoinThrottle parses a +j parameter of the form 'joins:seconds'.
+func ParseJoinThrottle(param string) (joins int, period time.Duration, ok bool) {
+	j, sec, found := strings.Cut(param, ":")
+	if !found {
+		return 0, 0, false
+	}
+
+	joins, err := strconv.Atoi(j)
+	if err != nil || joins < 1 {
+		return 0, 0, false
+	}
+	seconds, err := strconv.Atoi(sec)
+	if err != nil || seconds < 1 {
+		return 0, 0, false
+	}
+	return joins, time.Duration(seconds) * time.Second, true
+}
+
+// list returns the list associated with a listable mode char
+func (c *Channel) list(modeChar byte) []string {
+	switch modeChar {
+	case 'b':
+		return c.Ban
+	case 'e':
+		return c.BanExcept
+	case 'I':
+		return c.InviteExcept
+	}
+	return nil
+}
+
 func keyIsValid(key string) bool {
 	return key != "" && !strings.ContainsAny(key, "\000\r\n\t\v ") && len(key) < 23
 }
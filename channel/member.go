@@ -20,6 +20,18 @@ func (m Member) Is(p prefix) bool {
 	}
 }
 
+// HasRank returns true if the member's highest prefix is ranked at
+// least as high as p.
+func (m Member) HasRank(p prefix) bool {
+	if m.Prefix == 0 {
+		return false
+	}
+	// prefixes are ordered from highest to lowest rank, so the lowest
+	// set bit is the member's highest prefix
+	highest := m.Prefix & -m.Prefix
+	return highest <= p
+}
+
 // Returns the highest prefix that the member has. If multiPrefix is
 // true, returns all the modes that this member has in order of rank.
 func (m Member) HighestPrefix(multiPrefix bool) string {
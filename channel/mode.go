@@ -62,6 +62,21 @@ func (p prefix) modeLetters() string {
 	return s
 }
 
+// StatusPrefix returns the prefix that a STATUSMSG target like
+// '@#chan' begins with. If target is not a prefix symbol followed by a
+// channel name, ok is false.
+func StatusPrefix(target string) (p prefix, ok bool) {
+	if len(target) < 3 || (ChanType(target[1]) != Remote && ChanType(target[1]) != Local) {
+		return 0, false
+	}
+	for i := Founder; i <= Voice; i <<= 1 {
+		if i.String()[0] == target[0] {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 var memberLetter = map[byte]prefix{
 	'q': Founder,
 	'a': Protected,
@@ -93,6 +108,8 @@ var channelLetter = map[byte]struct {
 	's': {secret, false, false, false},
 	't': {protected, false, false, false},
 	'n': {noExternal, false, false, false},
+	'R': {registeredOnly, false, false, false},
+	'j': {joinThrottle, true, false, false},
 }
 
 func ban(ch *Channel, mask string, add bool) {
@@ -156,3 +173,13 @@ func moderated(ch *Channel, p string, add bool)  { ch.Moderated = add }
 func secret(ch *Channel, p string, add bool)     { ch.Secret = add }
 func protected(ch *Channel, p string, add bool)  { ch.Protected = add }
 func noExternal(ch *Channel, p string, add bool) { ch.NoExternal = add }
+
+func registeredOnly(ch *Channel, p string, add bool) { ch.RegisteredOnly = add }
+
+func joinThrottle(ch *Channel, param string, add bool) {
+	if add {
+		ch.JoinLimit, ch.JoinPeriod, _ = ParseJoinThrottle(param)
+	} else {
+		ch.JoinLimit, ch.JoinPeriod = 0, 0
+	}
+}
@@ -0,0 +1,351 @@
+package client
+
+import (
+	"net"
+	"sync"
+
+	cap "github.com/mitchr/gossip/capability"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// An always-on client is not tied to any single connection. It stays
+// registered (keeping its nick and channels) after its account's
+// connections close, and any number of connections, called sessions,
+// can be attached to it at once. Everything written to an always-on
+// client is written to each of its sessions; messages that arrive
+// while no sessions are attached are kept so that they can be replayed
+// later.
+//
+// The sessions of an always-on client act on it one at a time, by
+// handing what they do to the goroutine that owns it with Do.
+type alwaysOn struct {
+	addr net.Addr
+
+	// functions waiting to be run by the goroutine that owns the client,
+	// which stops once stopped is closed
+	queued  chan func()
+	stopped chan struct{}
+
+	lock     sync.Mutex
+	sessions []*Client
+	// messages received while no sessions were attached, oldest first.
+	// Each entry is either a single message, or every message of a
+	// multiline batch.
+	missed [][]*msg.Message
+	// the maximum number of missed entries that are kept
+	replay int
+	closed bool
+}
+
+// NewAlwaysOn creates an always-on client that takes its identity from
+// the already registered client from. from is not attached; use
+// AttachSession for that. At most replay missed messages are kept.
+func NewAlwaysOn(from *Client, replay int) *Client {
+	return newAlwaysOn(from, from.RemoteAddr(), replay)
+}
+
+// ResumeAlwaysOn recreates an always-on client that was handed over by
+// the process that this one replaced. Its identity is taken from from,
+// which does not need a connection, and it has already missed the
+// messages in missed.
+func ResumeAlwaysOn(from *Client, addr net.Addr, replay int, missed [][]*msg.Message) *Client {
+	c := newAlwaysOn(from, addr, replay)
+	c.alwaysOn.missed = missed
+	return c
+}
+
+func newAlwaysOn(from *Client, addr net.Addr, replay int) *Client {
+	c := &Client{
+		flushed:  make(chan struct{}),
+		writeErr: make(chan error),
+
+		Nick:     from.Nick,
+		User:     from.User,
+		Realname: from.Realname,
+		Host:     from.Host,
+
+		JoinTime: from.JoinTime,
+		Idle:     from.Idle,
+		Mode:     from.Mode,
+
+		Caps:       make(map[string]bool),
+		CapVersion: from.capVersion(),
+
+		SASLMech:        from.SASLMech,
+		IsAuthenticated: from.IsAuthenticated,
+
+		alwaysOn: &alwaysOn{
+			addr:    addr,
+			replay:  replay,
+			queued:  make(chan func()),
+			stopped: make(chan struct{}),
+		},
+	}
+	for _, k := range from.CapsList() {
+		c.Caps[k] = true
+	}
+	c.lastRead.Store(from.lastRead.Load())
+	go c.alwaysOn.own()
+	return c
+}
+
+func (a *alwaysOn) own() {
+	for {
+		select {
+		case f := <-a.queued:
+			f()
+		case <-a.stopped:
+			return
+		}
+	}
+}
+
+// Do runs f on the goroutine that owns the always-on client c, and
+// waits for it to return. f must not call Do itself. Once c has been
+// closed, f is run by the caller instead.
+func (c *Client) Do(f func()) {
+	done := make(chan struct{})
+	select {
+	case c.alwaysOn.queued <- func() { defer close(done); f() }:
+		<-done
+	case <-c.alwaysOn.stopped:
+		f()
+	}
+}
+
+// IsAlwaysOn returns true if c was created with NewAlwaysOn.
+func (c *Client) IsAlwaysOn() bool { return c.alwaysOn != nil }
+
+// AttachedTo returns the always-on client that the session c was
+// attached to, or nil if c is an ordinary client. This remains set
+// after c is detached.
+func (c *Client) AttachedTo() *Client { return c.attachedTo }
+
+// AttachSession starts sending everything written to c to session as
+// well. The messages that c missed while it had no sessions are
+// returned and forgotten, with multiline batches kept together.
+func (c *Client) AttachSession(session *Client) [][]*msg.Message {
+	a := c.alwaysOn
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	session.attachedTo = c
+	a.sessions = append(a.sessions, session)
+	c.syncCaps()
+
+	missed := a.missed
+	a.missed = nil
+	return missed
+}
+
+// Missed returns the messages that c has missed while it had no
+// sessions, oldest first. If c is not an always-on client, this is nil.
+func (c *Client) Missed() [][]*msg.Message {
+	if c.alwaysOn == nil {
+		return nil
+	}
+	c.alwaysOn.lock.Lock()
+	defer c.alwaysOn.lock.Unlock()
+	return append([][]*msg.Message(nil), c.alwaysOn.missed...)
+}
+
+// DetachSession stops sending messages to session. It returns the
+// number of sessions that are still attached, and false if session was
+// not attached to c.
+func (c *Client) DetachSession(session *Client) (int, bool) {
+	a := c.alwaysOn
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for i, v := range a.sessions {
+		if v == session {
+			a.sessions = append(a.sessions[:i], a.sessions[i+1:]...)
+			c.syncCaps()
+			return len(a.sessions), true
+		}
+	}
+	return len(a.sessions), false
+}
+
+// Sessions returns the sessions that are attached to c. If c is not an
+// always-on client, this is nil.
+func (c *Client) Sessions() []*Client {
+	if c.alwaysOn == nil {
+		return nil
+	}
+	c.alwaysOn.lock.Lock()
+	defer c.alwaysOn.lock.Unlock()
+	return append([]*Client(nil), c.alwaysOn.sessions...)
+}
+
+// SyncCaps updates the capabilities of an always-on client after the
+// capabilities of one of its sessions have changed.
+func (c *Client) SyncCaps() {
+	c.alwaysOn.lock.Lock()
+	defer c.alwaysOn.lock.Unlock()
+	c.syncCaps()
+}
+
+// an always-on client has the capabilities that all of its sessions
+// share, so that nothing is sent to a session that it does not
+// understand. If there are no sessions, the capabilities are left as
+// they were.
+func (c *Client) syncCaps() {
+	sessions := c.alwaysOn.sessions
+	if len(sessions) == 0 {
+		return
+	}
+
+	caps := make(map[string]bool)
+	for _, k := range sessions[0].CapsList() {
+		shared := true
+		for _, v := range sessions[1:] {
+			if !v.HasCap(k) {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			caps[k] = true
+		}
+	}
+
+	version := sessions[0].capVersion()
+	for _, v := range sessions[1:] {
+		if v := v.capVersion(); v < version {
+			version = v
+		}
+	}
+
+	c.capsLock.Lock()
+	defer c.capsLock.Unlock()
+	c.Caps = caps
+	c.CapVersion = version
+}
+
+func (c *Client) capVersion() int {
+	c.capsLock.RLock()
+	defer c.capsLock.RUnlock()
+	return c.CapVersion
+}
+
+// writeSessions writes b to every session. Sessions that cannot accept
+// tags are given untagged instead.
+func (a *alwaysOn) writeSessions(b, untagged []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.write(b, untagged)
+}
+
+func (a *alwaysOn) write(b, untagged []byte) {
+	for _, v := range a.sessions {
+		if v.HasMessageTags() || v.HasCap(cap.ServerTime.Name) {
+			v.Write(b)
+		} else {
+			v.Write(untagged)
+		}
+	}
+}
+
+// writeMessage sends m to every session, or keeps it to be replayed if
+// there are no sessions.
+func (a *alwaysOn) writeMessage(m msg.Msg) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.sessions) == 0 {
+		a.keep(m)
+		return
+	}
+	a.write(m.Bytes(), m.RemoveAllTags().Bytes())
+}
+
+// keep remembers m if it is a message that should be replayed. A
+// multiline batch is kept as a single entry, so that it is never
+// partly replayed.
+func (a *alwaysOn) keep(m msg.Msg) {
+	if a.replay <= 0 || a.closed {
+		return
+	}
+
+	switch m := m.(type) {
+	case *msg.Message:
+		if replayable(m) {
+			a.remember([]*msg.Message{m.Copy()})
+		}
+	case *msg.Buffer:
+		var group []*msg.Message
+		for _, v := range m.Messages() {
+			if v, ok := v.(*msg.Message); ok {
+				group = append(group, v.Copy())
+			}
+		}
+		if len(group) > 0 && isMultiline(group[0]) {
+			a.remember(group)
+			return
+		}
+		for _, v := range group {
+			if replayable(v) {
+				a.remember([]*msg.Message{v})
+			}
+		}
+	}
+}
+
+func (a *alwaysOn) remember(entry []*msg.Message) {
+	if len(a.missed) == a.replay {
+		a.missed = a.missed[1:]
+	}
+	a.missed = append(a.missed, entry)
+}
+
+func replayable(m *msg.Message) bool {
+	switch m.Command {
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		return true
+	}
+	return false
+}
+
+func isMultiline(m *msg.Message) bool {
+	return m.Command == "BATCH" && len(m.Params) > 1 && m.Params[1] == string(msg.Multiline)
+}
+
+// ForgetMissed removes the message with the given msgid from the
+// messages that c has missed, so that it is not replayed. If the
+// message is part of a multiline batch, the whole batch is removed.
+func (c *Client) ForgetMissed(msgid string) {
+	if c.alwaysOn == nil {
+		return
+	}
+	a := c.alwaysOn
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	kept := a.missed[:0]
+	for _, entry := range a.missed {
+		if _, id := entry[0].HasTag("msgid"); id != msgid {
+			kept = append(kept, entry)
+		}
+	}
+	a.missed = kept
+}
+
+// close detaches every session and closes them. It returns false if
+// it was already closed.
+func (a *alwaysOn) close() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return false
+	}
+	a.closed = true
+	close(a.stopped)
+	for _, v := range a.sessions {
+		v.Close()
+	}
+	a.sessions = nil
+	a.missed = nil
+	return true
+}
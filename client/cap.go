@@ -7,7 +7,7 @@ func (c *Client) ApplyCap(cap string, remove bool) {
 	// or tries to disable a capability which is not enabled, the
 	// server MUST continue processing the REQ subcommand as though
 	// handling this capability was successful."
-	if (c.Caps[cap] && !remove) || (!c.Caps[cap] && remove) {
+	if (c.HasCap(cap) && !remove) || (!c.HasCap(cap) && remove) {
 		return
 	}
 
@@ -15,6 +15,9 @@ func (c *Client) ApplyCap(cap string, remove bool) {
 	if handler != nil {
 		handler(c, remove)
 	}
+
+	c.capsLock.Lock()
+	defer c.capsLock.Unlock()
 	if remove {
 		delete(c.Caps, cap)
 	} else {
@@ -22,6 +25,14 @@ func (c *Client) ApplyCap(cap string, remove bool) {
 	}
 }
 
+// HasCap returns true if the client has enabled cap.
+func (c *Client) HasCap(cap string) bool {
+	c.capsLock.RLock()
+	defer c.capsLock.RUnlock()
+
+	return c.Caps[cap]
+}
+
 type capHandler func(*Client, bool)
 
 var capHandlers = map[string]capHandler{
@@ -43,4 +54,4 @@ func messageTags(c *Client, remove bool) {
 	}
 }
 
-func (c *Client) HasMessageTags() bool { return c.Caps[cap.MessageTags.Name] }
+func (c *Client) HasMessageTags() bool { return c.HasCap(cap.MessageTags.Name) }
@@ -5,16 +5,20 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mitchr/gossip/capability"
+	"github.com/mitchr/gossip/metadata"
 	"github.com/mitchr/gossip/sasl"
 	"github.com/mitchr/gossip/scan/msg"
 )
@@ -22,6 +26,16 @@ import (
 type Client struct {
 	conn net.Conn
 
+	// messages waiting to be written to conn
+	sendq       chan []byte
+	sendqLock   sync.RWMutex
+	sendqClosed bool
+
+	// receives an error if this client can no longer be written to
+	writeErr chan error
+	// closed once the connection has been closed
+	flushed chan struct{}
+
 	Nick     string
 	User     string
 	Realname string
@@ -31,9 +45,14 @@ type Client struct {
 	JoinTime int64
 	// last time that client sent a succcessful message
 	Idle time.Time
+	// unix nanosecond timestamp of the last time that anything was read
+	// from the client
+	lastRead atomic.Int64
 
 	reader *bufio.Reader
 	msgBuf []byte
+	// an incomplete line that was being read when reading failed
+	partial []byte
 
 	modeLock          sync.Mutex
 	Mode              Mode
@@ -41,46 +60,72 @@ type Client struct {
 	ServerPassAttempt []byte
 	RegSuspended      bool
 
-	// Represents a set of IRCv3 capabilities
+	// Represents a set of IRCv3 capabilities. Other clients' goroutines
+	// read these, so once the client is in use they are read with HasCap
+	// and changed with ApplyCap.
 	Caps map[string]bool
 	// The maximum CAP version that this client supports. If no version is
 	// explicity requested, this will be 0.
 	CapVersion int
+	capsLock   sync.RWMutex
 
 	// Mechanism that is currently in use for this client
 	SASLMech sasl.Mechanism
 
+	// Mechanism of an authentication that is still in progress. It
+	// replaces SASLMech only once it succeeds, so that a client that is
+	// reauthenticating keeps its old account until then.
+	PendingSASL sasl.Mechanism
+
 	// True if this client has authenticated using SASL
 	IsAuthenticated bool
 
-	// used to signal when client has successfully responded to server PING
-	PONG chan struct{}
-
 	AuthCtx []byte
 
-	grants    uint8
-	grantLock sync.Mutex
+	// Limits how quickly this client's messages are processed. If nil,
+	// the client is not limited.
+	flood      *FloodLimit
+	tokens     float64
+	lastRefill time.Time
+	floodLock  sync.Mutex
+
+	// set if this is an always-on client
+	alwaysOn *alwaysOn
+	// the always-on client that this session was attached to
+	attachedTo *Client
+
+	// key/value pairs that this client has set on itself, and the keys
+	// of other users' and channels' metadata that it wants to be told
+	// about
+	Metadata     metadata.Store
+	MetadataSubs metadata.Set
 }
 
-func New(conn net.Conn) *Client {
+// New creates a client for the given connection. sendq is the number
+// of messages that can be waiting to be written to conn before the
+// client is considered too slow.
+func New(conn net.Conn, sendq int) *Client {
 	now := time.Now()
 	c := &Client{
 		conn:     conn,
+		sendq:    make(chan []byte, sendq),
+		writeErr: make(chan error, 1),
+		flushed:  make(chan struct{}),
 		JoinTime: now.Unix(),
 		Idle:     now,
 
 		reader: bufio.NewReaderSize(conn, 512),
 		msgBuf: make([]byte, 512),
 
-		PONG: make(chan struct{}, 1),
 		Caps: make(map[string]bool),
 
 		SASLMech: sasl.None{},
 	}
 
-	c.FillGrants()
+	c.lastRead.Store(now.UnixNano())
 	c.Host = populateHostname(c.RemoteAddr().String())
 
+	go c.writeLoop()
 	return c
 }
 
@@ -132,7 +177,12 @@ func (c *Client) Id() string {
 	return "*"
 }
 
-func (c *Client) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+func (c *Client) RemoteAddr() net.Addr {
+	if c.alwaysOn != nil {
+		return c.alwaysOn.addr
+	}
+	return c.conn.RemoteAddr()
+}
 
 // returns true if the client is connected over tls
 func (c *Client) IsSecure() bool {
@@ -140,7 +190,9 @@ func (c *Client) IsSecure() bool {
 	return ok
 }
 
-func (c *Client) Certificate() ([]byte, error) {
+// PeerCertificates returns the certificate chain that the client
+// provided, starting with its own certificate
+func (c *Client) PeerCertificates() ([]*x509.Certificate, error) {
 	if !c.IsSecure() {
 		return nil, errors.New("client is not connected over tls")
 	}
@@ -150,6 +202,15 @@ func (c *Client) Certificate() ([]byte, error) {
 		return nil, errors.New("client has not provided a certificate")
 	}
 
+	return certs, nil
+}
+
+func (c *Client) Certificate() ([]byte, error) {
+	certs, err := c.PeerCertificates()
+	if err != nil {
+		return nil, err
+	}
+
 	return certs[0].Raw, nil
 }
 
@@ -175,30 +236,66 @@ func (c *Client) CertificateFingerprint() (string, error) {
 }
 
 func (c *Client) CapsSet() string {
-	caps := make([]string, len(c.Caps))
-	i := 0
+	return strings.Join(c.CapsList(), " ")
+}
+
+// CapsList returns the capabilities that the client has enabled, in no
+// particular order.
+func (c *Client) CapsList() []string {
+	c.capsLock.RLock()
+	defer c.capsLock.RUnlock()
+
+	caps := make([]string, 0, len(c.Caps))
 	for k := range c.Caps {
-		caps[i] = k
-		i++
+		caps = append(caps, k)
 	}
-	return strings.Join(caps, " ")
+	return caps
 }
 
 func (c *Client) SupportsCapVersion(v int) bool {
+	c.capsLock.RLock()
+	defer c.capsLock.RUnlock()
+
 	return c.CapVersion >= v
 }
 
-// Read until encountering a newline. If the client does not have any
-// grants left, this returns an error.
-func (c *Client) ReadMsg() ([]byte, error) {
-	err := c.requestGrant()
-	if err != nil {
-		return nil, err
+// SetCapVersion raises the CAP version that the client supports to v.
+// It is never lowered.
+func (c *Client) SetCapVersion(v int) {
+	c.capsLock.Lock()
+	defer c.capsLock.Unlock()
+
+	if v > c.CapVersion {
+		c.CapVersion = v
 	}
+}
+
+// Read until encountering a newline. If the client cannot afford to
+// send this message, this returns ErrFlood. A throttled client waits
+// for its tokens until ctx is done.
+func (c *Client) ReadMsg(ctx context.Context) ([]byte, error) {
+	b, err := c.readLine()
+	if err == nil || err == msg.ErrMsgSizeOverflow {
+		if err := c.spendTokens(ctx, commandName(b)); err != nil {
+			return nil, err
+		}
+	}
+	return b, err
+}
+
+// LastRead returns the last time that anything was read from the
+// client.
+func (c *Client) LastRead() time.Time { return time.Unix(0, c.lastRead.Load()) }
+
+func (c *Client) readLine() ([]byte, error) {
+	defer func() { c.lastRead.Store(time.Now().UnixNano()) }()
 
 	for n := 0; n < len(c.msgBuf); n++ {
 		b, err := c.reader.ReadByte()
 		if err != nil {
+			// remember what was read of this line in case the connection
+			// is detached
+			c.partial = append(c.partial[:0], c.msgBuf[:n]...)
 			return nil, err
 		}
 		c.msgBuf[n] = b
@@ -211,19 +308,83 @@ func (c *Client) ReadMsg() ([]byte, error) {
 	return nil, msg.ErrMsgSizeOverflow
 }
 
+var ErrSendQExceeded = errors.New("SendQ exceeded")
+
+// Write queues b to be sent to the client. If the client's send queue
+// is full, b is dropped and ErrSendQExceeded is reported on WriteErr.
 func (c *Client) Write(b []byte) (int, error) {
-	if err := c.conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 250)); err != nil {
-		return 0, err
+	if c.alwaysOn != nil {
+		c.alwaysOn.writeSessions(b, b)
+		return len(b), nil
 	}
 
-	return c.conn.Write(b)
+	c.sendqLock.RLock()
+	defer c.sendqLock.RUnlock()
+
+	if c.sendqClosed {
+		return 0, net.ErrClosed
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	// callers may reuse b after Write returns, so queue a copy
+	select {
+	case c.sendq <- append([]byte(nil), b...):
+		return len(b), nil
+	default:
+		c.reportWriteErr(ErrSendQExceeded)
+		return 0, ErrSendQExceeded
+	}
+}
+
+// WriteErr receives an error when messages can no longer be delivered
+// to this client, either because its send queue overflowed or because
+// writing to its connection failed.
+func (c *Client) WriteErr() <-chan error { return c.writeErr }
+
+func (c *Client) reportWriteErr(err error) {
+	select {
+	case c.writeErr <- err:
+	default:
+		// an error has already been reported
+	}
 }
 
-const timeFormat string = "2006-01-02T15:04:05.999Z"
+// writeLoop sends queued messages to the client until the queue is
+// closed, and then closes the underlying connection.
+func (c *Client) writeLoop() {
+	var err error
+	for b := range c.sendq {
+		// once a write has failed, discard everything else in the queue
+		if err != nil {
+			continue
+		}
+		if _, err = c.conn.Write(b); err != nil {
+			c.reportWriteErr(err)
+		}
+	}
+	c.conn.Close()
+	close(c.flushed)
+}
+
+// Flushed is closed once the client has been closed and every message
+// in its send queue has been written (or discarded because writing
+// failed).
+func (c *Client) Flushed() <-chan struct{} { return c.flushed }
+
+// TimeFormat is the format of server-time timestamps
+const TimeFormat string = "2006-01-02T15:04:05.999Z"
 
 func (c *Client) WriteMessage(m msg.Msg) {
-	if c.Caps[capability.ServerTime.Name] {
-		m.AddTag("time", time.Now().UTC().Format(timeFormat))
+	// always-on clients need to know when missed messages were sent
+	if c.HasCap(capability.ServerTime.Name) || c.alwaysOn != nil {
+		m.AddTag("time", time.Now().UTC().Format(TimeFormat))
+	}
+
+	if c.alwaysOn != nil {
+		c.alwaysOn.writeMessage(m)
+		return
 	}
 
 	c.Write(m.Bytes())
@@ -234,54 +395,68 @@ func (c *Client) WriteMessageFrom(m msg.Msg, from *Client) {
 		m.AddTag("bot", "")
 	}
 
-	if !c.HasMessageTags() {
+	// always-on clients keep the tags of the messages that they store,
+	// since each session has tags removed as needed
+	if !c.HasMessageTags() && c.alwaysOn == nil {
 		m = m.RemoveAllTags()
 	}
 
 	// if from == "*", then we assume that the sender has no authn
-	if from.SASLMech.Authn() != "*" && c.Caps[capability.AccountTag.Name] {
+	if from.SASLMech.Authn() != "*" && c.HasCap(capability.AccountTag.Name) {
 		m.AddTag("account", from.SASLMech.Authn())
 	}
 
 	c.WriteMessage(m)
 }
 
-func (c *Client) Close() error { return c.conn.Close() }
-
-const maxGrants = 20
-
-var ErrFlood = errors.New("Flooding")
-
-// requestGrant allows the client to process one message. If the client
-// has no grants, this returns an error.
-func (c *Client) requestGrant() error {
-	c.grantLock.Lock()
-	defer c.grantLock.Unlock()
-
-	if c.grants == 0 {
-		return ErrFlood
+// StopReading interrupts any read that is in progress, and causes all
+// future reads to fail.
+func (c *Client) StopReading() error { return c.conn.SetReadDeadline(time.Now()) }
+
+// Detach gives up ownership of the client's connection so that it can
+// be handed to another process. Reading must have already been stopped
+// with StopReading. A duplicate of the connection's file is returned
+// along with any input that has been received but not yet processed.
+// The client is then closed; its queued messages are still sent.
+func (c *Client) Detach() (*os.File, []byte, error) {
+	fc, ok := c.conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, nil, errors.New("connection cannot be detached")
 	}
+	f, err := fc.File()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pending := append([]byte(nil), c.partial...)
+	buffered, _ := c.reader.Peek(c.reader.Buffered())
+	pending = append(pending, buffered...)
 
-	c.grants--
-	return nil
+	c.Close()
+	return f, pending, nil
 }
 
-// FillGrants fills the clients grant queue to the max.
-func (c *Client) FillGrants() {
-	c.grantLock.Lock()
-	defer c.grantLock.Unlock()
+// how long a closing client has to receive the rest of its send queue
+const flushTimeout = time.Second * 5
 
-	c.grants = maxGrants
-}
+// Close stops accepting new messages for this client. The connection
+// is closed after the messages that are already queued are sent.
+func (c *Client) Close() error {
+	if c.alwaysOn != nil {
+		if c.alwaysOn.close() {
+			close(c.flushed)
+		}
+		return nil
+	}
 
-// Increment the grant counter by 1. If the client already has max
-// grants, this does nothing.
-func (c *Client) AddGrant() {
-	c.grantLock.Lock()
-	defer c.grantLock.Unlock()
+	c.sendqLock.Lock()
+	defer c.sendqLock.Unlock()
 
-	if c.grants == maxGrants {
-		return
+	if c.sendqClosed {
+		return nil
 	}
-	c.grants++
+	c.sendqClosed = true
+	close(c.sendq)
+
+	return c.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
 }
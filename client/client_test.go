@@ -2,9 +2,11 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/mitchr/gossip/capability"
 	"github.com/mitchr/gossip/sasl"
@@ -21,7 +23,7 @@ func TestWriteMessageFrom(t *testing.T) {
 		from.Caps[capability.MessageTags.Name] = true
 
 		in, out := net.Pipe()
-		c := New(in)
+		c := New(in, 1)
 		go c.WriteMessageFrom(msg.New(nil, "a", "", "", "PRIVMSG", []string{"b"}, false), from)
 
 		resp, _ := bufio.NewReader(out).ReadString('\n')
@@ -31,3 +33,26 @@ func TestWriteMessageFrom(t *testing.T) {
 		}
 	})
 }
+
+func TestThrottleStopsWaitingWhenDone(t *testing.T) {
+	c := &Client{Caps: make(map[string]bool)}
+	c.SetFlood(&FloodLimit{Burst: 1, Rate: 0.001, Throttle: true})
+	c.FillTokens()
+	if err := c.spendTokens(context.Background(), "NICK"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		cancel()
+	}()
+
+	start := time.Now()
+	if err := c.spendTokens(ctx, "NICK"); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("kept waiting for tokens after the context was done")
+	}
+}
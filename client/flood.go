@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrFlood = errors.New("Flooding")
+
+// FloodLimit configures the token bucket used to limit how quickly a
+// client's messages are processed. Each message spends tokens from the
+// bucket, and the bucket is refilled at a constant rate.
+type FloodLimit struct {
+	// The maximum number of tokens a client can hold, i.e. the number of
+	// messages that can be sent in a burst.
+	Burst float64 `json:"burst"`
+
+	// The number of tokens added to the bucket every second.
+	Rate float64 `json:"rate"`
+
+	// The number of tokens spent by specific commands. Commands that are
+	// not listed cost 1 token.
+	Cost map[string]float64 `json:"cost"`
+
+	// If true, a client that runs out of tokens has their messages
+	// delayed until they can afford them instead of being disconnected.
+	Throttle bool `json:"throttle"`
+
+	// Operators are not limited.
+	ExemptOpers bool `json:"exemptOpers"`
+	// Messages sent before a client has registered are not limited.
+	ExemptRegistration bool `json:"exemptRegistration"`
+}
+
+// cost returns the number of tokens spent by the given command
+func (f *FloodLimit) cost(command string) float64 {
+	if v, ok := f.Cost[strings.ToUpper(command)]; ok {
+		return v
+	}
+	return 1
+}
+
+func (f *FloodLimit) exempt(c *Client) bool {
+	if f.ExemptRegistration && !c.Is(Registered) {
+		return true
+	}
+	if f.ExemptOpers && (c.Is(Op) || c.Is(LocalOp)) {
+		return true
+	}
+	return false
+}
+
+// SetFlood changes how quickly the client's messages are processed. A
+// nil f means that the client is not limited. The tokens that the
+// client has are kept, up to f's burst.
+func (c *Client) SetFlood(f *FloodLimit) {
+	c.floodLock.Lock()
+	defer c.floodLock.Unlock()
+
+	c.flood = f
+	if f != nil && c.tokens > f.Burst {
+		c.tokens = f.Burst
+	}
+}
+
+// FillTokens fills the client's token bucket to the max.
+func (c *Client) FillTokens() {
+	c.floodLock.Lock()
+	defer c.floodLock.Unlock()
+
+	if c.flood != nil {
+		c.tokens = c.flood.Burst
+	}
+	c.lastRefill = time.Now()
+}
+
+// spendTokens charges the client for sending the given command. If the
+// client cannot afford it, either ErrFlood is returned or, if the
+// client is being throttled, this blocks until enough tokens are
+// available or ctx is done.
+func (c *Client) spendTokens(ctx context.Context, command string) error {
+	c.floodLock.Lock()
+	f := c.flood
+	if f == nil || f.exempt(c) {
+		c.floodLock.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	if elapsed := now.Sub(c.lastRefill); elapsed > 0 {
+		c.tokens += elapsed.Seconds() * f.Rate
+		if c.tokens > f.Burst {
+			c.tokens = f.Burst
+		}
+		c.lastRefill = now
+	}
+
+	cost := f.cost(command)
+	if c.tokens >= cost {
+		c.tokens -= cost
+		c.floodLock.Unlock()
+		return nil
+	}
+	if !f.Throttle || f.Rate <= 0 {
+		c.floodLock.Unlock()
+		return ErrFlood
+	}
+
+	// wait until the bucket has refilled enough to pay for this message
+	wait := time.Duration((cost - c.tokens) / f.Rate * float64(time.Second))
+	c.tokens = 0
+	c.lastRefill = now.Add(wait)
+	c.floodLock.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// commandName extracts the command from a raw message, skipping over
+// any tags and source.
+func commandName(b []byte) string {
+	fields := bytes.Fields(b)
+	for len(fields) > 0 && (fields[0][0] == '@' || fields[0][0] == ':') {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return string(fields[0])
+}
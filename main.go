@@ -4,7 +4,9 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
+	"syscall"
 
 	"github.com/mitchr/gossip/server"
 )
@@ -66,13 +68,39 @@ func main() {
 
 	// capture OS interrupt signal so that we can gracefully shutdown server
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	go s.Serve()
 
-	<-interrupt
-	err = s.Close()
+	select {
+	case sig := <-interrupt:
+		err = s.Shutdown("Received " + sig.String())
+	case <-s.Stopped():
+		// an operator used DIE or RESTART
+		err = s.Shutdown("")
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
+
+	if s.RestartRequested() {
+		err = restart()
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// restart starts a new copy of this process with the same arguments
+func restart() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Start()
 }
@@ -0,0 +1,154 @@
+// Package metadata holds the key/value pairs that users and channels
+// can have attached to them.
+// https://ircv3.net/specs/extensions/metadata
+package metadata
+
+import (
+	"sort"
+	"sync"
+)
+
+// ValidKey returns true if k is made up only of the characters that
+// metadata keys are allowed to use
+func ValidKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, r := range k {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '_' || r == '.' || r == '/' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// A Store maps metadata keys to their values. The zero value is an
+// empty Store that is ready to use.
+type Store struct {
+	lock   sync.RWMutex
+	values map[string]string
+}
+
+func (s *Store) Get(k string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v, ok := s.values[k]
+	return v, ok
+}
+
+func (s *Store) Set(k, v string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.values == nil {
+		s.values = make(map[string]string)
+	}
+	s.values[k] = v
+}
+
+// Delete removes k, and returns false if it was not set
+func (s *Store) Delete(k string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.values[k]
+	delete(s.values, k)
+	return ok
+}
+
+func (s *Store) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.values)
+}
+
+// Keys returns every key that is set, in sorted order
+func (s *Store) Keys() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return sortedKeys(s.values)
+}
+
+// All returns a copy of every key and its value
+func (s *Store) All() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	all := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		all[k] = v
+	}
+	return all
+}
+
+// Clear removes every key, and returns the keys that were removed in
+// sorted order
+func (s *Store) Clear() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := sortedKeys(s.values)
+	s.values = nil
+	return keys
+}
+
+// A Set is a set of metadata keys, such as the keys that a client has
+// subscribed to. The zero value is an empty Set that is ready to use.
+type Set struct {
+	lock sync.RWMutex
+	keys map[string]bool
+}
+
+func (s *Set) Add(k string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.keys == nil {
+		s.keys = make(map[string]bool)
+	}
+	s.keys[k] = true
+}
+
+// Remove removes k, and returns false if it was not in the set
+func (s *Set) Remove(k string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ok := s.keys[k]
+	delete(s.keys, k)
+	return ok
+}
+
+func (s *Set) Has(k string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.keys[k]
+}
+
+func (s *Set) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.keys)
+}
+
+// Keys returns every key in the set, in sorted order
+func (s *Set) Keys() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return sortedKeys(s.keys)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
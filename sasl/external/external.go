@@ -4,6 +4,7 @@ package external
 import (
 	"crypto/sha256"
 	"crypto/subtle"
+	"crypto/x509"
 	"database/sql"
 
 	"github.com/mitchr/gossip/client"
@@ -29,34 +30,60 @@ func (c *Credential) Check(username string, fingerprint [sha256.Size]byte) bool
 type External struct {
 	db     *sql.DB
 	client *client.Client
+
+	// if set, client certificates must have been issued by one of roots
+	roots *x509.CertPool
+
+	account string
 }
 
-func New(db *sql.DB, client *client.Client) *External { return &External{db, client} }
+func New(db *sql.DB, client *client.Client, roots *x509.CertPool) *External {
+	return &External{db: db, client: client, roots: roots}
+}
 
-func (e *External) Authn() string { return e.client.Nick }
+func (e *External) Authn() string { return e.account }
 
-func (e *External) Next([]byte) (challenge []byte, err error) {
-	// grab client cert if it exists
-	certfp, err := e.client.CertificateSha()
+// Next logs the client in to the account that its certificate belongs
+// to. The client response is an optional authorization identity, which
+// must be the name of that account if it is given.
+func (e *External) Next(authzid []byte) (challenge []byte, err error) {
+	certs, err := e.client.PeerCertificates()
 	if err != nil {
 		return nil, sasl.ErrSaslFail
 	}
 
-	cred, err := e.lookup(e.client.Nick)
+	if e.roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, v := range certs[1:] {
+			intermediates.AddCert(v)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         e.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return nil, sasl.ErrInvalidKey
+		}
+	}
+
+	account, err := e.lookup(sha256.Sum256(certs[0].Raw))
 	if err != nil {
 		return nil, sasl.ErrSaslFail
 	}
-
-	if !cred.Check(e.client.Nick, certfp) {
+	if len(authzid) != 0 && string(authzid) != account {
 		return nil, sasl.ErrInvalidKey
 	}
 
+	e.account = account
 	return nil, nil
 }
 
-func (e *External) lookup(username string) (*Credential, error) {
-	c := &Credential{}
-	row := e.db.QueryRow("SELECT username, clientCert FROM sasl_external WHERE username = ?", username)
-	err := row.Scan(&c.Username, &c.Cert)
-	return c, err
+// lookup finds the account that fingerprint belongs to. An account can
+// have any number of fingerprints, but each fingerprint only belongs to
+// one account.
+func (e *External) lookup(fingerprint [sha256.Size]byte) (string, error) {
+	var username string
+	err := e.db.QueryRow("SELECT username FROM sasl_external_certs WHERE fingerprint = ?", fingerprint[:]).Scan(&username)
+	return username, err
 }
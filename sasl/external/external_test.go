@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
 	"encoding/pem"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mitchr/gossip/client"
 	_ "modernc.org/sqlite"
 )
 
@@ -27,6 +29,12 @@ func initTable() (*sql.DB, error) {
 		username TEXT,
 		clientCert BLOB,
 		PRIMARY KEY(username)
+	);
+
+	CREATE TABLE IF NOT EXISTS sasl_external_certs(
+		username TEXT,
+		fingerprint BLOB,
+		PRIMARY KEY(fingerprint)
 	);`)
 
 	return DB, nil
@@ -67,16 +75,16 @@ func TestCredential(t *testing.T) {
 	}
 }
 
-func TestExternal(t *testing.T) {
-	serverCert := generateCert()
-	clientCert := generateCert()
-	// certPool, _ := x509.SystemCertPool()
+// connectWithCert returns the server side of a tls connection where the
+// client presented cert
+func connectWithCert(t *testing.T, cert tls.Certificate) *client.Client {
+	t.Helper()
 
-	l, _ := tls.Listen("tcp", ":7070", &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequestClientCert})
+	l, _ := tls.Listen("tcp", ":7070", &tls.Config{Certificates: []tls.Certificate{generateCert()}, ClientAuth: tls.RequestClientCert})
 	defer l.Close()
 
 	go func() {
-		_, err := tls.Dial("tcp", ":7070", &tls.Config{Certificates: []tls.Certificate{clientCert}, InsecureSkipVerify: true})
+		_, err := tls.Dial("tcp", ":7070", &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
 		if err != nil {
 			fmt.Println(err)
 		}
@@ -86,27 +94,101 @@ func TestExternal(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer c.Close()
+	t.Cleanup(func() { c.Close() })
 
 	// client may not have written or read anything yet, so we need to force the handshake
-	if !c.(*tls.Conn).ConnectionState().HandshakeComplete {
-		err = c.(*tls.Conn).Handshake()
-		if err != nil {
-			t.Fatal(err)
+	if err := c.(*tls.Conn).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return client.New(c, 8)
+}
+
+func TestExternal(t *testing.T) {
+	db, err := initTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := generateCert(), generateCert()
+	for _, cert := range []tls.Certificate{first, second} {
+		cred := NewCredential("alice", cert.Certificate[0])
+		db.Exec("INSERT INTO sasl_external_certs VALUES(?, ?)", cred.Username, cred.Cert)
+	}
+
+	tests := []struct {
+		cert    tls.Certificate
+		authzid string
+		account string
+	}{
+		{first, "", "alice"},
+		{second, "", "alice"},
+		{second, "alice", "alice"},
+		{second, "bob", ""},
+		{generateCert(), "", ""},
+	}
+
+	for i, tt := range tests {
+		e := New(db, connectWithCert(t, tt.cert), nil)
+		_, err := e.Next([]byte(tt.authzid))
+		if e.Authn() != tt.account || (err == nil) != (tt.account != "") {
+			t.Errorf("%d: expected %q, got (%q, %v)", i, tt.account, e.Authn(), err)
 		}
 	}
+}
 
+func TestExternalCA(t *testing.T) {
 	db, err := initTable()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	cred := NewCredential("alice", clientCert.Certificate[0])
-	db.Exec("INSERT INTO sasl_external VALUES(?, ?)", cred.Username, cred.Cert)
+	ca, caKey := generateCA()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
 
-	if !cred.Check("alice", sha256.Sum256(clientCert.Certificate[0])) {
-		t.Error("check failed")
+	issued, selfSigned := generateClientCert(ca, caKey), generateCert()
+	for _, cert := range []tls.Certificate{issued, selfSigned} {
+		cred := NewCredential("alice", cert.Certificate[0])
+		db.Exec("INSERT INTO sasl_external_certs VALUES(?, ?)", cred.Username, cred.Cert)
+	}
+
+	if _, err := New(db, connectWithCert(t, issued), roots).Next(nil); err != nil {
+		t.Error("expected certificate issued by CA to be accepted, got", err)
+	}
+	if _, err := New(db, connectWithCert(t, selfSigned), roots).Next(nil); err == nil {
+		t.Error("expected self-signed certificate to be rejected")
+	}
+}
+
+func generateCA() (*x509.Certificate, ed25519.PrivateKey) {
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gossip CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Minute * 1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
 	}
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+	ca, _ := x509.ParseCertificate(der)
+	return ca, priv
+}
+
+func generateClientCert(ca *x509.Certificate, caKey ed25519.PrivateKey) tls.Certificate {
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Minute * 1),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.CreateCertificate(rand.Reader, &template, ca, pub, caKey)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
 }
 
 func generateCert() tls.Certificate {
@@ -0,0 +1,117 @@
+// Implementation of SASL OAUTHBEARER (RFC 7628), where bearer tokens are
+// JSON Web Tokens that are verified locally
+package oauthbearer
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/mitchr/gossip/sasl"
+)
+
+// Accounts decides which account a token logs in to. It is given the
+// account named by the token, and returns the name that the account is
+// stored under, along with the nick to reserve for it if the account
+// has to be created; an empty nick reserves nothing. An error rejects
+// the token.
+type Accounts func(claim string) (account, nick string, err error)
+
+type OAuthBearer struct {
+	db       *sql.DB
+	verifier *Verifier
+	accounts Accounts
+
+	account string
+	// set once the client has been told why its token was rejected
+	failed bool
+}
+
+// New creates an OAUTHBEARER exchange. If accounts is nil, tokens log in
+// to exactly the account that they name, and its nick is reserved.
+func New(db *sql.DB, v *Verifier, accounts Accounts) *OAuthBearer {
+	if accounts == nil {
+		accounts = func(claim string) (string, string, error) { return claim, claim, nil }
+	}
+	return &OAuthBearer{db: db, verifier: v, accounts: accounts}
+}
+
+func (o *OAuthBearer) Authn() string { return o.account }
+
+func (o *OAuthBearer) Next(b []byte) (challenge []byte, err error) {
+	// "the client MUST then send either an additional client response
+	// consisting of a single %x01 (control A) character to the server in
+	// order to allow the server to finish the exchange"
+	if o.failed {
+		return nil, sasl.ErrSaslFail
+	}
+
+	authzid, token, err := parseResponse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	claim, err := o.verifier.Verify(token)
+	// we can only log clients in to the account that the token is for
+	if err == nil && authzid != "" && authzid != claim {
+		err = ErrBadClaims
+	}
+	var account, nick string
+	if err == nil {
+		account, nick, err = o.accounts(claim)
+	}
+	if err != nil {
+		o.failed = true
+		return []byte(`{"status":"invalid_token"}`), nil
+	}
+
+	// accounts are created the first time that they log in
+	_, err = o.db.Exec("INSERT OR IGNORE INTO sasl_oauthbearer VALUES(?, ?)", account, nick)
+	if err != nil {
+		return nil, err
+	}
+
+	o.account = account
+	return nil, nil
+}
+
+// parseResponse reads the authzid and the bearer token from the initial
+// client response
+//
+//	client-resp = (gs2-header kvsep *kvpair kvsep) / kvsep
+//	gs2-header  = gs2-cbind-flag "," [ gs2-authzid ] ","
+//	kvpair      = key "=" value kvsep
+//	kvsep       = %x01
+func parseResponse(b []byte) (authzid, token string, err error) {
+	fields := bytes.Split(b, []byte{1})
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 || len(fields[len(fields)-2]) != 0 {
+		return "", "", errors.New("malformed OAUTHBEARER response")
+	}
+
+	gs2 := strings.Split(string(fields[0]), ",")
+	// channel binding is not supported
+	if len(gs2) != 3 || (gs2[0] != "n" && gs2[0] != "y") {
+		return "", "", errors.New("malformed OAUTHBEARER gs2 header")
+	}
+	if gs2[1] != "" {
+		if !strings.HasPrefix(gs2[1], "a=") {
+			return "", "", errors.New("malformed OAUTHBEARER gs2 header")
+		}
+		authzid = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(gs2[1][2:])
+	}
+
+	for _, kv := range fields[1 : len(fields)-2] {
+		k, v, _ := strings.Cut(string(kv), "=")
+		if k != "auth" {
+			continue
+		}
+
+		scheme, t, _ := strings.Cut(v, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return "", "", errors.New("unsupported OAUTHBEARER auth scheme")
+		}
+		return authzid, t, nil
+	}
+	return "", "", errors.New("missing OAUTHBEARER auth")
+}
@@ -0,0 +1,250 @@
+package oauthbearer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchr/gossip/sasl"
+	_ "modernc.org/sqlite"
+)
+
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *rsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:])
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		r, s, e := ecdsa.Sign(rand.Reader, k, h[:])
+		err = e
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writePEM(t *testing.T, pub crypto.PublicKey) string {
+	t.Helper()
+
+	b, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0644)
+	return path
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	t.Helper()
+
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, b, 0644)
+	return path
+}
+
+func valid(sub string) map[string]interface{} {
+	return map[string]interface{}{"sub": sub, "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestVerifyPEM(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	v, err := NewVerifier(writePEM(t, rsaKey.Public()), writePEM(t, edKey.Public()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token   string
+		account string
+		err     error
+	}{
+		{sign(t, "RS256", "", rsaKey, valid("tim")), "tim", nil},
+		{sign(t, "EdDSA", "", edKey, valid("jim")), "jim", nil},
+		{sign(t, "RS256", "", rsaKey, map[string]interface{}{"sub": "tim", "exp": time.Now().Add(-time.Hour).Unix()}), "", ErrExpired},
+		{sign(t, "RS256", "", rsaKey, map[string]interface{}{"sub": "tim"}), "", ErrExpired},
+		{sign(t, "RS256", "", rsaKey, map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}), "", ErrBadClaims},
+		// an algorithm that the key can't have made
+		{sign(t, "ES256", "", rsaKey, valid("tim")), "", ErrBadSignature},
+		{"a.b", "", ErrMalformedToken},
+	}
+
+	for _, tt := range tests {
+		account, err := v.Verify(tt.token)
+		if account != tt.account || !errors.Is(err, tt.err) {
+			t.Errorf("expected (%q, %v), got (%q, %v)", tt.account, tt.err, account, err)
+		}
+	}
+
+	// a key we don't know about
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := v.Verify(sign(t, "RS256", "", other, valid("tim"))); err != ErrBadSignature {
+		t.Error("expected signature from unknown key to be rejected, got", err)
+	}
+}
+
+func TestVerifyJWKS(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	enc := base64.RawURLEncoding.EncodeToString
+
+	path := writeJWKS(t, map[string]string{
+		"kty": "EC", "kid": "one", "crv": "P-256", "use": "sig",
+		"x": enc(ecKey.X.FillBytes(make([]byte, 32))),
+		"y": enc(ecKey.Y.FillBytes(make([]byte, 32))),
+	})
+	v, err := NewVerifier(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Claim = "preferred_username"
+	v.Issuer = "https://id.example.com"
+	v.Audience = "gossip"
+
+	claims := valid("1234")
+	claims["preferred_username"] = "tim"
+	claims["iss"] = "https://id.example.com"
+	claims["aud"] = []string{"other", "gossip"}
+
+	account, err := v.Verify(sign(t, "ES256", "one", ecKey, claims))
+	if err != nil || account != "tim" {
+		t.Errorf("expected tim, got (%q, %v)", account, err)
+	}
+
+	// a token naming a different key
+	if _, err := v.Verify(sign(t, "ES256", "two", ecKey, claims)); err != ErrBadSignature {
+		t.Error("expected token for unknown key id to be rejected, got", err)
+	}
+
+	claims["aud"] = "other"
+	if _, err := v.Verify(sign(t, "ES256", "one", ecKey, claims)); err != ErrBadClaims {
+		t.Error("expected token for another audience to be rejected, got", err)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	tests := []struct {
+		in             string
+		authzid, token string
+		err            bool
+	}{
+		{"n,,\x01auth=Bearer abc\x01\x01", "", "abc", false},
+		{"n,a=user@example.com,\x01host=server.example.com\x01port=143\x01auth=Bearer abc\x01\x01", "user@example.com", "abc", false},
+		{"n,a=a=2Cb,\x01auth=Bearer abc\x01\x01", "a,b", "abc", false},
+		{"p=tls-unique,,\x01auth=Bearer abc\x01\x01", "", "", true},
+		{"n,,\x01auth=Basic abc\x01\x01", "", "", true},
+		{"n,,\x01host=x\x01\x01", "", "", true},
+		{"n,,\x01auth=Bearer abc\x01", "", "", true},
+	}
+
+	for _, tt := range tests {
+		authzid, token, err := parseResponse([]byte(tt.in))
+		if authzid != tt.authzid || token != tt.token || (err != nil) != tt.err {
+			t.Errorf("%q: expected (%q, %q, %v), got (%q, %q, %v)", tt.in, tt.authzid, tt.token, tt.err, authzid, token, err)
+		}
+	}
+}
+
+func TestOAUTHBEARER(t *testing.T) {
+	db, err := initTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	v, err := NewVerifier(writePEM(t, key.Public()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ProvisionsAccount", func(t *testing.T) {
+		o := New(db, v, nil)
+		challenge, err := o.Next([]byte("n,,\x01auth=Bearer " + sign(t, "EdDSA", "", key, valid("tim")) + "\x01\x01"))
+		if challenge != nil || err != nil {
+			t.Fatal("expected success, got", string(challenge), err)
+		}
+		if o.Authn() != "tim" {
+			t.Error("expected tim, got", o.Authn())
+		}
+
+		var nick string
+		db.QueryRow("SELECT nick FROM sasl_oauthbearer WHERE username=?", "tim").Scan(&nick)
+		if nick != "tim" {
+			t.Error("account was not provisioned")
+		}
+
+		// logging in again is fine
+		if _, err := New(db, v, nil).Next([]byte("n,,\x01auth=Bearer " + sign(t, "EdDSA", "", key, valid("tim")) + "\x01\x01")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("RejectedAccount", func(t *testing.T) {
+		o := New(db, v, func(claim string) (string, string, error) { return "", "", ErrBadClaims })
+		challenge, err := o.Next([]byte("n,,\x01auth=Bearer " + sign(t, "EdDSA", "", key, valid("jim")) + "\x01\x01"))
+		if string(challenge) != `{"status":"invalid_token"}` || err != nil {
+			t.Fatal("expected error challenge, got", string(challenge), err)
+		}
+
+		var name string
+		if db.QueryRow("SELECT username FROM sasl_oauthbearer WHERE username=?", "jim").Scan(&name) == nil {
+			t.Error("rejected account was provisioned")
+		}
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		o := New(db, v, nil)
+		challenge, err := o.Next([]byte("n,a=jim,\x01auth=Bearer " + sign(t, "EdDSA", "", key, valid("tim")) + "\x01\x01"))
+		if string(challenge) != `{"status":"invalid_token"}` || err != nil {
+			t.Fatal("expected error challenge, got", string(challenge), err)
+		}
+
+		_, err = o.Next([]byte{1})
+		if err != sasl.ErrSaslFail {
+			t.Error("expected failure, got", err)
+		}
+	})
+}
+
+func initTable() (*sql.DB, error) {
+	DB, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS sasl_oauthbearer(
+		username TEXT,
+		nick TEXT,
+		PRIMARY KEY(username)
+	)`)
+	return DB, err
+}
@@ -1,11 +1,17 @@
 package msg
 
-import "github.com/google/uuid"
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
 
 type BatchType string
 
 const (
-	Label BatchType = "labeled-response"
+	Label     BatchType = "labeled-response"
+	Multiline BatchType = "draft/multiline"
+	Metadata  BatchType = "metadata"
 )
 
 type Buffer struct {
@@ -26,7 +32,15 @@ func (b *Buffer) WrapInBatch(batchType BatchType) *Buffer {
 	end := New(nil, "", "", "", "BATCH", []string{"-" + batchLabel}, false)
 	b.msgs = append([]Msg{start}, append(b.msgs, end)...)
 
-	b.AddTag("batch", batchLabel)
+	// messages that are already part of a nested batch stay in it
+	for _, v := range b.msgs {
+		if m, ok := v.(*Message); ok {
+			if inBatch, _ := m.HasTag("batch"); inBatch {
+				continue
+			}
+		}
+		v.AddTag("batch", batchLabel)
+	}
 	return b
 }
 
@@ -40,6 +54,9 @@ func (b *Buffer) AddMsg(m Msg) {
 
 }
 
+// Messages returns the messages in the buffer
+func (b *Buffer) Messages() []Msg { return append([]Msg(nil), b.msgs...) }
+
 func (b *Buffer) Bytes() []byte {
 	buf := []byte{}
 	for _, v := range b.msgs {
@@ -66,3 +83,33 @@ func (b *Buffer) RemoveAllTags() Msg {
 	}
 	return b
 }
+
+// SplitList joins items with sep, spread over as many messages as are
+// needed to keep each one within MaxLineLength. line returns the
+// message that holds list, some of the joined items; it is also called
+// with an empty list to measure the rest of the message. If maxItems is
+// greater than 0, a message holds no more than maxItems items. An item
+// that is too long to share a message is given one of its own. If there
+// are no items, the buffer holds one message with an empty list.
+func SplitList(items []string, sep string, maxItems int, line func(list string) *Message) *Buffer {
+	empty := line("")
+	room := MaxLineLength - (len(empty.Bytes()) - empty.SizeOfTags())
+
+	buff := &Buffer{}
+	var list strings.Builder
+	count := 0
+	for _, v := range items {
+		if count > 0 && (list.Len()+len(sep)+len(v) > room || (maxItems > 0 && count == maxItems)) {
+			buff.AddMsg(line(list.String()))
+			list.Reset()
+			count = 0
+		}
+		if count > 0 {
+			list.WriteString(sep)
+		}
+		list.WriteString(v)
+		count++
+	}
+	buff.AddMsg(line(list.String()))
+	return buff
+}
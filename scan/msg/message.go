@@ -4,10 +4,25 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
 
+const (
+	// MaxLineLength is the longest that a message can be, not counting its
+	// tags, but counting the "\r\n" that ends it
+	MaxLineLength = 512
+
+	// MaxClientTagLength is the most room that client-only tags can take
+	// up, counting the leading '@' and trailing ' '
+	MaxClientTagLength = 4096
+
+	// MaxTagLength is the most room that all of a message's tags can take
+	// up together, counting the leading '@' and trailing ' '
+	MaxTagLength = 8191
+)
+
 type Tag struct {
 	// true if this tag is a client only tag
 	ClientPrefix bool
@@ -82,7 +97,11 @@ func (m Message) estimateMessageSize() int {
 	return n
 }
 
+// Bytes serializes m. A message that is too long to send is truncated
+// first; see Truncate.
 func (m Message) Bytes() []byte {
+	m.Truncate()
+
 	var b bytes.Buffer
 	b.Grow(m.estimateMessageSize())
 
@@ -159,11 +178,25 @@ func (m *Message) HasTag(k string) (bool, string) {
 	return false, ""
 }
 
+// Tags returns a copy of the message's tags
+func (m *Message) Tags() []Tag { return append([]Tag(nil), m.tags...) }
+
+// RemoveTag removes every tag with the key k
+func (m *Message) RemoveTag(k string) {
+	kept := m.tags[:0]
+	for _, v := range m.tags {
+		if v.Key != k {
+			kept = append(kept, v)
+		}
+	}
+	m.tags = kept
+}
+
 // Generate a unique uuid for this message. Subsequent calls to SetMsgid
 // do not change the id.
 func (m *Message) SetMsgid() {
 	for _, v := range m.tags {
-		if v.Value == "msgid" {
+		if v.Key == "msgid" {
 			return
 		}
 	}
@@ -180,14 +213,7 @@ func (m *Message) SizeOfTags() int {
 
 	tagCount := 0
 	for _, v := range m.tags {
-		size += len(v.Key)
-
-		if v.ClientPrefix {
-			size++ // acocunt for '+'
-		}
-		if v.Value != "" {
-			size += len(v.Value) + 1 // account for '='
-		}
+		size += v.size()
 
 		// this is not the last tag, so account for ';' between tags
 		if tagCount != len(m.tags)-1 {
@@ -199,6 +225,108 @@ func (m *Message) SizeOfTags() int {
 	return size
 }
 
+// size returns the length of t once serialized
+func (t Tag) size() int {
+	size := len(t.Key)
+	if t.ClientPrefix {
+		size++ // acocunt for '+'
+	}
+	if t.Value != "" {
+		size += len(t.Value) + 1 // account for '='
+	}
+	return size
+}
+
+// lineLength returns the length of m once serialized, not counting its
+// tags
+func (m *Message) lineLength() int {
+	n := len(m.Command) + 2 // "\r\n"
+	if m.Nick != "" {
+		n += len(m.Nick) + 1
+	}
+	if m.User != "" {
+		n += len(m.User) + 1
+	}
+	if m.Host != "" {
+		n += len(m.Host) + 1
+	}
+	if m.Nick != "" || m.User != "" || m.Host != "" {
+		n++
+	}
+	for _, v := range m.Params {
+		n += len(v) + 1
+	}
+	if m.trailingSet && len(m.Params) > 0 {
+		n++ // ':'
+	}
+	return n
+}
+
+// Truncate makes m fit within the limits that a client can be expected
+// to read. Client-only tags that would go over MaxClientTagLength, and
+// any tags that would go over MaxTagLength, are dropped. If the rest of
+// the message is longer than MaxLineLength, its trailing parameter is
+// cut short without splitting a UTF-8 sequence. Truncate returns true
+// if the trailing parameter was shortened.
+//
+// Truncate never modifies the tags or params that m shares with its
+// copies.
+func (m *Message) Truncate() bool {
+	if m.SizeOfTags() > MaxTagLength || m.sizeOfClientTags() > MaxClientTagLength {
+		m.tags = m.fittedTags()
+	}
+
+	over := m.lineLength() - MaxLineLength
+	if over <= 0 || !m.trailingSet || len(m.Params) == 0 {
+		return false
+	}
+
+	last := m.Params[len(m.Params)-1]
+	cut := len(last) - over
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(last[cut]) {
+		cut--
+	}
+
+	m.Params = append([]string(nil), m.Params...)
+	m.Params[len(m.Params)-1] = last[:cut]
+	return true
+}
+
+func (m *Message) sizeOfClientTags() int {
+	size := 0
+	for _, v := range m.tags {
+		if v.ClientPrefix {
+			if size == 0 {
+				size = 1 // '@' and ' ', less the ';' counted below
+			}
+			size += v.size() + 1
+		}
+	}
+	return size
+}
+
+// fittedTags returns the tags of m that fit within the tag limits, in
+// order
+func (m *Message) fittedTags() []Tag {
+	var kept []Tag
+	size, clientSize := 1, 1
+	for _, v := range m.tags {
+		n := v.size() + 1
+		if size+n > MaxTagLength || (v.ClientPrefix && clientSize+n > MaxClientTagLength) {
+			continue
+		}
+		size += n
+		if v.ClientPrefix {
+			clientSize += n
+		}
+		kept = append(kept, v)
+	}
+	return kept
+}
+
 func (m *Message) TrimNonClientTags() {
 	trimmed := []Tag{}
 	for _, v := range m.tags {
@@ -216,6 +344,14 @@ func (m Message) RemoveAllTags() Msg {
 	return &m
 }
 
+// Copy returns a copy of the message that can be modified without
+// affecting the original.
+func (m Message) Copy() *Message {
+	m.tags = append([]Tag(nil), m.tags...)
+	m.Params = append([]string(nil), m.Params...)
+	return &m
+}
+
 func (m Message) Format(a ...interface{}) *Message {
 	aPos := 0
 	newParams := make([]string, len(m.Params))
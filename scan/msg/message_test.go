@@ -2,7 +2,9 @@ package msg
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/mitchr/gossip/scan"
 )
@@ -228,6 +230,138 @@ func TestMessageFormat(t *testing.T) {
 	}
 }
 
+func TestMessageCopy(t *testing.T) {
+	m := New([]Tag{{Key: "a", Value: "b"}}, "dan", "d", "localhost", "PRIVMSG", []string{"#chan", "hi"}, true)
+
+	cp := m.Copy()
+	cp.AddTag("time", "now")
+	cp.Params[0] = "#other"
+
+	if m.String() != "@a=b :dan!d@localhost PRIVMSG #chan :hi\r\n" {
+		t.Error("modifying copy changed original:", m)
+	}
+	if cp.String() != "@a=b;time=now :dan!d@localhost PRIVMSG #other :hi\r\n" {
+		t.Error("copy modified incorrectly:", cp)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	line := func(list string) *Message {
+		return New([]Tag{{Key: "a", Value: "b"}}, "gossip", "", "", "353", []string{"bob", "=", "#chan", list}, true)
+	}
+
+	lists := func(buff *Buffer) []string {
+		l := []string{}
+		for _, m := range buff.Messages() {
+			l = append(l, m.(*Message).Params[3])
+		}
+		return l
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		buff := SplitList(nil, " ", 0, line)
+		if !reflect.DeepEqual(lists(buff), []string{""}) {
+			t.Error("expected a single empty reply:", buff)
+		}
+	})
+
+	t.Run("MaxItems", func(t *testing.T) {
+		got := lists(SplitList([]string{"a", "b", "c", "d", "e"}, " ", 2, line))
+		if !reflect.DeepEqual(got, []string{"a b", "c d", "e"}) {
+			t.Error("items were not split by count:", got)
+		}
+	})
+
+	t.Run("Length", func(t *testing.T) {
+		items := make([]string, 100)
+		for i := range items {
+			items[i] = strings.Repeat(string(rune('a'+i%26)), 9)
+		}
+		buff := SplitList(items, " ", 0, line)
+		if buff.Len() < 2 {
+			t.Fatal("expected more than one reply")
+		}
+
+		got := []string{}
+		for _, m := range buff.Messages() {
+			if l := len(m.Bytes()) - m.(*Message).SizeOfTags(); l > MaxLineLength {
+				t.Error("reply is too long:", l)
+			}
+			got = append(got, strings.Fields(m.(*Message).Params[3])...)
+		}
+		if !reflect.DeepEqual(got, items) {
+			t.Error("items were lost or reordered")
+		}
+	})
+
+	t.Run("LongItem", func(t *testing.T) {
+		long := strings.Repeat("x", MaxLineLength)
+		got := lists(SplitList([]string{"a", long, "b"}, " ", 0, line))
+		if !reflect.DeepEqual(got, []string{"a", long, "b"}) {
+			t.Error("oversized item was not given its own reply")
+		}
+	})
+}
+
+func TestTruncate(t *testing.T) {
+	t.Run("Trailing", func(t *testing.T) {
+		m := New(nil, "dan", "d", "localhost", "PRIVMSG", []string{"#chan", strings.Repeat("a", 600)}, true)
+		original := m.Copy()
+		if !m.Truncate() {
+			t.Fatal("expected message to be truncated")
+		}
+		if l := len(m.Bytes()); l != MaxLineLength {
+			t.Error("expected truncated message to fill the line, got", l)
+		}
+		if m.lineLength() != len(m.Bytes()) {
+			t.Error("line length is miscounted:", m.lineLength(), len(m.Bytes()))
+		}
+		if len(original.Params[1]) != 600 {
+			t.Error("truncating modified a copy")
+		}
+	})
+
+	t.Run("UTF8", func(t *testing.T) {
+		m := New(nil, "dan", "d", "localhost", "PRIVMSG", []string{"#chan", strings.Repeat("é", 300)}, true)
+		m.Truncate()
+		if !utf8.ValidString(m.Params[1]) {
+			t.Error("truncation split a UTF-8 sequence")
+		}
+		if l := len(m.Bytes()); l > MaxLineLength || l < MaxLineLength-1 {
+			t.Error("unexpected length", l)
+		}
+	})
+
+	t.Run("Fits", func(t *testing.T) {
+		m := New(nil, "dan", "d", "localhost", "PRIVMSG", []string{"#chan", "hi"}, true)
+		if m.Truncate() || m.String() != ":dan!d@localhost PRIVMSG #chan :hi\r\n" {
+			t.Error("message that fits was changed:", m)
+		}
+	})
+
+	t.Run("Tags", func(t *testing.T) {
+		m := New([]Tag{
+			{ClientPrefix: true, Key: "a", Value: strings.Repeat("x", 4000)},
+			{ClientPrefix: true, Key: "b", Value: strings.Repeat("x", 200)},
+			{Key: "msgid", Value: "id"},
+		}, "dan", "d", "localhost", "TAGMSG", []string{"#chan"}, false)
+		m.Truncate()
+
+		if m.sizeOfClientTags() > MaxClientTagLength || m.SizeOfTags() > MaxTagLength {
+			t.Error("tags are over the limit")
+		}
+		if ok, _ := m.HasTag("b"); ok {
+			t.Error("client tag over the limit was kept")
+		}
+		if ok, _ := m.HasTag("a"); !ok {
+			t.Error("client tag within the limit was dropped")
+		}
+		if ok, _ := m.HasTag("msgid"); !ok {
+			t.Error("server tag was dropped")
+		}
+	})
+}
+
 var testInput []byte = []byte("@a=b :bob!Bob@example.com PRIVMSG alice :Welcome to the server!\r\n")
 
 func BenchmarkLex(b *testing.B) {
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+	cap "github.com/mitchr/gossip/capability"
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// An account that has opted in to always-on is represented by a single
+// always-on client that owns its nick and channel memberships. Each
+// connection that authenticates to the account is attached to that
+// client as a session. Sessions act on behalf of the always-on client,
+// and everything sent to the always-on client is sent to each session.
+// When the last session disconnects the always-on client stays, and the
+// messages it receives are replayed to the next session that attaches.
+
+// SET is nonstandard
+// SET ALWAYSON [ON|OFF]
+func SET(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
+	if len(m.Params) == 0 {
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "SET")
+	}
+
+	switch strings.ToUpper(m.Params[0]) {
+	case "ALWAYSON":
+		if !conf.AlwaysOn.Enabled {
+			return s.NOTICE(c, "Always-on is not enabled on this server")
+		}
+		if !c.IsAuthenticated {
+			return s.NOTICE(c, "You must be logged in to change account settings")
+		}
+		account := c.SASLMech.Authn()
+
+		if len(m.Params) < 2 {
+			if s.isAlwaysOn(account) {
+				return s.NOTICE(c, "ALWAYSON is ON")
+			}
+			return s.NOTICE(c, "ALWAYSON is OFF")
+		}
+
+		switch strings.ToUpper(m.Params[1]) {
+		case "ON":
+			s.setAlwaysOn(account, true)
+			if !c.IsAlwaysOn() {
+				return s.NOTICE(c, "ALWAYSON is ON, starting from your next connection")
+			}
+			return s.NOTICE(c, "ALWAYSON is ON")
+		case "OFF":
+			s.setAlwaysOn(account, false)
+			if c.IsAlwaysOn() {
+				return s.NOTICE(c, "ALWAYSON is OFF, starting when your last connection closes")
+			}
+			return s.NOTICE(c, "ALWAYSON is OFF")
+		default:
+			return s.NOTICE(c, "ALWAYSON must be ON or OFF")
+		}
+
+	default:
+		return s.NOTICE(c, "Unsupported setting "+m.Params[0])
+	}
+}
+
+// isAlwaysOn returns true if account has opted in to always-on
+func (s *Server) isAlwaysOn(account string) bool {
+	if !s.Config().AlwaysOn.Enabled {
+		return false
+	}
+
+	var on bool
+	s.db.QueryRow("SELECT alwaysOn FROM account_settings WHERE username=?", account).Scan(&on)
+	return on
+}
+
+func (s *Server) setAlwaysOn(account string, on bool) {
+	s.db.Exec(`INSERT INTO account_settings(username, alwaysOn) VALUES(?, ?)
+		ON CONFLICT(username) DO UPDATE SET alwaysOn=excluded.alwaysOn`, account, on)
+}
+
+// alwaysOnClient returns the always-on client that c would be attached
+// to when it registers, or nil if there is none
+func (s *Server) alwaysOnClient(c *client.Client) *client.Client {
+	if !c.IsAuthenticated {
+		return nil
+	}
+
+	s.alwaysOnLock.Lock()
+	defer s.alwaysOnLock.Unlock()
+	return s.alwaysOn[strings.ToLower(c.SASLMech.Authn())]
+}
+
+// attachAlwaysOn finishes the registration of c by attaching it to the
+// always-on client of its account, which is created if this is the
+// account's first connection. If c's account is not always-on, this
+// returns false and c should be registered as usual.
+func (s *Server) attachAlwaysOn(c *client.Client) bool {
+	conf := s.Config()
+	if !c.IsAuthenticated || !s.isAlwaysOn(c.SASLMech.Authn()) {
+		return false
+	}
+	account := strings.ToLower(c.SASLMech.Authn())
+
+	c.SetMode(client.Registered)
+	s.unknowns.Dec()
+
+	s.alwaysOnLock.Lock()
+	a, existed := s.alwaysOn[account]
+	if !existed {
+		a = client.NewAlwaysOn(c, conf.AlwaysOn.Replay)
+		s.loadAccountMetadata(a)
+		s.alwaysOn[account] = a
+		s.setClient(a)
+	}
+	s.alwaysOnLock.Unlock()
+
+	a.Do(func() {
+		c.Nick = a.Nick
+		missed := a.AttachSession(c)
+
+		buff := s.welcome(c)
+		if existed {
+			// catch the session up on the channels that it is already in
+			for _, ch := range s.channelsOf(a) {
+				buff.AddMsg(msg.New(nil, a.Nick, a.User, a.Host, "JOIN", []string{ch.String()}, false))
+				if ch.Topic != "" {
+					buff.AddMsg(TOPIC(s, c, &msg.Message{Params: []string{ch.String()}}))
+				}
+				buff.AddMsg(s.readMarker(c, ch.String()))
+				buff.AddMsg(NAMES(s, c, &msg.Message{Params: []string{ch.String()}}))
+			}
+		} else {
+			s.max.KeepMax(uint(s.clientLen()))
+			s.notify(a, prepMessage(RPL_MONONLINE, conf.Name, "*", a), cap.None)
+		}
+		c.WriteMessage(buff)
+		s.replay(c, missed)
+	})
+
+	c.FillTokens()
+	return true
+}
+
+// runSession runs f, which acts on c. If c is a session, f is run by
+// the goroutine that owns c's always-on client, so that the sessions
+// never act on it at the same time. c takes its nick from the
+// always-on client first, in case another session has changed it.
+func (s *Server) runSession(c *client.Client, f func()) {
+	a := c.AttachedTo()
+	if a == nil {
+		f()
+		return
+	}
+	a.Do(func() {
+		c.Nick = a.Nick
+		f()
+	})
+}
+
+// detachSession detaches c from the always-on client a and disconnects
+// it. If a's account is no longer always-on, a quits once its last
+// session is gone.
+func (s *Server) detachSession(a, c *client.Client, reason string) {
+	remaining, ok := a.DetachSession(c)
+	if !ok {
+		return
+	}
+
+	c.WriteMessage(msg.New(nil, "", "", "", "ERROR", []string{reason}, true))
+	c.Close()
+
+	if remaining == 0 && !s.isAlwaysOn(a.SASLMech.Authn()) {
+		QUIT(s, a, &msg.Message{Params: []string{reason}})
+	}
+}
+
+// forgetAlwaysOn removes the always-on client a once it has quit
+func (s *Server) forgetAlwaysOn(a *client.Client) {
+	s.alwaysOnLock.Lock()
+	defer s.alwaysOnLock.Unlock()
+
+	account := strings.ToLower(a.SASLMech.Authn())
+	if s.alwaysOn[account] == a {
+		delete(s.alwaysOn, account)
+	}
+}
+
+// replay sends c the messages that its always-on client missed. If c
+// supports batches, the messages are grouped into a chathistory batch
+// for each conversation; otherwise they are played back as they are.
+// Multiline batches are replayed whole, nested in the chathistory
+// batch, to clients that support them.
+func (s *Server) replay(c *client.Client, missed [][]*msg.Message) {
+	tags := c.HasMessageTags() || c.HasCap(cap.ServerTime.Name)
+	write := func(m *msg.Message, batch string) {
+		var out msg.Msg = m.Copy()
+		if !tags {
+			out = out.RemoveAllTags()
+		}
+		if batch != "" {
+			out.AddTag("batch", batch)
+		}
+		c.Write(out.Bytes())
+	}
+	writeEntry := func(entry []*msg.Message, batch string) {
+		if len(entry) == 1 {
+			write(entry[0], batch)
+			return
+		}
+		if !supportsMultiline(c) {
+			for _, m := range unbatch(entry) {
+				write(m, batch)
+			}
+			return
+		}
+
+		// only the opening and closing of the multiline batch are tagged
+		// as being part of the chathistory batch
+		write(entry[0], batch)
+		for _, m := range entry[1 : len(entry)-1] {
+			write(m, "")
+		}
+		write(entry[len(entry)-1], batch)
+	}
+
+	if !c.HasCap(cap.Batch.Name) {
+		for _, entry := range missed {
+			writeEntry(entry, "")
+		}
+		return
+	}
+
+	// conversations are batched in the order that they were first seen
+	var targets []string
+	conversations := make(map[string][][]*msg.Message)
+	for _, entry := range missed {
+		// a multiline batch is sorted by its first line
+		m := entry[0]
+		if len(entry) > 1 {
+			m = entry[1]
+		}
+		if len(m.Params) == 0 {
+			continue
+		}
+
+		target, _ := s.stripStatus(m.Params[0])
+		// a private conversation is named after the other participant
+		if !isValidChannelString(target) {
+			target = m.Nick
+		}
+
+		k := strings.ToLower(target)
+		if _, ok := conversations[k]; !ok {
+			targets = append(targets, target)
+		}
+		conversations[k] = append(conversations[k], entry)
+	}
+
+	for _, target := range targets {
+		id := uuid.NewString()
+		c.Write(msg.New(nil, "", "", "", "BATCH", []string{"+" + id, "chathistory", target}, false).Bytes())
+		for _, entry := range conversations[strings.ToLower(target)] {
+			writeEntry(entry, id)
+		}
+		c.Write(msg.New(nil, "", "", "", "BATCH", []string{"-" + id}, false).Bytes())
+	}
+}
+
+// echoToSessions shows the message m, which was sent by the session
+// from, to every other session of the always-on client a
+func (s *Server) echoToSessions(a, from *client.Client, m *msg.Message) {
+	for _, v := range a.Sessions() {
+		if v == from || (m.Command == "REDACT" && !v.HasCap(cap.MessageRedaction.Name)) {
+			continue
+		}
+
+		if !v.HasMessageTags() {
+			if m.Command != "TAGMSG" {
+				v.WriteMessage(m.RemoveAllTags())
+			}
+			continue
+		}
+		v.WriteMessage(m.Copy())
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mitchr/gossip/sasl/plain"
+)
+
+func newAlwaysOnServer(t *testing.T) *Server {
+	t.Helper()
+
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.AlwaysOn.Enabled = true
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	plainCred := plain.NewCredential("alice", "pass")
+	s.persistPlain(plainCred.Username, "alice", plainCred.Pass)
+	s.setAlwaysOn("alice", true)
+	return s
+}
+
+// login connects and registers as alice, reading past everything but
+// the lines that follow the registration burst
+func login(nick, caps string) (net.Conn, *bufio.Reader) {
+	c, _ := net.Dial("tcp", ":6667")
+	r := bufio.NewReader(c)
+
+	if caps != "" {
+		caps = " " + caps
+	}
+	c.Write([]byte("CAP REQ :sasl" + caps + "\r\nNICK " + nick + "\r\nUSER " + nick + " 0 0 :" + nick + "\r\nAUTHENTICATE PLAIN\r\n"))
+	readLines(r, 2)
+
+	c.Write([]byte("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\000alice\000pass")) + "\r\nCAP END\r\n"))
+	readLines(r, 2+14)
+	return c, r
+}
+
+func TestAlwaysOnKeepsPresence(t *testing.T) {
+	s := newAlwaysOnServer(t)
+	defer s.Close()
+
+	alice, aliceResp := login("alice", "")
+	alice.Write([]byte("JOIN #test\r\n"))
+	readLines(aliceResp, 3)
+
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("JOIN #test\r\n"))
+	readLines(bobResp, 3)
+
+	alice.Write([]byte("QUIT\r\n"))
+	readLines(aliceResp, 2) // bob's JOIN, and ERROR
+	alice.Close()
+
+	bob.Write([]byte("PRIVMSG #test :are you there?\r\nPRIVMSG alice :hello\r\nNAMES #test\r\n"))
+	// members are listed in no particular order
+	names, _ := bobResp.ReadString('\n')
+	if names != ":gossip 353 bob = #test :@alice bob\r\n" && names != ":gossip 353 bob = #test :bob @alice\r\n" {
+		t.Error("expected alice to still be in #test, got", names)
+	}
+
+	// reconnecting with a different nick gives back the old one
+	alice, aliceResp = login("a", "")
+	defer alice.Close()
+
+	join, _ := aliceResp.ReadBytes('\n')
+	assertResponse(join, ":alice!alice@localhost JOIN #test\r\n", t)
+	readLines(aliceResp, 2)
+
+	chanMsg, _ := aliceResp.ReadBytes('\n')
+	privMsg, _ := aliceResp.ReadBytes('\n')
+	assertResponse(chanMsg, ":bob!bob@localhost PRIVMSG #test :are you there?\r\n", t)
+	assertResponse(privMsg, ":bob!bob@localhost PRIVMSG alice :hello\r\n", t)
+}
+
+func TestAlwaysOnReplayBatch(t *testing.T) {
+	s := newAlwaysOnServer(t)
+	defer s.Close()
+
+	alice, aliceResp := login("alice", "")
+	alice.Write([]byte("QUIT\r\n"))
+	readLines(aliceResp, 1)
+	alice.Close()
+
+	bob, _ := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("PRIVMSG alice :one\r\nPRIVMSG alice :two\r\n"))
+
+	alice, aliceResp = login("alice", "batch")
+	defer alice.Close()
+
+	start, _ := aliceResp.ReadString('\n')
+	if !strings.HasPrefix(start, "BATCH +") || !strings.HasSuffix(start, " chathistory bob\r\n") {
+		t.Fatal("expected chathistory batch, got", start)
+	}
+	id := strings.Fields(start)[1][1:]
+
+	for _, text := range []string{"one", "two"} {
+		line, _ := aliceResp.ReadString('\n')
+		if !strings.HasPrefix(line, "@batch="+id+" ") || !strings.HasSuffix(line, ":bob!bob@localhost PRIVMSG alice :"+text+"\r\n") {
+			t.Error("unexpected replayed message", line)
+		}
+	}
+
+	end, _ := aliceResp.ReadBytes('\n')
+	assertResponse(end, "BATCH -"+id+"\r\n", t)
+}
+
+func TestAlwaysOnMultipleSessions(t *testing.T) {
+	s := newAlwaysOnServer(t)
+	defer s.Close()
+
+	first, firstResp := login("alice", "")
+	defer first.Close()
+	first.Write([]byte("JOIN #test\r\n"))
+	readLines(firstResp, 3)
+
+	second, secondResp := login("alice", "")
+	defer second.Close()
+	readLines(secondResp, 3)
+
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("JOIN #test\r\n"))
+	readLines(bobResp, 3)
+	readLines(firstResp, 1)
+	readLines(secondResp, 1)
+
+	// both sessions receive messages sent to alice
+	bob.Write([]byte("PRIVMSG alice :hi\r\n"))
+	resp, _ := firstResp.ReadBytes('\n')
+	assertResponse(resp, ":bob!bob@localhost PRIVMSG alice :hi\r\n", t)
+	resp, _ = secondResp.ReadBytes('\n')
+	assertResponse(resp, ":bob!bob@localhost PRIVMSG alice :hi\r\n", t)
+
+	// what one session sends is shown to the other
+	first.Write([]byte("PRIVMSG #test :hello\r\n"))
+	resp, _ = bobResp.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost PRIVMSG #test :hello\r\n", t)
+	resp, _ = secondResp.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost PRIVMSG #test :hello\r\n", t)
+
+	// a nick that one session changes is the other's too
+	first.Write([]byte("NICK alice2\r\n"))
+	readLines(firstResp, 1)
+	readLines(secondResp, 1)
+	readLines(bobResp, 1)
+	second.Write([]byte("CAP LIST\r\n"))
+	resp, _ = secondResp.ReadBytes('\n')
+	if !strings.HasPrefix(string(resp), ":gossip CAP alice2 LIST") {
+		t.Error("the second session did not take the new nick:", string(resp))
+	}
+
+	// one session leaving does not affect the other
+	first.Write([]byte("QUIT\r\n"))
+	second.Write([]byte("PRIVMSG bob :still here\r\n"))
+	resp, _ = bobResp.ReadBytes('\n')
+	assertResponse(resp, ":alice2!alice@localhost PRIVMSG bob :still here\r\n", t)
+}
+
+func TestAlwaysOnOff(t *testing.T) {
+	s := newAlwaysOnServer(t)
+	defer s.Close()
+
+	alice, aliceResp := login("alice", "")
+	alice.Write([]byte("SET ALWAYSON OFF\r\n"))
+	resp, _ := aliceResp.ReadBytes('\n')
+	assertResponse(resp, "NOTICE :ALWAYSON is OFF, starting when your last connection closes\r\n", t)
+
+	alice.Write([]byte("QUIT\r\n"))
+	readLines(aliceResp, 1)
+	alice.Close()
+
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("PRIVMSG alice :hello\r\n"))
+	resp, _ = bobResp.ReadBytes('\n')
+	assertResponse(resp, ":gossip 401 bob alice :No such nick/channel\r\n", t)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -13,56 +14,45 @@ import (
 	"github.com/mitchr/gossip/client"
 	"github.com/mitchr/gossip/sasl"
 	"github.com/mitchr/gossip/sasl/external"
+	"github.com/mitchr/gossip/sasl/oauthbearer"
 	"github.com/mitchr/gossip/sasl/plain"
 	"github.com/mitchr/gossip/sasl/scram"
 	"github.com/mitchr/gossip/scan/msg"
 )
 
+// errAccountExists is returned when an account can't be created because
+// another mechanism already has an account by that name
+var errAccountExists = errors.New("account already exists")
+
 func AUTHENTICATE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
-	_, saslNone := c.SASLMech.(sasl.None)
-	// // "If the client completes registration (with CAP END, NICK, USER and
-	// // any other necessary messages) while the SASL authentication is
-	// // still in progress, the server SHOULD abort it and send a 906
-	// // numeric, then register the client without authentication"
-	// if c.Is(client.Registered) && !saslNone && !c.IsAuthenticated {
-	// 	c.SASLMech = nil
-	// 	return prepMessage(ERR_SASLABORTED, s.Name, c.Id())
-	// }
-
-	// client must have requested the SASL capability, and has not yet registered
-	// if !c.Caps[cap.SASL.Name] || c.Is(client.Registered) {
-	// 	return prepMessage(ERR_SASLFAIL, s.Name, c.Id())
-	// }
+	conf := s.Config()
 
 	// "If the client attempts to issue the AUTHENTICATE command after
 	// already authenticating successfully, the server MUST reject it
 	// with a 907 numeric"
-	if c.IsAuthenticated {
-		return prepMessage(ERR_SASLALREADY, s.Name, c.Id())
+	// Once registered, clients may reauthenticate to switch accounts
+	// instead. Sessions of an always-on client share its account, so they
+	// cannot switch it.
+	if c.IsAuthenticated && (!c.Is(client.Registered) || c.AttachedTo() != nil) {
+		return prepMessage(ERR_SASLALREADY, conf.Name, c.Id())
 	}
 
 	if len(m.Params) == 0 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "AUTHENTICATE")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "AUTHENTICATE")
 	}
 
 	if m.Params[0] == "*" {
-		c.SASLMech = nil
-		return prepMessage(ERR_SASLABORTED, s.Name, c.Id())
+		s.abortSASL(c)
+		return prepMessage(ERR_SASLABORTED, conf.Name, c.Id())
 	}
 
 	// this client has no mechanism yet
-	if saslNone {
-		switch m.Params[0] {
-		case "PLAIN":
-			c.SASLMech = plain.New(s.db)
-		case "EXTERNAL":
-			c.SASLMech = external.New(s.db, c)
-		case "SCRAM-SHA-256":
-			c.SASLMech = scram.New(s.db, sha256.New)
-		default:
+	if c.PendingSASL == nil {
+		c.PendingSASL = s.newMechanism(c, m.Params[0])
+		if c.PendingSASL == nil {
 			buff := &msg.Buffer{}
-			buff.AddMsg(prepMessage(RPL_SASLMECHS, s.Name, c.Id(), cap.SASL.Value))
-			buff.AddMsg(prepMessage(ERR_SASLFAIL, s.Name, c.Id()))
+			buff.AddMsg(prepMessage(RPL_SASLMECHS, conf.Name, c.Id(), strings.Join(s.saslMechanisms(conf, c), ",")))
+			buff.AddMsg(prepMessage(ERR_SASLFAIL, conf.Name, c.Id()))
 			return buff
 		}
 
@@ -70,7 +60,7 @@ func AUTHENTICATE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		// so we can be assured that the server should be sending a blank
 		// challenge here. In the future if more mechanisms are added, this
 		// will have to be reevaluated
-		return msg.New(nil, s.Name, "", "", "AUTHENTICATE", []string{"+"}, false)
+		return msg.New(nil, conf.Name, "", "", "AUTHENTICATE", []string{"+"}, false)
 	}
 
 	// if this was not a continuation request
@@ -88,45 +78,107 @@ func AUTHENTICATE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	decodedResp := make([]byte, base64.StdEncoding.DecodedLen(len(c.AuthCtx)))
 	n, err := base64.StdEncoding.Decode(decodedResp, c.AuthCtx)
 	if err != nil {
-		return prepMessage(ERR_SASLFAIL, s.Name, c.Id())
+		c.PendingSASL = nil
+		return prepMessage(ERR_SASLFAIL, conf.Name, c.Id())
 	}
 
-	challenge, err := c.SASLMech.Next(decodedResp[:n])
+	challenge, err := c.PendingSASL.Next(decodedResp[:n])
 	if err != nil {
-		return prepMessage(ERR_SASLFAIL, s.Name, c.Id())
+		c.PendingSASL = nil
+		return prepMessage(ERR_SASLFAIL, conf.Name, c.Id())
 	}
-	if challenge == nil {
-		c.IsAuthenticated = true
-		buff := &msg.Buffer{}
-		buff.AddMsg(prepMessage(RPL_LOGGEDIN, s.Name, c.Id(), c, c.SASLMech.Authn(), c.Id()))
-		buff.AddMsg(prepMessage(RPL_SASLSUCCESS, s.Name, c.Id()))
-		if c.Caps[cap.AccountNotify.Name] {
+	if challenge != nil {
+		encodedChallenge := base64.StdEncoding.EncodeToString(challenge)
+		return msg.New(nil, conf.Name, "", "", "AUTHENTICATE", []string{encodedChallenge}, false)
+	}
+
+	mech := c.PendingSASL
+	c.PendingSASL = nil
+
+	// a registered client was classified by its old account, so it has
+	// to fit in the class of its new one
+	if c.Is(client.Registered) {
+		if err := s.reclassify(c, mech.Authn()); err != nil {
+			return prepMessage(ERR_SASLFAIL, conf.Name, c.Id())
+		}
+	}
+
+	changed := mech.Authn() != c.SASLMech.Authn()
+	// the metadata of the account being left must not follow the client
+	// into its new one
+	if changed && c.IsAuthenticated {
+		c.Metadata.Clear()
+	}
+	c.SASLMech = mech
+	c.IsAuthenticated = true
+	s.loadAccountMetadata(c)
+
+	buff := &msg.Buffer{}
+	buff.AddMsg(prepMessage(RPL_LOGGEDIN, conf.Name, c.Id(), c, c.SASLMech.Authn(), c.Id()))
+	buff.AddMsg(prepMessage(RPL_SASLSUCCESS, conf.Name, c.Id()))
+	if changed {
+		if c.HasCap(cap.AccountNotify.Name) {
 			buff.AddMsg(msg.New(nil, c.Nick, c.User, c.Host, "ACCOUNT", []string{c.SASLMech.Authn()}, false))
 		}
 		s.accountNotify(c)
-		return buff
 	}
+	if c.Is(client.Registered) {
+		buff.AddMsg(s.recheckNick(c))
+	}
+	return buff
+}
 
-	encodedChallenge := base64.StdEncoding.EncodeToString(challenge)
-	return msg.New(nil, s.Name, "", "", "AUTHENTICATE", []string{encodedChallenge}, false)
+// abortSASL discards any authentication that c has in progress
+func (s *Server) abortSASL(c *client.Client) {
+	c.PendingSASL = nil
+	c.AuthCtx = c.AuthCtx[:0]
 }
 
-func (s *Server) accountNotify(c *client.Client) {
-	// if c.Caps[cap.AccountNotify.Name] {
-	// 	c.WriteMessage(msg.New(nil, c.Nick, c.User, c.Host, "ACCOUNT", []string{c.SASLMech.Authn()}, false))
-	// }
+// LOGOUT is nonstandard
+// LOGOUT
+func LOGOUT(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	if !c.IsAuthenticated {
+		return s.NOTICE(c, "You are not logged in")
+	}
+	// the account is shared by all of the always-on client's sessions
+	if c.IsAlwaysOn() {
+		return s.NOTICE(c, "Always-on clients cannot log out; use SET ALWAYSON OFF first")
+	}
 
+	if err := s.reclassify(c, ""); err != nil {
+		QUIT(s, c, &msg.Message{Params: []string{err.Error()}})
+		return nil
+	}
+
+	s.abortSASL(c)
+	c.SASLMech = sasl.None{}
+	c.IsAuthenticated = false
+	// the metadata stays with the account
+	c.Metadata.Clear()
+
+	buff := &msg.Buffer{}
+	buff.AddMsg(prepMessage(RPL_LOGGEDOUT, s.Config().Name, c.Id(), c))
+	if c.HasCap(cap.AccountNotify.Name) {
+		buff.AddMsg(msg.New(nil, c.Nick, c.User, c.Host, "ACCOUNT", []string{"*"}, false))
+	}
+	s.accountNotify(c)
+	buff.AddMsg(s.recheckNick(c))
+	return buff
+}
+
+// accountNotify tells the clients that share a channel with c, or that
+// monitor c, which account c is now logged in to
+func (s *Server) accountNotify(c *client.Client) {
 	// keep track of all clients in the same channel with c
 	clients := make(map[*client.Client]bool)
 	chans := s.channelsOf(c)
 	for _, v := range chans {
 		v.ForAllMembersExcept(c, func(m *channel.Member) {
-			if clients[m.Client] || !m.Caps[cap.AccountNotify.Name] {
+			if clients[m.Client] || !m.HasCap(cap.AccountNotify.Name) {
 				return
 			}
 			clients[m.Client] = true
 			m.WriteMessage(msg.New(nil, c.Nick, c.User, c.Host, "ACCOUNT", []string{c.SASLMech.Authn()}, false))
-			s.writeReply(m.Client, msg.New(nil, "", "", "", "ACCOUNT", []string{c.SASLMech.Authn()}, false))
 		})
 	}
 
@@ -137,18 +189,25 @@ func (s *Server) accountNotify(c *client.Client) {
 // for now, username is assumed to be the same as the current client's nick
 // REGISTER PASS <pass>
 // REGISTER CERT
+// an account can have any number of certificates
+// REGISTER GROUP
+// REGISTER UNGROUP <nick>
 // REGISTER <channel>
 func REGISTER(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) == 0 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "REGISTER")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "REGISTER")
 	}
 
 	switch arg := strings.ToUpper(m.Params[0]); {
 	case arg == "PASS":
 		if len(m.Params) < 2 {
-			return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "REGISTER PASS")
+			return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "REGISTER PASS")
 		}
 		pass := m.Params[1]
+		if s.accountExists(c.Id()) {
+			return s.NOTICE(c, "Account already exists")
+		}
 
 		plainCred := plain.NewCredential(c.Id(), pass)
 		s.persistPlain(plainCred.Username, c.Nick, plainCred.Pass)
@@ -163,8 +222,35 @@ func REGISTER(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		if err != nil {
 			return s.NOTICE(c, err.Error())
 		}
+
+		// a client that is logged in adds the certificate to its own
+		// account; anyone else creates a new account
+		if c.IsAuthenticated {
+			cred := external.NewCredential(c.SASLMech.Authn(), cert)
+			if err := s.addExternalCert(s.db, cred.Username, cred.Cert); err != nil {
+				return s.NOTICE(c, "Certificate is already registered")
+			}
+			break
+		}
+
+		if s.accountExists(c.Id()) {
+			return s.NOTICE(c, "Account already exists")
+		}
 		cred := external.NewCredential(c.Id(), cert)
-		s.persistExternal(cred.Username, c.Nick, cred.Cert)
+		if err := s.persistExternal(cred.Username, c.Nick, cred.Cert); errors.Is(err, errAccountExists) {
+			return s.NOTICE(c, "Account already exists")
+		} else if err != nil {
+			return s.NOTICE(c, "Certificate is already registered")
+		}
+
+	case arg == "GROUP":
+		return s.groupNick(c)
+
+	case arg == "UNGROUP":
+		if len(m.Params) < 2 {
+			return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "REGISTER UNGROUP")
+		}
+		return s.ungroupNick(c, m.Params[1])
 
 	case isValidChannelString(arg):
 		// channel must exist already, sender must be an op in that channel,
@@ -204,8 +290,33 @@ func (s *Server) persistScram(username, nick string, serverKey, storedKey, salt
 	s.db.Exec("INSERT INTO sasl_scram VALUES(?, ?, ?, ?, ?, ?)", username, nick, serverKey, storedKey, salt, iteration)
 }
 
-func (s *Server) persistExternal(username, nick string, cert []byte) {
-	s.db.Exec("INSERT INTO sasl_external VALUES(?, ?, ?)", username, nick, cert)
+// persistExternal creates the account username, which logs in with the
+// certificate fingerprint cert. errAccountExists is returned if
+// username already has an EXTERNAL account.
+func (s *Server) persistExternal(username, nick string, cert []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO sasl_external VALUES(?, ?, ?)", username, nick, cert); err != nil {
+		return errAccountExists
+	}
+	if err := s.addExternalCert(tx, username, cert); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addExternalCert lets the existing account username log in with the
+// certificate fingerprint cert. A certificate can only belong to one
+// account.
+func (s *Server) addExternalCert(db interface {
+	Exec(string, ...any) (sql.Result, error)
+}, username string, cert []byte) error {
+	_, err := db.Exec("INSERT INTO sasl_external_certs VALUES(?, ?)", username, cert)
+	return err
 }
 
 func (s *Server) persistChan(owner, channel string) {
@@ -213,17 +324,67 @@ func (s *Server) persistChan(owner, channel string) {
 }
 
 func (s *Server) chanAlreadyRegistered(channel string) bool {
-	r := s.db.QueryRow("select chan from channels where chan=?", channel)
-	return r.Err() == sql.ErrNoRows
+	var name string
+	err := s.db.QueryRow("select chan from channels where lower(chan)=lower(?)", channel).Scan(&name)
+	return err == nil
+}
+
+// accountExists reports whether any SASL mechanism has an account named
+// username, ignoring case
+func (s *Server) accountExists(username string) bool {
+	var name string
+	err := s.db.QueryRow(`
+		select username from sasl_plain where lower(username)=lower(?)
+		union
+		select username from sasl_scram where lower(username)=lower(?)
+		union
+		select username from sasl_external where lower(username)=lower(?)
+		union
+		select username from sasl_external_certs where lower(username)=lower(?)
+		union
+		select username from sasl_oauthbearer where lower(username)=lower(?)
+	`, username, username, username, username, username).Scan(&name)
+	return err == nil
+}
+
+// oauthAccount decides which account an OAUTHBEARER token that names
+// claim logs in to. claim has to be usable as a nick, and can't be an
+// account that was registered with another mechanism. A new account
+// only reserves its nick if no other account owns it already.
+func (s *Server) oauthAccount(claim string) (string, string, error) {
+	if !validateNick(claim) || len(claim) > s.Config().Limits.Nick {
+		return "", "", oauthbearer.ErrBadClaims
+	}
+
+	var account string
+	if s.db.QueryRow("SELECT username FROM sasl_oauthbearer WHERE lower(username)=lower(?)", claim).Scan(&account) == nil {
+		return account, "", nil
+	}
+	if s.accountExists(claim) {
+		return "", "", errAccountExists
+	}
+
+	nick := claim
+	if s.userAccountForNickExists(claim) != "" {
+		nick = ""
+	}
+	return claim, nick, nil
 }
 
+// userAccountForNickExists returns the account that owns the nick n,
+// either because it was the account's nick when it was registered or
+// because it has been grouped with the account since
 func (s *Server) userAccountForNickExists(n string) (username string) {
 	s.db.QueryRow(`
-		select username from sasl_plain where nick=?
+		select username from sasl_plain where lower(nick)=lower(?)
+		union
+		select username from sasl_scram where lower(nick)=lower(?)
+		union
+		select username from sasl_external where lower(nick)=lower(?)
 		union
-		select username from sasl_scram where nick=?
+		select username from sasl_oauthbearer where lower(nick)=lower(?)
 		union
-		select username from sasl_external where nick=?
-	`, n, n, n).Scan(&username)
+		select username from account_nicks where nick=lower(?)
+	`, n, n, n, n, n).Scan(&username)
 	return
 }
@@ -2,10 +2,19 @@ package server
 
 import (
 	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mitchr/gossip/sasl/external"
 	"github.com/mitchr/gossip/sasl/plain"
@@ -44,7 +53,7 @@ func TestChannelREGISTER(t *testing.T) {
 
 	founderMode, _ := r.ReadBytes('\n')
 	regResp, _ := r.ReadBytes('\n')
-	assertResponse(founderMode, fmt.Sprintf(":%s MODE #test +q alice\r\n", s.Name), t)
+	assertResponse(founderMode, fmt.Sprintf(":%s MODE #test +q alice\r\n", s.Config().Name), t)
 	assertResponse(regResp, "NOTICE :Registered\r\n", t)
 }
 
@@ -87,7 +96,7 @@ func TestAUTHENTICATE(t *testing.T) {
 		c.Write([]byte("AUTHENTICATE PLAIN\r\n"))
 		resp, _ := r.ReadBytes('\n')
 
-		assertResponse(resp, prepMessage(ERR_SASLALREADY, s.Name, "*").String(), t)
+		assertResponse(resp, prepMessage(ERR_SASLALREADY, s.Config().Name, "*").String(), t)
 	})
 
 	t.Run("TestAUTHENTICATEAbort", func(t *testing.T) {
@@ -98,14 +107,17 @@ func TestAUTHENTICATE(t *testing.T) {
 		r.ReadBytes('\n') // cap ack
 		r.ReadBytes('\n') // authenticate +
 
-		for i := 0; i < 13; i++ {
+		// registration completing aborts the exchange
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, prepMessage(ERR_SASLABORTED, s.Config().Name, "c").String(), t)
+		for i := 0; i < 14; i++ {
 			r.ReadBytes('\n')
 		}
 
 		c.Write([]byte("AUTHENTICATE *\r\n"))
-		resp, _ := r.ReadBytes('\n')
+		resp, _ = r.ReadBytes('\n')
 
-		assertResponse(resp, prepMessage(ERR_SASLABORTED, s.Name, "c").String(), t)
+		assertResponse(resp, prepMessage(ERR_SASLABORTED, s.Config().Name, "c").String(), t)
 	})
 
 	t.Run("TestMissingParams", func(t *testing.T) {
@@ -139,8 +151,8 @@ func TestAUTHENTICATE(t *testing.T) {
 		mechList, _ := r.ReadBytes('\n')
 		fail, _ := r.ReadBytes('\n')
 
-		assertResponse(mechList, prepMessage(RPL_SASLMECHS, s.Name, "*", "PLAIN,EXTERNAL,SCRAM-SHA-256").String(), t)
-		assertResponse(fail, prepMessage(ERR_SASLFAIL, s.Name, "*").String(), t)
+		assertResponse(mechList, prepMessage(RPL_SASLMECHS, s.Config().Name, "*", "PLAIN,EXTERNAL,SCRAM-SHA-256").String(), t)
+		assertResponse(fail, prepMessage(ERR_SASLFAIL, s.Config().Name, "*").String(), t)
 	})
 }
 
@@ -174,6 +186,117 @@ func TestAUTHENTICATEPLAIN(t *testing.T) {
 	assertResponse(authenticationSuccess, ":gossip 903 a :SASL authentication successful\r\n", t)
 }
 
+func TestAUTHENTICATEFailureAllowsRetry(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r, p := connect(s)
+	defer p()
+
+	c.Write([]byte("CAP REQ sasl\r\nAUTHENTICATE PLAIN\r\n"))
+	readLines(r, 2)
+
+	c.Write([]byte("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\000tim\000wrong")) + "\r\n"))
+	resp, _ := r.ReadBytes('\n')
+	assertResponse(resp, prepMessage(ERR_SASLFAIL, s.Config().Name, "*").String(), t)
+
+	c.Write([]byte("AUTHENTICATE PLAIN\r\n"))
+	resp, _ = r.ReadBytes('\n')
+	assertResponse(resp, ":gossip AUTHENTICATE +\r\n", t)
+}
+
+// authenticate logs in to the PLAIN account user with pass
+func authenticate(c net.Conn, r *bufio.Reader, user, pass string) {
+	c.Write([]byte("AUTHENTICATE PLAIN\r\n"))
+	r.ReadBytes('\n')
+	c.Write([]byte("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\000"+user+"\000"+pass)) + "\r\n"))
+}
+
+func TestSASLReauthenticate(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	for _, account := range []string{"tim", "jim"} {
+		cred := plain.NewCredential(account, "pass")
+		s.persistPlain(cred.Username, account, cred.Pass)
+	}
+
+	alice, aliceResp := connectAndRegister("alice")
+	defer alice.Close()
+	alice.Write([]byte("CAP REQ sasl\r\nJOIN #test\r\n"))
+	readLines(aliceResp, 4)
+
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("CAP REQ account-notify\r\nJOIN #test\r\n"))
+	readLines(bobResp, 4)
+	readLines(aliceResp, 1)
+
+	authenticate(alice, aliceResp, "tim", "pass")
+	readLines(aliceResp, 2)
+	resp, _ := bobResp.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost ACCOUNT tim\r\n", t)
+
+	// switching to another account
+	authenticate(alice, aliceResp, "jim", "pass")
+	loggedIn, _ := aliceResp.ReadBytes('\n')
+	assertResponse(loggedIn, ":gossip 900 alice alice!alice@localhost jim :You are now logged in as alice\r\n", t)
+	readLines(aliceResp, 1)
+	resp, _ = bobResp.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost ACCOUNT jim\r\n", t)
+
+	// a failed reauthentication keeps the current account
+	authenticate(alice, aliceResp, "tim", "wrong")
+	resp, _ = aliceResp.ReadBytes('\n')
+	assertResponse(resp, ":gossip 904 alice :SASL authentication failed\r\n", t)
+	alice.Write([]byte("WHOIS alice\r\n"))
+	resp, _ = readLines(aliceResp, 5)
+	assertResponse(resp, ":gossip 330 alice alice jim :is logged in as\r\n", t)
+}
+
+func TestLOGOUT(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	cred := plain.NewCredential("tim", "pass")
+	s.persistPlain(cred.Username, "tim", cred.Pass)
+
+	alice, aliceResp := connectAndRegister("alice")
+	defer alice.Close()
+	alice.Write([]byte("LOGOUT\r\n"))
+	resp, _ := aliceResp.ReadBytes('\n')
+	assertResponse(resp, "NOTICE :You are not logged in\r\n", t)
+
+	alice.Write([]byte("CAP REQ sasl\r\nJOIN #test\r\n"))
+	readLines(aliceResp, 4)
+	authenticate(alice, aliceResp, "tim", "pass")
+	readLines(aliceResp, 2)
+
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("CAP REQ account-notify\r\nJOIN #test\r\n"))
+	readLines(bobResp, 4)
+
+	alice.Write([]byte("LOGOUT\r\n"))
+	readLines(aliceResp, 1) // bob's JOIN
+	resp, _ = aliceResp.ReadBytes('\n')
+	assertResponse(resp, ":gossip 901 alice alice!alice@localhost :You are now logged out\r\n", t)
+	resp, _ = bobResp.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost ACCOUNT *\r\n", t)
+}
+
 func TestAUTHENTICATEEXTERNAL(t *testing.T) {
 	s, err := New(generateConfig())
 	if err != nil {
@@ -201,10 +324,115 @@ func TestAUTHENTICATEEXTERNAL(t *testing.T) {
 
 	c.Write([]byte("AUTHENTICATE +\r\n"))
 	resp, _ = r.ReadBytes('\n')
-	assertResponse(resp, prepMessage(RPL_LOGGEDIN, s.Name, "a", "a!a@localhost", "a", "a").String(), t)
+	assertResponse(resp, prepMessage(RPL_LOGGEDIN, s.Config().Name, "a", "a!a@localhost", "a", "a").String(), t)
 
 	resp, _ = r.ReadBytes('\n')
-	assertResponse(resp, prepMessage(RPL_SASLSUCCESS, s.Name, "a").String(), t)
+	assertResponse(resp, prepMessage(RPL_SASLSUCCESS, s.Config().Name, "a").String(), t)
+}
+
+func TestAUTHENTICATEEXTERNALAuthzid(t *testing.T) {
+	s, err := New(generateConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	cert := generateCert()
+	cred := external.NewCredential("alice", cert.Certificate[0])
+	s.persistExternal(cred.Username, "alice", cred.Cert)
+
+	dial := func(nick, authzid string) (*tls.Conn, *bufio.Reader) {
+		c, err := tls.Dial("tcp", ":6697", &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(c)
+
+		c.Write([]byte("CAP REQ sasl\r\nNICK " + nick + "\r\nUSER " + nick + " 0 0 :" + nick + "\r\nAUTHENTICATE EXTERNAL\r\n"))
+		readLines(r, 2)
+		resp := "+"
+		if authzid != "" {
+			resp = base64.StdEncoding.EncodeToString([]byte(authzid))
+		}
+		c.Write([]byte("AUTHENTICATE " + resp + "\r\n"))
+		return c, r
+	}
+
+	// the account is found by the certificate, whatever the nick is
+	c, r := dial("a", "")
+	defer c.Close()
+	resp, _ := r.ReadBytes('\n')
+	assertResponse(resp, prepMessage(RPL_LOGGEDIN, s.Config().Name, "a", "a!a@localhost", "alice", "a").String(), t)
+
+	// the same certificate can't be added to the account twice
+	c.Write([]byte("CAP END\r\nREGISTER CERT\r\n"))
+	resp, _ = readLines(r, 1+14+1)
+	assertResponse(resp, "NOTICE :Certificate is already registered\r\n", t)
+
+	c2, r2 := dial("b", "alice")
+	defer c2.Close()
+	resp, _ = r2.ReadBytes('\n')
+	assertResponse(resp, prepMessage(RPL_LOGGEDIN, s.Config().Name, "b", "b!b@localhost", "alice", "b").String(), t)
+
+	c3, r3 := dial("c", "bob")
+	defer c3.Close()
+	resp, _ = r3.ReadBytes('\n')
+	assertResponse(resp, prepMessage(ERR_SASLFAIL, s.Config().Name, "c").String(), t)
+}
+
+func TestREGISTERCERTExistingAccount(t *testing.T) {
+	s, err := New(generateConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	// the nick alice is not reserved, but the account alice exists
+	s.persistPlain("alice", "al", []byte("pass"))
+
+	cert := generateCert()
+	c, err := tls.Dial("tcp", ":6697", &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	// someone using alice's nick can't add a certificate to her account
+	c.Write([]byte("NICK alice\r\nUSER alice 0 0 :alice\r\nREGISTER CERT\r\n"))
+	resp, _ := readLines(r, 14+1)
+	assertResponse(resp, "NOTICE :Account already exists\r\n", t)
+
+	var username string
+	if s.db.QueryRow("SELECT username FROM sasl_external_certs").Scan(&username) == nil {
+		t.Error("certificate was added to", username)
+	}
+}
+
+func TestExternalCertsMigration(t *testing.T) {
+	conf := generateConfig()
+	conf.Datasource = t.TempDir() + "/gossip.db"
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// accounts that were registered before sasl_external_certs existed
+	// only have their certificate in sasl_external
+	cred := external.NewCredential("alice", generateCert().Certificate[0])
+	s.db.Exec("INSERT INTO sasl_external VALUES(?, ?, ?)", cred.Username, "alice", cred.Cert)
+	if err := s.loadDatabase(conf.Datasource); err != nil {
+		t.Fatal(err)
+	}
+
+	var username string
+	s.db.QueryRow("SELECT username FROM sasl_external_certs WHERE fingerprint=?", cred.Cert).Scan(&username)
+	if username != "alice" {
+		t.Errorf("expected certificate to be moved to alice, got %q", username)
+	}
 }
 
 func TestAUTHENTICATESCRAM(t *testing.T) {
@@ -227,6 +455,152 @@ func TestAUTHENTICATESCRAM(t *testing.T) {
 	assertResponse(resp, ":gossip AUTHENTICATE +\r\n", t)
 }
 
+func TestAUTHENTICATEOAUTHBEARER(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.OAuthBearer.Keys = []string{keyPath}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	enc := base64.RawURLEncoding.EncodeToString
+	tokenFor := func(sub string) string {
+		payload := fmt.Sprintf(`{"sub":%q,"exp":%d}`, sub, time.Now().Add(time.Hour).Unix())
+		signed := enc([]byte(`{"alg":"EdDSA","typ":"JWT"}`)) + "." + enc([]byte(payload))
+		return signed + "." + enc(ed25519.Sign(priv, []byte(signed)))
+	}
+	token := tokenFor("tim")
+
+	c, r, p := connect(s)
+	defer p()
+
+	c.Write([]byte("CAP LS 302\r\n"))
+	ls, _ := r.ReadString('\n')
+	if !strings.Contains(ls, "sasl=PLAIN,EXTERNAL,SCRAM-SHA-256,OAUTHBEARER") {
+		t.Error("OAUTHBEARER was not advertised:", ls)
+	}
+
+	c.Write([]byte("CAP REQ sasl\r\nNICK a\r\nUSER a 0 0 :A\r\nAUTHENTICATE OAUTHBEARER\r\n"))
+	readLines(r, 2)
+
+	c.Write([]byte("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("n,,\x01auth=Bearer "+token+"\x01\x01")) + "\r\n"))
+	resp, _ := r.ReadBytes('\n')
+	assertResponse(resp, ":gossip 900 a a!a@pipe tim :You are now logged in as a\r\n", t)
+	resp, _ = r.ReadBytes('\n')
+	assertResponse(resp, ":gossip 903 a :SASL authentication successful\r\n", t)
+
+	// the account was created on login
+	if s.userAccountForNickExists("tim") != "tim" {
+		t.Error("account was not created")
+	}
+
+	s.persistPlain("alice", "bob", []byte("pass"))
+	login := func(sub string) string {
+		c, r, p := connect(s)
+		defer p()
+
+		c.Write([]byte("CAP REQ sasl\r\nNICK a\r\nUSER a 0 0 :A\r\nAUTHENTICATE OAUTHBEARER\r\n"))
+		readLines(r, 2)
+		c.Write([]byte("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("n,,\x01auth=Bearer "+tokenFor(sub)+"\x01\x01")) + "\r\n"))
+		resp, _ := r.ReadString('\n')
+		return resp
+	}
+
+	t.Run("TestExistingAccount", func(t *testing.T) {
+		if resp := login("alice"); strings.Contains(resp, " 900 ") {
+			t.Error("logged in to an account of another mechanism:", resp)
+		}
+	})
+
+	t.Run("TestInvalidAccountName", func(t *testing.T) {
+		if resp := login("al!ce"); strings.Contains(resp, " 900 ") {
+			t.Error("logged in with an invalid account name:", resp)
+		}
+	})
+
+	t.Run("TestCaseFolding", func(t *testing.T) {
+		resp := login("TIM")
+		assertResponse([]byte(resp), ":gossip 900 a a!a@pipe tim :You are now logged in as a\r\n", t)
+	})
+
+	t.Run("TestNickOwnedByAnotherAccount", func(t *testing.T) {
+		login("bob")
+		if owner := s.userAccountForNickExists("bob"); owner != "alice" {
+			t.Errorf("expected bob to still belong to alice, got %q", owner)
+		}
+	})
+}
+
+func TestSASLMechanismsConfig(t *testing.T) {
+	t.Run("TestUnknownMechanism", func(t *testing.T) {
+		conf := &Config{Name: "gossip", Port: ":6667"}
+		conf.SASL.Mechanisms = []string{"PLAIN", "CRAM-MD5"}
+		if _, err := New(conf); err == nil {
+			t.Error("expected unknown mechanism to be rejected")
+		}
+	})
+
+	t.Run("TestTLSOnly", func(t *testing.T) {
+		conf := &Config{Name: "gossip", Port: ":6667"}
+		conf.SASL.Mechanisms = []string{"scram-sha-256", "plain"}
+		conf.SASL.TLSOnly = []string{"PLAIN"}
+		s, err := New(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		go s.Serve()
+
+		c, r, p := connect(s)
+		defer p()
+
+		c.Write([]byte("CAP LS 302\r\n"))
+		ls, _ := r.ReadString('\n')
+		if !strings.Contains(ls, " sasl=SCRAM-SHA-256 ") {
+			t.Error("expected only SCRAM-SHA-256 to be advertised, got", ls)
+		}
+
+		c.Write([]byte("CAP REQ sasl\r\nAUTHENTICATE PLAIN\r\n"))
+		r.ReadBytes('\n')
+		mechList, _ := r.ReadBytes('\n')
+		fail, _ := r.ReadBytes('\n')
+		assertResponse(mechList, prepMessage(RPL_SASLMECHS, s.Config().Name, "*", "SCRAM-SHA-256").String(), t)
+		assertResponse(fail, prepMessage(ERR_SASLFAIL, s.Config().Name, "*").String(), t)
+	})
+
+	t.Run("TestNoMechanisms", func(t *testing.T) {
+		conf := &Config{Name: "gossip", Port: ":6667"}
+		conf.SASL.Mechanisms = []string{"PLAIN"}
+		conf.SASL.TLSOnly = []string{"PLAIN"}
+		s, err := New(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		go s.Serve()
+
+		c, r, p := connect(s)
+		defer p()
+
+		c.Write([]byte("CAP LS 302\r\n"))
+		ls, _ := r.ReadString('\n')
+		if strings.Contains(ls, "sasl") {
+			t.Error("expected sasl not to be advertised, got", ls)
+		}
+
+		c.Write([]byte("CAP REQ sasl\r\n"))
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, ":gossip CAP * NAK :sasl\r\n", t)
+	})
+}
+
 func TestEndRegistrationWithANickBelongingToRegisteredAccount(t *testing.T) {
 	s, err := New(conf)
 	if err != nil {
@@ -242,5 +616,114 @@ func TestEndRegistrationWithANickBelongingToRegisteredAccount(t *testing.T) {
 
 	c.Write([]byte("nick m\r\nuser u s e r\r\n"))
 	resp, _ := r.ReadBytes('\n')
-	assertResponse(resp, prepMessage(ERR_NICKNAMEINUSE, s.Name, "m", "m").String(), t)
+	assertResponse(resp, prepMessage(ERR_NICKNAMEINUSE, s.Config().Name, "m", "m").String(), t)
+}
+
+func TestNICKToRegisteredNick(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	s.persistPlain("m", "m", []byte("pass"))
+
+	c, r := connectAndRegister("a")
+	defer c.Close()
+
+	c.Write([]byte("NICK M\r\n"))
+	resp, _ := r.ReadBytes('\n')
+	assertResponse(resp, prepMessage(ERR_NICKNAMEINUSE, s.Config().Name, "a", "M").String(), t)
+}
+
+func TestNickEnforcementRename(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.NickEnforcement.Mode = enforceRename
+	conf.NickEnforcement.Grace = time.Millisecond * 50
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	s.persistPlain("m", "m", []byte("pass"))
+
+	c, r := connectAndRegister("m")
+	defer c.Close()
+
+	resp, _ := r.ReadBytes('\n')
+	assertResponse(resp, "NOTICE :The nick m belongs to the account m. If you do not log in within 50ms, you will be renamed.\r\n", t)
+
+	resp, _ = r.ReadBytes('\n')
+	assertResponse(resp, "NOTICE :You did not log in to the account that owns m, so your nick has been changed\r\n", t)
+
+	resp, _ = r.ReadBytes('\n')
+	if !strings.HasPrefix(string(resp), ":m!m@localhost NICK :Guest") {
+		t.Error("expected to be renamed to a guest nick, got", string(resp))
+	}
+}
+
+func TestGuestNickFitsLimit(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.NickEnforcement.Mode = enforceRename
+	conf.Limits.Nick = 7
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 20; i++ {
+		nick, ok := s.guestNick()
+		if !ok || len(nick) > 7 || !strings.HasPrefix(nick, "Guest") || !validateNick(nick) {
+			t.Fatalf("expected a valid guest nick of at most 7 characters, got %q", nick)
+		}
+	}
+
+	conf = &Config{}
+	conf.NickEnforcement.Mode = enforceRename
+	conf.NickEnforcement.GuestPrefix = "gu*st"
+	conf.setDefaults()
+	if conf.checkNickEnforcement() == nil {
+		t.Error("expected a guest prefix that is not a valid nick to be rejected")
+	}
+}
+
+func TestREGISTERGROUP(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	plainCred := plain.NewCredential("tim", "tanstaaftanstaaf")
+	s.persistPlain(plainCred.Username, "a", plainCred.Pass)
+
+	c, r, p := connect(s)
+	defer p()
+
+	c.Write([]byte("CAP REQ sasl\r\nNICK a\r\nUSER a 0 0 :A\r\nAUTHENTICATE PLAIN\r\n"))
+	readLines(r, 2)
+	c.Write([]byte("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\000tim\000tanstaaftanstaaf")) + "\r\nCAP END\r\n"))
+	readLines(r, 2+14)
+
+	c.Write([]byte("NICK b\r\nREGISTER GROUP\r\n"))
+	readLines(r, 1)
+	resp, _ := r.ReadBytes('\n')
+	assertResponse(resp, "NOTICE :Registered\r\n", t)
+
+	if owner := s.userAccountForNickExists("B"); owner != "tim" {
+		t.Errorf("expected b to belong to tim, got %q", owner)
+	}
+
+	c.Write([]byte("REGISTER UNGROUP b\r\n"))
+	resp, _ = r.ReadBytes('\n')
+	assertResponse(resp, "NOTICE :Unregistered\r\n", t)
+
+	if owner := s.userAccountForNickExists("b"); owner != "" {
+		t.Errorf("expected b to be released, but it belongs to %q", owner)
+	}
 }
@@ -1,8 +1,8 @@
 package server
 
 import (
-	"crypto/x509"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,11 +22,6 @@ var subs = map[string]subcommand{
 }
 
 // list capabilities that server supports
-// TODO (only for CAP302 clients): when server capabilties take up too
-// much message space, split up into multiple responses like
-//
-//	CAP * LS * :
-//	CAP * LS :
 func LS(s *Server, c *client.Client, params ...string) msg.Msg {
 	// suspend registration if client has not yet registered
 	if !c.Is(client.Registered) {
@@ -38,24 +33,26 @@ func LS(s *Server, c *client.Client, params ...string) msg.Msg {
 		version, _ = strconv.Atoi(params[0])
 	}
 	// store largest cap version
-	if version > c.CapVersion {
-		c.CapVersion = version
-	}
+	c.SetCapVersion(version)
 
 	if c.SupportsCapVersion(302) {
 		// CAP LS 302 implicitly adds 'cap-notify' to capabilities
 		c.ApplyCap(cap.CapNotify.Name, false)
 	}
 
-	return msg.New(nil, s.Name, "", "", "CAP", []string{c.Id(), "LS", s.capString(version >= 302)}, true)
+	return s.capReply(c, "LS", s.capList(s.Config(), c, version >= 302))
 }
 
 // see what capabilities this client has active during this connection
 func capLIST(s *Server, c *client.Client, params ...string) msg.Msg {
-	return msg.New(nil, s.Name, "", "", "CAP", []string{c.Id(), "LIST", c.CapsSet()}, true)
+	caps := c.CapsList()
+	sort.Strings(caps)
+	return s.capReply(c, "LIST", caps)
 }
 
 func REQ(s *Server, c *client.Client, params ...string) msg.Msg {
+	conf := s.Config()
+
 	// suspend registration if client has not yet registered
 	if !c.Is(client.Registered) {
 		c.RegSuspended = true
@@ -63,10 +60,13 @@ func REQ(s *Server, c *client.Client, params ...string) msg.Msg {
 
 	// if a client requests multiple caps it will be in the form ':cap1
 	// cap2 cap3' which the message parser will treat as one entire
-	// parameter. we have to split it ourselves here
-	if len(params) > 0 {
-		params = strings.Split(params[0], " ")
+	// parameter. we have to split it ourselves here, ignoring any extra
+	// spaces
+	var requested []string
+	for _, v := range params {
+		requested = append(requested, strings.Fields(v)...)
 	}
+	nak := msg.New(nil, conf.Name, "", "", "CAP", []string{c.Id(), "NAK", strings.Join(requested, " ")}, true)
 
 	// "The capability identifier set must be accepted as a whole, or
 	// rejected entirely."
@@ -74,26 +74,31 @@ func REQ(s *Server, c *client.Client, params ...string) msg.Msg {
 	todo := make([]struct {
 		cap    string
 		remove bool
-	}, len(params))
-	for i, v := range params {
-		remove := false
-		if v[0] == '-' {
-			v = v[1:]
-			remove = true
+	}, len(requested))
+	for i, v := range requested {
+		remove := strings.HasPrefix(v, "-")
+		v = strings.TrimPrefix(v, "-")
+		// a value is what the server advertises, not something that can be
+		// requested, so only the name is looked at
+		v, _, _ = strings.Cut(v, "=")
+
+		// sts is only a policy, and can't be requested
+		if !s.hasCap(v) || v == cap.STS.Name || (v == cap.SASL.Name && len(s.saslMechanisms(conf, c)) == 0) {
+			return nak
 		}
-		if s.hasCap(v) {
-			todo[i].cap = v
-			todo[i].remove = remove
-		} else { // capability not recognized
-			return msg.New(nil, s.Name, "", "", "CAP", []string{c.Id(), "NAK", strings.Join(params, " ")}, true)
+		// cap-notify is implied by 302, so those clients can't turn it off
+		if remove && v == cap.CapNotify.Name && c.SupportsCapVersion(302) {
+			return nak
 		}
+		todo[i].cap = v
+		todo[i].remove = remove
 	}
 
 	// apply all changes
 	for _, v := range todo {
 		c.ApplyCap(v.cap, v.remove)
 	}
-	return msg.New(nil, s.Name, "", "", "CAP", []string{c.Id(), "ACK", strings.Join(params, " ")}, true)
+	return msg.New(nil, conf.Name, "", "", "CAP", []string{c.Id(), "ACK", strings.Join(requested, " ")}, true)
 }
 
 func END(s *Server, c *client.Client, params ...string) msg.Msg {
@@ -108,54 +113,226 @@ func END(s *Server, c *client.Client, params ...string) msg.Msg {
 
 // used for capability negotiation
 func CAP(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
+
 	// no subcommand given
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_INVALIDCAPCMD, s.Name, c.Id(), "CAP")
+		return prepMessage(ERR_INVALIDCAPCMD, conf.Name, c.Id(), "CAP")
 
 	}
 
 	subcom, ok := subs[strings.ToUpper(m.Params[0])]
 	if !ok {
-		return prepMessage(ERR_INVALIDCAPCMD, s.Name, c.Id(), "CAP "+m.Params[0])
+		return prepMessage(ERR_INVALIDCAPCMD, conf.Name, c.Id(), "CAP "+m.Params[0])
 	}
 	return subcom(s, c, m.Params[1:]...)
 }
 
 func TAGMSG(s *Server, c *client.Client, m *msg.Message) msg.Msg { return s.communicate(m, c) }
 
-func (s *Server) capString(cap302Enabled bool) string {
-	caps := ""
-	for i, v := range s.supportedCaps {
-		caps += v.Name
-		if cap302Enabled && len(v.Value) > 0 {
-			if v == cap.STS {
-				caps += "=" + s.getSTSValue()
+// capList returns the capabilities that c is offered under conf. If
+// values is true, each capability that has a value is given as
+// name=value.
+func (s *Server) capList(conf *Config, c *client.Client, values bool) []string {
+	caps := make([]string, 0, len(s.supportedCaps))
+	for _, v := range s.supportedCaps {
+		name := v.Name
+		switch v {
+		case cap.SASL:
+			// there is no point in offering SASL without any mechanisms
+			mechs := s.saslMechanisms(conf, c)
+			if len(mechs) == 0 {
+				continue
+			}
+			if values {
+				name += "=" + strings.Join(mechs, ",")
+			}
+		case cap.Multiline:
+			if values {
+				name += fmt.Sprintf("=max-bytes=%d,max-lines=%d", conf.Limits.Multiline.Bytes, conf.Limits.Multiline.Lines)
+			}
+		case cap.Metadata:
+			if values {
+				name += fmt.Sprintf("=max-subs=%d,max-keys=%d,max-value-bytes=%d", conf.Limits.Metadata.Subs, conf.Limits.Metadata.Keys, conf.Limits.Metadata.ValueBytes)
+			}
+		case cap.STS:
+			// a policy can only be advertised if there is a TLS port to
+			// upgrade to
+			if s.tlsListener == nil || !conf.TLS.STS.Enabled {
+				continue
+			}
+			if values {
+				name += "=" + s.getSTSValue(conf, c.IsSecure())
+			}
+		default:
+			if values && len(v.Value) > 0 {
+				name += "=" + v.Value
+			}
+		}
+		caps = append(caps, name)
+	}
+	return caps
+}
+
+// capReply returns the CAP subcommand reply that lists caps. Replies to
+// 302 clients are split up to keep each line within 512 bytes; every
+// line of an LS or LIST reply but the last is marked with "*" so that
+// the client knows to wait for the rest.
+func (s *Server) capReply(c *client.Client, subcommand string, caps []string) msg.Msg {
+	conf := s.Config()
+	reply := func(caps []string, more bool) *msg.Message {
+		params := []string{c.Id(), subcommand}
+		if more {
+			params = append(params, "*")
+		}
+		return msg.New(nil, conf.Name, "", "", "CAP", append(params, strings.Join(caps, " ")), true)
+	}
+	if !c.SupportsCapVersion(302) {
+		return reply(caps, false)
+	}
+
+	continued := subcommand == "LS" || subcommand == "LIST"
+	// room for ":<server> CAP <nick> <subcommand> * :" and "\r\n"
+	room := 512 - len(":"+conf.Name+" CAP "+c.Id()+" "+subcommand+" * :\r\n")
+
+	buff := &msg.Buffer{}
+	var line []string
+	length := 0
+	for _, v := range caps {
+		// a line always holds at least one cap, however long it is
+		if len(line) > 0 && length+1+len(v) > room {
+			buff.AddMsg(reply(line, continued))
+			line, length = nil, 0
+		}
+		if len(line) > 0 {
+			length++
+		}
+		line = append(line, v)
+		length += len(v)
+	}
+	buff.AddMsg(reply(line, false))
+	return buff
+}
+
+// capsChanged tells each client that supports cap-notify about the caps
+// that it is offered now that it wasn't under old, and the caps that it
+// is no longer offered. Caps that are taken away are also disabled. Each
+// client is updated by the goroutine that owns it, except for caller,
+// which is already running on its own.
+func (s *Server) capsChanged(old *Config, caller *client.Client) {
+	s.clientLock.RLock()
+	clients := make([]*client.Client, 0, len(s.clients))
+	for _, v := range s.clients {
+		clients = append(clients, v)
+	}
+	s.clientLock.RUnlock()
+
+	for _, c := range clients {
+		c := c
+		if !c.IsAlwaysOn() {
+			notify := func() { s.notifyCapsChanged(old, c) }
+			if c == caller {
+				notify()
 			} else {
-				caps += "=" + v.Value
+				s.conns.queue(c, notify)
+			}
+			continue
+		}
+
+		// the sessions of an always-on client are each told separately,
+		// since they may be offered different caps
+		notify := func() {
+			for _, v := range c.Sessions() {
+				s.notifyCapsChanged(old, v)
 			}
+			c.SyncCaps()
 		}
-		if i != len(s.supportedCaps)-1 {
-			caps += " "
+		if c == caller || caller.AttachedTo() == c {
+			notify()
+		} else {
+			c.Do(notify)
 		}
 	}
-	return caps
 }
 
-func (s *Server) getSTSValue() string {
-	// calculate TLS certificate expiration duration for sts value
-	var duration time.Duration
-	if s.TLS.STS.Duration != 0 {
-		duration = s.TLS.STS.Duration
-	} else {
+func (s *Server) notifyCapsChanged(old *Config, c *client.Client) {
+	if !c.HasCap(cap.CapNotify.Name) {
+		return
+	}
+	values := c.SupportsCapVersion(302)
+	was := s.capList(old, c, values)
+	now := s.capList(s.Config(), c, values)
+
+	// a cap with a new value is offered again
+	before := make(map[string]bool, len(was))
+	for _, v := range was {
+		before[withoutSTSDuration(v)] = true
+	}
+	var added []string
+	offered := make(map[string]bool, len(now))
+	for _, v := range now {
+		if !before[withoutSTSDuration(v)] {
+			added = append(added, v)
+		}
+		name, _, _ := strings.Cut(v, "=")
+		offered[name] = true
+	}
+
+	var removed []string
+	for _, v := range was {
+		name, _, _ := strings.Cut(v, "=")
+		if !offered[name] {
+			removed = append(removed, name)
+			c.ApplyCap(name, true)
+		}
+	}
+
+	if len(removed) > 0 {
+		c.WriteMessage(s.capReply(c, "DEL", removed))
+	}
+	if len(added) > 0 {
+		c.WriteMessage(s.capReply(c, "NEW", added))
+	}
+}
+
+// withoutSTSDuration drops the duration from the value of an sts cap.
+// When the duration is taken from the certificate, it counts down
+// between any two listings of the cap, and clients pick up the current
+// duration whenever they next connect securely anyway.
+func withoutSTSDuration(v string) string {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name != cap.STS.Name {
+		return v
+	}
+
+	var keep []string
+	for _, param := range strings.Split(value, ",") {
+		if !strings.HasPrefix(param, "duration=") {
+			keep = append(keep, param)
+		}
+	}
+	return name + "=" + strings.Join(keep, ",")
+}
+
+// getSTSValue returns the value of the sts capability. Clients that are
+// connected over plaintext are told which port to reconnect to, and
+// clients that are connected over TLS are told how long to keep using
+// it for.
+// https://ircv3.net/specs/extensions/sts#server-policy-advertisement
+func (s *Server) getSTSValue(conf *Config, secure bool) string {
+	if !secure {
+		return "port=" + conf.TLS.STS.Port
+	}
+
+	duration := conf.TLS.STS.Duration
+	if leaf := conf.leaf(); duration == 0 && leaf != nil {
 		// use time until certificate expires
-		cert, _ := x509.ParseCertificate(s.TLS.Config.Certificates[0].Certificate[0])
-		duration = time.Until(cert.NotAfter)
+		duration = time.Until(leaf.NotAfter)
 	}
 
-	val := fmt.Sprintf(cap.STS.Value, s.Config.TLS.STS.Port, duration.Seconds())
-	if s.Config.TLS.STS.Preload {
+	val := fmt.Sprintf("duration=%.f", duration.Seconds())
+	if conf.TLS.STS.Preload {
 		val += ",preload"
 	}
-
 	return val
 }
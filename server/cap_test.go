@@ -3,15 +3,20 @@ package server
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
+
 	cap "github.com/mitchr/gossip/capability"
 	"github.com/mitchr/gossip/channel"
-	"github.com/mitchr/gossip/sasl/external"
+	"github.com/mitchr/gossip/client"
 	"github.com/mitchr/gossip/sasl/plain"
 	"github.com/mitchr/gossip/scan/msg"
 )
@@ -44,7 +49,7 @@ func TestCAP(t *testing.T) {
 		resp, _ := r.ReadBytes('\n')
 
 		b, _ := s.getClient("b")
-		assertResponse(resp, fmt.Sprintf(":%s 001 b :Welcome to the %s IRC Network %s\r\n", s.Name, s.Network, b.String()), t)
+		assertResponse(resp, fmt.Sprintf(":%s 001 b :Welcome to the %s IRC Network %s\r\n", s.Config().Name, s.Config().Network, b.String()), t)
 	})
 
 	t.Run("TestUnregisteredBeforeEND", func(t *testing.T) {
@@ -90,13 +95,13 @@ func TestREQ(t *testing.T) {
 	t.Run("REQEmptyParam", func(t *testing.T) {
 		c.Write([]byte("CAP REQ\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :\r\n", s.Config().Name), t)
 	})
 
 	t.Run("REQ2Params", func(t *testing.T) {
 		c.Write([]byte("CAP REQ :cap-notify message-tags\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :cap-notify message-tags\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :cap-notify message-tags\r\n", s.Config().Name), t)
 		bob, _ := s.getClient("bob")
 		delete(bob.Caps, cap.CapNotify.Name)
 		delete(bob.Caps, cap.MessageTags.Name)
@@ -106,28 +111,42 @@ func TestREQ(t *testing.T) {
 		c.Write([]byte("CAP REQ message-tags\r\n"))
 
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :message-tags\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :message-tags\r\n", s.Config().Name), t)
 	})
 
 	t.Run("REQRemove", func(t *testing.T) {
 		c.Write([]byte("CAP REQ -message-tags\r\n"))
 
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :-message-tags\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :-message-tags\r\n", s.Config().Name), t)
+	})
+
+	t.Run("REQExtraSpaces", func(t *testing.T) {
+		c.Write([]byte("CAP REQ :  invite-notify   away-notify \r\n"))
+
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :invite-notify away-notify\r\n", s.Config().Name), t)
+	})
+
+	t.Run("REQWithValue", func(t *testing.T) {
+		c.Write([]byte("CAP REQ :sasl=PLAIN\r\n"))
+
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob ACK :sasl=PLAIN\r\n", s.Config().Name), t)
 	})
 
 	t.Run("UnknownCapability", func(t *testing.T) {
 		c.Write([]byte("CAP REQ :not-real\r\n"))
 
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s CAP bob NAK :not-real\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob NAK :not-real\r\n", s.Config().Name), t)
 	})
 
 	t.Run("MixedKnown+Unknown", func(t *testing.T) {
 		c.Write([]byte("CAP REQ :message-tags not-real\r\n"))
 
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s CAP bob NAK :message-tags not-real\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob NAK :message-tags not-real\r\n", s.Config().Name), t)
 	})
 }
 
@@ -144,13 +163,14 @@ func TestCAP302(t *testing.T) {
 
 	c.Write([]byte("CAP LS 302\r\n"))
 	r.ReadBytes('\n')
+	bob, _ := s.getClient("bob")
 
 	// hacky way to test this because we don't have to worry about map
 	// values being out of order
 	t.Run("TestCAPLS302Values", func(t *testing.T) {
 		c.Write([]byte("CAP LS 302\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s CAP bob LS :%s\r\n", s.Name, s.capString(true)), t)
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob LS :%s\r\n", s.Config().Name, strings.Join(s.capList(s.Config(), bob, true), " ")), t)
 	})
 
 	// "If a client sends a lower CAP version (or omits the version number
@@ -159,7 +179,7 @@ func TestCAP302(t *testing.T) {
 	t.Run("TestCAPLSValues", func(t *testing.T) {
 		c.Write([]byte("CAP LS\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s CAP bob LS :%s\r\n", s.Name, s.capString(false)), t)
+		assertResponse(resp, fmt.Sprintf(":%s CAP bob LS :%s\r\n", s.Config().Name, strings.Join(s.capList(s.Config(), bob, false), " ")), t)
 	})
 
 	t.Run("TestCAPUpgrade", func(t *testing.T) {
@@ -173,6 +193,155 @@ func TestCAP302(t *testing.T) {
 	})
 }
 
+func TestCAPReplySplit(t *testing.T) {
+	s := &Server{}
+	s.config.Store(&Config{Name: "gossip"})
+	c := &client.Client{Nick: "bob", CapVersion: 302}
+
+	caps := make([]string, 100)
+	for i := range caps {
+		caps[i] = fmt.Sprintf("vendor/cap-%d=some,value", i)
+	}
+
+	buff := s.capReply(c, "LS", caps).(*msg.Buffer)
+	lines := strings.SplitAfter(string(buff.Bytes()), "\r\n")
+	lines = lines[:len(lines)-1]
+	if len(lines) < 2 {
+		t.Fatal("expected reply to be split, got", lines)
+	}
+
+	var got []string
+	for i, v := range lines {
+		if len(v) > 512 {
+			t.Errorf("line %d is %d bytes long", i, len(v))
+		}
+		more := strings.HasPrefix(v, ":gossip CAP bob LS * :")
+		if more != (i < len(lines)-1) {
+			t.Errorf("line %d has the wrong continuation marker: %s", i, v)
+		}
+		_, list, _ := strings.Cut(strings.TrimSuffix(v, "\r\n"), " :")
+		got = append(got, strings.Fields(list)...)
+	}
+	if strings.Join(got, " ") != strings.Join(caps, " ") {
+		t.Error("caps were lost when splitting")
+	}
+
+	// older clients can't put a split reply back together
+	c.CapVersion = 0
+	if _, ok := s.capReply(c, "LS", caps).(*msg.Message); !ok {
+		t.Error("expected a single line for a client without 302")
+	}
+}
+
+func TestCapNotifyOnREHASH(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	pass, _ := bcrypt.GenerateFromPassword([]byte("adminpass"), bcrypt.MinCost)
+	conf.Ops = map[string][]byte{"admin": pass}
+	conf.configSource = strings.NewReader(`{
+		"name": "gossip",
+		"limits": {"multiline": {"bytes": 8192}},
+		"sasl": {"mechanisms": ["PLAIN"], "tlsOnly": ["PLAIN"]}
+	}`)
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("a")
+	defer c.Close()
+	c.Write([]byte("CAP LS 302\r\nCAP REQ sasl\r\n"))
+	for resp, _ := r.ReadString('\n'); !strings.Contains(resp, "ACK"); resp, _ = r.ReadString('\n') {
+	}
+
+	// b is updated by its own goroutine rather than by a's REHASH
+	b, bResp := connectAndRegister("b")
+	defer b.Close()
+	b.Write([]byte("CAP LS 302\r\nCAP REQ sasl\r\n"))
+	for resp, _ := bResp.ReadString('\n'); !strings.Contains(resp, "ACK"); resp, _ = bResp.ReadString('\n') {
+	}
+
+	c.Write([]byte("OPER admin adminpass\r\nREHASH\r\n"))
+	for resp, _ := r.ReadString('\n'); !strings.Contains(resp, " MODE a +o"); resp, _ = r.ReadString('\n') {
+	}
+	resp, _ := r.ReadBytes('\n')
+	assertResponse(resp, ":gossip CAP a DEL :sasl\r\n", t)
+	resp, _ = r.ReadBytes('\n')
+	assertResponse(resp, ":gossip CAP a NEW :draft/multiline=max-bytes=8192,max-lines=100\r\n", t)
+
+	a, _ := s.getClient("a")
+	if a.Caps[cap.SASL.Name] {
+		t.Error("sasl should have been disabled when it was deleted")
+	}
+
+	resp, _ = bResp.ReadBytes('\n')
+	assertResponse(resp, ":gossip CAP b DEL :sasl\r\n", t)
+	bResp.ReadBytes('\n')
+	b.Write([]byte("CAP LIST\r\n"))
+	resp, _ = bResp.ReadBytes('\n')
+	assertResponse(resp, ":gossip CAP b LIST :cap-notify\r\n", t)
+
+	// another REHASH is turned away rather than waited on
+	resp, _ = r.ReadBytes('\n')
+	assertResponse(resp, ":gossip 382 a config :Rehashing\r\n", t)
+	s.rehashLock.Lock()
+	c.Write([]byte("REHASH\r\n"))
+	resp, _ = r.ReadBytes('\n')
+	s.rehashLock.Unlock()
+	assertResponse(resp, "NOTICE :Could not rehash: the config is already being reloaded\r\n", t)
+}
+
+func TestCapNotifyOnREHASHAlwaysOn(t *testing.T) {
+	s := newAlwaysOnServer(t)
+	defer s.Close()
+	s.Config().configSource = strings.NewReader(`{
+		"name": "gossip",
+		"alwaysOn": {"enabled": true},
+		"sasl": {"mechanisms": ["PLAIN"], "tlsOnly": ["PLAIN"]}
+	}`)
+	pass, _ := bcrypt.GenerateFromPassword([]byte("adminpass"), bcrypt.MinCost)
+	s.Config().Ops = map[string][]byte{"admin": pass}
+
+	first, firstResp := login("alice", "cap-notify")
+	defer first.Close()
+	second, secondResp := login("alice", "cap-notify")
+	defer second.Close()
+
+	// the session that asks is already running on alice's goroutine, and
+	// the other one is told by it
+	first.Write([]byte("OPER admin adminpass\r\nREHASH\r\n"))
+	for resp, _ := firstResp.ReadString('\n'); !strings.Contains(resp, " MODE alice +o"); resp, _ = firstResp.ReadString('\n') {
+	}
+	for _, r := range []*bufio.Reader{firstResp, secondResp} {
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, ":gossip CAP alice DEL :sasl\r\n", t)
+	}
+
+	alice, _ := s.getClient("alice")
+	if alice.HasCap(cap.SASL.Name) {
+		t.Error("sasl should have been disabled for the always-on client")
+	}
+}
+
+func TestWithoutSTSDuration(t *testing.T) {
+	tests := map[string]string{
+		"sts=duration=100,preload": "sts=preload",
+		"sts=duration=100":         "sts=",
+		"sts=port=6697":            "sts=port=6697",
+		"sasl=PLAIN":               "sasl=PLAIN",
+	}
+	for in, out := range tests {
+		if got := withoutSTSDuration(in); got != out {
+			t.Errorf("%s: expected %s, got %s", in, out, got)
+		}
+	}
+
+	if withoutSTSDuration("sts=duration=100") != withoutSTSDuration("sts=duration=99") {
+		t.Error("a change in duration should not offer sts again")
+	}
+}
+
 func TestTAGMSG(t *testing.T) {
 	s, err := New(conf)
 	if err != nil {
@@ -301,18 +470,18 @@ func TestMultiPrefix(t *testing.T) {
 	c1.Write([]byte("NAMES #local\r\n"))
 	namreply, _ := r1.ReadBytes('\n')
 	r1.ReadBytes('\n')
-	assertResponse(namreply, prepMessage(RPL_NAMREPLY, s.Name, "a", "=", "#local", "~&@%+b").String(), t)
+	assertResponse(namreply, prepMessage(RPL_NAMREPLY, s.Config().Name, "a", "=", "#local", "~&@%+b").String(), t)
 
 	// local.SetMember(&channel.Member{Client: a})
 
 	c1.Write([]byte("WHO #local\r\n"))
 	whoreply, _ := r1.ReadBytes('\n')
 	r1.ReadBytes('\n')
-	assertResponse(whoreply, prepMessage(RPL_WHOREPLY, s.Name, "a", "#local", "b", "localhost", s.Name, "b", "H~&@%+", "b").String(), t)
+	assertResponse(whoreply, prepMessage(RPL_WHOREPLY, s.Config().Name, "a", "#local", "b", "localhost", s.Config().Name, "b", "H~&@%+", "b").String(), t)
 
 	c1.Write([]byte("WHOIS b\r\n"))
 	whoisreply, _ := readLines(r1, 4)
-	assertResponse(whoisreply, prepMessage(RPL_WHOISCHANNELS, s.Name, "a", "b ", ":~&@%+#local").String(), t)
+	assertResponse(whoisreply, prepMessage(RPL_WHOISCHANNELS, s.Config().Name, "a", "b ", ":~&@%+#local").String(), t)
 }
 
 // TODO: find out if it is acceptable to AUTHENTICATE after registering
@@ -360,12 +529,12 @@ func TestAccountTag(t *testing.T) {
 	clientFirst := []byte("\000tim\000tanstaaftanstaaf")
 	firstEncoded := base64.StdEncoding.EncodeToString(clientFirst)
 	a.Write([]byte("AUTHENTICATE " + firstEncoded + "\r\n" + "CAP END\r\n"))
-	readLines(r, 15)
+	readLines(r, 16)
 
 	b, r2, p2 := connect(s)
 	defer p2()
 	b.Write([]byte("CAP REQ account-tag\r\nNICK b\r\nUSER u s e r\r\nCAP END\r\n"))
-	readLines(r2, 14)
+	readLines(r2, 15)
 
 	a.Write([]byte("PRIVMSG b :hey\r\n"))
 	resp, _ := r2.ReadBytes('\n')
@@ -397,7 +566,7 @@ func TestAwayNotify(t *testing.T) {
 	t.Run("TestShouldNotifyChannel", func(t *testing.T) {
 		c2.Write([]byte("AWAY :I'm away\r\n"))
 		resp, _ := r2.ReadBytes('\n')
-		assertResponse(resp, prepMessage(RPL_NOWAWAY, s.Name, b.Nick).String(), t)
+		assertResponse(resp, prepMessage(RPL_NOWAWAY, s.Config().Name, b.Nick).String(), t)
 
 		notify, _ := r1.ReadBytes('\n')
 		assertResponse(notify, fmt.Sprintf(":%s AWAY :%s\r\n", b, b.AwayMsg), t)
@@ -428,7 +597,7 @@ func TestExtendedJoin(t *testing.T) {
 	defer a.Close()
 
 	aClient, _ := s.getClient("a")
-	aClient.SASLMech = external.New(nil, aClient)
+	aClient.SASLMech = resumedAccount("a")
 
 	b, r2 := connectAndRegister("b")
 	defer b.Close()
@@ -474,34 +643,78 @@ func TestSTS(t *testing.T) {
 	defer s.Close()
 	go s.Serve()
 
-	clientCert := generateCert()
-	c, err := tls.Dial("tcp", ":6697", &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}})
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer c.Close()
-	r := bufio.NewReader(c)
+	t.Run("TestPlaintext", func(t *testing.T) {
+		c, r := connectAndRegister("a")
+		defer c.Close()
 
-	c.Write([]byte("NICK test\r\nUSER test 0 0 :realname\r\n"))
-	c.Write([]byte("CAP LS 302\r\n"))
+		c.Write([]byte("CAP LS 302\r\n"))
+		resp, _ := r.ReadString('\n')
+		// need to use contains here because the caps can be in any order
+		if !strings.Contains(resp, " sts=port=6697 ") {
+			t.Error("expected sts port, got", resp)
+		}
 
-	resp, _ := readLines(r, 14)
-	// need to use contains here because the caps can be in any order
-	if !strings.Contains(string(resp), "sts="+s.getSTSValue()) {
-		t.Fail()
-	}
+		// sts can't be requested
+		c.Write([]byte("CAP REQ sts\r\n"))
+		resp, _ = r.ReadString('\n')
+		assertResponse([]byte(resp), ":gossip CAP a NAK :sts\r\n", t)
+	})
+
+	t.Run("TestTLS", func(t *testing.T) {
+		clientCert := generateCert()
+		c, err := tls.Dial("tcp", ":6697", &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+
+		c.Write([]byte("NICK test\r\nUSER test 0 0 :realname\r\n"))
+		c.Write([]byte("CAP LS 302\r\n"))
+
+		resp, _ := readLines(r, 15)
+		if !strings.Contains(string(resp), " sts=duration=") || strings.Contains(string(resp), "port=") {
+			t.Error("expected sts duration without a port, got", string(resp))
+		}
+	})
 }
 
 func TestSTSConfig(t *testing.T) {
 	var s Server
-	s.Config = generateConfig()
+	s.config.Store(generateConfig())
 
-	s.Config.TLS.STS.Port = "1010"
-	s.Config.TLS.STS.Duration = time.Hour * 744 // 1 month
-	s.Config.TLS.STS.Preload = true
+	s.Config().TLS.STS.Port = "1010"
+	s.Config().TLS.STS.Duration = time.Hour * 744 // 1 month
+	s.Config().TLS.STS.Preload = true
 
-	if s.getSTSValue() != fmt.Sprintf(cap.STS.Value, s.Config.TLS.STS.Port, s.Config.TLS.STS.Duration.Seconds())+",preload" {
-		t.Fail()
+	if v := s.getSTSValue(s.Config(), false); v != "port=1010" {
+		t.Error("unexpected plaintext value", v)
+	}
+	if v := s.getSTSValue(s.Config(), true); v != fmt.Sprintf("duration=%.f,preload", s.Config().TLS.STS.Duration.Seconds()) {
+		t.Error("unexpected tls value", v)
+	}
+
+	// the duration defaults to how long the certificate has left
+	s.Config().TLS.STS.Duration = 0
+	s.Config().TLS.STS.Preload = false
+	cert, _ := x509.ParseCertificate(s.Config().TLS.Config.Certificates[0].Certificate[0])
+	v := s.getSTSValue(s.Config(), true)
+	seconds, err := strconv.ParseFloat(strings.TrimPrefix(v, "duration="), 64)
+	if err != nil || math.Abs(seconds-time.Until(cert.NotAfter).Seconds()) > 2 {
+		t.Error("unexpected tls value", v)
+	}
+}
+
+func TestSTSPortDefault(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeKeyPair(t, dir, "gossip")
+
+	conf, err := NewConfig(strings.NewReader(fmt.Sprintf(`{"tls": {"enabled": true, "port": "127.0.0.1:6697", "pubkey": %q, "privkey": %q, "sts": {"enabled": true}}}`, pair.Pubkey, pair.Privkey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.TLS.STS.Port != "6697" {
+		t.Error("expected sts port to default to 6697, got", conf.TLS.STS.Port)
 	}
 }
 
@@ -526,7 +739,7 @@ func TestUserhostInNames(t *testing.T) {
 	c1.Write([]byte("CAP REQ userhost-in-names\r\nNAMES #local\r\n"))
 	r1.ReadBytes('\n')
 	names, _ := r1.ReadBytes('\n')
-	assertResponse(names, prepMessage(RPL_NAMREPLY, s.Name, "a", "=", "#local", b.String()).String(), t)
+	assertResponse(names, prepMessage(RPL_NAMREPLY, s.Config().Name, "a", "=", "#local", b.String()).String(), t)
 }
 
 func TestLabeledResponse(t *testing.T) {
@@ -544,5 +757,5 @@ func TestLabeledResponse(t *testing.T) {
 	r1.ReadBytes('\n')
 	resp, _ := r1.ReadBytes('\n')
 
-	assertResponse(resp, msg.New([]msg.Tag{{Key: "label", Value: "123456"}}, s.Name, "", "", "401", []string{"a", "noNick", "No such nick/channel"}, true).String(), t)
+	assertResponse(resp, msg.New([]msg.Tag{{Key: "label", Value: "123456"}}, s.Config().Name, "", "", "401", []string{"a", "noNick", "No such nick/channel"}, true).String(), t)
 }
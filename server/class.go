@@ -0,0 +1,414 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+	"github.com/mitchr/gossip/scan/wild"
+)
+
+// Class groups together connections that share the same limits. A
+// connection belongs to the first configured class that it matches; if
+// it matches none, it belongs to a default class that has no limits.
+type Class struct {
+	Name string `json:"name"`
+
+	// A connection matches this class if it matches every one of the
+	// following criteria that is set.
+
+	// The connection comes from an address in one of these networks.
+	CIDR []string `json:"cidr"`
+	// The connection was accepted by the listener on this port (e.g.
+	// ":6697").
+	Listener string `json:"listener"`
+	// The connection is (or is not) using TLS.
+	TLS *bool `json:"tls"`
+	// The client has authenticated to an account that matches this
+	// wildcard mask. Since accounts are only known after SASL, classes
+	// with an account are matched when registration completes.
+	Account string `json:"account"`
+
+	// The maximum number of clients in this class. If 0, unlimited.
+	MaxClients int `json:"maxClients"`
+	// The maximum number of simultaneous connections from a single IP.
+	MaxPerIP int `json:"maxPerIP"`
+	// The maximum number of simultaneous connections from a single
+	// subnet. The size of a subnet is given by SubnetV4 and SubnetV6,
+	// which default to /24 and /64.
+	MaxPerSubnet int `json:"maxPerSubnet"`
+	SubnetV4     int `json:"subnetV4"`
+	SubnetV6     int `json:"subnetV6"`
+
+	// Limits how quickly a single IP can make new connections. If
+	// Connects is 0, there is no limit.
+	ConnectRate struct {
+		Connects int           `json:"connects"`
+		Period   time.Duration `json:"period"`
+	} `json:"connectRate"`
+
+	// Parameters given to clients in this class. If left unset, the
+	// server-wide values are used. Since a client's SendQ is created
+	// when it connects, the SendQ of an account class is not applied.
+	SendQ    int                `json:"sendq"`
+	Flood    *client.FloodLimit `json:"flood"`
+	Timeouts Timeouts           `json:"timeouts"`
+
+	nets []*net.IPNet
+}
+
+var (
+	ErrServerFull      = errors.New("Closing Link: Server is full")
+	ErrClassFull       = errors.New("Closing Link: Too many clients in your connection class")
+	ErrTooManyFromIP   = errors.New("Closing Link: Too many connections from your IP")
+	ErrTooManyFromNet  = errors.New("Closing Link: Too many connections from your subnet")
+	ErrConnectingQuick = errors.New("Closing Link: Reconnecting too fast")
+)
+
+// prepare parses the class's networks and fills in any unset
+// parameters from the server-wide config
+func (class *Class) prepare(c *Config) error {
+	class.nets = make([]*net.IPNet, len(class.CIDR))
+	for i, v := range class.CIDR {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return fmt.Errorf("class %s: %w", class.Name, err)
+		}
+		class.nets[i] = n
+	}
+
+	if class.SubnetV4 == 0 {
+		class.SubnetV4 = 24
+	}
+	if class.SubnetV6 == 0 {
+		class.SubnetV6 = 64
+	}
+	if class.SendQ == 0 {
+		class.SendQ = c.SendQ
+	}
+	if class.Flood == nil {
+		class.Flood = &c.Flood
+	}
+	class.Timeouts.fill(c.Timeouts)
+	return nil
+}
+
+// matches reports whether the connection u, authenticated as account,
+// belongs in this class
+func (class *Class) matches(u net.Conn, account string) bool {
+	if len(class.nets) > 0 {
+		ip := remoteIP(u)
+		found := false
+		for _, n := range class.nets {
+			if ip != nil && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if class.Listener != "" {
+		_, want, _ := net.SplitHostPort(class.Listener)
+		_, port, err := net.SplitHostPort(u.LocalAddr().String())
+		if err != nil || port != want {
+			return false
+		}
+	}
+
+	if class.TLS != nil {
+		if _, ok := u.(*tls.Conn); ok != *class.TLS {
+			return false
+		}
+	}
+
+	if class.Account != "" && (account == "" || !wild.Match(class.Account, account)) {
+		return false
+	}
+	return true
+}
+
+// subnet returns the subnet that ip belongs to in this class
+func (class *Class) subnet(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.Mask(net.CIDRMask(class.SubnetV4, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(class.SubnetV6, 128)).String()
+}
+
+func remoteIP(u net.Conn) net.IP {
+	host, _, err := net.SplitHostPort(u.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// classify returns the class that u belongs to. If account is empty,
+// classes that match on an account are skipped.
+func (s *Server) classify(u net.Conn, account string) *Class {
+	conf := s.Config()
+	for i := range conf.Classes {
+		if conf.Classes[i].matches(u, account) {
+			return &conf.Classes[i]
+		}
+	}
+	return conf.defaultClass
+}
+
+// connection is an admitted connection that counts against its class's
+// limits
+type connection struct {
+	u     net.Conn
+	class *Class
+	// the account that class was matched with
+	account string
+	ip      string
+	subnet  string
+
+	// closed once the connection is released
+	done chan struct{}
+	// work that has to be done by the goroutine serving the client,
+	// because it changes the client
+	queued chan func()
+}
+
+// connTracker counts the connections that are currently open so that
+// connection limits can be enforced
+type connTracker struct {
+	m       sync.Mutex
+	total   int
+	classes map[string]int
+	ips     map[string]int
+	subnets map[string]int
+	rate    map[string]*window
+	clients map[*client.Client]connection
+}
+
+func (t *connTracker) init() {
+	if t.classes == nil {
+		t.classes = make(map[string]int)
+		t.ips = make(map[string]int)
+		t.subnets = make(map[string]int)
+		t.rate = make(map[string]*window)
+		t.clients = make(map[*client.Client]connection)
+	}
+}
+
+// admit checks that a new connection from u fits within the limits of
+// class, and if so counts it. The connection must later be released.
+func (s *Server) admit(u net.Conn, class *Class) (connection, error) {
+	t := &s.conns
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.init()
+
+	conn := connection{u: u, class: class, ip: u.RemoteAddr().String(), done: make(chan struct{}), queued: make(chan func())}
+	if ip := remoteIP(u); ip != nil {
+		conn.ip = ip.String()
+		conn.subnet = class.Name + " " + class.subnet(ip)
+	}
+
+	if class.ConnectRate.Connects != 0 {
+		now := time.Now()
+		w := t.rate[conn.ip]
+		if w == nil {
+			w = &window{}
+			t.rate[conn.ip] = w
+		}
+		if w.count(now, class.ConnectRate.Period) >= class.ConnectRate.Connects {
+			return conn, ErrConnectingQuick
+		}
+		w.add(now, class.ConnectRate.Period)
+
+		// forget about this ip once its connections have aged out
+		ip, period := conn.ip, class.ConnectRate.Period
+		time.AfterFunc(period, func() {
+			t.m.Lock()
+			defer t.m.Unlock()
+			if w := t.rate[ip]; w != nil && w.count(time.Now(), period) == 0 {
+				delete(t.rate, ip)
+			}
+		})
+	}
+
+	if err := t.fits(conn, s.Config().MaxClients); err != nil {
+		return conn, err
+	}
+	t.add(conn, 1)
+	return conn, nil
+}
+
+// fits returns an error if counting conn would exceed any limit
+func (t *connTracker) fits(conn connection, maxClients int) error {
+	class := conn.class
+	switch {
+	case maxClients != 0 && t.total >= maxClients:
+		return ErrServerFull
+	case class.MaxClients != 0 && t.classes[class.Name] >= class.MaxClients:
+		return ErrClassFull
+	case class.MaxPerIP != 0 && t.ips[class.Name+" "+conn.ip] >= class.MaxPerIP:
+		return ErrTooManyFromIP
+	case class.MaxPerSubnet != 0 && conn.subnet != "" && t.subnets[conn.subnet] >= class.MaxPerSubnet:
+		return ErrTooManyFromNet
+	}
+	return nil
+}
+
+// add adjusts the counts for conn by n
+func (t *connTracker) add(conn connection, n int) {
+	t.total += n
+	t.classes[conn.class.Name] += n
+	t.ips[conn.class.Name+" "+conn.ip] += n
+	if conn.subnet != "" {
+		t.subnets[conn.subnet] += n
+	}
+
+	if t.classes[conn.class.Name] == 0 {
+		delete(t.classes, conn.class.Name)
+	}
+	if t.ips[conn.class.Name+" "+conn.ip] == 0 {
+		delete(t.ips, conn.class.Name+" "+conn.ip)
+	}
+	if conn.subnet != "" && t.subnets[conn.subnet] == 0 {
+		delete(t.subnets, conn.subnet)
+	}
+}
+
+// track associates an admitted connection with its client
+func (t *connTracker) track(c *client.Client, conn connection) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.clients[c] = conn
+}
+
+// release stops counting c's connection
+func (t *connTracker) release(c *client.Client) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if conn, ok := t.clients[c]; ok {
+		t.add(conn, -1)
+		delete(t.clients, c)
+		close(conn.done)
+	}
+}
+
+// all returns every client that is currently connected
+func (t *connTracker) all() []*client.Client {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	clients := make([]*client.Client, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// released returns a channel that is closed once c's connection has
+// been released
+func (t *connTracker) released(c *client.Client) <-chan struct{} {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if conn, ok := t.clients[c]; ok {
+		return conn.done
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// queue has f run by the goroutine that serves c. If c's connection has
+// already been released, f is dropped.
+func (t *connTracker) queue(c *client.Client, f func()) {
+	t.m.Lock()
+	conn, ok := t.clients[c]
+	t.m.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case conn.queued <- f:
+	case <-conn.done:
+	}
+}
+
+// classOf returns the class that c currently belongs to
+func (t *connTracker) classOf(c *client.Client) *Class {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.clients[c].class
+}
+
+// reclassify moves c into the class matching its account, if there is
+// one. An error is returned if c does not fit within that class.
+func (s *Server) reclassify(c *client.Client, account string) error {
+	t := &s.conns
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	old, ok := t.clients[c]
+	if !ok {
+		return nil
+	}
+	class := s.classify(old.u, account)
+	if old.class == class {
+		return nil
+	}
+
+	conn := connection{u: old.u, class: class, account: account, ip: old.ip, done: old.done, queued: old.queued}
+	if ip := net.ParseIP(old.ip); ip != nil {
+		conn.subnet = class.Name + " " + class.subnet(ip)
+	}
+
+	// the client's old connection should not count against itself
+	t.add(old, -1)
+	if err := t.fits(conn, s.Config().MaxClients); err != nil {
+		t.add(old, 1)
+		return err
+	}
+	t.add(conn, 1)
+	t.clients[c] = conn
+
+	c.SetFlood(class.Flood)
+	return nil
+}
+
+// reloadClasses moves every client into the class that matches it
+// under the current config, so that changes made by REHASH apply to
+// clients that are already connected. Clients are not disconnected if
+// they no longer fit within their class.
+func (s *Server) reloadClasses() {
+	t := &s.conns
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for c, conn := range t.clients {
+		t.add(conn, -1)
+		conn.class = s.classify(conn.u, conn.account)
+		if ip := net.ParseIP(conn.ip); ip != nil {
+			conn.subnet = conn.class.Name + " " + conn.class.subnet(ip)
+		}
+		t.add(conn, 1)
+		t.clients[c] = conn
+
+		c.SetFlood(conn.class.Flood)
+	}
+}
+
+// reject tells u why it cannot connect, and then closes it
+func reject(u net.Conn, err error) {
+	u.SetWriteDeadline(time.Now().Add(time.Second))
+	u.Write(msg.New(nil, "", "", "", "ERROR", []string{err.Error()}, true).Bytes())
+	u.Close()
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mitchr/gossip/sasl/plain"
+)
+
+var localhost = []string{"127.0.0.0/8", "::1/128"}
+
+func TestMaxPerIP(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Classes: []Class{{Name: "local", CIDR: localhost, MaxPerIP: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, _ := connectAndRegister("a")
+	defer c1.Close()
+
+	c2, _ := net.Dial("tcp", ":6667")
+	defer c2.Close()
+	resp, _ := bufio.NewReader(c2).ReadBytes('\n')
+	assertResponse(resp, "ERROR :Closing Link: Too many connections from your IP\r\n", t)
+}
+
+func TestMaxClients(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667", MaxClients: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, _ := connectAndRegister("a")
+	defer c1.Close()
+
+	c2, _ := net.Dial("tcp", ":6667")
+	defer c2.Close()
+	resp, _ := bufio.NewReader(c2).ReadBytes('\n')
+	assertResponse(resp, "ERROR :Closing Link: Server is full\r\n", t)
+}
+
+func TestConnectRate(t *testing.T) {
+	class := Class{Name: "local", CIDR: localhost}
+	class.ConnectRate.Connects = 1
+	class.ConnectRate.Period = time.Minute
+
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Classes: []Class{class}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, _ := connectAndRegister("a")
+	c1.Close()
+
+	c2, _ := net.Dial("tcp", ":6667")
+	defer c2.Close()
+	resp, _ := bufio.NewReader(c2).ReadBytes('\n')
+	assertResponse(resp, "ERROR :Closing Link: Reconnecting too fast\r\n", t)
+}
+
+func TestInvalidClassCIDR(t *testing.T) {
+	_, err := New(&Config{Name: "gossip", Port: ":6667", Classes: []Class{{Name: "bad", CIDR: []string{"127.0.0.1"}}}})
+	if err == nil {
+		t.Error("accepted invalid CIDR")
+	}
+}
+
+func TestAccountClass(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Classes: []Class{{Name: "staff", Account: "tim"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	plainCred := plain.NewCredential("tim", "tanstaaftanstaaf")
+	s.persistPlain(plainCred.Username, "a", plainCred.Pass)
+
+	c, r, p := connect(s)
+	defer p()
+
+	c.Write([]byte("CAP REQ sasl\r\nNICK a\r\nUSER a 0 0 :A\r\nAUTHENTICATE PLAIN\r\n"))
+	readLines(r, 2)
+
+	clientFirst := []byte("\000tim\000tanstaaftanstaaf")
+	c.Write([]byte("AUTHENTICATE " + base64.StdEncoding.EncodeToString(clientFirst) + "\r\nCAP END\r\n"))
+	readLines(r, 2+14)
+
+	a, _ := s.getClient("a")
+	if class := s.conns.classOf(a); class.Name != "staff" {
+		t.Errorf("expected client to be in class staff, got %s", class.Name)
+	}
+}
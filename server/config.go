@@ -6,11 +6,16 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 	"time"
+
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/sasl/oauthbearer"
 )
 
 type Config struct {
@@ -41,17 +46,42 @@ type Config struct {
 		// A path to the server's private key
 		Privkey string `json:"privkey"`
 
+		// More certificates, which are chosen by the server name that
+		// clients ask for (SNI). Clients that ask for a name that none of
+		// them match are served Pubkey.
+		SNI []KeyPair `json:"sni"`
+		// certificates are reloaded whenever their files change
+		certs *certStore
+
+		// The oldest version of TLS that clients can use, either "1.2" (the
+		// default) or "1.3".
+		MinVersion string `json:"minVersion"`
+
+		// The cipher suites that can be used with TLS 1.2, by their names
+		// in crypto/tls. If empty, Go's defaults are used. The TLS 1.3
+		// cipher suites can't be configured.
+		Ciphers []string `json:"ciphers"`
+
+		// How client certificates are handled. "request" (the default)
+		// asks clients for a certificate but accepts any. "verify" rejects
+		// certificates that were not issued by ClientCA, and "require"
+		// also rejects clients that don't have one.
+		ClientAuth string `json:"clientAuth"`
+		// A path to PEM encoded CA certificates
+		ClientCA string `json:"clientCA"`
+
 		STS struct {
 			// Enables strict transport security, which provides opportunistic
 			// TLS client connection upgrades
 			Enabled bool `json:"enabled"`
 
-			// The port that clients should be told to connect to. This defaults
-			// to TLS.Port if not set.
+			// The port that clients connected over plaintext should be told
+			// to reconnect to with TLS. This defaults to the port of TLS.Port
+			// if not set.
 			Port string `json:"port"`
 
-			// The time that is advertised to clients about how long they should
-			// stay connected with TLS. This defaults to the difference between
+			// The time that is advertised to clients connected over TLS about
+			// how long they should keep connecting with TLS. This defaults to the difference between
 			// the current time and the `NotAfter` property of the server's
 			// certificate.
 			Duration time.Duration `json:"duration"`
@@ -73,6 +103,155 @@ type Config struct {
 
 	// A map where operator names are the keys and pass is the value
 	Ops map[string][]byte `json:"ops,omitempty"`
+
+	// Length limits that are advertised in RPL_ISUPPORT. Any limit that
+	// is left as 0 is given a default value.
+	Limits struct {
+		Away    int `json:"away"`
+		Channel int `json:"channel"`
+		Host    int `json:"host"`
+		Kick    int `json:"kick"`
+		Nick    int `json:"nick"`
+		Topic   int `json:"topic"`
+		User    int `json:"user"`
+
+		// The maximum number of entries in each of the b, e, and I lists
+		List int `json:"list"`
+
+		// The largest draft/multiline batch that a client can send, as
+		// the total length of its lines and as the number of lines
+		Multiline struct {
+			Bytes int `json:"bytes"`
+			Lines int `json:"lines"`
+		} `json:"multiline"`
+
+		// The number of metadata keys that a user or channel can have set,
+		// the longest value that a key can be given, and the number of
+		// keys that a client can subscribe to
+		Metadata struct {
+			Keys       int `json:"keys"`
+			ValueBytes int `json:"valueBytes"`
+			Subs       int `json:"subs"`
+		} `json:"metadata"`
+	} `json:"limits"`
+
+	// The number of messages that can be waiting to be sent to a client.
+	// If a client falls this far behind, it is disconnected. Defaults to
+	// 512.
+	SendQ int `json:"sendq"`
+
+	// Limits how quickly each client's messages are processed. Defaults
+	// to a burst of 20 messages, refilled at one message every 2 seconds.
+	Flood client.FloodLimit `json:"flood"`
+
+	// How long clients are given to receive their final messages when
+	// the server shuts down. Defaults to 5 seconds.
+	ShutdownGrace time.Duration `json:"shutdownGrace"`
+
+	// How long the server waits on clients before disconnecting them.
+	// These can be overridden for each connection class.
+	Timeouts Timeouts `json:"timeouts"`
+
+	// The maximum number of clients that can be connected at once. If 0,
+	// there is no limit.
+	MaxClients int `json:"maxClients"`
+
+	// Connection classes, in order of precedence. Connections that don't
+	// match any class are not subject to any per-class limits.
+	Classes      []Class `json:"classes"`
+	defaultClass *Class
+
+	// Controls how nicks that belong to an account are kept from clients
+	// that are not logged in to that account.
+	NickEnforcement struct {
+		// If "refuse" (the default), other clients cannot use the nick at
+		// all. If "rename", they can use it, but are renamed to a guest
+		// nick unless they log in to the account within Grace.
+		Mode string `json:"mode"`
+
+		// Defaults to 30 seconds.
+		Grace time.Duration `json:"grace"`
+
+		// Guest nicks are made from this prefix followed by a number.
+		// Defaults to "Guest".
+		GuestPrefix string `json:"guestPrefix"`
+	} `json:"nickEnforcement"`
+
+	// Controls which SASL mechanisms clients can use
+	SASL struct {
+		// The mechanisms that are offered, in the order that they are
+		// advertised. Defaults to every mechanism that gossip implements.
+		Mechanisms []string `json:"mechanisms"`
+
+		// Mechanisms that are only offered to clients that are connected
+		// over TLS, such as PLAIN, which sends passwords as they are.
+		TLSOnly []string `json:"tlsOnly"`
+
+		External struct {
+			// A path to PEM encoded CA certificates. If set, EXTERNAL only
+			// accepts client certificates that were issued by one of them.
+			CA string `json:"ca"`
+		} `json:"external"`
+	} `json:"sasl"`
+	externalCA *x509.CertPool
+
+	// Enables the OAUTHBEARER SASL mechanism, which logs clients in with
+	// JSON Web Tokens. An account is created the first time that a token
+	// for it is used.
+	OAuthBearer struct {
+		// Paths to files holding the public keys that tokens can be signed
+		// with, either PEM encoded or as a JWKS. OAUTHBEARER is only
+		// offered if at least one is given.
+		Keys []string `json:"keys"`
+
+		// The claim that holds the account name. Defaults to "sub".
+		Claim string `json:"claim"`
+
+		// If set, tokens must have been issued by Issuer and intended for
+		// Audience.
+		Issuer   string `json:"issuer"`
+		Audience string `json:"audience"`
+	} `json:"oauthbearer"`
+	oauthbearer *oauthbearer.Verifier
+
+	// Accounts can opt in to staying connected after their last
+	// connection closes with the nonstandard SET ALWAYSON command.
+	AlwaysOn struct {
+		Enabled bool `json:"enabled"`
+
+		// The number of messages that are kept for an always-on client
+		// while it has no connections, to be replayed when it reconnects.
+		// Defaults to 256.
+		Replay int `json:"replay"`
+	} `json:"alwaysOn"`
+
+	// Controls how messages can be taken back with REDACT, or edited,
+	// after they are sent
+	Redaction struct {
+		// How long a client can redact or edit its own messages for after
+		// sending them. If 0, there is no limit. Server operators are not
+		// limited, and neither are channel operators in their channel.
+		Window time.Duration `json:"window"`
+	} `json:"redaction"`
+
+	// Limits how quickly clients can JOIN channels
+	JoinThrottle struct {
+		// The number of channels a single client can join within Period.
+		// If 0, clients can join as quickly as they like.
+		Joins  int           `json:"joins"`
+		Period time.Duration `json:"period"`
+
+		// A channel is considered flooded if it admits more than Joins
+		// clients within Period. A flooded channel is locked down by
+		// setting Mode (either "i" or "R") for Duration. Period defaults to
+		// 10 seconds, Mode to "i", and Duration to 1 minute.
+		Flood struct {
+			Joins    int           `json:"joins"`
+			Period   time.Duration `json:"period"`
+			Mode     string        `json:"mode"`
+			Duration time.Duration `json:"duration"`
+		} `json:"flood"`
+	} `json:"joinThrottle"`
 }
 
 // Unmarshal's the server's config file
@@ -85,6 +264,20 @@ func loadConfig(r io.Reader) (*Config, error) {
 		return nil, err
 	}
 
+	c.setDefaults()
+	if err := c.checkJoinThrottle(); err != nil {
+		return nil, err
+	}
+	if err := c.checkNickEnforcement(); err != nil {
+		return nil, err
+	}
+	if err := c.prepareClasses(); err != nil {
+		return nil, err
+	}
+	if err := c.prepareSASL(); err != nil {
+		return nil, err
+	}
+
 	// convert []byte back from base64
 	base64.StdEncoding.Decode(c.Password, c.Password)
 	for k := range c.Ops {
@@ -94,6 +287,163 @@ func loadConfig(r io.Reader) (*Config, error) {
 	return c, nil
 }
 
+// setDefaults fills in any unset limits, queue sizes, timeouts, and
+// flood parameters
+func (c *Config) setDefaults() {
+	defaults := []struct {
+		limit *int
+		value int
+	}{
+		{&c.Limits.Away, 200},
+		{&c.Limits.Channel, 64},
+		{&c.Limits.Host, 64},
+		{&c.Limits.Kick, 200},
+		{&c.Limits.Nick, 30},
+		{&c.Limits.Topic, 307},
+		{&c.Limits.User, 18},
+		{&c.Limits.List, 25},
+		{&c.Limits.Multiline.Bytes, 4096},
+		{&c.Limits.Multiline.Lines, 100},
+		{&c.Limits.Metadata.Keys, 20},
+		{&c.Limits.Metadata.ValueBytes, 300},
+		{&c.Limits.Metadata.Subs, 50},
+		{&c.SendQ, 512},
+		{&c.AlwaysOn.Replay, 256},
+	}
+	for _, v := range defaults {
+		if *v.limit == 0 {
+			*v.limit = v.value
+		}
+	}
+
+	if c.NickEnforcement.Mode == "" {
+		c.NickEnforcement.Mode = enforceRefuse
+	}
+	if c.NickEnforcement.Grace == 0 {
+		c.NickEnforcement.Grace = time.Second * 30
+	}
+	if c.NickEnforcement.GuestPrefix == "" {
+		c.NickEnforcement.GuestPrefix = "Guest"
+	}
+
+	if c.JoinThrottle.Period == 0 {
+		c.JoinThrottle.Period = time.Second * 10
+	}
+	if c.JoinThrottle.Flood.Period == 0 {
+		c.JoinThrottle.Flood.Period = time.Second * 10
+	}
+	if c.JoinThrottle.Flood.Mode == "" {
+		c.JoinThrottle.Flood.Mode = "i"
+	}
+	if c.JoinThrottle.Flood.Duration == 0 {
+		c.JoinThrottle.Flood.Duration = time.Minute
+	}
+
+	if c.ShutdownGrace == 0 {
+		c.ShutdownGrace = time.Second * 5
+	}
+
+	c.Timeouts.fill(Timeouts{
+		Ping:         time.Minute * 5,
+		Pong:         time.Second * 10,
+		Registration: time.Second * 10,
+	})
+
+	if c.Flood.Burst == 0 {
+		c.Flood.Burst = 20
+	}
+	if c.Flood.Rate == 0 {
+		c.Flood.Rate = 0.5
+	}
+	cost := make(map[string]float64, len(c.Flood.Cost))
+	for k, v := range c.Flood.Cost {
+		cost[strings.ToUpper(k)] = v
+	}
+	c.Flood.Cost = cost
+}
+
+// checkJoinThrottle returns an error if the join throttle settings
+// can't be used
+func (c *Config) checkJoinThrottle() error {
+	j := c.JoinThrottle
+	if j.Joins < 0 || j.Period < 0 {
+		return errors.New("JoinThrottle.Joins and JoinThrottle.Period cannot be negative")
+	}
+	if j.Flood.Joins < 0 || j.Flood.Period < 0 || j.Flood.Duration < 0 {
+		return errors.New("JoinThrottle.Flood.Joins, Period, and Duration cannot be negative")
+	}
+	if j.Flood.Mode != "i" && j.Flood.Mode != "R" {
+		return fmt.Errorf("JoinThrottle.Flood.Mode must be \"i\" or \"R\", not %q", j.Flood.Mode)
+	}
+	return nil
+}
+
+// checkNickEnforcement returns an error if clients would be renamed to
+// guest nicks that are not valid nicks
+func (c *Config) checkNickEnforcement() error {
+	if c.NickEnforcement.Mode != enforceRename {
+		return nil
+	}
+	prefix := c.NickEnforcement.GuestPrefix
+	if !validateNick(prefix) || len(prefix) >= c.Limits.Nick {
+		return fmt.Errorf("NickEnforcement.GuestPrefix %q must be a valid nick shorter than Limits.Nick", prefix)
+	}
+	return nil
+}
+
+// Timeouts control how long the server waits on clients
+type Timeouts struct {
+	// A client that has been silent for this long is sent a PING.
+	// Defaults to 5 minutes.
+	Ping time.Duration `json:"ping"`
+
+	// How long a client has to respond to a PING before it is
+	// disconnected. Defaults to 10 seconds.
+	Pong time.Duration `json:"pong"`
+
+	// How long a client has to complete registration. Defaults to 10
+	// seconds.
+	Registration time.Duration `json:"registration"`
+
+	// If set, registered clients that have not sent any commands other
+	// than PING or PONG for this long are disconnected.
+	Idle time.Duration `json:"idle"`
+	// Operators are (or are not) disconnected for being idle. If unset,
+	// they are.
+	IdleExemptOpers *bool `json:"idleExemptOpers"`
+}
+
+// fill sets any unset timeouts to their value in d
+func (t *Timeouts) fill(d Timeouts) {
+	if t.Ping == 0 {
+		t.Ping = d.Ping
+	}
+	if t.Pong == 0 {
+		t.Pong = d.Pong
+	}
+	if t.Registration == 0 {
+		t.Registration = d.Registration
+	}
+	if t.Idle == 0 {
+		t.Idle = d.Idle
+	}
+	if t.IdleExemptOpers == nil {
+		t.IdleExemptOpers = d.IdleExemptOpers
+	}
+}
+
+// prepareClasses readies each connection class for matching
+func (c *Config) prepareClasses() error {
+	for i := range c.Classes {
+		if err := c.Classes[i].prepare(c); err != nil {
+			return err
+		}
+	}
+
+	c.defaultClass = &Class{Name: "default"}
+	return c.defaultClass.prepare(c)
+}
+
 // NewConfig reads the file at path into a Config.
 func NewConfig(r io.Reader) (*Config, error) {
 	c, err := loadConfig(r)
@@ -106,19 +456,17 @@ func NewConfig(r io.Reader) (*Config, error) {
 			return nil, errors.New("TLS.Port must be defined")
 		}
 
-		if c.TLS.STS.Port != "" {
-			c.TLS.STS.Port = c.TLS.Port[1:]
+		if c.TLS.STS.Port == "" {
+			_, port, err := net.SplitHostPort(c.TLS.Port)
+			if err != nil {
+				return nil, err
+			}
+			c.TLS.STS.Port = port
 		}
 
-		cachedCert, err := tls.LoadX509KeyPair(c.TLS.Pubkey, c.TLS.Privkey)
-		if err != nil {
+		if err := c.prepareTLS(); err != nil {
 			return nil, err
 		}
-
-		c.TLS.Config = &tls.Config{
-			ClientAuth:     tls.RequestClientCert,
-			GetCertificate: getCertificate(&cachedCert, c.TLS.Pubkey, c.TLS.Privkey),
-		}
 	}
 
 	if c.MOTD != "" {
@@ -141,20 +489,3 @@ func WriteConfigToPath(c *Config, path string) error {
 	encoder.SetIndent("", "\t")
 	return encoder.Encode(c)
 }
-
-// when sending certificate to the client, check to see if it is
-// expired and reload it if it is
-func getCertificate(cached *tls.Certificate, pubkey, privkey string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-		cert, _ := x509.ParseCertificate(cached.Certificate[0])
-		if time.Now().After(cert.NotAfter) {
-			c, err := tls.LoadX509KeyPair(pubkey, privkey)
-			if err != nil {
-				return nil, err
-			}
-			cached = &c
-		}
-
-		return cached, nil
-	}
-}
@@ -3,12 +3,15 @@ package server
 import (
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	cap "github.com/mitchr/gossip/capability"
 	"github.com/mitchr/gossip/channel"
@@ -41,6 +44,10 @@ var commands = map[string]executor{
 	"LIST":   LIST,
 	"INVITE": INVITE,
 	"KICK":   KICK,
+	"RENAME": RENAME,
+
+	// metadata
+	"METADATA": METADATA,
 
 	// server queries
 	"MOTD":   MOTD,
@@ -55,9 +62,12 @@ var commands = map[string]executor{
 	"WHOWAS": WHOWAS,
 
 	// communication
-	"PRIVMSG": PRIVMSG,
-	"NOTICE":  NOTICE,
-	"TAGMSG":  TAGMSG,
+	"PRIVMSG":  PRIVMSG,
+	"NOTICE":   NOTICE,
+	"TAGMSG":   TAGMSG,
+	"BATCH":    BATCH,
+	"REDACT":   REDACT,
+	"MARKREAD": MARKREAD,
 
 	// miscellaneous
 	"PING":    PING,
@@ -67,15 +77,21 @@ var commands = map[string]executor{
 
 	"AWAY":     AWAY,
 	"REHASH":   REHASH,
+	"DIE":      DIE,
+	"RESTART":  RESTART,
+	"UPGRADE":  UPGRADE,
 	"USERHOST": USERHOST,
 	"MONITOR":  MONITOR,
+	"SET":      SET,
+	"LOGOUT":   LOGOUT,
 }
 
 func PASS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if c.Is(client.Registered) {
-		return prepMessage(ERR_ALREADYREGISTRED, s.Name, c.Id())
+		return prepMessage(ERR_ALREADYREGISTRED, conf.Name, c.Id())
 	} else if len(m.Params) != 1 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "PASS")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "PASS")
 	}
 
 	c.ServerPassAttempt = []byte(m.Params[0])
@@ -83,13 +99,14 @@ func PASS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 }
 
 func NICK(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_NONICKNAMEGIVEN, s.Name, c.Id())
+		return prepMessage(ERR_NONICKNAMEGIVEN, conf.Name, c.Id())
 	}
 
 	nick := m.Params[0]
-	if !validateNick(nick) {
-		return prepMessage(ERR_ERRONEUSNICKNAME, s.Name, c.Id())
+	if !validateNick(nick) || len(nick) > conf.Limits.Nick {
+		return prepMessage(ERR_ERRONEUSNICKNAME, conf.Name, c.Id())
 	}
 
 	// trying to change nick to what it already is; a no-op
@@ -100,17 +117,24 @@ func NICK(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	changingCase := false
 
 	// if nickname is already in use, send back error
-	if _, ok := s.getClient(nick); ok {
+	if other, ok := s.getClient(nick); ok {
 		// client is changing the case of their nick
 		if strings.ToLower(nick) == strings.ToLower(c.Nick) {
 			changingCase = true
-		} else {
-			return prepMessage(ERR_NICKNAMEINUSE, s.Name, c.Id(), nick)
+		} else if c.Is(client.Registered) || !other.IsAlwaysOn() {
+			return prepMessage(ERR_NICKNAMEINUSE, conf.Name, c.Id(), nick)
 		}
+		// a registering client may be about to attach to the always-on
+		// client that holds this nick; endRegistration decides
 	}
 
 	// nick has been set previously
-	if c.Nick != "" {
+	if c.Is(client.Registered) {
+		owner := s.reservedFor(c, nick)
+		if owner != "" && conf.NickEnforcement.Mode != enforceRename {
+			return prepMessage(ERR_NICKNAMEINUSE, conf.Name, c.Id(), nick)
+		}
+
 		// give back NICK to the caller and notify all the channels this
 		// user is part of that their nick changed
 		c.WriteMessage(msg.New(nil, c.String(), "", "", "NICK", []string{nick}, true))
@@ -128,7 +152,7 @@ func NICK(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		}
 
 		if !changingCase {
-			s.notify(c, prepMessage(RPL_MONOFFLINE, s.Name, "*", c.Id()), cap.None)
+			s.notify(c, prepMessage(RPL_MONOFFLINE, conf.Name, "*", c.Id()), cap.None)
 		}
 
 		// update client map entry
@@ -137,9 +161,14 @@ func NICK(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		s.setClient(c)
 
 		if !changingCase {
-			s.notify(c, prepMessage(RPL_MONONLINE, s.Name, "*", c.Id()), cap.None)
+			s.notify(c, prepMessage(RPL_MONONLINE, conf.Name, "*", c.Id()), cap.None)
 		}
-	} else { // nick is being set for first time
+
+		if owner != "" {
+			return s.enforceNick(c, owner)
+		}
+		s.stopEnforcing(c)
+	} else { // client is still registering
 		c.Nick = nick
 		return s.endRegistration(c)
 	}
@@ -172,10 +201,11 @@ func isDisallowedNickChar(r rune) bool {
 }
 
 func USER(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if c.Is(client.Registered) {
-		return prepMessage(ERR_ALREADYREGISTRED, s.Name, c.Id())
+		return prepMessage(ERR_ALREADYREGISTRED, conf.Name, c.Id())
 	} else if len(m.Params) < 4 || m.Params[3] == "" {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "USER")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "USER")
 	}
 
 	modeBits, err := strconv.Atoi(m.Params[1])
@@ -184,29 +214,30 @@ func USER(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		c.SetMode(client.Mode(modeBits) & (client.Invisible | client.Wallops))
 	}
 
-	c.User = m.Params[0]
+	c.User = truncate(m.Params[0], conf.Limits.User)
 	c.Realname = m.Params[3]
 	return s.endRegistration(c)
 }
 
 func OPER(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 2 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "OPER")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "OPER")
 	}
 
 	name := m.Params[0]
 	pass := m.Params[1]
 
 	// will fail if username doesn't exist or if pass is incorrect
-	if bcrypt.CompareHashAndPassword(s.Ops[name], []byte(pass)) != nil {
-		return prepMessage(ERR_PASSWDMISMATCH, s.Name, c.Id())
+	if bcrypt.CompareHashAndPassword(conf.Ops[name], []byte(pass)) != nil {
+		return prepMessage(ERR_PASSWDMISMATCH, conf.Name, c.Id())
 	}
 
 	c.SetMode(client.Op)
 
 	buff := &msg.Buffer{}
-	buff.AddMsg(prepMessage(RPL_YOUREOPER, s.Name, c.Id()))
-	buff.AddMsg(msg.New(nil, s.Name, "", "", "MODE", []string{c.Nick, "+o"}, false))
+	buff.AddMsg(prepMessage(RPL_YOUREOPER, conf.Name, c.Id()))
+	buff.AddMsg(msg.New(nil, conf.Name, "", "", "MODE", []string{c.Nick, "+o"}, false))
 	return buff
 }
 
@@ -215,6 +246,7 @@ func QUIT(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	if len(m.Params) > 0 {
 		reason = m.Params[0]
 	}
+	s.forgetBatch(c)
 
 	if !c.Is(client.Registered) {
 		s.unknowns.Dec()
@@ -222,8 +254,19 @@ func QUIT(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		return nil
 	}
 
+	// a session leaving does not affect its always-on client
+	if a := c.AttachedTo(); a != nil {
+		s.detachSession(a, c, reason)
+		return nil
+	}
+	if c.IsAlwaysOn() {
+		s.forgetAlwaysOn(c)
+	}
+
 	s.whowasHistory.push(c.Nick, c.User, c.Host, c.Realname)
-	s.notify(c, prepMessage(RPL_MONOFFLINE, s.Name, "*", c.Id()), cap.None)
+	s.joinThrottle.forget(c)
+	s.stopEnforcing(c)
+	s.notify(c, prepMessage(RPL_MONOFFLINE, s.Config().Name, "*", c.Id()), cap.None)
 
 	// send QUIT to all channels that client is connected to, and
 	// remove that client from the channel
@@ -246,6 +289,7 @@ func QUIT(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 }
 
 func (s *Server) endRegistration(c *client.Client) msg.Msg {
+	conf := s.Config()
 	if c.RegSuspended {
 		return nil
 	}
@@ -253,52 +297,87 @@ func (s *Server) endRegistration(c *client.Client) msg.Msg {
 		return nil
 	}
 
-	// client tried to finish registration with the nick of an already registered account
-	if authn := s.userAccountForNickExists(c.Nick); authn != "" && c.SASLMech.Authn() != authn {
-		return prepMessage(ERR_NICKNAMEINUSE, s.Name, c.Id(), c.Nick)
-	}
+	// a client that is attaching to an always-on client takes its nick,
+	// so it does not matter whether its own nick is available
+	if s.alwaysOnClient(c) == nil {
+		// client tried to finish registration with the nick of an already registered account
+		if s.reservedFor(c, c.Nick) != "" && conf.NickEnforcement.Mode != enforceRename {
+			return prepMessage(ERR_NICKNAMEINUSE, conf.Name, c.Id(), c.Nick)
+		}
 
-	// we need this check here for the following situation: 1->NICK n;
-	// 2->NICK n; 1-> USER u s e r; and then 2 tries to send USER, we
-	// should reject 2's registration for having the same nick
-	if _, ok := s.getClient(c.Nick); ok {
-		return prepMessage(ERR_NICKNAMEINUSE, s.Name, c.Id(), c.Nick)
+		// we need this check here for the following situation: 1->NICK n;
+		// 2->NICK n; 1-> USER u s e r; and then 2 tries to send USER, we
+		// should reject 2's registration for having the same nick
+		if _, ok := s.getClient(c.Nick); ok {
+			return prepMessage(ERR_NICKNAMEINUSE, conf.Name, c.Id(), c.Nick)
+		}
 	}
 
 	buff := &msg.Buffer{}
 
-	if s.Password != nil {
-		if bcrypt.CompareHashAndPassword(s.Password, c.ServerPassAttempt) != nil {
-			buff.AddMsg(prepMessage(ERR_PASSWDMISMATCH, s.Name, c.Id()))
+	if conf.Password != nil {
+		if bcrypt.CompareHashAndPassword(conf.Password, c.ServerPassAttempt) != nil {
+			buff.AddMsg(prepMessage(ERR_PASSWDMISMATCH, conf.Name, c.Id()))
 			// write buffer to client first because QUIT will immediate close the underlying conn
 			c.WriteMessage(buff)
-			QUIT(s, c, &msg.Message{Params: []string{"Closing Link: " + s.Name + " (Bad Password)"}})
+			QUIT(s, c, &msg.Message{Params: []string{"Closing Link: " + conf.Name + " (Bad Password)"}})
+			return nil
+		}
+	}
+
+	// "If the client completes registration (with CAP END, NICK, USER and
+	// any other necessary messages) while the SASL authentication is
+	// still in progress, the server SHOULD abort it and send a 906
+	// numeric, then register the client without authentication"
+	if c.PendingSASL != nil {
+		s.abortSASL(c)
+		buff.AddMsg(prepMessage(ERR_SASLABORTED, conf.Name, c.Id()))
+	}
+
+	if c.IsAuthenticated {
+		if err := s.reclassify(c, c.SASLMech.Authn()); err != nil {
+			QUIT(s, c, &msg.Message{Params: []string{err.Error()}})
 			return nil
 		}
 	}
 
+	if s.attachAlwaysOn(c) {
+		return nil
+	}
+
 	c.SetMode(client.Registered)
 	s.setClient(c)
 	s.unknowns.Dec()
 	s.max.KeepMax(uint(s.clientLen()))
 
+	buff.AddMsg(s.welcome(c))
+	if owner := s.reservedFor(c, c.Nick); owner != "" {
+		buff.AddMsg(s.enforceNick(c, owner))
+	}
+
+	// after registration burst, give clients a full token bucket
+	c.FillTokens()
+
+	s.notify(c, prepMessage(RPL_MONONLINE, conf.Name, "*", c), cap.None)
+	return buff
+}
+
+// welcome returns the burst of messages that is sent to a client when
+// it registers
+func (s *Server) welcome(c *client.Client) *msg.Buffer {
+	conf := s.Config()
+	buff := &msg.Buffer{}
+
 	// send RPL_WELCOME and friends in acceptance
-	buff.AddMsg(prepMessage(RPL_WELCOME, s.Name, c.Id(), s.Network, c))
-	buff.AddMsg(prepMessage(RPL_YOURHOST, s.Name, c.Id(), s.Name))
-	buff.AddMsg(prepMessage(RPL_CREATED, s.Name, c.Id(), s.created))
+	buff.AddMsg(prepMessage(RPL_WELCOME, conf.Name, c.Id(), conf.Network, c))
+	buff.AddMsg(prepMessage(RPL_YOURHOST, conf.Name, c.Id(), conf.Name))
+	buff.AddMsg(prepMessage(RPL_CREATED, conf.Name, c.Id(), s.created))
 	// serverName, version, userModes, chanModes
-	buff.AddMsg(prepMessage(RPL_MYINFO, s.Name, c.Id(), s.Name, "0", "ioOrw", "beliIkmstn"))
-	for _, support := range isupportTokens {
-		buff.AddMsg(prepMessage(RPL_ISUPPORT, s.Name, c.Id(), support))
-	}
+	buff.AddMsg(prepMessage(RPL_MYINFO, conf.Name, c.Id(), conf.Name, "0", "ioOrw", "beliIjkmnRst"))
+	buff.AddMsg(s.isupport(c))
 
 	buff.AddMsg(LUSERS(s, c, nil))
 	buff.AddMsg(MOTD(s, c, nil))
-
-	// after registration burst, give clients max grants
-	c.FillGrants()
-
-	s.notify(c, prepMessage(RPL_MONONLINE, s.Name, "*", c), cap.None)
 	return buff
 }
 
@@ -313,14 +392,14 @@ func SETNAME(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	// "If a client sends a SETNAME command without having negotiated the
 	// capability, the server SHOULD handle it silently (with no
 	// response), as historic implementations did."
-	if _, verbose := c.Caps[cap.Setname.Name]; !verbose {
+	if verbose := c.HasCap(cap.Setname.Name); !verbose {
 		return nil
 	}
 
 	chans := s.channelsOf(c)
 	for _, v := range chans {
 		v.ForAllMembersExcept(c, func(m *channel.Member) {
-			if !m.Caps[cap.Setname.Name] {
+			if !m.HasCap(cap.Setname.Name) {
 				return
 			}
 			m.WriteMessage(msg.New(nil, c.String(), "", "", "SETNAME", []string{c.Realname}, true))
@@ -334,8 +413,9 @@ func SETNAME(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 }
 
 func JOIN(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "JOIN")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "JOIN")
 	}
 
 	buff := &msg.Buffer{}
@@ -360,17 +440,35 @@ func JOIN(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	defer s.joinLock.Unlock()
 
 	for i := range chans {
+		if !s.clientCanJoin(c) {
+			s.stdReply(c, FAIL, "JOIN", "TOO_MANY_JOINS", chans[i], "You are joining channels too quickly")
+			return buff
+		}
+
+		// joining a channel that was renamed joins it under its new name
+		if to, ok := s.renamedTo(chans[i]); ok {
+			buff.AddMsg(prepMessage(ERR_LINKCHANNEL, conf.Name, c.Id(), chans[i], to))
+			chans[i] = to
+		}
+
 		if ch, ok := s.getChannel(chans[i]); ok { // channel already exists
+			if !s.channelCanAdmit(ch) {
+				buff.AddMsg(prepMessage(ERR_THROTTLE, conf.Name, c.Id(), ch))
+				return buff
+			}
+
 			err := ch.Admit(c, keys[i])
 			if err != nil {
 				if err == channel.ErrKeyMissing {
-					buff.AddMsg(prepMessage(ERR_BADCHANNELKEY, s.Name, c.Id(), ch))
+					buff.AddMsg(prepMessage(ERR_BADCHANNELKEY, conf.Name, c.Id(), ch))
 				} else if err == channel.ErrLimitReached { // not aceepting new clients
-					buff.AddMsg(prepMessage(ERR_CHANNELISFULL, s.Name, c.Id(), ch))
+					buff.AddMsg(prepMessage(ERR_CHANNELISFULL, conf.Name, c.Id(), ch))
 				} else if err == channel.ErrNotInvited {
-					buff.AddMsg(prepMessage(ERR_INVITEONLYCHAN, s.Name, c.Id(), ch))
+					buff.AddMsg(prepMessage(ERR_INVITEONLYCHAN, conf.Name, c.Id(), ch))
 				} else if err == channel.ErrBanned { // client is banned
-					buff.AddMsg(prepMessage(ERR_BANNEDFROMCHAN, s.Name, c.Id(), ch))
+					buff.AddMsg(prepMessage(ERR_BANNEDFROMCHAN, conf.Name, c.Id(), ch))
+				} else if err == channel.ErrNeedAccount {
+					buff.AddMsg(prepMessage(ERR_NEEDREGGEDNICK, conf.Name, c.Id(), ch))
 				}
 				return buff
 			}
@@ -378,14 +476,16 @@ func JOIN(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 			// send JOIN to all participants of channel
 			joinMsgParams := []string{ch.String(), c.SASLMech.Authn(), c.Realname}
 			ch.ForAllMembersExcept(c, func(m *channel.Member) {
-				if m.Caps[cap.ExtendedJoin.Name] {
+				if m.HasCap(cap.ExtendedJoin.Name) {
 					m.WriteMessage(msg.New(nil, c.Nick, c.User, c.Host, "JOIN", joinMsgParams, false))
 				} else {
 					m.WriteMessage(msg.New(nil, c.Nick, c.User, c.Host, "JOIN", joinMsgParams[:1], false))
 				}
 			})
 
-			if c.Caps[cap.ExtendedJoin.Name] {
+			s.recordJoin(c, ch)
+
+			if c.HasCap(cap.ExtendedJoin.Name) {
 				buff.AddMsg(msg.New(nil, c.Nick, c.User, c.Host, "JOIN", joinMsgParams, false))
 			} else {
 				buff.AddMsg(msg.New(nil, c.Nick, c.User, c.Host, "JOIN", joinMsgParams[:1], false))
@@ -395,23 +495,34 @@ func JOIN(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 				// only send topic if it exists
 				buff.AddMsg(TOPIC(s, c, &msg.Message{Params: []string{ch.String()}}))
 			}
+			buff.AddMsg(s.readMarker(c, ch.String()))
 			buff.AddMsg(NAMES(s, c, &msg.Message{Params: []string{ch.String()}}))
+			buff.AddMsg(s.metadataOnJoin(c, ch))
 			s.awayNotify(c, ch)
 		} else { // create new channel
 			chanChar := channel.ChanType(chans[i][0])
 			chanName := chans[i][1:]
 
-			if !isValidChannelString(string(chanChar) + chanName) {
-				buff.AddMsg(prepMessage(ERR_NOSUCHCHANNEL, s.Name, c.Id(), chans[i]))
+			if !isValidChannelString(string(chanChar)+chanName) || len(chans[i]) > conf.Limits.Channel {
+				buff.AddMsg(prepMessage(ERR_NOSUCHCHANNEL, conf.Name, c.Id(), chans[i]))
 				return buff
 			}
 
 			newChan := channel.New(chanName, chanChar)
+			newChan.MaxList = conf.Limits.List
+			s.restoreChannel(newChan)
 			s.setChannel(newChan)
 			newChan.SetMember(&channel.Member{Client: c, Prefix: channel.Operator})
+			s.recordJoin(c, newChan)
 			buff.AddMsg(msg.New(nil, c.String(), "", "", "JOIN", []string{newChan.String()}, false))
 
+			if newChan.Topic != "" {
+				buff.AddMsg(TOPIC(s, c, &msg.Message{Params: []string{newChan.String()}}))
+			}
+
+			buff.AddMsg(s.readMarker(c, newChan.String()))
 			buff.AddMsg(NAMES(s, c, &msg.Message{Params: []string{newChan.String()}}))
+			buff.AddMsg(s.metadataOnJoin(c, newChan))
 		}
 	}
 	return buff
@@ -466,8 +577,9 @@ func PART(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 }
 
 func TOPIC(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "TOPIC")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "TOPIC")
 	}
 
 	ch, errMsg := s.clientBelongstoChan(c, m.Params[0])
@@ -477,76 +589,78 @@ func TOPIC(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 
 	if len(m.Params) >= 2 { // modify topic
 		if m, _ := ch.GetMember(c.Nick); ch.Protected && !m.Is(channel.Operator) {
-			return prepMessage(ERR_CHANOPRIVSNEEDED, s.Name, c.Id(), ch)
+			return prepMessage(ERR_CHANOPRIVSNEEDED, conf.Name, c.Id(), ch)
 		}
-		ch.Topic = m.Params[1]
+		ch.Topic = truncate(m.Params[1], conf.Limits.Topic)
 		ch.TopicSetBy = c
 		ch.TopicSetAt = time.Now()
-		ch.WriteMessage(msg.New(nil, s.Name, "", "", "TOPIC", []string{ch.String(), ch.Topic}, true))
+		ch.WriteMessage(msg.New(nil, conf.Name, "", "", "TOPIC", []string{ch.String(), ch.Topic}, true))
 		return nil
 	} else {
 		buff := &msg.Buffer{}
 		if ch.Topic == "" {
-			buff.AddMsg(prepMessage(RPL_NOTOPIC, s.Name, c.Id(), ch))
+			buff.AddMsg(prepMessage(RPL_NOTOPIC, conf.Name, c.Id(), ch))
 		} else { // give back existing topic
-			buff.AddMsg(prepMessage(RPL_TOPIC, s.Name, c.Id(), ch, ch.Topic))
-			buff.AddMsg(prepMessage(RPL_TOPICWHOTIME, s.Name, c.Id(), ch, ch.TopicSetBy, ch.TopicSetAt.Unix()))
+			buff.AddMsg(prepMessage(RPL_TOPIC, conf.Name, c.Id(), ch, ch.Topic))
+			buff.AddMsg(prepMessage(RPL_TOPICWHOTIME, conf.Name, c.Id(), ch, ch.TopicSetBy, ch.TopicSetAt.Unix()))
 		}
 		return buff
 	}
 }
 
 func INVITE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 2 {
 		chans := s.getChannelsClientInvitedTo(c)
 		buff := &msg.Buffer{}
 		for _, v := range chans {
-			buff.AddMsg(prepMessage(RPL_INVITELIST, s.Name, c.Id(), v))
+			buff.AddMsg(prepMessage(RPL_INVITELIST, conf.Name, c.Id(), v))
 		}
-		buff.AddMsg(prepMessage(RPL_ENDOFINVITELIST, s.Name, c.Id()))
+		buff.AddMsg(prepMessage(RPL_ENDOFINVITELIST, conf.Name, c.Id()))
 		return buff
 	}
 
 	nick := m.Params[0]
 	ch, ok := s.getChannel(m.Params[1])
 	if !ok { // channel does not exist
-		return prepMessage(ERR_NOSUCHCHANNEL, s.Name, c.Id(), m.Params[1])
+		return prepMessage(ERR_NOSUCHCHANNEL, conf.Name, c.Id(), m.Params[1])
 	}
 
 	sender, _ := ch.GetMember(c.Nick)
 	recipient, _ := s.getClient(nick)
 	if sender == nil { // only members can invite
-		return prepMessage(ERR_NOTONCHANNEL, s.Name, c.Id(), ch)
+		return prepMessage(ERR_NOTONCHANNEL, conf.Name, c.Id(), ch)
 	} else if ch.Invite && !sender.Is(channel.Operator) { // if invite mode set, only ops can send an invite
-		return prepMessage(ERR_CHANOPRIVSNEEDED, s.Name, c.Id(), ch)
+		return prepMessage(ERR_CHANOPRIVSNEEDED, conf.Name, c.Id(), ch)
 	} else if recipient == nil { // nick not on server
-		return prepMessage(ERR_NOSUCHNICK, s.Name, c.Id(), nick)
+		return prepMessage(ERR_NOSUCHNICK, conf.Name, c.Id(), nick)
 	} else if _, ok := ch.GetMember(nick); ok { // can't invite a member who is already on channel
-		return prepMessage(ERR_USERONCHANNEL, s.Name, c.Id(), nick, ch)
+		return prepMessage(ERR_USERONCHANNEL, conf.Name, c.Id(), nick, ch)
 	}
 
 	ch.Invited = append(ch.Invited, nick)
 
 	recipient.WriteMessageFrom(msg.New(nil, sender.Nick, sender.User, sender.Host, "INVITE", []string{nick, ch.String()}, false), c)
 	ch.ForAllMembers(func(m *channel.Member) {
-		if m.Caps[cap.InviteNotify.Name] {
+		if m.HasCap(cap.InviteNotify.Name) {
 			m.WriteMessageFrom(msg.New(nil, sender.Nick, sender.User, sender.Host, "INVITE", []string{nick, ch.String()}, false), c)
 		}
 	})
 
-	return prepMessage(RPL_INVITING, s.Name, c.Id(), nick, ch)
+	return prepMessage(RPL_INVITING, conf.Name, c.Id(), nick, ch)
 }
 
 // if c belongs to the channel associated with chanName, return that
 // channel. If it doesn't, or if the channel doesn't exist, write a
 // numeric reply to the client and return nil.
 func (s *Server) clientBelongstoChan(c *client.Client, chanName string) (*channel.Channel, msg.Msg) {
+	conf := s.Config()
 	ch, ok := s.getChannel(chanName)
 	if !ok { // channel not found
-		return nil, prepMessage(ERR_NOSUCHCHANNEL, s.Name, c.Id(), chanName)
+		return nil, prepMessage(ERR_NOSUCHCHANNEL, conf.Name, c.Id(), chanName)
 	} else {
 		if _, ok := ch.GetMember(c.Nick); !ok { // client does not belong to channel
-			return nil, prepMessage(ERR_NOTONCHANNEL, s.Name, c.Id(), ch)
+			return nil, prepMessage(ERR_NOTONCHANNEL, conf.Name, c.Id(), ch)
 		}
 	}
 	return ch, nil
@@ -554,19 +668,20 @@ func (s *Server) clientBelongstoChan(c *client.Client, chanName string) (*channe
 
 // either one chan with many nicks, or 1 chan per nick
 func KICK(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 2 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "KICK")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "KICK")
 	}
 
 	comment := c.Nick
 	if len(m.Params) == 3 {
-		comment = m.Params[2]
+		comment = truncate(m.Params[2], conf.Limits.Kick)
 	}
 
 	chans := strings.Split(m.Params[0], ",")
 	users := strings.Split(m.Params[1], ",")
 	if !(len(chans) == 1 && len(users) > 0) && !(len(chans) == len(users)) {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "KICK")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "KICK")
 	}
 
 	// fill chans with copies of itself
@@ -583,13 +698,13 @@ func KICK(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	for i := 0; i < len(chans); i++ {
 		ch, _ := s.getChannel(chans[i])
 		if ch == nil {
-			return prepMessage(ERR_NOSUCHCHANNEL, s.Name, c.Id(), chans[i])
+			return prepMessage(ERR_NOSUCHCHANNEL, conf.Name, c.Id(), chans[i])
 		}
 		self, _ := ch.GetMember(c.Nick)
 		if self == nil {
-			return prepMessage(ERR_NOTONCHANNEL, s.Name, c.Id(), ch)
+			return prepMessage(ERR_NOTONCHANNEL, conf.Name, c.Id(), ch)
 		} else if !self.Is(channel.Operator) {
-			return prepMessage(ERR_CHANOPRIVSNEEDED, s.Name, c.Id(), ch)
+			return prepMessage(ERR_CHANOPRIVSNEEDED, conf.Name, c.Id(), ch)
 		}
 
 		if errMsg := s.kickMember(c, ch, users[i], comment); errMsg != nil {
@@ -604,7 +719,7 @@ func KICK(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 func (s *Server) kickMember(c *client.Client, ch *channel.Channel, memberNick string, comment string) msg.Msg {
 	u, _ := ch.GetMember(memberNick)
 	if u == nil {
-		return prepMessage(ERR_USERNOTINCHANNEL, s.Name, c.Id(), memberNick, ch)
+		return prepMessage(ERR_USERNOTINCHANNEL, s.Config().Name, c.Id(), memberNick, ch)
 	}
 
 	// send KICK to all channel members but self
@@ -617,8 +732,9 @@ func (s *Server) kickMember(c *client.Client, ch *channel.Channel, memberNick st
 }
 
 func NAMES(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) == 0 {
-		return prepMessage(RPL_ENDOFNAMES, s.Name, c.Id(), "*")
+		return prepMessage(RPL_ENDOFNAMES, conf.Name, c.Id(), "*")
 	}
 
 	buff := &msg.Buffer{}
@@ -632,18 +748,23 @@ func NAMES(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 			if ch.Secret && !ok { // chan is secret and client does not belong
 				continue
 			} else {
-				sym, members := constructNAMREPLY(ch, ok, c.Caps[cap.MultiPrefix.Name], c.Caps[cap.UserhostInNames.Name])
-				buff.AddMsg(prepMessage(RPL_NAMREPLY, s.Name, c.Id(), sym, ch, members))
+				sym, members := constructNAMREPLY(ch, ok, c.HasCap(cap.MultiPrefix.Name), c.HasCap(cap.UserhostInNames.Name))
+				if len(members) == 0 {
+					continue
+				}
+				buff.AddMsg(msg.SplitList(members, " ", 0, func(list string) *msg.Message {
+					return prepMessage(RPL_NAMREPLY, conf.Name, c.Id(), sym, ch, list)
+				}))
 			}
 		}
 	}
-	buff.AddMsg(prepMessage(RPL_ENDOFNAMES, s.Name, c.Id(), m.Params[0]))
+	buff.AddMsg(prepMessage(RPL_ENDOFNAMES, conf.Name, c.Id(), m.Params[0]))
 	return buff
 }
 
 func LIST(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	buff := &msg.Buffer{}
-	defer buff.AddMsg(prepMessage(RPL_LISTEND, s.Name, c.Id()))
+	defer buff.AddMsg(prepMessage(RPL_LISTEND, s.Config().Name, c.Id()))
 
 	if len(m.Params) == 0 {
 		// reply with all channels that aren't secret
@@ -779,25 +900,27 @@ func (s *Server) sendListReply(ch *channel.Channel, c *client.Client) msg.Msg {
 	if ch.Secret && !ok {
 		return nil
 	}
-	return prepMessage(RPL_LIST, s.Name, c.Id(), ch, ch.Len(), ch.Topic)
+	return prepMessage(RPL_LIST, s.Config().Name, c.Id(), ch, ch.Len(), ch.Topic)
 }
 
 func MOTD(s *Server, c *client.Client, m *msg.Message) msg.Msg {
-	if len(s.motd) == 0 {
-		return prepMessage(ERR_NOMOTD, s.Name, c.Id())
+	conf := s.Config()
+	if len(conf.motd) == 0 {
+		return prepMessage(ERR_NOMOTD, conf.Name, c.Id())
 	}
 
 	buff := &msg.Buffer{}
 
-	buff.AddMsg(prepMessage(RPL_MOTDSTART, s.Name, c.Id(), s.Name))
-	for _, v := range s.motd {
-		buff.AddMsg(prepMessage(RPL_MOTD, s.Name, c.Id(), v))
+	buff.AddMsg(prepMessage(RPL_MOTDSTART, conf.Name, c.Id(), conf.Name))
+	for _, v := range conf.motd {
+		buff.AddMsg(prepMessage(RPL_MOTD, conf.Name, c.Id(), v))
 	}
-	buff.AddMsg(prepMessage(RPL_ENDOFMOTD, s.Name, c.Id()))
+	buff.AddMsg(prepMessage(RPL_ENDOFMOTD, conf.Name, c.Id()))
 	return buff
 }
 
 func LUSERS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	invis := 0
 	ops := 0
 	clientSize := s.clientLen()
@@ -816,34 +939,36 @@ func LUSERS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	s.clientLock.RUnlock()
 
 	buff := &msg.Buffer{}
-	buff.AddMsg(prepMessage(RPL_LUSERCLIENT, s.Name, c.Id(), clientSize, invis, 1))
-	buff.AddMsg(prepMessage(RPL_LUSEROP, s.Name, c.Id(), ops))
-	buff.AddMsg(prepMessage(RPL_LUSERUNKNOWN, s.Name, c.Id(), s.unknowns.Get()))
-	buff.AddMsg(prepMessage(RPL_LUSERCHANNELS, s.Name, c.Id(), s.channelLen()))
-	buff.AddMsg(prepMessage(RPL_LUSERME, s.Name, c.Id(), clientSize, 1))
-	buff.AddMsg(prepMessage(RPL_LOCALUSERS, s.Name, c.Id(), clientSize, max, clientSize, max))
-	buff.AddMsg(prepMessage(RPL_GLOBALUSERS, s.Name, c.Id(), clientSize, max, clientSize, max))
+	buff.AddMsg(prepMessage(RPL_LUSERCLIENT, conf.Name, c.Id(), clientSize, invis, 1))
+	buff.AddMsg(prepMessage(RPL_LUSEROP, conf.Name, c.Id(), ops))
+	buff.AddMsg(prepMessage(RPL_LUSERUNKNOWN, conf.Name, c.Id(), s.unknowns.Get()))
+	buff.AddMsg(prepMessage(RPL_LUSERCHANNELS, conf.Name, c.Id(), s.channelLen()))
+	buff.AddMsg(prepMessage(RPL_LUSERME, conf.Name, c.Id(), clientSize, 1))
+	buff.AddMsg(prepMessage(RPL_LOCALUSERS, conf.Name, c.Id(), clientSize, max, clientSize, max))
+	buff.AddMsg(prepMessage(RPL_GLOBALUSERS, conf.Name, c.Id(), clientSize, max, clientSize, max))
 	return buff
 }
 
 func TIME(s *Server, c *client.Client, m *msg.Message) msg.Msg {
-	return prepMessage(RPL_TIME, s.Name, c.Id(), s.Name, time.Now().Local())
+	conf := s.Config()
+	return prepMessage(RPL_TIME, conf.Name, c.Id(), conf.Name, time.Now().Local())
 }
 
 // TODO: support commands like this that intersperse the modechar and modem.Params MODE &oulu +b *!*@*.edu +e *!*@*.bu.edu
 func MODE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 { // give back own mode
-		return prepMessage(RPL_UMODEIS, s.Name, c.Id(), c.Mode)
+		return prepMessage(RPL_UMODEIS, conf.Name, c.Id(), c.Mode)
 	}
 
 	target := m.Params[0]
 	if !isValidChannelString(target) {
 		client, ok := s.getClient(target)
 		if !ok {
-			return prepMessage(ERR_NOSUCHNICK, s.Name, c.Id(), target)
+			return prepMessage(ERR_NOSUCHNICK, conf.Name, c.Id(), target)
 		}
 		if client.Nick != c.Nick { // can't modify another user
-			return prepMessage(ERR_USERSDONTMATCH, s.Name, c.Id())
+			return prepMessage(ERR_USERSDONTMATCH, conf.Name, c.Id())
 		}
 
 		if len(m.Params) == 2 { // modify own mode
@@ -852,22 +977,22 @@ func MODE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 			for _, v := range mode.Parse([]byte(m.Params[1])) {
 				found := c.ApplyMode(v)
 				if !found {
-					buff.AddMsg(prepMessage(ERR_UMODEUNKNOWNFLAG, s.Name, c.Id()))
+					buff.AddMsg(prepMessage(ERR_UMODEUNKNOWNFLAG, conf.Name, c.Id()))
 				} else {
 					appliedModes = append(appliedModes, v)
 				}
 			}
 
 			modeStr := buildModestr(appliedModes)
-			buff.AddMsg(msg.New(nil, s.Name, "", "", "MODE", []string{c.Nick, modeStr}, false))
+			buff.AddMsg(msg.New(nil, conf.Name, "", "", "MODE", []string{c.Nick, modeStr}, false))
 			return buff
 		} else { // give back own mode
-			return prepMessage(RPL_UMODEIS, s.Name, c.Id(), c.Mode)
+			return prepMessage(RPL_UMODEIS, conf.Name, c.Id(), c.Mode)
 		}
 	} else {
 		ch, ok := s.getChannel(target)
 		if !ok {
-			return prepMessage(ERR_NOSUCHCHANNEL, s.Name, c.Id(), target)
+			return prepMessage(ERR_NOSUCHCHANNEL, conf.Name, c.Id(), target)
 		}
 
 		if len(m.Params) == 1 { // modeStr not given, give back channel modes
@@ -877,15 +1002,18 @@ func MODE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 			}
 
 			buff := &msg.Buffer{}
-			buff.AddMsg(prepMessage(RPL_CHANNELMODEIS, s.Name, c.Id(), ch, modeStr, strings.Join(params, " ")))
-			buff.AddMsg(prepMessage(RPL_CREATIONTIME, s.Name, c.Id(), ch, ch.CreatedAt))
+			buff.AddMsg(prepMessage(RPL_CHANNELMODEIS, conf.Name, c.Id(), ch, modeStr, strings.Join(params, " ")))
+			buff.AddMsg(prepMessage(RPL_CREATIONTIME, conf.Name, c.Id(), ch, ch.CreatedAt))
 			return buff
 		} else { // modeStr given
 			self, belongs := ch.GetMember(c.Id())
 			if !belongs || !self.Is(channel.Operator) {
-				return prepMessage(ERR_CHANOPRIVSNEEDED, s.Name, c.Id(), ch)
+				return prepMessage(ERR_CHANOPRIVSNEEDED, conf.Name, c.Id(), ch)
 			}
 
+			s.joinLock.Lock()
+			defer s.joinLock.Unlock()
+
 			buff := &msg.Buffer{}
 			modes := mode.Parse([]byte(m.Params[1]))
 			channel.PrepareModes(modes, m.Params[2:])
@@ -904,14 +1032,19 @@ func MODE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 				}
 				err := ch.ApplyMode(m)
 				if errors.Is(err, channel.ErrNeedMoreParams) {
-					return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), err)
+					return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), err)
 				} else if errors.Is(err, channel.ErrUnknownMode) {
-					return prepMessage(ERR_UNKNOWNMODE, s.Name, c.Id(), err, ch)
+					return prepMessage(ERR_UNKNOWNMODE, conf.Name, c.Id(), err, ch)
 				} else if errors.Is(err, channel.ErrNotInChan) {
-					return prepMessage(ERR_USERNOTINCHANNEL, s.Name, c.Id(), err, ch)
+					return prepMessage(ERR_USERNOTINCHANNEL, conf.Name, c.Id(), err, ch)
 				} else if errors.Is(err, channel.ErrInvalidKey) {
-					return prepMessage(ERR_INVALIDKEY, s.Name, c.Id(), ch)
+					return prepMessage(ERR_INVALIDKEY, conf.Name, c.Id(), ch)
+				} else if errors.Is(err, channel.ErrListFull) {
+					buff.AddMsg(prepMessage(ERR_BANLISTFULL, conf.Name, c.Id(), ch, m.ModeChar))
+				} else if errors.Is(err, channel.ErrInvalidParam) {
+					return prepMessage(ERR_INVALIDMODEPARAM, conf.Name, c.Id(), ch, m.ModeChar, m.Param)
 				} else {
+					s.modeChanged(ch, m)
 					appliedModes = append(appliedModes, m)
 				}
 			}
@@ -920,7 +1053,7 @@ func MODE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 
 			// only write final MODE to channel if any mode was actually altered
 			if modeStr != "" {
-				ch.WriteMessageFrom(msg.New(nil, s.Name, "", "", "MODE", []string{ch.String(), modeStr}, false), c)
+				ch.WriteMessageFrom(msg.New(nil, conf.Name, "", "", "MODE", []string{ch.String(), modeStr}, false), c)
 			}
 			return buff
 		}
@@ -956,22 +1089,25 @@ func buildModestr(modes []mode.Mode) string {
 
 // used for responding to requests to list the various channel mode lists
 func (s *Server) sendChannelModeList(c *client.Client, ch *channel.Channel, list []string, dataResponse *msg.Message, endResponse *msg.Message) msg.Msg {
+	conf := s.Config()
 	buff := &msg.Buffer{}
 	for _, v := range list {
-		buff.AddMsg(prepMessage(dataResponse, s.Name, c.Id(), ch, v))
+		buff.AddMsg(prepMessage(dataResponse, conf.Name, c.Id(), ch, v))
 	}
-	buff.AddMsg(prepMessage(endResponse, s.Name, c.Id(), ch))
+	buff.AddMsg(prepMessage(endResponse, conf.Name, c.Id(), ch))
 	return buff
 }
 
 func INFO(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	buff := &msg.Buffer{}
-	buff.AddMsg(prepMessage(RPL_INFO, s.Name, c.Id(), "gossip is licensed under GPLv3"))
-	buff.AddMsg(prepMessage(RPL_ENDOFINFO, s.Name, c.Id()))
+	buff.AddMsg(prepMessage(RPL_INFO, conf.Name, c.Id(), "gossip is licensed under GPLv3"))
+	buff.AddMsg(prepMessage(RPL_ENDOFINFO, conf.Name, c.Id()))
 	return buff
 }
 
 func WHO(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	mask := "*"
 	if len(m.Params) > 0 {
 		if mask == "0" {
@@ -996,13 +1132,13 @@ func WHO(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		ch.ForAllMembers(func(m *channel.Member) {
 			if whox {
 				resp := constructSpcrplResponse(fields, m.Client, s)
-				buff.AddMsg(prepMessage(RPL_WHOSPCRPL, s.Name, c.Id(), resp))
+				buff.AddMsg(prepMessage(RPL_WHOSPCRPL, conf.Name, c.Id(), resp))
 			} else {
-				flags := whoreplyFlagsForMember(m, c.Caps[cap.MultiPrefix.Name])
-				buff.AddMsg(prepMessage(RPL_WHOREPLY, s.Name, c.Id(), ch, m.User, m.Host, s.Name, m.Nick, flags, m.Realname))
+				flags := whoreplyFlagsForMember(m, c.HasCap(cap.MultiPrefix.Name))
+				buff.AddMsg(prepMessage(RPL_WHOREPLY, conf.Name, c.Id(), ch, m.User, m.Host, conf.Name, m.Nick, flags, m.Realname))
 			}
 		})
-		buff.AddMsg(prepMessage(RPL_ENDOFWHO, s.Name, c.Id(), mask))
+		buff.AddMsg(prepMessage(RPL_ENDOFWHO, conf.Name, c.Id(), mask))
 		return buff
 	}
 
@@ -1011,12 +1147,12 @@ func WHO(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	if ok {
 		if whox {
 			resp := constructSpcrplResponse(fields, whoClient, s)
-			buff.AddMsg(prepMessage(RPL_WHOSPCRPL, s.Name, c.Id(), resp))
+			buff.AddMsg(prepMessage(RPL_WHOSPCRPL, conf.Name, c.Id(), resp))
 		} else {
 			flags := whoreplyFlagsForClient(whoClient)
-			buff.AddMsg(prepMessage(RPL_WHOREPLY, s.Name, c.Id(), "*", whoClient.User, whoClient.Host, s.Name, whoClient.Nick, flags, whoClient.Realname))
+			buff.AddMsg(prepMessage(RPL_WHOREPLY, conf.Name, c.Id(), "*", whoClient.User, whoClient.Host, conf.Name, whoClient.Nick, flags, whoClient.Realname))
 		}
-		buff.AddMsg(prepMessage(RPL_ENDOFWHO, s.Name, c.Id(), mask))
+		buff.AddMsg(prepMessage(RPL_ENDOFWHO, conf.Name, c.Id(), mask))
 		return buff
 	}
 
@@ -1038,15 +1174,15 @@ func WHO(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		if wild.Match(mask, strings.ToLower(v.Nick)) {
 			if whox {
 				resp := constructSpcrplResponse(fields, v, s)
-				buff.AddMsg(prepMessage(RPL_WHOSPCRPL, s.Name, c.Id(), resp))
+				buff.AddMsg(prepMessage(RPL_WHOSPCRPL, conf.Name, c.Id(), resp))
 			} else {
 				flags := whoreplyFlagsForClient(v)
-				buff.AddMsg(prepMessage(RPL_WHOREPLY, s.Name, c.Id(), "*", v.User, v.Host, s.Name, v.Nick, flags, v.Realname))
+				buff.AddMsg(prepMessage(RPL_WHOREPLY, conf.Name, c.Id(), "*", v.User, v.Host, conf.Name, v.Nick, flags, v.Realname))
 			}
 		}
 	}
 	s.clientLock.RUnlock()
-	buff.AddMsg(prepMessage(RPL_ENDOFWHO, s.Name, c.Id(), mask))
+	buff.AddMsg(prepMessage(RPL_ENDOFWHO, conf.Name, c.Id(), mask))
 	return buff
 }
 
@@ -1101,7 +1237,7 @@ func constructSpcrplResponse(params string, c *client.Client, s *Server) string
 		case 'h':
 			resp[i] = c.Host
 		case 's':
-			resp[i] = s.Name
+			resp[i] = s.Config().Name
 		case 'n':
 			resp[i] = c.Nick
 		case 'f':
@@ -1170,34 +1306,35 @@ func WHOIS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		s.clientLock.RUnlock()
 	}
 
-	buff.AddMsg(prepMessage(RPL_ENDOFWHOIS, s.Name, c.Id(), m.Params[0]))
+	buff.AddMsg(prepMessage(RPL_ENDOFWHOIS, s.Config().Name, c.Id(), m.Params[0]))
 	return buff
 }
 
 func (s *Server) sendWHOIS(c *client.Client, v *client.Client) *msg.Buffer {
+	conf := s.Config()
 	buff := &msg.Buffer{}
 
 	if v.Is(client.Away) {
-		buff.AddMsg(prepMessage(RPL_AWAY, s.Name, c.Id(), v.Nick, v.AwayMsg))
+		buff.AddMsg(prepMessage(RPL_AWAY, conf.Name, c.Id(), v.Nick, v.AwayMsg))
 	}
 
-	buff.AddMsg(prepMessage(RPL_WHOISUSER, s.Name, c.Id(), v.Nick, v.User, v.Host, v.Realname))
-	buff.AddMsg(prepMessage(RPL_WHOISSERVER, s.Name, c.Id(), v.Nick, s.Name, "wip irc server"))
+	buff.AddMsg(prepMessage(RPL_WHOISUSER, conf.Name, c.Id(), v.Nick, v.User, v.Host, v.Realname))
+	buff.AddMsg(prepMessage(RPL_WHOISSERVER, conf.Name, c.Id(), v.Nick, conf.Name, "wip irc server"))
 	if v.Is(client.Bot) {
-		buff.AddMsg(prepMessage(RPL_WHOISBOT, s.Name, c.Id(), v.Nick))
+		buff.AddMsg(prepMessage(RPL_WHOISBOT, conf.Name, c.Id(), v.Nick))
 	}
 	if v.Is(client.Op) {
-		buff.AddMsg(prepMessage(RPL_WHOISOPERATOR, s.Name, c.Id(), v.Nick))
+		buff.AddMsg(prepMessage(RPL_WHOISOPERATOR, conf.Name, c.Id(), v.Nick))
 	}
 	if v == c || c.Is(client.Op) { // querying whois on self or self is an op
 		if v.IsSecure() {
 			certPrint, err := v.CertificateFingerprint()
 			if err == nil {
-				buff.AddMsg(prepMessage(RPL_WHOISCERTFP, s.Name, c.Id(), v.Nick, certPrint))
+				buff.AddMsg(prepMessage(RPL_WHOISCERTFP, conf.Name, c.Id(), v.Nick, certPrint))
 			}
 		}
 	}
-	buff.AddMsg(prepMessage(RPL_WHOISIDLE, s.Name, c.Id(), v.Nick, time.Since(v.Idle).Round(time.Second).Seconds(), v.JoinTime))
+	buff.AddMsg(prepMessage(RPL_WHOISIDLE, conf.Name, c.Id(), v.Nick, time.Since(v.Idle).Round(time.Second).Seconds(), v.JoinTime))
 
 	chans := []string{}
 	s.chanLock.RLock()
@@ -1210,26 +1347,29 @@ func (s *Server) sendWHOIS(c *client.Client, v *client.Client) *msg.Buffer {
 		if (k.Secret || v.Is(client.Invisible)) && !(senderBelongs && clientBelongs) {
 			continue
 		}
-		hasMultiPrefix := c.Caps[cap.MultiPrefix.Name]
+		hasMultiPrefix := c.HasCap(cap.MultiPrefix.Name)
 		chans = append(chans, string(member.HighestPrefix(hasMultiPrefix))+k.String())
 	}
 	s.chanLock.RUnlock()
 
-	chanParam := ""
 	if len(chans) > 0 {
-		chanParam = " :" + strings.Join(chans, " ")
+		buff.AddMsg(msg.SplitList(chans, " ", 0, func(list string) *msg.Message {
+			return prepMessage(RPL_WHOISCHANNELS, conf.Name, c.Id(), v.Nick, " :"+list)
+		}))
+	} else {
+		buff.AddMsg(prepMessage(RPL_WHOISCHANNELS, conf.Name, c.Id(), v.Nick, ""))
 	}
-	buff.AddMsg(prepMessage(RPL_WHOISCHANNELS, s.Name, c.Id(), v.Nick, chanParam))
 
 	if v.IsAuthenticated {
-		buff.AddMsg(prepMessage(RPL_WHOISACCOUNT, s.Name, c.Id(), v.Nick, v.SASLMech.Authn()))
+		buff.AddMsg(prepMessage(RPL_WHOISACCOUNT, conf.Name, c.Id(), v.Nick, v.SASLMech.Authn()))
 	}
 	return buff
 }
 
 func WHOWAS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_NONICKNAMEGIVEN, s.Name, c.Id())
+		return prepMessage(ERR_NONICKNAMEGIVEN, conf.Name, c.Id())
 	}
 
 	count := s.whowasHistory.len()
@@ -1246,15 +1386,15 @@ func WHOWAS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	nicks := strings.Split(m.Params[0], ",")
 	info := s.whowasHistory.search(nicks, count)
 	if len(info) == 0 {
-		buff.AddMsg(prepMessage(ERR_WASNOSUCHNICK, s.Name, c.Id(), m.Params[0]))
-		buff.AddMsg(prepMessage(RPL_ENDOFWHOWAS, s.Name, c.Id(), m.Params[0]))
+		buff.AddMsg(prepMessage(ERR_WASNOSUCHNICK, conf.Name, c.Id(), m.Params[0]))
+		buff.AddMsg(prepMessage(RPL_ENDOFWHOWAS, conf.Name, c.Id(), m.Params[0]))
 		return buff
 	}
 
 	for _, v := range info {
-		buff.AddMsg(prepMessage(RPL_WHOWASUSER, s.Name, c.Id(), v.nick, v.user, v.host, v.realname))
+		buff.AddMsg(prepMessage(RPL_WHOWASUSER, conf.Name, c.Id(), v.nick, v.user, v.host, v.realname))
 	}
-	buff.AddMsg(prepMessage(RPL_ENDOFWHOWAS, s.Name, c.Id(), m.Params[0]))
+	buff.AddMsg(prepMessage(RPL_ENDOFWHOWAS, conf.Name, c.Id(), m.Params[0]))
 	return buff
 }
 
@@ -1263,7 +1403,7 @@ func NOTICE(s *Server, c *client.Client, m *msg.Message) msg.Msg  { return s.com
 
 // communicate is used for PRIVMSG/NOTICE
 func (s *Server) communicate(m *msg.Message, c *client.Client) msg.Msg {
-	msgCopy := *m
+	msgCopy := m.Copy()
 	// "Tags without the client-only prefix MUST be removed by the
 	// server before being relayed with any message to another client."
 	msgCopy.TrimNonClientTags()
@@ -1275,97 +1415,153 @@ func (s *Server) communicate(m *msg.Message, c *client.Client) msg.Msg {
 
 	if len(m.Params) < 2 && m.Command != "TAGMSG" {
 		if !skipReplies {
-			return prepMessage(ERR_NOTEXTTOSEND, s.Name, c.Id())
+			return prepMessage(ERR_NOTEXTTOSEND, s.Config().Name, c.Id())
 		}
 		return nil
 	}
 
+	// a message tagged with the msgid of an earlier one replaces it
+	editing, original := msgCopy.HasTag("draft/edit")
+
 	buff := &msg.Buffer{}
+	truncated := false
 	recipients := strings.Split(m.Params[0], ",")
 	for _, v := range recipients {
 		msgCopy.Params[0] = v
+		if editing && !s.mayChange(c, m.Command, v, original, true) {
+			continue
+		}
 
-		// TODO: support sending to only a specific user mode in channel (i.e., PRIVMSG %#buffy)
-		//			 when implemented, re-enable STATUSMSG ISUPPORT
-		if isValidChannelString(v) {
-			ch, _ := s.getChannel(v)
-			if ch == nil { // channel doesn't exist
-				if !skipReplies {
-					buff.AddMsg(prepMessage(ERR_NOSUCHCHANNEL, s.Name, c.Id(), v))
-				}
-				continue
-			}
+		// each target is sent its own message
+		msgCopy.RemoveTag("msgid")
+		msgCopy.SetMsgid()
+		_, msgid := msgCopy.HasTag("msgid")
 
-			self, _ := ch.GetMember(c.Nick)
-			if self == nil {
-				if ch.NoExternal {
-					// chan does not allow external messages; client needs to join
-					if !skipReplies {
-						buff.AddMsg(prepMessage(ERR_CANNOTSENDTOCHAN, s.Name, c.Id(), ch))
-					}
-					continue
-				}
-			} else if ch.Moderated && self.Prefix == 0 {
-				// member has no mode, so they cannot speak in a moderated chan
-				if !skipReplies {
-					buff.AddMsg(prepMessage(ERR_CANNOTSENDTOCHAN, s.Name, c.Id(), ch))
-				}
-				continue
+		reply, delivered := s.sendTo(c, v, skipReplies, func(to *client.Client) {
+			if editing {
+				to.ForgetMissed(original)
 			}
-
-			// write to everybody else in the chan besides self
-			ch.ForAllMembersExcept(c, func(m *channel.Member) {
-				if msgCopy.Command == "TAGMSG" && !m.Caps[cap.MessageTags.Name] {
-					return
-				}
-				if m.Caps[cap.MessageTags.Name] {
-					msgCopy.SetMsgid()
-				}
-				m.WriteMessageFrom(&msgCopy, c)
-			})
-		} else { // client->client
-			target, ok := s.getClient(v)
-			if !ok {
-				if !skipReplies {
-					buff.AddMsg(prepMessage(ERR_NOSUCHNICK, s.Name, c.Id(), v))
-				}
-				continue
+			if msgCopy.Command == "TAGMSG" && !to.HasCap(cap.MessageTags.Name) {
+				return
 			}
+			to.WriteMessageFrom(msgCopy.Copy(), c)
+		})
+		buff.AddMsg(reply)
+		if !delivered {
+			continue
+		}
+		chanName, _ := s.stripStatus(v)
+		s.sent.add(msgid, c, chanName)
 
-			if target.Is(client.Away) {
-				buff.AddMsg(prepMessage(RPL_AWAY, s.Name, c.Id(), target.Nick, target.AwayMsg))
-				continue
-			}
-			if msgCopy.Command == "TAGMSG" && !target.Caps[cap.MessageTags.Name] {
-				continue
-			}
-			if target.Caps[cap.MessageTags.Name] {
-				msgCopy.SetMsgid()
-			}
-			target.WriteMessageFrom(&msgCopy, c)
+		// the sender's prefix can push a message that they were allowed to
+		// send over the limit
+		if msgCopy.Copy().Truncate() {
+			truncated = true
 		}
 
-		if c.Caps[cap.EchoMessage.Name] {
+		if c.HasCap(cap.EchoMessage.Name) {
 			if !c.HasMessageTags() {
 				buff.AddMsg(msgCopy.RemoveAllTags())
 			} else {
-				buff.AddMsg(&msgCopy)
+				buff.AddMsg(msgCopy.Copy())
 			}
 		}
 	}
 
+	if truncated && !skipReplies {
+		s.stdReply(c, WARN, m.Command, "MESSAGE_TRUNCATED", "", "Your message was too long, so it was truncated")
+	}
 	return buff
 }
 
+// stripStatus returns target without its STATUSMSG prefix, and whether
+// it had one. Since '&' is both a prefix and the local channel type, a
+// target that names an existing channel as a whole, like '&chan', is
+// left alone.
+func (s *Server) stripStatus(target string) (string, bool) {
+	if _, ok := channel.StatusPrefix(target); !ok {
+		return target, false
+	}
+	if _, ok := s.getChannel(target); ok {
+		return target, false
+	}
+	return target[1:], true
+}
+
+// sendTo calls deliver for each client that a message from c to target
+// should reach. If the message can't be sent, delivered is false and
+// reply explains why; errors are left out if skipReplies is set.
+func (s *Server) sendTo(c *client.Client, target string, skipReplies bool, deliver func(*client.Client)) (reply msg.Msg, delivered bool) {
+	conf := s.Config()
+
+	// a STATUSMSG target like '@#chan' should only be delivered to
+	// members with that prefix or higher
+	chanName, isStatusMsg := s.stripStatus(target)
+	status, _ := channel.StatusPrefix(target)
+
+	if isValidChannelString(chanName) {
+		ch, _ := s.getChannel(chanName)
+		if ch == nil { // channel doesn't exist
+			if !skipReplies {
+				reply = prepMessage(ERR_NOSUCHCHANNEL, conf.Name, c.Id(), target)
+			}
+			return reply, false
+		}
+
+		self, _ := ch.GetMember(c.Nick)
+		if self == nil {
+			if ch.NoExternal {
+				// chan does not allow external messages; client needs to join
+				if !skipReplies {
+					reply = prepMessage(ERR_CANNOTSENDTOCHAN, conf.Name, c.Id(), ch)
+				}
+				return reply, false
+			}
+		} else if ch.Moderated && self.Prefix == 0 {
+			// member has no mode, so they cannot speak in a moderated chan
+			if !skipReplies {
+				reply = prepMessage(ERR_CANNOTSENDTOCHAN, conf.Name, c.Id(), ch)
+			}
+			return reply, false
+		}
+
+		// write to everybody else in the chan besides self
+		ch.ForAllMembersExcept(c, func(m *channel.Member) {
+			if isStatusMsg && !m.HasRank(status) {
+				return
+			}
+			deliver(m.Client)
+		})
+		return nil, true
+	}
+
+	// client->client
+	to, ok := s.getClient(target)
+	if !ok {
+		if !skipReplies {
+			reply = prepMessage(ERR_NOSUCHNICK, conf.Name, c.Id(), target)
+		}
+		return reply, false
+	}
+
+	if to.Is(client.Away) {
+		return prepMessage(RPL_AWAY, conf.Name, c.Id(), to.Nick, to.AwayMsg), false
+	}
+	deliver(to)
+	return nil, true
+}
+
 func PING(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "PING")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "PING")
 	}
-	return msg.New(nil, s.Name, "", "", "PONG", []string{s.Name, m.Params[0]}, m.Params[0] == "")
+	return msg.New(nil, conf.Name, "", "", "PONG", []string{conf.Name, m.Params[0]}, m.Params[0] == "")
 }
 
+// PONG does nothing; receiving any message from a client is enough to
+// know that it is still alive
 func PONG(s *Server, c *client.Client, m *msg.Message) msg.Msg {
-	c.PONG <- struct{}{}
 	return nil
 }
 
@@ -1374,24 +1570,25 @@ func PONG(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 func ERROR(s *Server, c *client.Client, m *msg.Message) msg.Msg { return nil }
 
 func AWAY(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	defer s.awayNotify(c, s.channelsOf(c)...)
 
 	// remove away
 	if len(m.Params) == 0 || m.Params[0] == "" {
 		c.AwayMsg = ""
 		c.UnsetMode(client.Away)
-		return prepMessage(RPL_UNAWAY, s.Name, c.Id())
+		return prepMessage(RPL_UNAWAY, conf.Name, c.Id())
 	}
 
-	c.AwayMsg = m.Params[0]
+	c.AwayMsg = truncate(m.Params[0], conf.Limits.Away)
 	c.SetMode(client.Away)
-	return prepMessage(RPL_NOWAWAY, s.Name, c.Id())
+	return prepMessage(RPL_NOWAWAY, conf.Name, c.Id())
 }
 
 func (s *Server) awayNotify(c *client.Client, chans ...*channel.Channel) {
 	for _, v := range chans {
 		v.ForAllMembersExcept(c, func(m *channel.Member) {
-			if m.Caps[cap.AwayNotify.Name] {
+			if m.HasCap(cap.AwayNotify.Name) {
 				m.WriteMessage(msg.New(nil, c.String(), "", "", "AWAY", []string{c.AwayMsg}, true))
 			}
 		})
@@ -1401,19 +1598,104 @@ func (s *Server) awayNotify(c *client.Client, chans ...*channel.Channel) {
 
 func REHASH(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	if !c.Is(client.Op) {
-		return prepMessage(ERR_NOPRIVILEGES, s.Name, c.Id())
+		return prepMessage(ERR_NOPRIVILEGES, s.Config().Name, c.Id())
+	}
+
+	// the config file is read from the start each time, so only one
+	// REHASH can read it at once. Another REHASH is turned away rather
+	// than waited on, since this one waits on every client while it
+	// tells them about new caps.
+	if !s.rehashLock.TryLock() {
+		return s.NOTICE(c, "Could not rehash: the config is already being reloaded")
+	}
+	defer s.rehashLock.Unlock()
+
+	// the config file has already been read to the end once
+	old := s.Config()
+	if seeker, ok := old.configSource.(io.Seeker); ok {
+		seeker.Seek(0, io.SeekStart)
+	}
+	conf, err := NewConfig(old.configSource)
+	if err != nil {
+		return s.NOTICE(c, "Could not rehash: "+err.Error())
 	}
 
-	conf, _ := NewConfig(s.configSource)
-	s.Config = conf
+	// clients that support cap-notify are told about the caps that the
+	// new config adds or takes away
+	s.config.Store(conf)
+	s.capsChanged(old, c)
+	s.reloadClasses()
 
-	fileName := s.configSource.(*os.File).Name()
-	return prepMessage(RPL_REHASHING, s.Name, c.Id(), fileName)
+	s.chanLock.RLock()
+	for _, v := range s.channels {
+		v.MaxList = conf.Limits.List
+	}
+	s.chanLock.RUnlock()
+
+	fileName := "config"
+	if f, ok := conf.configSource.(*os.File); ok {
+		fileName = f.Name()
+	}
+	return prepMessage(RPL_REHASHING, conf.Name, c.Id(), fileName)
+}
+
+func DIE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	if !c.Is(client.Op) {
+		return prepMessage(ERR_NOPRIVILEGES, s.Config().Name, c.Id())
+	}
+
+	go s.Shutdown(shutdownReason(c, m, "DIE"))
+	return nil
+}
+
+func RESTART(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	if !c.Is(client.Op) {
+		return prepMessage(ERR_NOPRIVILEGES, s.Config().Name, c.Id())
+	}
+
+	s.restart.Store(true)
+	go s.Shutdown(shutdownReason(c, m, "RESTART"))
+	return nil
+}
+
+// UPGRADE restarts the server without disconnecting plaintext clients.
+// TLS clients have to reconnect.
+func UPGRADE(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	if !c.Is(client.Op) {
+		return prepMessage(ERR_NOPRIVILEGES, s.Config().Name, c.Id())
+	}
+
+	secure := 0
+	for _, v := range s.conns.all() {
+		if v.Is(client.Registered) && v.IsSecure() {
+			secure++
+		}
+	}
+
+	// let the operator know what's happening before their connection is
+	// handed off
+	c.WriteMessage(s.NOTICE(c, fmt.Sprintf("Upgrading server; %d TLS connections will have to reconnect", secure)))
+	go func() {
+		if err := s.Upgrade(); err != nil {
+			log.Println("upgrade failed:", err)
+		}
+	}()
+	return nil
+}
+
+// shutdownReason uses the reason given to DIE or RESTART, or makes one
+// up if the operator didn't give one
+func shutdownReason(c *client.Client, m *msg.Message, cmd string) string {
+	if len(m.Params) > 0 && m.Params[0] != "" {
+		return m.Params[0]
+	}
+	return cmd + " by " + c.Nick
 }
 
 func USERHOST(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "USERHOST")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "USERHOST")
 	}
 
 	replies := make([]string, 0, len(m.Params))
@@ -1423,7 +1705,9 @@ func USERHOST(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 			replies = append(replies, constructUserhostReply(client))
 		}
 	}
-	return prepMessage(RPL_USERHOST, s.Name, c.Id(), strings.Join(replies, " "))
+	return msg.SplitList(replies, " ", 0, func(list string) *msg.Message {
+		return prepMessage(RPL_USERHOST, conf.Name, c.Id(), list)
+	})
 }
 
 func constructUserhostReply(c *client.Client) string {
@@ -1442,12 +1726,13 @@ func constructUserhostReply(c *client.Client) string {
 }
 
 func WALLOPS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "WALLOPS")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "WALLOPS")
 	}
 
 	if !c.Is(client.Op) {
-		return prepMessage(ERR_NOPRIVILEGES, s.Name, c.Id())
+		return prepMessage(ERR_NOPRIVILEGES, conf.Name, c.Id())
 	}
 
 	m.Nick = c.Nick
@@ -1464,7 +1749,23 @@ func WALLOPS(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	return nil
 }
 
+// commands that a session of an always-on client handles by itself
+var sessionCommands = map[string]bool{
+	"CAP":          true,
+	"PING":         true,
+	"PONG":         true,
+	"QUIT":         true,
+	"AUTHENTICATE": true,
+	// multiline batches are collected per connection
+	"BATCH": true,
+}
+
 func (s *Server) executeMessage(m *msg.Message, c *client.Client) {
+	s.runSession(c, func() { s.execute(m, c) })
+}
+
+func (s *Server) execute(m *msg.Message, c *client.Client) {
+	conf := s.Config()
 	upper := strings.ToUpper(m.Command)
 	// ignore unregistered user commands until registration completes
 	if !c.Is(client.Registered) && (upper != "CAP" && upper != "NICK" && upper != "USER" && upper != "PASS" && upper != "AUTHENTICATE" && upper != "QUIT" && upper != "PING") {
@@ -1472,17 +1773,52 @@ func (s *Server) executeMessage(m *msg.Message, c *client.Client) {
 		return
 	}
 
+	// lines of an open multiline batch are held until it closes
+	if s.addToBatch(c, m) {
+		return
+	}
+
 	hasLabel, label := m.HasTag("label")
 
+	// sessions act on behalf of their always-on client, except for
+	// commands that only concern the connection itself
+	actor := c
+	attached := c.AttachedTo()
+	if attached != nil && !sessionCommands[upper] {
+		actor = attached
+	}
+
 	if e, ok := commands[upper]; ok {
-		c.Idle = time.Now()
-		resp := e(s, c, m)
+		// keepalives do not count as activity
+		if upper != "PING" && upper != "PONG" {
+			c.Idle = time.Now()
+			actor.Idle = c.Idle
+		}
+
+		// the session's own copy of the message is replied to as usual, and
+		// the other sessions are shown what was sent
+		var echo *msg.Message
+		if actor != c && (upper == "PRIVMSG" || upper == "NOTICE" || upper == "TAGMSG" || upper == "REDACT") {
+			echo = m.Copy()
+			echo.TrimNonClientTags()
+			echo.Nick, echo.User, echo.Host = actor.Nick, actor.User, actor.Host
+		}
+
+		resp := e(s, actor, m)
+		if echo != nil {
+			s.echoToSessions(actor, c, echo)
+		}
+		// a session that this command attached has already shared its caps
+		// with its always-on client
+		if upper == "CAP" && attached != nil {
+			attached.SyncCaps()
+		}
 
 		// check if we need to batch these messages
-		if c.Caps[cap.LabeledResponses.Name] {
+		if c.HasCap(cap.LabeledResponses.Name) {
 			// send ACK
 			if hasLabel && resp == nil {
-				c.WriteMessage(msg.New([]msg.Tag{{Key: "label", Value: label}}, s.Name, "", "", "ACK", nil, false))
+				c.WriteMessage(msg.New([]msg.Tag{{Key: "label", Value: label}}, conf.Name, "", "", "ACK", nil, false))
 				return
 			}
 
@@ -1498,10 +1834,22 @@ func (s *Server) executeMessage(m *msg.Message, c *client.Client) {
 			c.WriteMessage(resp)
 		}
 	} else {
-		errMsg := prepMessage(ERR_UNKNOWNCOMMAND, s.Name, c.Id(), m.Command)
-		if c.Caps[cap.LabeledResponses.Name] && hasLabel {
+		errMsg := prepMessage(ERR_UNKNOWNCOMMAND, conf.Name, c.Id(), m.Command)
+		if c.HasCap(cap.LabeledResponses.Name) && hasLabel {
 			errMsg.AddTag("label", label)
 		}
 		c.WriteMessage(errMsg)
 	}
 }
+
+// truncate shortens str to at most n bytes without splitting a
+// multibyte character
+func truncate(str string, n int) string {
+	if len(str) <= n {
+		return str
+	}
+	for n > 0 && !utf8.RuneStart(str[n]) {
+		n--
+	}
+	return str[:n]
+}
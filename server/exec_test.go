@@ -8,6 +8,7 @@ import (
 
 	"github.com/mitchr/gossip/channel"
 	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -115,7 +116,7 @@ func TestRegistration(t *testing.T) {
 		resp, _ := r.ReadBytes('\n')
 
 		foo, _ := s.getClient("foo")
-		assertResponse(resp, prepMessage(RPL_WELCOME, s.Name, foo.Nick, s.Network, foo).String(), t)
+		assertResponse(resp, prepMessage(RPL_WELCOME, s.Config().Name, foo.Nick, s.Config().Network, foo).String(), t)
 	})
 
 	t.Run("TestNickCaseChange", func(t *testing.T) {
@@ -149,19 +150,19 @@ func TestOPER(t *testing.T) {
 	t.Run("TestMissingParams", func(t *testing.T) {
 		c.Write([]byte("OPER\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 461 a OPER :Not enough parameters\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 461 a OPER :Not enough parameters\r\n", s.Config().Name), t)
 	})
 	t.Run("TestIncorrectpassword", func(t *testing.T) {
 		c.Write([]byte("OPER admin wrongPass\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 464 a :Password Incorrect\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 464 a :Password Incorrect\r\n", s.Config().Name), t)
 	})
 	t.Run("TestCorrectPassword", func(t *testing.T) {
 		c.Write([]byte("OPER admin adminpass\r\n"))
 		operResp, _ := r.ReadBytes('\n')
 		modeResp, _ := r.ReadBytes('\n')
-		assertResponse(operResp, fmt.Sprintf(":%s 381 a :You are now an IRC operator\r\n", s.Name), t)
-		assertResponse(modeResp, fmt.Sprintf(":%s MODE a +o\r\n", s.Name), t)
+		assertResponse(operResp, fmt.Sprintf(":%s 381 a :You are now an IRC operator\r\n", s.Config().Name), t)
+		assertResponse(modeResp, fmt.Sprintf(":%s MODE a +o\r\n", s.Config().Name), t)
 	})
 }
 
@@ -188,8 +189,8 @@ func TestPASS(t *testing.T) {
 		resp, _ := r.ReadBytes('\n')
 		err, _ := r.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 464 chris :Password Incorrect\r\n", s.Name), t)
-		assertResponse(err, fmt.Sprintf("ERROR :Closing Link: %s (Bad Password)\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 464 chris :Password Incorrect\r\n", s.Config().Name), t)
+		assertResponse(err, fmt.Sprintf("ERROR :Closing Link: %s (Bad Password)\r\n", s.Config().Name), t)
 	})
 	t.Run("TestPASSParamMissing", func(t *testing.T) {
 		c, r, p := connect(s)
@@ -199,8 +200,8 @@ func TestPASS(t *testing.T) {
 		err, _ := r.ReadBytes('\n')
 		// err, _ := r.ReadBytes('\n')
 
-		assertResponse(err, fmt.Sprintf(":%s 461 * PASS :Not enough parameters\r\n", s.Name), t)
-		// assertResponse(err, fmt.Sprintf("ERROR :Closing Link: %s (Bad Password)\r\n", s.Name), t)
+		assertResponse(err, fmt.Sprintf(":%s 461 * PASS :Not enough parameters\r\n", s.Config().Name), t)
+		// assertResponse(err, fmt.Sprintf("ERROR :Closing Link: %s (Bad Password)\r\n", s.Config().Name), t)
 	})
 	t.Run("TestPASSIncorrect", func(t *testing.T) {
 		c, r, p := connect(s)
@@ -212,8 +213,8 @@ func TestPASS(t *testing.T) {
 		resp, _ := r.ReadBytes('\n')
 		err, _ := r.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 464 chris :Password Incorrect\r\n", s.Name), t)
-		assertResponse(err, fmt.Sprintf("ERROR :Closing Link: %s (Bad Password)\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 464 chris :Password Incorrect\r\n", s.Config().Name), t)
+		assertResponse(err, fmt.Sprintf("ERROR :Closing Link: %s (Bad Password)\r\n", s.Config().Name), t)
 	})
 	t.Run("TestPASSCorrect", func(t *testing.T) {
 		c, r, p := connect(s)
@@ -223,12 +224,12 @@ func TestPASS(t *testing.T) {
 		c.Write([]byte("NICK chris\r\n"))
 		c.Write([]byte("USER c 0 * :Chrisa!\r\n"))
 
-		readLines(r, 13)
+		readLines(r, 14)
 
 		t.Run("TestPASSAlreadyRegistered", func(t *testing.T) {
 			c.Write([]byte("PASS letmein\r\n"))
 			err, _ := r.ReadBytes('\n')
-			assertResponse(err, fmt.Sprintf(":%s 462 chris :You may not reregister\r\n", s.Name), t)
+			assertResponse(err, fmt.Sprintf(":%s 462 chris :You may not reregister\r\n", s.Config().Name), t)
 		})
 	})
 }
@@ -340,21 +341,21 @@ func TestChannelCreation(t *testing.T) {
 	endNames, _ := r1.ReadBytes('\n')
 
 	assertResponse(joinResp, ":alice!alice@localhost JOIN #local\r\n", t)
-	assertResponse(namreply, fmt.Sprintf(":%s 353 alice = #local :@alice\r\n", s.Name), t)
-	assertResponse(endNames, fmt.Sprintf(":%s 366 alice #local :End of /NAMES list\r\n", s.Name), t)
+	assertResponse(namreply, fmt.Sprintf(":%s 353 alice = #local :@alice\r\n", s.Config().Name), t)
+	assertResponse(endNames, fmt.Sprintf(":%s 366 alice #local :End of /NAMES list\r\n", s.Config().Name), t)
 
 	t.Run("TestJoinNoParam", func(t *testing.T) {
 		c1.Write([]byte("JOIN\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 461 alice JOIN :Not enough parameters\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 461 alice JOIN :Not enough parameters\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestJoinNonexistentChannelType", func(t *testing.T) {
 		c1.Write([]byte("JOIN *testChan\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 403 alice *testChan :No such channel\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 403 alice *testChan :No such channel\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestCreateChanSameTime", func(t *testing.T) {
@@ -412,7 +413,7 @@ func TestChannelCreation(t *testing.T) {
 
 		c3.Write([]byte("LIST #chan1,#chan2,#chan3\r\n"))
 		response, _ := r3.ReadBytes('\n')
-		assertResponse(response, fmt.Sprintf(":%s 323 c :End of /LIST\r\n", s.Name), t)
+		assertResponse(response, fmt.Sprintf(":%s 323 c :End of /LIST\r\n", s.Config().Name), t)
 	})
 }
 
@@ -452,7 +453,7 @@ func TestChannelKeys(t *testing.T) {
 		c2.Write([]byte("JOIN #1\r\n"))
 		resp, _ := r2.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 475 dan #1 :Cannot join channel (+k)\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 475 dan #1 :Cannot join channel (+k)\r\n", s.Config().Name), t)
 	})
 }
 
@@ -477,19 +478,19 @@ func TestTOPIC(t *testing.T) {
 	c.Write([]byte("TOPIC &test\r\n"))
 
 	unchanged, _ := r.ReadBytes('\n')
-	assertResponse(unchanged, fmt.Sprintf(":%s 331 alice &test :No topic is set\r\n", s.Name), t)
+	assertResponse(unchanged, fmt.Sprintf(":%s 331 alice &test :No topic is set\r\n", s.Config().Name), t)
 	changed, _ := r.ReadBytes('\n')
-	assertResponse(changed, fmt.Sprintf(":%s TOPIC &test :This is a test\r\n", s.Name), t)
+	assertResponse(changed, fmt.Sprintf(":%s TOPIC &test :This is a test\r\n", s.Config().Name), t)
 	retrieve, _ := r.ReadBytes('\n')
-	assertResponse(retrieve, fmt.Sprintf(":%s 332 alice &test :This is a test\r\n", s.Name), t)
+	assertResponse(retrieve, fmt.Sprintf(":%s 332 alice &test :This is a test\r\n", s.Config().Name), t)
 	r.ReadBytes('\n')
 	// TODO: figure out a way to check the unix timestamp
 	// topicWhoTime, _ := r.ReadBytes('\n')
-	// assertResponse(topicWhoTime, fmt.Sprintf(RPL_TOPICWHOTIME, s.Name, "alice", "&test", "alice", 0), t)
+	// assertResponse(topicWhoTime, fmt.Sprintf(RPL_TOPICWHOTIME, s.Config().Name, "alice", "&test", "alice", 0), t)
 
 	r.ReadBytes('\n')
 	clear, _ := r.ReadBytes('\n')
-	assertResponse(clear, fmt.Sprintf(":%s 331 alice &test :No topic is set\r\n", s.Name), t)
+	assertResponse(clear, fmt.Sprintf(":%s 331 alice &test :No topic is set\r\n", s.Config().Name), t)
 
 	t.Run("MissingParam", func(t *testing.T) {
 		c.Write([]byte("TOPIC\r\n"))
@@ -506,7 +507,7 @@ func TestTOPIC(t *testing.T) {
 		defer c2.Close()
 		c2.Write([]byte("JOIN &test\r\nTOPIC &test :I have no privileges\r\n"))
 		resp, _ := readLines(r2, 4)
-		assertResponse(resp, fmt.Sprintf(":%s 482 b &test :You're not a channel operator\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 482 b &test :You're not a channel operator\r\n", s.Config().Name), t)
 	})
 }
 
@@ -576,7 +577,7 @@ func TestKICK(t *testing.T) {
 		c1.Write([]byte("KICK #local unknownUser\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 441 alice unknownUser #local :They aren't on that channel\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 441 alice unknownUser #local :They aren't on that channel\r\n", s.Config().Name), t)
 	})
 }
 
@@ -597,19 +598,19 @@ func TestNAMES(t *testing.T) {
 	namreply, _ := r.ReadBytes('\n')
 	end, _ := r.ReadBytes('\n')
 
-	assertResponse(namreply, fmt.Sprintf(":%s 353 alice = &test :@alice\r\n", s.Name), t)
-	assertResponse(end, fmt.Sprintf(":%s 366 alice &test :End of /NAMES list\r\n", s.Name), t)
+	assertResponse(namreply, fmt.Sprintf(":%s 353 alice = &test :@alice\r\n", s.Config().Name), t)
+	assertResponse(end, fmt.Sprintf(":%s 366 alice &test :End of /NAMES list\r\n", s.Config().Name), t)
 
 	t.Run("TestNoParam", func(t *testing.T) {
 		c.Write([]byte("NAMES\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 366 alice * :End of /NAMES list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 366 alice * :End of /NAMES list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestUnknownChan", func(t *testing.T) {
 		c.Write([]byte("NAMES #notReal\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 366 alice #notReal :End of /NAMES list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 366 alice #notReal :End of /NAMES list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestSecretChanNotBelong", func(t *testing.T) {
@@ -619,7 +620,7 @@ func TestNAMES(t *testing.T) {
 
 		c.Write([]byte("NAMES #secret\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 366 alice #secret :End of /NAMES list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 366 alice #secret :End of /NAMES list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestSecretChanBelong", func(t *testing.T) {
@@ -630,8 +631,8 @@ func TestNAMES(t *testing.T) {
 		c.Write([]byte("NAMES #secret\r\n"))
 		namreply, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
-		assertResponse(namreply, fmt.Sprintf(":%s 353 alice @ #secret :alice\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 366 alice #secret :End of /NAMES list\r\n", s.Name), t)
+		assertResponse(namreply, fmt.Sprintf(":%s 353 alice @ #secret :alice\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 366 alice #secret :End of /NAMES list\r\n", s.Config().Name), t)
 	})
 }
 
@@ -650,7 +651,7 @@ func TestLIST(t *testing.T) {
 		c.Write([]byte("LIST \r\n"))
 		end, _ := r.ReadBytes('\n')
 
-		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestNoParams", func(t *testing.T) {
@@ -660,8 +661,8 @@ func TestLIST(t *testing.T) {
 		listReply, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
 
-		assertResponse(listReply, fmt.Sprintf(":%s 322 alice &test 1 :\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Name), t)
+		assertResponse(listReply, fmt.Sprintf(":%s 322 alice &test 1 :\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestParam", func(t *testing.T) {
@@ -671,8 +672,8 @@ func TestLIST(t *testing.T) {
 		listReply, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
 
-		assertResponse(listReply, fmt.Sprintf(":%s 322 alice &params 1 :\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Name), t)
+		assertResponse(listReply, fmt.Sprintf(":%s 322 alice &params 1 :\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Config().Name), t)
 	})
 
 	// if a client is a member of a secret channel, they should get an RPL_LIST reply for it
@@ -683,8 +684,8 @@ func TestLIST(t *testing.T) {
 		c.Write([]byte("LIST &params\r\n"))
 		listReply, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
-		assertResponse(listReply, fmt.Sprintf(":%s 322 alice &params 1 :\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Name), t)
+		assertResponse(listReply, fmt.Sprintf(":%s 322 alice &params 1 :\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestSecretNotBelongs", func(t *testing.T) {
@@ -693,7 +694,7 @@ func TestLIST(t *testing.T) {
 
 		c.Write([]byte("LIST &params\r\n"))
 		end, _ := r.ReadBytes('\n')
-		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 alice :End of /LIST\r\n", s.Config().Name), t)
 	})
 }
 
@@ -723,8 +724,8 @@ func TestELIST(t *testing.T) {
 		resp, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 322 a #past 0 :\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 323 a :End of /LIST\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 322 a #past 0 :\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 a :End of /LIST\r\n", s.Config().Name), t)
 	})
 
 	t.Run("C>", func(t *testing.T) {
@@ -732,8 +733,8 @@ func TestELIST(t *testing.T) {
 		resp, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 322 a #future 0 :\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 323 a :End of /LIST\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 322 a #future 0 :\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 a :End of /LIST\r\n", s.Config().Name), t)
 	})
 
 	t.Run("T<", func(t *testing.T) {
@@ -741,8 +742,8 @@ func TestELIST(t *testing.T) {
 		resp, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 322 a #past 0 :\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 323 a :End of /LIST\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 322 a #past 0 :\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 a :End of /LIST\r\n", s.Config().Name), t)
 	})
 
 	t.Run("T>", func(t *testing.T) {
@@ -750,8 +751,8 @@ func TestELIST(t *testing.T) {
 		resp, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 322 a #future 0 :\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 323 a :End of /LIST\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 322 a #future 0 :\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 323 a :End of /LIST\r\n", s.Config().Name), t)
 	})
 }
 
@@ -770,21 +771,21 @@ func TestMOTD(t *testing.T) {
 	t.Run("NoFile", func(t *testing.T) {
 		c.Write([]byte("MOTD\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, prepMessage(ERR_NOMOTD, s.Name, "alice").String(), t)
+		assertResponse(resp, prepMessage(ERR_NOMOTD, s.Config().Name, "alice").String(), t)
 	})
 
 	t.Run("Success", func(t *testing.T) {
-		s.motd = []string{"this is line 1", "line 2"}
+		s.Config().motd = []string{"this is line 1", "line 2"}
 		c.Write([]byte("MOTD\r\n"))
 		start, _ := r.ReadBytes('\n')
 		line1, _ := r.ReadBytes('\n')
 		line2, _ := r.ReadBytes('\n')
 		end, _ := r.ReadBytes('\n')
 
-		assertResponse(start, prepMessage(RPL_MOTDSTART, s.Name, "alice", s.Name).String(), t)
-		assertResponse(line1, prepMessage(RPL_MOTD, s.Name, "alice", "this is line 1").String(), t)
-		assertResponse(line2, prepMessage(RPL_MOTD, s.Name, "alice", "line 2").String(), t)
-		assertResponse(end, prepMessage(RPL_ENDOFMOTD, s.Name, "alice").String(), t)
+		assertResponse(start, prepMessage(RPL_MOTDSTART, s.Config().Name, "alice", s.Config().Name).String(), t)
+		assertResponse(line1, prepMessage(RPL_MOTD, s.Config().Name, "alice", "this is line 1").String(), t)
+		assertResponse(line2, prepMessage(RPL_MOTD, s.Config().Name, "alice", "line 2").String(), t)
+		assertResponse(end, prepMessage(RPL_ENDOFMOTD, s.Config().Name, "alice").String(), t)
 	})
 }
 
@@ -808,7 +809,7 @@ func TestMODEChannel(t *testing.T) {
 	t.Run("TestUserNotInChan", func(t *testing.T) {
 		c1.Write([]byte("MODE #local +o bob\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 441 alice bob #local :They aren't on that channel\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 441 alice bob #local :They aren't on that channel\r\n", s.Config().Name), t)
 	})
 
 	bob := &channel.Member{Client: s.clients["bob"]}
@@ -820,8 +821,8 @@ func TestMODEChannel(t *testing.T) {
 	getModeResp, _ := r1.ReadBytes('\n')
 	r1.ReadBytes('\n')
 
-	assertResponse(applied, fmt.Sprintf(":%s MODE #local +ko pass bob\r\n", s.Name), t)
-	assertResponse(getModeResp, fmt.Sprintf(":%s 324 alice #local k\r\n", s.Name), t)
+	assertResponse(applied, fmt.Sprintf(":%s MODE #local +ko pass bob\r\n", s.Config().Name), t)
+	assertResponse(getModeResp, fmt.Sprintf(":%s 324 alice #local k\r\n", s.Config().Name), t)
 
 	if bob.Prefix != channel.Operator {
 		t.Error("Failed to set member mode")
@@ -830,48 +831,48 @@ func TestMODEChannel(t *testing.T) {
 	t.Run("TestUnknownChannel", func(t *testing.T) {
 		c1.Write([]byte("MODE #notExist +w\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 403 alice #notExist :No such channel\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 403 alice #notExist :No such channel\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestChannelModeMissingParam", func(t *testing.T) {
 		c1.Write([]byte("MODE #local +l\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 461 alice :+l :Not enough parameters\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 461 alice :+l :Not enough parameters\r\n", s.Config().Name), t)
 	})
 
 	// should silently ignore extra parameters
 	t.Run("TestChannelModeTooManyParam", func(t *testing.T) {
 		c1.Write([]byte("MODE #local +l 1 2\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s MODE #local +l 1\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s MODE #local +l 1\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestUnknownMode", func(t *testing.T) {
 		c1.Write([]byte("MODE #local +w\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 472 alice w :is unknown mode char to me for #local\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 472 alice w :is unknown mode char to me for #local\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestIllFormedKey", func(t *testing.T) {
 		c1.Write([]byte("MODE #local +k :ill-formed key\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 525 alice #local :Key is not well-formed\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 525 alice #local :Key is not well-formed\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestEmptyKey", func(t *testing.T) {
 		c1.Write([]byte("MODE #local +k :\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 525 alice #local :Key is not well-formed\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 525 alice #local :Key is not well-formed\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestTooLongKey", func(t *testing.T) {
 		c1.Write([]byte("MODE #local +k 123456789012345678901234\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 525 alice #local :Key is not well-formed\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 525 alice #local :Key is not well-formed\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestRPLBANLIST", func(t *testing.T) {
-		s.clients["alice"].FillGrants()
+		s.clients["alice"].FillTokens()
 
 		c1.Write([]byte("MODE #local +b abc\r\nMODE #local +b def\r\nMODE #local +b ghi\r\n"))
 		readLines(r1, 3)
@@ -881,10 +882,10 @@ func TestMODEChannel(t *testing.T) {
 		ghi, _ := r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
 
-		assertResponse(abc, fmt.Sprintf(":%s 367 alice #local abc\r\n", s.Name), t)
-		assertResponse(def, fmt.Sprintf(":%s 367 alice #local def\r\n", s.Name), t)
-		assertResponse(ghi, fmt.Sprintf(":%s 367 alice #local ghi\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 368 alice #local :End of channel ban list\r\n", s.Name), t)
+		assertResponse(abc, fmt.Sprintf(":%s 367 alice #local abc\r\n", s.Config().Name), t)
+		assertResponse(def, fmt.Sprintf(":%s 367 alice #local def\r\n", s.Config().Name), t)
+		assertResponse(ghi, fmt.Sprintf(":%s 367 alice #local ghi\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 368 alice #local :End of channel ban list\r\n", s.Config().Name), t)
 
 		// test that 'MODE #local b' works
 		c1.Write([]byte("MODE #local b\r\n"))
@@ -892,14 +893,14 @@ func TestMODEChannel(t *testing.T) {
 		def, _ = r1.ReadBytes('\n')
 		ghi, _ = r1.ReadBytes('\n')
 		end, _ = r1.ReadBytes('\n')
-		assertResponse(abc, fmt.Sprintf(":%s 367 alice #local abc\r\n", s.Name), t)
-		assertResponse(def, fmt.Sprintf(":%s 367 alice #local def\r\n", s.Name), t)
-		assertResponse(ghi, fmt.Sprintf(":%s 367 alice #local ghi\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 368 alice #local :End of channel ban list\r\n", s.Name), t)
+		assertResponse(abc, fmt.Sprintf(":%s 367 alice #local abc\r\n", s.Config().Name), t)
+		assertResponse(def, fmt.Sprintf(":%s 367 alice #local def\r\n", s.Config().Name), t)
+		assertResponse(ghi, fmt.Sprintf(":%s 367 alice #local ghi\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 368 alice #local :End of channel ban list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestRPLEXCEPTLIST", func(t *testing.T) {
-		s.clients["alice"].FillGrants()
+		s.clients["alice"].FillTokens()
 
 		c1.Write([]byte("MODE #local +e abc\r\nMODE #local +e def\r\nMODE #local +e ghi\r\n"))
 		r1.ReadBytes('\n')
@@ -911,14 +912,14 @@ func TestMODEChannel(t *testing.T) {
 		ghi, _ := r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
 
-		assertResponse(abc, fmt.Sprintf(":%s 348 alice #local abc\r\n", s.Name), t)
-		assertResponse(def, fmt.Sprintf(":%s 348 alice #local def\r\n", s.Name), t)
-		assertResponse(ghi, fmt.Sprintf(":%s 348 alice #local ghi\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 349 alice #local :End of channel exception list\r\n", s.Name), t)
+		assertResponse(abc, fmt.Sprintf(":%s 348 alice #local abc\r\n", s.Config().Name), t)
+		assertResponse(def, fmt.Sprintf(":%s 348 alice #local def\r\n", s.Config().Name), t)
+		assertResponse(ghi, fmt.Sprintf(":%s 348 alice #local ghi\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 349 alice #local :End of channel exception list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestRPLINVITELIST", func(t *testing.T) {
-		s.clients["alice"].FillGrants()
+		s.clients["alice"].FillTokens()
 
 		c1.Write([]byte("MODE #local +I abc\r\nMODE #local +I def\r\nMODE #local +I ghi\r\n"))
 		r1.ReadBytes('\n')
@@ -930,10 +931,10 @@ func TestMODEChannel(t *testing.T) {
 		ghi, _ := r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
 
-		assertResponse(abc, fmt.Sprintf(":%s 346 alice #local abc\r\n", s.Name), t)
-		assertResponse(def, fmt.Sprintf(":%s 346 alice #local def\r\n", s.Name), t)
-		assertResponse(ghi, fmt.Sprintf(":%s 346 alice #local ghi\r\n", s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 347 alice #local :End of channel invite list\r\n", s.Name), t)
+		assertResponse(abc, fmt.Sprintf(":%s 346 alice #local abc\r\n", s.Config().Name), t)
+		assertResponse(def, fmt.Sprintf(":%s 346 alice #local def\r\n", s.Config().Name), t)
+		assertResponse(ghi, fmt.Sprintf(":%s 346 alice #local ghi\r\n", s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 347 alice #local :End of channel invite list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestMODE+oWithoutPrivileges", func(t *testing.T) {
@@ -947,7 +948,7 @@ func TestMODEChannel(t *testing.T) {
 		c2.Write([]byte("JOIN #test\r\nMODE #test +o bar\r\n"))
 
 		resp, _ := readLines(r2, 4)
-		assertResponse(resp, prepMessage(ERR_CHANOPRIVSNEEDED, s.Name, "bar", "#test").String(), t)
+		assertResponse(resp, prepMessage(ERR_CHANOPRIVSNEEDED, s.Config().Name, "bar", "#test").String(), t)
 
 		test, _ := s.getChannel("#test")
 		bar, _ := test.GetMember("bar")
@@ -962,8 +963,8 @@ func TestMODEChannel(t *testing.T) {
 
 		opRemoved, _ := r1.ReadBytes('\n')
 		keyRemoved, _ := r1.ReadBytes('\n')
-		assertResponse(opRemoved, fmt.Sprintf(":%s MODE #local -o bob\r\n", s.Name), t)
-		assertResponse(keyRemoved, fmt.Sprintf(":%s MODE #local -k\r\n", s.Name), t)
+		assertResponse(opRemoved, fmt.Sprintf(":%s MODE #local -o bob\r\n", s.Config().Name), t)
+		assertResponse(keyRemoved, fmt.Sprintf(":%s MODE #local -k\r\n", s.Config().Name), t)
 	})
 }
 
@@ -983,13 +984,13 @@ func TestMODEClient(t *testing.T) {
 	t.Run("TestModeNoParam", func(t *testing.T) {
 		c.Write([]byte("MODE\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 221 alice r\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 221 alice r\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestUnknownNick", func(t *testing.T) {
 		c.Write([]byte("MODE bob +o\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 401 alice bob :No such nick/channel\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 401 alice bob :No such nick/channel\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestModifyOtherUser", func(t *testing.T) {
@@ -998,26 +999,26 @@ func TestMODEClient(t *testing.T) {
 
 		c.Write([]byte("MODE bob +o\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 502 alice :Can't change mode for other users\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 502 alice :Can't change mode for other users\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestUnknownMode", func(t *testing.T) {
 		c.Write([]byte("MODE alice +j\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 501 alice :Unknown MODE flag\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 501 alice :Unknown MODE flag\r\n", s.Config().Name), t)
 		r.ReadBytes('\n')
 	})
 
 	t.Run("TestOwnModeEcho", func(t *testing.T) {
 		c.Write([]byte("MODE alice\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 221 alice r\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 221 alice r\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestAddMode", func(t *testing.T) {
 		c.Write([]byte("MODE alice +w\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s MODE alice +w\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s MODE alice +w\r\n", s.Config().Name), t)
 
 		if !alice.Is(client.Wallops) {
 			t.Error(alice.Mode)
@@ -1027,7 +1028,7 @@ func TestMODEClient(t *testing.T) {
 	t.Run("TestRemoveMode", func(t *testing.T) {
 		c.Write([]byte("MODE alice -w\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s MODE alice -w\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s MODE alice -w\r\n", s.Config().Name), t)
 
 		if alice.Is(client.Wallops) {
 			t.Error(alice.Mode)
@@ -1037,7 +1038,7 @@ func TestMODEClient(t *testing.T) {
 	t.Run("TestAddMultipleMode", func(t *testing.T) {
 		c.Write([]byte("MODE alice +wi\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s MODE alice +wi\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s MODE alice +wi\r\n", s.Config().Name), t)
 
 		if !alice.Is(client.Wallops) || !alice.Is(client.Invisible) {
 			t.Error(alice.Mode)
@@ -1047,7 +1048,7 @@ func TestMODEClient(t *testing.T) {
 	t.Run("TestRemoveMultipleMode", func(t *testing.T) {
 		c.Write([]byte("MODE alice -wi\r\n"))
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s MODE alice -wi\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s MODE alice -wi\r\n", s.Config().Name), t)
 
 		if alice.Is(client.Wallops) || alice.Is(client.Invisible) {
 			t.Error(alice.Mode)
@@ -1070,8 +1071,8 @@ func TestWHOClient(t *testing.T) {
 		c1.Write([]byte("WHO\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 352 alice * alice localhost %s alice H :0 alice\r\n", s.Name, s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 315 alice * :End of WHO list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 352 alice * alice localhost %s alice H :0 alice\r\n", s.Config().Name, s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 315 alice * :End of WHO list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestAwayOp", func(t *testing.T) {
@@ -1081,8 +1082,8 @@ func TestWHOClient(t *testing.T) {
 		c1.Write([]byte("WHO\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 352 alice * alice localhost %s alice G* :0 alice\r\n", s.Name, s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 315 alice * :End of WHO list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 352 alice * alice localhost %s alice G* :0 alice\r\n", s.Config().Name, s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 315 alice * :End of WHO list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("WHObob", func(t *testing.T) {
@@ -1092,7 +1093,7 @@ func TestWHOClient(t *testing.T) {
 		c1.Write([]byte("WHO bob\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 		r1.ReadBytes('\n') // end
-		assertResponse(resp, fmt.Sprintf(":%s 352 alice * bob localhost %s bob H :0 bob\r\n", s.Name, s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 352 alice * bob localhost %s bob H :0 bob\r\n", s.Config().Name, s.Config().Name), t)
 	})
 }
 
@@ -1112,13 +1113,13 @@ func TestWHOXClient(t *testing.T) {
 	c1.Write([]byte("WHO bob %tcuihsnfdlaor,10\r\n"))
 	resp, _ := r1.ReadBytes('\n')
 	r1.ReadBytes('\n')
-	assertResponse(resp, fmt.Sprintf(":%s 354 alice 10 * bob 127.0.0.1 localhost gossip bob H 0 0 0 n/a :bob\r\n", s.Name), t)
+	assertResponse(resp, fmt.Sprintf(":%s 354 alice 10 * bob 127.0.0.1 localhost gossip bob H 0 0 0 n/a :bob\r\n", s.Config().Name), t)
 
 	t.Run("OutOfOrder", func(t *testing.T) {
 		c1.Write([]byte("WHO bob %afnt,42\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 		r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 354 alice 42 bob H 0\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 354 alice 42 bob H 0\r\n", s.Config().Name), t)
 	})
 }
 
@@ -1143,8 +1144,8 @@ func TestWHOChannel(t *testing.T) {
 		c1.Write([]byte("WHO #local\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 352 alice #local alice localhost %s alice H :0 alice\r\n", s.Name, s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 315 alice #local :End of WHO list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 352 alice #local alice localhost %s alice H :0 alice\r\n", s.Config().Name, s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 315 alice #local :End of WHO list\r\n", s.Config().Name), t)
 	})
 
 	t.Run("AwayOpsVoice", func(t *testing.T) {
@@ -1153,8 +1154,8 @@ func TestWHOChannel(t *testing.T) {
 		c1.Write([]byte("WHO #local\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 352 alice #local alice localhost %s alice G*@+ :0 alice\r\n", s.Name, s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 315 alice #local :End of WHO list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 352 alice #local alice localhost %s alice G*@+ :0 alice\r\n", s.Config().Name, s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 315 alice #local :End of WHO list\r\n", s.Config().Name), t)
 	})
 
 	c2, _ := connectAndRegister("bob")
@@ -1168,8 +1169,8 @@ func TestWHOChannel(t *testing.T) {
 		c1.Write([]byte("WHO\r\n"))
 		resp, _ := r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 352 alice * alice localhost %s alice G* :0 alice\r\n", s.Name, s.Name), t)
-		assertResponse(end, fmt.Sprintf(":%s 315 alice * :End of WHO list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 352 alice * alice localhost %s alice G* :0 alice\r\n", s.Config().Name, s.Config().Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 315 alice * :End of WHO list\r\n", s.Config().Name), t)
 	})
 
 	// when bob joins a channel that alice is also joined to, they now
@@ -1183,7 +1184,7 @@ func TestWHOChannel(t *testing.T) {
 		r1.ReadBytes('\n')
 		r1.ReadBytes('\n')
 		end, _ := r1.ReadBytes('\n')
-		assertResponse(end, fmt.Sprintf(":%s 315 alice * :End of WHO list\r\n", s.Name), t)
+		assertResponse(end, fmt.Sprintf(":%s 315 alice * :End of WHO list\r\n", s.Config().Name), t)
 	})
 
 }
@@ -1208,11 +1209,11 @@ func TestWHOIS(t *testing.T) {
 	chans, _ := r1.ReadBytes('\n')
 	end, _ := r1.ReadBytes('\n')
 
-	assertResponse(whois, fmt.Sprintf(":%s 311 alice bob bob %s * :bob\r\n", s.Name, "localhost"), t)
-	assertResponse(server, fmt.Sprintf(":%s 312 alice bob %s :wip irc server\r\n", s.Name, s.Name), t)
-	// assertResponse(idle, fmt.Sprintf(":%s 317 alice bob %v %v :seconds idle, signon time\r\n", s.Name, time.Since(bob.Idle).Round(time.Second).Seconds(), bob.JoinTime), t)
-	assertResponse(chans, fmt.Sprintf(":%s 319 alice bob\r\n", s.Name), t)
-	assertResponse(end, fmt.Sprintf(":%s 318 alice bob :End of /WHOIS list\r\n", s.Name), t)
+	assertResponse(whois, fmt.Sprintf(":%s 311 alice bob bob %s * :bob\r\n", s.Config().Name, "localhost"), t)
+	assertResponse(server, fmt.Sprintf(":%s 312 alice bob %s :wip irc server\r\n", s.Config().Name, s.Config().Name), t)
+	// assertResponse(idle, fmt.Sprintf(":%s 317 alice bob %v %v :seconds idle, signon time\r\n", s.Config().Name, time.Since(bob.Idle).Round(time.Second).Seconds(), bob.JoinTime), t)
+	assertResponse(chans, fmt.Sprintf(":%s 319 alice bob\r\n", s.Config().Name), t)
+	assertResponse(end, fmt.Sprintf(":%s 318 alice bob :End of /WHOIS list\r\n", s.Config().Name), t)
 
 	t.Run("TestAWAY", func(t *testing.T) {
 		c2.Write([]byte("AWAY :I'm away\r\n"))
@@ -1247,11 +1248,11 @@ func TestWHOWAS(t *testing.T) {
 
 		c3.Write([]byte("WHOWAS alice\r\n"))
 		resp1, _ := r3.ReadBytes('\n')
-		assertResponse(resp1, prepMessage(RPL_WHOWASUSER, s.Name, "bob", "alice", "alice", "localhost", "alice").String(), t)
+		assertResponse(resp1, prepMessage(RPL_WHOWASUSER, s.Config().Name, "bob", "alice", "alice", "localhost", "alice").String(), t)
 		resp2, _ := r3.ReadBytes('\n')
-		assertResponse(resp2, prepMessage(RPL_WHOWASUSER, s.Name, "bob", "alice", "alice", "localhost", "alice").String(), t)
+		assertResponse(resp2, prepMessage(RPL_WHOWASUSER, s.Config().Name, "bob", "alice", "alice", "localhost", "alice").String(), t)
 		end, _ := r3.ReadBytes('\n')
-		assertResponse(end, prepMessage(RPL_ENDOFWHOWAS, s.Name, "bob", "alice").String(), t)
+		assertResponse(end, prepMessage(RPL_ENDOFWHOWAS, s.Config().Name, "bob", "alice").String(), t)
 	})
 
 	t.Run("TestCount1", func(t *testing.T) {
@@ -1269,9 +1270,9 @@ func TestWHOWAS(t *testing.T) {
 
 		c3.Write([]byte("WHOWAS alice 1\r\n"))
 		resp, _ := r3.ReadBytes('\n')
-		assertResponse(resp, prepMessage(RPL_WHOWASUSER, s.Name, "bob", "alice", "alice", "localhost", "alice").String(), t)
+		assertResponse(resp, prepMessage(RPL_WHOWASUSER, s.Config().Name, "bob", "alice", "alice", "localhost", "alice").String(), t)
 		end, _ := r3.ReadBytes('\n')
-		assertResponse(end, prepMessage(RPL_ENDOFWHOWAS, s.Name, "bob", "alice").String(), t)
+		assertResponse(end, prepMessage(RPL_ENDOFWHOWAS, s.Config().Name, "bob", "alice").String(), t)
 	})
 }
 
@@ -1294,7 +1295,7 @@ func TestChanFull(t *testing.T) {
 	c2.Write([]byte("JOIN #l\r\n"))
 	resp, _ := r2.ReadBytes('\n')
 
-	assertResponse(resp, fmt.Sprintf(":%s 471 bob #l :Cannot join channel (+l)\r\n", s.Name), t)
+	assertResponse(resp, fmt.Sprintf(":%s 471 bob #l :Cannot join channel (+l)\r\n", s.Config().Name), t)
 }
 
 func TestModerated(t *testing.T) {
@@ -1318,7 +1319,7 @@ func TestModerated(t *testing.T) {
 	r1.ReadBytes('\n')
 
 	resp, _ := readLines(r2, 4)
-	assertResponse(resp, fmt.Sprintf(":%s 404 bob #l :Cannot send to channel\r\n", s.Name), t)
+	assertResponse(resp, fmt.Sprintf(":%s 404 bob #l :Cannot send to channel\r\n", s.Config().Name), t)
 }
 
 func TestNoExternal(t *testing.T) {
@@ -1340,7 +1341,7 @@ func TestNoExternal(t *testing.T) {
 	c2.Write([]byte("PRIVMSG #l :hey\r\n"))
 	resp, _ := r2.ReadBytes('\n')
 
-	assertResponse(resp, fmt.Sprintf(":%s 404 bob #l :Cannot send to channel\r\n", s.Name), t)
+	assertResponse(resp, fmt.Sprintf(":%s 404 bob #l :Cannot send to channel\r\n", s.Config().Name), t)
 }
 
 func TestINVITE(t *testing.T) {
@@ -1370,20 +1371,20 @@ func TestINVITE(t *testing.T) {
 	t.Run("NoSuchChannel", func(t *testing.T) {
 		c1.Write([]byte("INVITE bob #notExist\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 403 alice #notExist :No such channel\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 403 alice #notExist :No such channel\r\n", s.Config().Name), t)
 	})
 
 	t.Run("NotOnChannel", func(t *testing.T) {
 		c2.Write([]byte("INVITE alice #local\r\n"))
 		resp, _ := r2.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 442 bob #local :You're not on that channel\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 442 bob #local :You're not on that channel\r\n", s.Config().Name), t)
 	})
 
 	t.Run("JoinInviteModedChannelWithoutBeingInvited", func(t *testing.T) {
 		c2.Write([]byte("JOIN #local\r\n"))
 		resp, _ := r2.ReadBytes('\n')
 
-		assertResponse(resp, fmt.Sprintf(":%s 473 bob #local :Cannot join channel (+i)\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 473 bob #local :Cannot join channel (+i)\r\n", s.Config().Name), t)
 	})
 
 	t.Run("JoinInviteModedChannelAfterInvite", func(t *testing.T) {
@@ -1444,7 +1445,225 @@ func TestBan(t *testing.T) {
 	c2.Write([]byte("JOIN #local\r\n"))
 	resp, _ := r2.ReadBytes('\n')
 
-	assertResponse(resp, fmt.Sprintf(":%s 474 bob #local :Cannot join channel (+b)\r\n", s.Name), t)
+	assertResponse(resp, fmt.Sprintf(":%s 474 bob #local :Cannot join channel (+b)\r\n", s.Config().Name), t)
+}
+
+func TestRegisteredOnly(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, r1 := connectAndRegister("alice")
+	defer c1.Close()
+	c2, r2 := connectAndRegister("bob")
+	defer c2.Close()
+
+	c1.Write([]byte("JOIN #local\r\n"))
+	c1.Write([]byte("MODE #local +R\r\n"))
+	readLines(r1, 4)
+	c2.Write([]byte("JOIN #local\r\n"))
+	resp, _ := r2.ReadBytes('\n')
+
+	assertResponse(resp, prepMessage(ERR_NEEDREGGEDNICK, s.Config().Name, "bob", "#local").String(), t)
+}
+
+func TestJoinThrottle(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, r1 := connectAndRegister("alice")
+	defer c1.Close()
+	c2, r2 := connectAndRegister("bob")
+	defer c2.Close()
+	c3, r3 := connectAndRegister("carl")
+	defer c3.Close()
+
+	t.Run("InvalidParam", func(t *testing.T) {
+		c1.Write([]byte("JOIN #local\r\n"))
+		c1.Write([]byte("MODE #local +j 2\r\n"))
+		resp, _ := readLines(r1, 4)
+		assertResponse(resp, prepMessage(ERR_INVALIDMODEPARAM, s.Config().Name, "alice", "#local", 'j', "2").String(), t)
+	})
+
+	t.Run("Throttled", func(t *testing.T) {
+		// only 1 join is allowed every 60 seconds, and alice's join has
+		// already been counted
+		c1.Write([]byte("MODE #local +j 2:60\r\n"))
+		r1.ReadBytes('\n')
+
+		c2.Write([]byte("JOIN #local\r\n"))
+		readLines(r2, 3)
+		r1.ReadBytes('\n')
+
+		c3.Write([]byte("JOIN #local\r\n"))
+		resp, _ := r3.ReadBytes('\n')
+		assertResponse(resp, prepMessage(ERR_THROTTLE, s.Config().Name, "carl", "#local").String(), t)
+	})
+
+	t.Run("ModeIs", func(t *testing.T) {
+		c1.Write([]byte("MODE #local\r\n"))
+		resp, _ := r1.ReadBytes('\n')
+		assertResponse(resp, prepMessage(RPL_CHANNELMODEIS, s.Config().Name, "alice", "#local", "j ", "2:60").String(), t)
+		r1.ReadBytes('\n')
+	})
+}
+
+func TestClientJoinRate(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.JoinThrottle.Joins = 1
+	conf.JoinThrottle.Period = time.Minute
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+
+	c.Write([]byte("JOIN #a\r\nJOIN #b\r\n"))
+	resp, _ := readLines(r, 4)
+	assertResponse(resp, "FAIL JOIN TOO_MANY_JOINS #b :You are joining channels too quickly\r\n", t)
+}
+
+func TestJoinFlood(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.JoinThrottle.Flood.Joins = 1
+	conf.JoinThrottle.Flood.Period = time.Minute
+	conf.JoinThrottle.Flood.Mode = "R"
+	conf.JoinThrottle.Flood.Duration = time.Millisecond * 100
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, r1 := connectAndRegister("alice")
+	defer c1.Close()
+	c2, r2 := connectAndRegister("bob")
+	defer c2.Close()
+
+	c1.Write([]byte("JOIN #local\r\n"))
+	readLines(r1, 3)
+	c2.Write([]byte("JOIN #local\r\n"))
+	readLines(r2, 3)
+
+	r1.ReadBytes('\n') // bob JOIN
+	lockdown, _ := r1.ReadBytes('\n')
+	assertResponse(lockdown, fmt.Sprintf(":%s MODE #local +R\r\n", s.Config().Name), t)
+	notice, _ := r1.ReadBytes('\n')
+	if !strings.HasPrefix(string(notice), fmt.Sprintf(":%s NOTICE alice :[#local] Join flood detected", s.Config().Name)) {
+		t.Error("expected flood notice, got", string(notice))
+	}
+
+	lifted, _ := r1.ReadBytes('\n')
+	assertResponse(lifted, fmt.Sprintf(":%s MODE #local -R\r\n", s.Config().Name), t)
+}
+
+func TestJoinFloodLeavesOperatorMode(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.JoinThrottle.Flood.Joins = 1
+	conf.JoinThrottle.Flood.Period = time.Minute
+	conf.JoinThrottle.Flood.Duration = time.Millisecond * 100
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, r1 := connectAndRegister("alice")
+	defer c1.Close()
+	c2, r2 := connectAndRegister("bob")
+	defer c2.Close()
+
+	c1.Write([]byte("JOIN #local\r\n"))
+	readLines(r1, 3)
+	c2.Write([]byte("JOIN #local\r\n"))
+	readLines(r2, 3)
+	lockdown, _ := readLines(r1, 2)
+	assertResponse(lockdown, fmt.Sprintf(":%s MODE #local +i\r\n", s.Config().Name), t)
+	r1.ReadBytes('\n') // notice
+
+	// alice decides to keep the channel invite only
+	c1.Write([]byte("MODE #local -i\r\nMODE #local +i\r\n"))
+	readLines(r1, 2)
+
+	time.Sleep(conf.JoinThrottle.Flood.Duration * 2)
+	c1.Write([]byte("PING x\r\n"))
+	for resp, _ := r1.ReadString('\n'); !strings.Contains(resp, "PONG"); resp, _ = r1.ReadString('\n') {
+		if strings.Contains(resp, "MODE #local -i") {
+			t.Error("lockdown removed a mode that an operator set")
+		}
+	}
+}
+
+func TestJoinFloodConfig(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.JoinThrottle.Flood.Mode = "x"
+	if _, err := New(conf); err == nil {
+		t.Error("expected an invalid flood mode to be rejected")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.Limits.Nick = 5
+	conf.Limits.Topic = 3
+	conf.Limits.List = 1
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	t.Run("ISUPPORT", func(t *testing.T) {
+		for _, v := range s.isupport(&client.Client{Nick: "alice"}).Messages() {
+			if tokens := strings.Fields(v.(*msg.Message).Params[1]); len(tokens) > 13 {
+				t.Error("too many tokens in line", v)
+			}
+		}
+		tokens := strings.Join(s.isupportTokens(), " ")
+		if !strings.Contains(tokens, "NICKLEN=5") || !strings.Contains(tokens, "TOPICLEN=3") || !strings.Contains(tokens, "MAXLIST=beI:1") || !strings.Contains(tokens, "WHOX") {
+			t.Error("ISUPPORT does not reflect config", tokens)
+		}
+	})
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+
+	t.Run("NICKLEN", func(t *testing.T) {
+		c.Write([]byte("NICK abcdef\r\n"))
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, prepMessage(ERR_ERRONEUSNICKNAME, s.Config().Name, "alice").String(), t)
+	})
+
+	t.Run("TOPICLEN", func(t *testing.T) {
+		c.Write([]byte("JOIN #l\r\nTOPIC #l :hello\r\n"))
+		resp, _ := readLines(r, 4)
+		assertResponse(resp, fmt.Sprintf(":%s TOPIC #l :hel\r\n", s.Config().Name), t)
+	})
+
+	t.Run("MAXLIST", func(t *testing.T) {
+		c.Write([]byte("MODE #l +b a!*@*\r\nMODE #l +b b!*@*\r\n"))
+		r.ReadBytes('\n')
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, prepMessage(ERR_BANLISTFULL, s.Config().Name, "alice", "#l", 'b').String(), t)
+	})
 }
 
 func TestPRIVMSG(t *testing.T) {
@@ -1468,7 +1687,7 @@ func TestPRIVMSG(t *testing.T) {
 	t.Run("TestNoTextToSend", func(t *testing.T) {
 		c1.Write([]byte("PRIVMSG bob\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, prepMessage(ERR_NOTEXTTOSEND, s.Name, "alice").String(), t)
+		assertResponse(resp, prepMessage(ERR_NOTEXTTOSEND, s.Config().Name, "alice").String(), t)
 	})
 
 	t.Run("TestClientPRIVMSG", func(t *testing.T) {
@@ -1481,7 +1700,7 @@ func TestPRIVMSG(t *testing.T) {
 	t.Run("TestNoSuchNick", func(t *testing.T) {
 		c1.Write([]byte("PRIVMSG notReal :hello\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, prepMessage(ERR_NOSUCHNICK, s.Name, "alice", "notReal").String(), t)
+		assertResponse(resp, prepMessage(ERR_NOSUCHNICK, s.Config().Name, "alice", "notReal").String(), t)
 	})
 
 	t.Run("TestChannelPRIVMSG", func(t *testing.T) {
@@ -1494,7 +1713,7 @@ func TestPRIVMSG(t *testing.T) {
 	t.Run("TestNoSuchChan", func(t *testing.T) {
 		c1.Write([]byte("PRIVMSG #notFound :hello\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, prepMessage(ERR_NOSUCHCHANNEL, s.Name, "alice", "#notFound").String(), t)
+		assertResponse(resp, prepMessage(ERR_NOSUCHCHANNEL, s.Config().Name, "alice", "#notFound").String(), t)
 	})
 
 	t.Run("TestMultipleTargets", func(t *testing.T) {
@@ -1510,9 +1729,99 @@ func TestPRIVMSG(t *testing.T) {
 		assertResponse(chanResp1, ":c!c@localhost PRIVMSG #local :From c\r\n", t)
 		assertResponse(chanResp2, ":c!c@localhost PRIVMSG #local :From c\r\n", t)
 		assertResponse(privmsgResp, ":c!c@localhost PRIVMSG bob :From c\r\n", t)
+
+		// c leaves before the next test, so that its QUIT isn't mistaken
+		// for a reply there
+		c3.Write([]byte("QUIT :Done\r\n"))
+		quit1, _ := r1.ReadBytes('\n')
+		quit2, _ := r2.ReadBytes('\n')
+		assertResponse(quit1, ":c!c@localhost QUIT :Done\r\n", t)
+		assertResponse(quit2, ":c!c@localhost QUIT :Done\r\n", t)
+	})
+
+	t.Run("TestTruncated", func(t *testing.T) {
+		text := strings.Repeat("a", 497)
+		c1.Write([]byte("PRIVMSG bob :" + text + "\r\n"))
+		resp, _ := r2.ReadBytes('\n')
+		prefix := ":alice!alice@localhost PRIVMSG bob :"
+		assertResponse(resp, prefix+text[:512-len(prefix)-2]+"\r\n", t)
+
+		warn, _ := r1.ReadBytes('\n')
+		assertResponse(warn, "WARN PRIVMSG MESSAGE_TRUNCATED :Your message was too long, so it was truncated\r\n", t)
 	})
 }
 
+func TestSTATUSMSG(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, r1 := connectAndRegister("alice")
+	defer c1.Close()
+	c2, r2 := connectAndRegister("bob")
+	defer c2.Close()
+	c3, r3 := connectAndRegister("carl")
+	defer c3.Close()
+
+	local := channel.New("local", channel.Remote)
+	local.SetMember(&channel.Member{Client: s.clients["alice"], Prefix: channel.Founder})
+	local.SetMember(&channel.Member{Client: s.clients["bob"], Prefix: channel.Voice})
+	local.SetMember(&channel.Member{Client: s.clients["carl"]})
+	s.setChannel(local)
+
+	c2.Write([]byte("CAP REQ echo-message\r\n"))
+	r2.ReadBytes('\n')
+
+	c2.Write([]byte("PRIVMSG @#local :ops only\r\n"))
+	resp, _ := r1.ReadBytes('\n')
+	assertResponse(resp, ":bob!bob@localhost PRIVMSG @#local :ops only\r\n", t)
+	echo, _ := r2.ReadBytes('\n')
+	assertResponse(echo, ":bob!bob@localhost PRIVMSG @#local :ops only\r\n", t)
+
+	c2.Write([]byte("PRIVMSG #local :everyone\r\n"))
+	r1.ReadBytes('\n')
+	r2.ReadBytes('\n')
+
+	// carl should not have received the first message
+	resp, _ = r3.ReadBytes('\n')
+	assertResponse(resp, ":bob!bob@localhost PRIVMSG #local :everyone\r\n", t)
+}
+
+func TestSTATUSMSGLocalChannel(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c1, r1 := connectAndRegister("alice")
+	defer c1.Close()
+	c2, r2 := connectAndRegister("bob")
+	defer c2.Close()
+
+	// '&' is both the local channel type and the protected prefix
+	loc := channel.New("loc", channel.Local)
+	loc.SetMember(&channel.Member{Client: s.clients["alice"], Prefix: channel.Operator})
+	loc.SetMember(&channel.Member{Client: s.clients["bob"]})
+	s.setChannel(loc)
+
+	c1.Write([]byte("PRIVMSG &loc :hi\r\n"))
+	resp, _ := r2.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost PRIVMSG &loc :hi\r\n", t)
+
+	c2.Write([]byte("PRIVMSG @&loc :ops only\r\n"))
+	resp, _ = r1.ReadBytes('\n')
+	assertResponse(resp, ":bob!bob@localhost PRIVMSG @&loc :ops only\r\n", t)
+
+	c1.Write([]byte("PRIVMSG @&loc :not for bob\r\nPRIVMSG &loc :for bob\r\n"))
+	resp, _ = r2.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost PRIVMSG &loc :for bob\r\n", t)
+}
+
 func TestChannelPRIVMSGTags(t *testing.T) {
 	s, err := New(conf)
 	if err != nil {
@@ -1570,21 +1879,21 @@ func TestPING(t *testing.T) {
 }
 
 func TestPONG(t *testing.T) {
-	s, err := New(conf)
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Timeouts: Timeouts{Ping: time.Millisecond * 50, Pong: time.Millisecond * 100}})
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer s.Close()
+	go s.Serve()
 
-	c := &client.Client{PONG: make(chan struct{}, 1)}
-	s.clients["c"] = c
-
-	PONG(s, c, nil)
+	c, r := connectAndRegister("alice")
+	defer c.Close()
 
-	select {
-	case <-c.PONG:
-	default:
-		t.Error("did not receive PONG")
+	// answering each PING should keep the client connected
+	for i := 0; i < 3; i++ {
+		ping, _ := r.ReadBytes('\n')
+		assertResponse(ping, ":gossip PING alice\r\n", t)
+		c.Write([]byte("PONG gossip\r\n"))
 	}
 }
 
@@ -1603,19 +1912,19 @@ func TestAWAY(t *testing.T) {
 
 	c1.Write([]byte("AWAY :I'm away\r\n"))
 	nowAway, _ := r1.ReadBytes('\n')
-	assertResponse(nowAway, fmt.Sprintf(":%s 306 alice :You have been marked as being away\r\n", s.Name), t)
+	assertResponse(nowAway, fmt.Sprintf(":%s 306 alice :You have been marked as being away\r\n", s.Config().Name), t)
 
 	c2.Write([]byte("PRIVMSG alice :Hey\r\n"))
 	awayMsg, _ := r2.ReadBytes('\n')
-	assertResponse(awayMsg, fmt.Sprintf(":%s 301 bob alice :I'm away\r\n", s.Name), t)
+	assertResponse(awayMsg, fmt.Sprintf(":%s 301 bob alice :I'm away\r\n", s.Config().Name), t)
 
 	c1.Write([]byte("AWAY\r\n"))
 	unAway, _ := r1.ReadBytes('\n')
-	assertResponse(unAway, fmt.Sprintf(":%s 305 alice :You are no longer marked as being away\r\n", s.Name), t)
+	assertResponse(unAway, fmt.Sprintf(":%s 305 alice :You are no longer marked as being away\r\n", s.Config().Name), t)
 
 	c1.Write([]byte("AWAY :\r\n"))
 	unAway, _ = r1.ReadBytes('\n')
-	assertResponse(unAway, fmt.Sprintf(":%s 305 alice :You are no longer marked as being away\r\n", s.Name), t)
+	assertResponse(unAway, fmt.Sprintf(":%s 305 alice :You are no longer marked as being away\r\n", s.Config().Name), t)
 }
 
 func TestUSERHOST(t *testing.T) {
@@ -1634,7 +1943,7 @@ func TestUSERHOST(t *testing.T) {
 	t.Run("TestNotAway", func(t *testing.T) {
 		c1.Write([]byte("USERHOST bob\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, prepMessage(RPL_USERHOST, s.Name, "alice", "bob=+localhost").String(), t)
+		assertResponse(resp, prepMessage(RPL_USERHOST, s.Config().Name, "alice", "bob=+localhost").String(), t)
 	})
 	t.Run("TestAway", func(t *testing.T) {
 		c2.Write([]byte("AWAY :I'm away\r\n"))
@@ -1642,7 +1951,7 @@ func TestUSERHOST(t *testing.T) {
 
 		c1.Write([]byte("USERHOST bob\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, prepMessage(RPL_USERHOST, s.Name, "alice", "bob=-localhost").String(), t)
+		assertResponse(resp, prepMessage(RPL_USERHOST, s.Config().Name, "alice", "bob=-localhost").String(), t)
 	})
 }
 
@@ -1693,10 +2002,28 @@ func TestREHASH(t *testing.T) {
 		c.Write([]byte("REHASH\r\n"))
 		resp, _ := r.ReadBytes('\n')
 
-		assertResponse(resp, prepMessage(ERR_NOPRIVILEGES, s.Name, "a").String(), t)
+		assertResponse(resp, prepMessage(ERR_NOPRIVILEGES, s.Config().Name, "a").String(), t)
 	})
 }
 
+func TestDIE(t *testing.T) {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("a")
+	defer c.Close()
+
+	for _, cmd := range []string{"DIE", "RESTART"} {
+		c.Write([]byte(cmd + "\r\n"))
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, prepMessage(ERR_NOPRIVILEGES, s.Config().Name, "a").String(), t)
+	}
+}
+
 func TestUnknownCommand(t *testing.T) {
 	s, err := New(conf)
 	if err != nil {
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/sasl"
+	"github.com/mitchr/gossip/sasl/external"
+	"github.com/mitchr/gossip/sasl/oauthbearer"
+	"github.com/mitchr/gossip/sasl/plain"
+	"github.com/mitchr/gossip/sasl/scram"
+)
+
+type mechanism struct {
+	// creates the mechanism for a client that has chosen it
+	new func(*Server, *client.Client) sasl.Mechanism
+
+	// if set, reports whether the mechanism can be used at all with the
+	// given configuration
+	configured func(*Config) bool
+}
+
+// every SASL mechanism that the server implements
+var mechanisms = map[string]mechanism{
+	"PLAIN": {
+		new: func(s *Server, c *client.Client) sasl.Mechanism { return plain.New(s.db) },
+	},
+	"EXTERNAL": {
+		new: func(s *Server, c *client.Client) sasl.Mechanism { return external.New(s.db, c, s.Config().externalCA) },
+	},
+	"SCRAM-SHA-256": {
+		new: func(s *Server, c *client.Client) sasl.Mechanism { return scram.New(s.db, sha256.New) },
+	},
+	"OAUTHBEARER": {
+		new: func(s *Server, c *client.Client) sasl.Mechanism {
+			return oauthbearer.New(s.db, s.Config().oauthbearer, s.oauthAccount)
+		},
+		configured: func(conf *Config) bool { return conf.oauthbearer != nil },
+	},
+}
+
+// the mechanisms that are enabled if none are configured, in the order
+// that they are advertised
+var defaultMechanisms = []string{"PLAIN", "EXTERNAL", "SCRAM-SHA-256", "OAUTHBEARER"}
+
+// prepareSASL checks that every configured mechanism exists, and loads
+// the certificates and keys that EXTERNAL and OAUTHBEARER verify
+// clients with
+func (c *Config) prepareSASL() error {
+	if len(c.SASL.Mechanisms) == 0 {
+		c.SASL.Mechanisms = append([]string(nil), defaultMechanisms...)
+	}
+	for _, list := range [][]string{c.SASL.Mechanisms, c.SASL.TLSOnly} {
+		for i, v := range list {
+			list[i] = strings.ToUpper(v)
+			if _, ok := mechanisms[list[i]]; !ok {
+				return fmt.Errorf("unknown SASL mechanism %s", v)
+			}
+		}
+	}
+
+	c.externalCA = nil
+	if c.SASL.External.CA != "" {
+		b, err := os.ReadFile(c.SASL.External.CA)
+		if err != nil {
+			return err
+		}
+		c.externalCA = x509.NewCertPool()
+		if !c.externalCA.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %s", c.SASL.External.CA)
+		}
+	}
+
+	c.oauthbearer = nil
+	if len(c.OAuthBearer.Keys) == 0 {
+		return nil
+	}
+
+	v, err := oauthbearer.NewVerifier(c.OAuthBearer.Keys...)
+	if err != nil {
+		return err
+	}
+	if c.OAuthBearer.Claim != "" {
+		v.Claim = c.OAuthBearer.Claim
+	}
+	v.Issuer = c.OAuthBearer.Issuer
+	v.Audience = c.OAuthBearer.Audience
+	c.oauthbearer = v
+	return nil
+}
+
+// saslMechanisms lists the SASL mechanisms that c can use under conf
+func (s *Server) saslMechanisms(conf *Config, c *client.Client) []string {
+	var mechs []string
+	for _, name := range conf.SASL.Mechanisms {
+		if s.offersMechanism(conf, c, name) {
+			mechs = append(mechs, name)
+		}
+	}
+	return mechs
+}
+
+func (s *Server) offersMechanism(conf *Config, c *client.Client, name string) bool {
+	m, ok := mechanisms[name]
+	if !ok || (m.configured != nil && !m.configured(conf)) {
+		return false
+	}
+
+	enabled := false
+	for _, v := range conf.SASL.Mechanisms {
+		if v == name {
+			enabled = true
+			break
+		}
+	}
+	if !enabled {
+		return false
+	}
+
+	// some mechanisms are only safe to use over a secure connection
+	for _, v := range conf.SASL.TLSOnly {
+		if v == name && !c.IsSecure() {
+			return false
+		}
+	}
+	return true
+}
+
+// newMechanism creates the mechanism called name for c, or returns nil
+// if c can't use it
+func (s *Server) newMechanism(c *client.Client, name string) sasl.Mechanism {
+	if !s.offersMechanism(s.Config(), c, name) {
+		return nil
+	}
+	return mechanisms[name].new(s, c)
+}
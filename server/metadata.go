@@ -0,0 +1,349 @@
+package server
+
+import (
+	"log"
+	"strings"
+
+	cap "github.com/mitchr/gossip/capability"
+	"github.com/mitchr/gossip/channel"
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/metadata"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// METADATA <target> <subcommand> [<param>...]
+// https://ircv3.net/specs/extensions/metadata
+func METADATA(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
+	if len(m.Params) < 2 {
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "METADATA")
+	}
+	sub, params := strings.ToUpper(m.Params[1]), m.Params[2:]
+
+	// subscriptions belong to the client, whatever the target is
+	switch sub {
+	case "SUB", "UNSUB":
+		if len(params) < 1 {
+			return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "METADATA")
+		}
+		if sub == "SUB" {
+			return s.subscribe(c, params)
+		}
+		return s.unsubscribe(c, params)
+	case "SUBS":
+		if keys := c.MetadataSubs.Keys(); len(keys) > 0 {
+			return s.keyList(c, RPL_METADATASUBS, keys)
+		}
+		return nil
+	case "GET", "LIST", "SET", "CLEAR", "SYNC":
+	default:
+		s.stdReply(c, FAIL, "METADATA", "SUBCOMMAND_INVALID", m.Params[1], "Invalid subcommand")
+		return nil
+	}
+
+	t, ok := s.metadataTarget(c, m.Params[0])
+	if !ok {
+		s.stdReply(c, FAIL, "METADATA", "INVALID_TARGET", m.Params[0], "Invalid target")
+		return nil
+	}
+	store := t.store()
+
+	switch sub {
+	case "GET":
+		if len(params) < 1 {
+			return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "METADATA")
+		}
+		buff := &msg.Buffer{}
+		for _, k := range params {
+			if !metadata.ValidKey(k) {
+				s.stdReply(c, FAIL, "METADATA", "KEY_INVALID", k, "Invalid key")
+				continue
+			}
+			if v, ok := store.Get(k); ok {
+				buff.AddMsg(prepMessage(RPL_KEYVALUE, conf.Name, c.Id(), t.name, k, v))
+			} else {
+				buff.AddMsg(prepMessage(RPL_KEYNOTSET, conf.Name, c.Id(), t.name, k))
+			}
+		}
+		return metadataBatch(c, buff)
+
+	case "LIST":
+		buff := &msg.Buffer{}
+		for _, k := range store.Keys() {
+			if v, ok := store.Get(k); ok {
+				buff.AddMsg(prepMessage(RPL_KEYVALUE, conf.Name, c.Id(), t.name, k, v))
+			}
+		}
+		return metadataBatch(c, buff)
+
+	case "SET":
+		if len(params) < 1 {
+			return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "METADATA")
+		}
+		k := params[0]
+		if !metadata.ValidKey(k) {
+			s.stdReply(c, FAIL, "METADATA", "KEY_INVALID", k, "Invalid key")
+			return nil
+		}
+		if !t.changeableBy(c) {
+			s.stdReply(c, FAIL, "METADATA", "KEY_NO_PERMISSION", t.name+" "+k, "You do not have permission to set this key")
+			return nil
+		}
+
+		if len(params) < 2 {
+			if store.Delete(k) {
+				s.metadataChanged(c, t, k, "", false)
+			}
+			return prepMessage(RPL_KEYNOTSET, conf.Name, c.Id(), t.name, k)
+		}
+
+		v := params[1]
+		if len(v) > conf.Limits.Metadata.ValueBytes {
+			s.stdReply(c, FAIL, "METADATA", "VALUE_INVALID", "", "Value is too long")
+			return nil
+		}
+		if _, ok := store.Get(k); !ok && store.Len() >= conf.Limits.Metadata.Keys {
+			s.stdReply(c, FAIL, "METADATA", "LIMIT_REACHED", t.name, "Metadata limit reached")
+			return nil
+		}
+		store.Set(k, v)
+		s.metadataChanged(c, t, k, v, true)
+		return prepMessage(RPL_KEYVALUE, conf.Name, c.Id(), t.name, k, v)
+
+	case "CLEAR":
+		if !t.changeableBy(c) {
+			s.stdReply(c, FAIL, "METADATA", "KEY_NO_PERMISSION", t.name+" *", "You do not have permission to set this key")
+			return nil
+		}
+		buff := &msg.Buffer{}
+		for _, k := range store.Clear() {
+			s.metadataChanged(c, t, k, "", false)
+			buff.AddMsg(prepMessage(RPL_KEYNOTSET, conf.Name, c.Id(), t.name, k))
+		}
+		return metadataBatch(c, buff)
+
+	default: // SYNC
+		buff := s.subscribedMetadata(c, t.name, store)
+		if t.ch != nil {
+			t.ch.ForAllMembers(func(m *channel.Member) {
+				buff.AddMsg(s.subscribedMetadata(c, m.Nick, &m.Metadata))
+			})
+		}
+		return metadataBatch(c, buff)
+	}
+}
+
+// A metadataTarget is the user or channel whose metadata is being
+// read or changed
+type metadataTarget struct {
+	name   string
+	client *client.Client
+	ch     *channel.Channel
+}
+
+func (t metadataTarget) store() *metadata.Store {
+	if t.ch != nil {
+		return &t.ch.Metadata
+	}
+	return &t.client.Metadata
+}
+
+// changeableBy returns true if c can change t's metadata. Users can
+// change their own, and channel operators can change their channel's.
+func (t metadataTarget) changeableBy(c *client.Client) bool {
+	if c.Is(client.Op) || t.client == c {
+		return true
+	}
+	if t.ch != nil {
+		self, _ := t.ch.GetMember(c.Nick)
+		return self != nil && self.HasRank(channel.Operator)
+	}
+	return false
+}
+
+// metadataTarget finds the user or channel named by target, where "*"
+// means c itself
+func (s *Server) metadataTarget(c *client.Client, target string) (metadataTarget, bool) {
+	if target == "*" {
+		return metadataTarget{name: c.Nick, client: c}, true
+	}
+	if isValidChannelString(target) {
+		ch, ok := s.getChannel(target)
+		if !ok {
+			return metadataTarget{}, false
+		}
+		return metadataTarget{name: ch.String(), ch: ch}, true
+	}
+	other, ok := s.getClient(target)
+	if !ok {
+		return metadataTarget{}, false
+	}
+	return metadataTarget{name: other.Nick, client: other}, true
+}
+
+// metadataChanged saves a change to the metadata of t that c made, and
+// tells the clients who are subscribed to k. If set is false, k was
+// removed.
+func (s *Server) metadataChanged(c *client.Client, t metadataTarget, k, v string, set bool) {
+	// a logged in user's metadata belongs to their account; a registered
+	// channel's is saved with the rest of its state
+	if t.ch != nil {
+		if err := s.saveChannel(s.db, t.ch); err != nil {
+			log.Println("could not save metadata:", err)
+		}
+	}
+	if t.client != nil && t.client.IsAuthenticated {
+		account := strings.ToLower(t.client.SASLMech.Authn())
+		var err error
+		if set {
+			_, err = s.db.Exec(`INSERT INTO account_metadata(username, key, value) VALUES(?, ?, ?)
+				ON CONFLICT(username, key) DO UPDATE SET value=excluded.value`, account, k, v)
+		} else {
+			_, err = s.db.Exec("DELETE FROM account_metadata WHERE username=? AND key=?", account, k)
+		}
+		if err != nil {
+			log.Println("could not save metadata:", err)
+		}
+	}
+
+	params := []string{t.name, k, "*"}
+	if set {
+		params = append(params, v)
+	}
+	change := msg.New(nil, c.Nick, c.User, c.Host, "METADATA", params, set)
+
+	told := map[*client.Client]bool{c: true}
+	tell := func(to *client.Client) {
+		if told[to] || !to.HasCap(cap.Metadata.Name) || !to.MetadataSubs.Has(k) {
+			return
+		}
+		told[to] = true
+		to.WriteMessage(change.Copy())
+	}
+
+	if t.ch != nil {
+		t.ch.ForAllMembers(func(m *channel.Member) { tell(m.Client) })
+		return
+	}
+
+	// users are told when somebody else changes their metadata
+	if t.client != c && t.client.HasCap(cap.Metadata.Name) {
+		told[t.client] = true
+		t.client.WriteMessage(change.Copy())
+	}
+	for _, ch := range s.channelsOf(t.client) {
+		ch.ForAllMembers(func(m *channel.Member) { tell(m.Client) })
+	}
+}
+
+// subscribedMetadata returns a METADATA message for each of the keys of
+// name's metadata that c is subscribed to
+func (s *Server) subscribedMetadata(c *client.Client, name string, store *metadata.Store) *msg.Buffer {
+	buff := &msg.Buffer{}
+	for _, k := range c.MetadataSubs.Keys() {
+		if v, ok := store.Get(k); ok {
+			buff.AddMsg(msg.New(nil, s.Config().Name, "", "", "METADATA", []string{name, k, "*", v}, true))
+		}
+	}
+	return buff
+}
+
+// metadataOnJoin tells c about the metadata of ch and its members after
+// it has joined ch, and tells the other members about c's metadata
+func (s *Server) metadataOnJoin(c *client.Client, ch *channel.Channel) msg.Msg {
+	buff := &msg.Buffer{}
+	if c.HasCap(cap.Metadata.Name) {
+		buff.AddMsg(s.subscribedMetadata(c, ch.String(), &ch.Metadata))
+	}
+
+	ch.ForAllMembersExcept(c, func(m *channel.Member) {
+		if c.HasCap(cap.Metadata.Name) {
+			buff.AddMsg(s.subscribedMetadata(c, m.Nick, &m.Metadata))
+		}
+		if m.HasCap(cap.Metadata.Name) {
+			if theirs := s.subscribedMetadata(m.Client, c.Nick, &c.Metadata); theirs.Len() > 0 {
+				m.WriteMessage(metadataBatch(m.Client, theirs))
+			}
+		}
+	})
+
+	if buff.Len() == 0 {
+		return nil
+	}
+	return metadataBatch(c, buff)
+}
+
+func (s *Server) subscribe(c *client.Client, keys []string) msg.Msg {
+	var added []string
+	for _, k := range keys {
+		if !metadata.ValidKey(k) {
+			s.stdReply(c, FAIL, "METADATA", "KEY_INVALID", k, "Invalid key")
+			continue
+		}
+		if !c.MetadataSubs.Has(k) && c.MetadataSubs.Len() >= s.Config().Limits.Metadata.Subs {
+			s.stdReply(c, FAIL, "METADATA", "TOO_MANY_SUBS", k, "Too many subscriptions")
+			break
+		}
+		c.MetadataSubs.Add(k)
+		added = append(added, k)
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+	return s.keyList(c, RPL_METADATASUBOK, added)
+}
+
+func (s *Server) unsubscribe(c *client.Client, keys []string) msg.Msg {
+	var removed []string
+	for _, k := range keys {
+		if !metadata.ValidKey(k) {
+			s.stdReply(c, FAIL, "METADATA", "KEY_INVALID", k, "Invalid key")
+			continue
+		}
+		c.MetadataSubs.Remove(k)
+		removed = append(removed, k)
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+	return s.keyList(c, RPL_METADATAUNSUBOK, removed)
+}
+
+// keyList returns reply with keys, split over as many replies as it
+// takes
+func (s *Server) keyList(c *client.Client, reply *msg.Message, keys []string) msg.Msg {
+	return msg.SplitList(keys, " ", 0, func(list string) *msg.Message {
+		return prepMessage(reply, s.Config().Name, c.Id(), list)
+	})
+}
+
+// loadAccountMetadata gives c the metadata that is saved for its
+// account
+func (s *Server) loadAccountMetadata(c *client.Client) {
+	rows, err := s.db.Query("SELECT key, value FROM account_metadata WHERE username=?", strings.ToLower(c.SASLMech.Authn()))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var k, v string
+		if rows.Scan(&k, &v) == nil {
+			c.Metadata.Set(k, v)
+		}
+	}
+}
+
+// metadataBatch groups the replies in buff into a metadata batch if c
+// supports batches
+func metadataBatch(c *client.Client, buff *msg.Buffer) msg.Msg {
+	if buff.Len() == 0 {
+		return nil
+	}
+	if c.HasCap(cap.Batch.Name) {
+		return buff.WrapInBatch(msg.Metadata)
+	}
+	return buff
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mitchr/gossip/sasl/plain"
+)
+
+func TestMETADATA(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.Limits.Metadata.Keys = 2
+	conf.Limits.Metadata.ValueBytes = 16
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	a, aResp := connectAndRegister("a")
+	defer a.Close()
+	a.Write([]byte("CAP REQ draft/metadata-2\r\n"))
+	readLines(aResp, 1)
+	b, bResp := connectAndRegister("b")
+	defer b.Close()
+	b.Write([]byte("CAP REQ draft/metadata-2\r\n"))
+	readLines(bResp, 1)
+
+	t.Run("SetAndGet", func(t *testing.T) {
+		a.Write([]byte("METADATA * SET display-name :Alice A\r\n"))
+		resp, _ := aResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 761 a a display-name * :Alice A\r\n", t)
+
+		b.Write([]byte("METADATA a GET display-name avatar\r\n"))
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 761 b a display-name * :Alice A\r\n", t)
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 766 b a avatar :key not set\r\n", t)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		a.Write([]byte("METADATA * SET Bad!Key :x\r\n"))
+		resp, _ := aResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL METADATA KEY_INVALID Bad!Key :Invalid key\r\n", t)
+
+		a.Write([]byte("METADATA * SET avatar :https://example.com/a.png\r\n"))
+		resp, _ = aResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL METADATA VALUE_INVALID :Value is too long\r\n", t)
+
+		a.Write([]byte("METADATA * SET avatar :a.png\r\nMETADATA * SET website :a.com\r\n"))
+		readLines(aResp, 1)
+		resp, _ = aResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL METADATA LIMIT_REACHED a :Metadata limit reached\r\n", t)
+
+		b.Write([]byte("METADATA a SET avatar :b.png\r\n"))
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL METADATA KEY_NO_PERMISSION a avatar :You do not have permission to set this key\r\n", t)
+
+		b.Write([]byte("METADATA #nowhere LIST\r\n"))
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL METADATA INVALID_TARGET #nowhere :Invalid target\r\n", t)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		b.Write([]byte("METADATA a LIST\r\n"))
+		resp, _ := bResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 761 b a avatar * :a.png\r\n", t)
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 761 b a display-name * :Alice A\r\n", t)
+	})
+
+	t.Run("Subscriptions", func(t *testing.T) {
+		b.Write([]byte("METADATA * SUB avatar Bad!Key\r\n"))
+		resp, _ := bResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL METADATA KEY_INVALID Bad!Key :Invalid key\r\n", t)
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 770 b :avatar\r\n", t)
+
+		// b learns about a's avatar when they come to share a channel
+		a.Write([]byte("JOIN #test\r\n"))
+		readLines(aResp, 3)
+		b.Write([]byte("JOIN #test\r\n"))
+		resp, _ = readLines(bResp, 4)
+		assertResponse(resp, ":gossip METADATA a avatar * :a.png\r\n", t)
+		readLines(aResp, 1)
+
+		a.Write([]byte("METADATA * SET avatar :new.png\r\n"))
+		readLines(aResp, 1)
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":a!a@localhost METADATA a avatar * :new.png\r\n", t)
+
+		// changes to keys that b hasn't subscribed to aren't sent
+		a.Write([]byte("METADATA * SET display-name\r\n"))
+		resp, _ = aResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 766 a a display-name :key not set\r\n", t)
+
+		b.Write([]byte("METADATA * SUBS\r\n"))
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 772 b :avatar\r\n", t)
+	})
+
+	t.Run("Channel", func(t *testing.T) {
+		b.Write([]byte("METADATA #test SET icon :x.png\r\n"))
+		resp, _ := bResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL METADATA KEY_NO_PERMISSION #test icon :You do not have permission to set this key\r\n", t)
+
+		a.Write([]byte("METADATA #test SET icon :x.png\r\n"))
+		resp, _ = aResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 761 a #test icon * :x.png\r\n", t)
+
+		b.Write([]byte("METADATA #test GET icon\r\n"))
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 761 b #test icon * :x.png\r\n", t)
+	})
+}
+
+func TestMETADATAPersistsForAccount(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	plainCred := plain.NewCredential("alice", "pass")
+	s.persistPlain(plainCred.Username, "alice", plainCred.Pass)
+
+	alice, aliceResp := login("alice", "draft/metadata-2")
+	alice.Write([]byte("METADATA * SET avatar :a.png\r\nQUIT\r\n"))
+	readLines(aliceResp, 2)
+	alice.Close()
+
+	alice, aliceResp = login("alice", "draft/metadata-2")
+	defer alice.Close()
+	alice.Write([]byte("METADATA * GET avatar\r\n"))
+	resp, _ := aliceResp.ReadBytes('\n')
+	assertResponse(resp, ":gossip 761 alice alice avatar * :a.png\r\n", t)
+
+	// logging out leaves the account's metadata behind
+	alice.Write([]byte("LOGOUT\r\nMETADATA * GET avatar\r\n"))
+	for {
+		resp, _ = aliceResp.ReadBytes('\n')
+		if strings.Contains(string(resp), " 766 ") || strings.Contains(string(resp), " 761 ") {
+			break
+		}
+	}
+	assertResponse(resp, ":gossip 766 alice alice avatar :key not set\r\n", t)
+}
+
+func TestMETADATAPersistsForRegisteredChannel(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	s.persistChan("a", "#test")
+
+	a, aResp := connectAndRegister("a")
+	defer a.Close()
+	a.Write([]byte("JOIN #test\r\nMETADATA #test SET icon :x.png\r\n"))
+	readLines(aResp, 4)
+
+	var b []byte
+	if err := s.db.QueryRow("SELECT state FROM channel_state WHERE chan='#test'").Scan(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"icon":"x.png"`) {
+		t.Errorf("metadata was not saved: %s", b)
+	}
+}
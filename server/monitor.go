@@ -75,15 +75,16 @@ func (m *monitor) clear(c string) {
 }
 
 func MONITOR(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
 	if len(m.Params) < 1 {
-		return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "MONITOR")
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "MONITOR")
 	}
 
 	modifier := m.Params[0]
 	switch modifier {
 	case "+":
 		if len(m.Params) < 2 {
-			return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "MONITOR")
+			return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "MONITOR")
 		}
 
 		targets := strings.Split(m.Params[1], ",")
@@ -97,7 +98,7 @@ func MONITOR(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		}
 	case "-":
 		if len(m.Params) < 2 {
-			return prepMessage(ERR_NEEDMOREPARAMS, s.Name, c.Id(), "MONITOR")
+			return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "MONITOR")
 		}
 
 		targets := strings.Split(m.Params[1], ",")
@@ -109,8 +110,7 @@ func MONITOR(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 	case "L":
 		l := s.monitor.list(c.Nick)
 		if len(l) != 0 {
-			// TODO: split this into multiple RPL_MONLIST if they go over the line length limit
-			s.writeReply(c, RPL_MONLIST, strings.Join(l, ","))
+			s.writeList(c, RPL_MONLIST, l)
 		}
 		s.writeReply(c, RPL_ENDOFMONLIST)
 	case "S":
@@ -127,10 +127,10 @@ func MONITOR(s *Server, c *client.Client, m *msg.Message) msg.Msg {
 		}
 
 		if len(on) != 0 {
-			s.writeReply(c, RPL_MONONLINE, strings.Join(on, ","))
+			s.writeList(c, RPL_MONONLINE, on)
 		}
 		if len(off) != 0 {
-			s.writeReply(c, RPL_MONOFFLINE, strings.Join(off, ","))
+			s.writeList(c, RPL_MONOFFLINE, off)
 		}
 	}
 	return nil
@@ -145,8 +145,8 @@ func (s *Server) notify(c *client.Client, m *msg.Message, extended capability.Ca
 		if !ok {
 			continue
 		}
-		_, hasExtendedMonitor := observer.Caps[capability.ExtendedMonitor.Name]
-		_, hasExtendedCapability := observer.Caps[extended.Name]
+		hasExtendedMonitor := observer.HasCap(capability.ExtendedMonitor.Name)
+		hasExtendedCapability := observer.HasCap(extended.Name)
 		if extended != capability.None && (!hasExtendedMonitor || !hasExtendedCapability) {
 			continue
 		}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -20,9 +22,9 @@ func TestMONITOR(t *testing.T) {
 		resp1, _ := r.ReadBytes('\n')
 		resp2, _ := r.ReadBytes('\n')
 		resp3, _ := r.ReadBytes('\n')
-		assertResponse(resp1, prepMessage(ERR_NEEDMOREPARAMS, s.Name, "alice", "MONITOR").String(), t)
-		assertResponse(resp2, prepMessage(ERR_NEEDMOREPARAMS, s.Name, "alice", "MONITOR").String(), t)
-		assertResponse(resp3, prepMessage(ERR_NEEDMOREPARAMS, s.Name, "alice", "MONITOR").String(), t)
+		assertResponse(resp1, prepMessage(ERR_NEEDMOREPARAMS, s.Config().Name, "alice", "MONITOR").String(), t)
+		assertResponse(resp2, prepMessage(ERR_NEEDMOREPARAMS, s.Config().Name, "alice", "MONITOR").String(), t)
+		assertResponse(resp3, prepMessage(ERR_NEEDMOREPARAMS, s.Config().Name, "alice", "MONITOR").String(), t)
 	})
 
 	on, _ := connectAndRegister("online")
@@ -32,7 +34,7 @@ func TestMONITOR(t *testing.T) {
 		c.Write([]byte("MONITOR + online\r\n"))
 		monline, _ := r.ReadBytes('\n')
 
-		assertResponse(monline, prepMessage(RPL_MONONLINE, s.Name, "alice", "online!online@localhost").String(), t)
+		assertResponse(monline, prepMessage(RPL_MONONLINE, s.Config().Name, "alice", "online!online@localhost").String(), t)
 	})
 
 	t.Run("TestMONITORL", func(t *testing.T) {
@@ -40,48 +42,77 @@ func TestMONITOR(t *testing.T) {
 		monlist, _ := r.ReadBytes('\n')
 		monend, _ := r.ReadBytes('\n')
 
-		assertResponse(monlist, prepMessage(RPL_MONLIST, s.Name, "alice", "online").String(), t)
-		assertResponse(monend, prepMessage(RPL_ENDOFMONLIST, s.Name, "alice").String(), t)
+		assertResponse(monlist, prepMessage(RPL_MONLIST, s.Config().Name, "alice", "online").String(), t)
+		assertResponse(monend, prepMessage(RPL_ENDOFMONLIST, s.Config().Name, "alice").String(), t)
 	})
 
 	t.Run("TestMONITOR+offline", func(t *testing.T) {
 		c.Write([]byte("MONITOR + offline\r\n"))
 		moffline, _ := r.ReadBytes('\n')
-		assertResponse(moffline, prepMessage(RPL_MONOFFLINE, s.Name, "alice", "offline").String(), t)
+		assertResponse(moffline, prepMessage(RPL_MONOFFLINE, s.Config().Name, "alice", "offline").String(), t)
 	})
 
 	t.Run("TestMONITORS", func(t *testing.T) {
 		c.Write([]byte("MONITOR S\r\n"))
 		monline, _ := r.ReadBytes('\n')
 		moffline, _ := r.ReadBytes('\n')
-		assertResponse(monline, prepMessage(RPL_MONONLINE, s.Name, "alice", "online!online@localhost").String(), t)
-		assertResponse(moffline, prepMessage(RPL_MONOFFLINE, s.Name, "alice", "offline").String(), t)
+		assertResponse(monline, prepMessage(RPL_MONONLINE, s.Config().Name, "alice", "online!online@localhost").String(), t)
+		assertResponse(moffline, prepMessage(RPL_MONOFFLINE, s.Config().Name, "alice", "offline").String(), t)
 	})
 
 	off, r2 := connectAndRegister("offline")
 	t.Run("TestNotifyOn", func(t *testing.T) {
 		onNotif, _ := r.ReadBytes('\n')
-		assertResponse(onNotif, prepMessage(RPL_MONONLINE, s.Name, "*", "offline!offline@localhost").String(), t)
+		assertResponse(onNotif, prepMessage(RPL_MONONLINE, s.Config().Name, "*", "offline!offline@localhost").String(), t)
 	})
 
 	t.Run("TestNotifyOff", func(t *testing.T) {
 		off.Close()
 		r2.ReadBytes('\n')
 		offNotif, _ := r.ReadBytes('\n')
-		assertResponse(offNotif, prepMessage(RPL_MONOFFLINE, s.Name, "*", "offline").String(), t)
+		assertResponse(offNotif, prepMessage(RPL_MONOFFLINE, s.Config().Name, "*", "offline").String(), t)
 	})
 
 	t.Run("TestMONITOR-", func(t *testing.T) {
 		c.Write([]byte("MONITOR - online\r\nMONITOR L\r\n"))
 		monlist, _ := r.ReadBytes('\n')
 		monend, _ := r.ReadBytes('\n')
-		assertResponse(monlist, prepMessage(RPL_MONLIST, s.Name, "alice", "offline").String(), t)
-		assertResponse(monend, prepMessage(RPL_ENDOFMONLIST, s.Name, "alice").String(), t)
+		assertResponse(monlist, prepMessage(RPL_MONLIST, s.Config().Name, "alice", "offline").String(), t)
+		assertResponse(monend, prepMessage(RPL_ENDOFMONLIST, s.Config().Name, "alice").String(), t)
 	})
 
 	t.Run("TestMONITORC", func(t *testing.T) {
 		c.Write([]byte("MONITOR C\r\nMONITOR L\r\n"))
 		monend, _ := r.ReadBytes('\n')
-		assertResponse(monend, prepMessage(RPL_ENDOFMONLIST, s.Name, "alice").String(), t)
+		assertResponse(monend, prepMessage(RPL_ENDOFMONLIST, s.Config().Name, "alice").String(), t)
+	})
+
+	t.Run("TestMONITORLSplit", func(t *testing.T) {
+		nicks := make([]string, 60)
+		for i := range nicks {
+			nicks[i] = fmt.Sprintf("watched%02d", i)
+		}
+		c.Write([]byte("MONITOR + " + strings.Join(nicks[:30], ",") + "\r\n"))
+		c.Write([]byte("MONITOR + " + strings.Join(nicks[30:], ",") + "\r\n"))
+		readLines(r, 60)
+
+		c.Write([]byte("MONITOR L\r\n"))
+		listed := 0
+		lines := 0
+		for {
+			resp, _ := r.ReadBytes('\n')
+			if len(resp) > 512 {
+				t.Error("reply is too long:", len(resp))
+			}
+			m := string(resp)
+			if strings.Contains(m, " 733 ") {
+				break
+			}
+			lines++
+			listed += strings.Count(m, ",") + 1
+		}
+		if lines < 2 || listed != len(nicks) {
+			t.Errorf("expected %d targets over several replies, got %d in %d", len(nicks), listed, lines)
+		}
 	})
 }
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	cap "github.com/mitchr/gossip/capability"
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// marks a line of a multiline batch that continues the line before it,
+// rather than starting a new one
+const concatTag = "draft/multiline-concat"
+
+// A multiline is a draft/multiline batch that a client has opened. Its
+// lines are held until the client closes the batch, and are then sent
+// all at once.
+// https://ircv3.net/specs/extensions/multiline
+type multiline struct {
+	id, target string
+	// the client-only tags that the batch was opened with
+	tags []msg.Tag
+
+	// either PRIVMSG or NOTICE, decided by the first line
+	command string
+	lines   []multilineLine
+	// the total length of the lines' text
+	bytes int
+
+	// if set, the batch is rejected with this error once it closes
+	err *batchError
+}
+
+type multilineLine struct {
+	tags   []msg.Tag
+	text   string
+	concat bool
+}
+
+type batchError struct{ code, context, description string }
+
+// BATCH is only accepted from clients to send draft/multiline batches
+//
+//	BATCH +<reference> draft/multiline <target>
+//	BATCH -<reference>
+func BATCH(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
+	if len(m.Params) < 1 || len(m.Params[0]) < 2 {
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "BATCH")
+	}
+
+	id := m.Params[0][1:]
+	switch m.Params[0][0] {
+	case '+':
+		if len(m.Params) < 3 {
+			return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "BATCH")
+		}
+		if m.Params[1] != string(msg.Multiline) || !c.HasCap(cap.Multiline.Name) {
+			s.stdReply(c, FAIL, "BATCH", "UNKNOWN_TYPE", m.Params[1], "Unsupported batch type")
+			return nil
+		}
+
+		target := m.Params[2]
+		if strings.Contains(target, ",") {
+			s.stdReply(c, FAIL, "BATCH", "MULTILINE_INVALID_TARGET", target, "Multiline batches can only have one target")
+			return nil
+		}
+
+		tagged := m.Copy()
+		tagged.TrimNonClientTags()
+		if !s.openBatch(c, &multiline{id: id, target: target, tags: tagged.Tags()}) {
+			s.stdReply(c, FAIL, "BATCH", "MULTILINE_INVALID", "", "A multiline batch is already open")
+		}
+		return nil
+
+	case '-':
+		b := s.takeBatch(c, id)
+		if b == nil {
+			s.stdReply(c, FAIL, "BATCH", "MULTILINE_INVALID", "", "No such batch is open")
+			return nil
+		}
+		if b.err == nil && len(b.lines) == 0 {
+			b.err = &batchError{"MULTILINE_INVALID", "", "Multiline batch is empty"}
+		}
+		if b.err != nil {
+			s.stdReply(c, FAIL, "BATCH", b.err.code, b.err.context, b.err.description)
+			return nil
+		}
+		return s.sendMultiline(c, b)
+
+	default:
+		s.stdReply(c, FAIL, "BATCH", "MULTILINE_INVALID", "", "Batch reference must start with + or -")
+		return nil
+	}
+}
+
+// openBatch makes b the open batch of c, unless c already has one
+func (s *Server) openBatch(c *client.Client, b *multiline) bool {
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+
+	if _, ok := s.batches[c]; ok {
+		return false
+	}
+	s.batches[c] = b
+	return true
+}
+
+// takeBatch closes the batch that c opened with id, and returns it
+func (s *Server) takeBatch(c *client.Client, id string) *multiline {
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+
+	b := s.batches[c]
+	if b == nil || b.id != id {
+		return nil
+	}
+	delete(s.batches, c)
+	return b
+}
+
+// forgetBatch throws away any batch that c has open
+func (s *Server) forgetBatch(c *client.Client) {
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+	delete(s.batches, c)
+}
+
+// addToBatch adds m to the batch that c has open, if m is tagged as
+// belonging to it. It returns false if m should be executed as usual.
+func (s *Server) addToBatch(c *client.Client, m *msg.Message) bool {
+	conf := s.Config()
+	inBatch, id := m.HasTag("batch")
+	if !inBatch {
+		return false
+	}
+
+	s.batchLock.Lock()
+	b := s.batches[c]
+	s.batchLock.Unlock()
+	if b == nil || b.id != id {
+		return false
+	}
+
+	b.add(m, conf.Limits.Multiline.Bytes, conf.Limits.Multiline.Lines)
+	return true
+}
+
+// add appends m to the batch. Once the batch is found to be invalid,
+// nothing more is added to it.
+func (b *multiline) add(m *msg.Message, maxBytes, maxLines int) {
+	if b.err != nil {
+		return
+	}
+
+	command := strings.ToUpper(m.Command)
+	if (command != "PRIVMSG" && command != "NOTICE") || (b.command != "" && command != b.command) {
+		b.err = &batchError{"MULTILINE_INVALID", "", "Multiline batches can only contain PRIVMSG or NOTICE, but not both"}
+		return
+	}
+	if len(m.Params) < 2 || !strings.EqualFold(m.Params[0], b.target) {
+		b.err = &batchError{"MULTILINE_INVALID_TARGET", b.target, "Every line must be sent to the batch's target"}
+		return
+	}
+
+	text := m.Params[1]
+	concat, _ := m.HasTag(concatTag)
+	if concat && text == "" {
+		b.err = &batchError{"MULTILINE_INVALID", "", "Blank lines cannot be concatenated"}
+		return
+	}
+
+	if len(b.lines)+1 > maxLines {
+		b.err = &batchError{"MULTILINE_MAX_LINES", strconv.Itoa(maxLines), "Multiline batch max-lines exceeded"}
+		return
+	}
+	if b.bytes+len(text) > maxBytes {
+		b.err = &batchError{"MULTILINE_MAX_BYTES", strconv.Itoa(maxBytes), "Multiline batch max-bytes exceeded"}
+		return
+	}
+
+	tagged := m.Copy()
+	tagged.TrimNonClientTags()
+	b.command = command
+	b.bytes += len(text)
+	b.lines = append(b.lines, multilineLine{tagged.Tags(), text, concat})
+}
+
+// sendMultiline delivers the batch b that c has closed
+func (s *Server) sendMultiline(c *client.Client, b *multiline) msg.Msg {
+	// a session sends the batch on behalf of its always-on client
+	from := c
+	if a := c.AttachedTo(); a != nil {
+		from = a
+	}
+	msgid := uuid.NewString()
+
+	reply, delivered := s.sendTo(from, b.target, b.command == "NOTICE", func(to *client.Client) {
+		to.WriteMessageFrom(b.render(from, to, msgid), from)
+	})
+	if !delivered {
+		return reply
+	}
+	chanName, _ := s.stripStatus(b.target)
+	s.sent.add(msgid, from, chanName)
+
+	for _, v := range from.Sessions() {
+		if v == c {
+			continue
+		}
+		if !v.HasMessageTags() {
+			v.WriteMessage(b.render(from, v, msgid).RemoveAllTags())
+			continue
+		}
+		v.WriteMessage(b.render(from, v, msgid))
+	}
+
+	if !c.HasCap(cap.EchoMessage.Name) {
+		return nil
+	}
+	if !c.HasMessageTags() {
+		return b.render(from, c, msgid).RemoveAllTags()
+	}
+	return b.render(from, c, msgid)
+}
+
+// render produces the messages that to is sent for the batch. Clients
+// that support multiline get the batch itself, and anyone else gets
+// its lines as separate messages.
+func (b *multiline) render(from, to *client.Client, msgid string) msg.Msg {
+	group := b.messages(from, msgid)
+	if !supportsMultiline(to) {
+		group = unbatch(group)
+	}
+
+	buff := &msg.Buffer{}
+	for _, v := range group {
+		buff.AddMsg(v)
+	}
+	return buff
+}
+
+// messages produces the batch as it is sent by from, with a new
+// reference tag
+func (b *multiline) messages(from *client.Client, msgid string) []*msg.Message {
+	ref := uuid.NewString()
+
+	open := msg.New(b.tags, from.Nick, from.User, from.Host, "BATCH", []string{"+" + ref, string(msg.Multiline), b.target}, false)
+	open.AddTag("msgid", msgid)
+	group := []*msg.Message{open}
+
+	for _, v := range b.lines {
+		line := msg.New(append([]msg.Tag{{Key: "batch", Value: ref}}, v.tags...), from.Nick, from.User, from.Host, b.command, []string{b.target, v.text}, true)
+		if v.concat {
+			line.AddTag(concatTag, "")
+		}
+		group = append(group, line)
+	}
+
+	return append(group, msg.New(nil, from.Nick, from.User, from.Host, "BATCH", []string{"-" + ref}, false))
+}
+
+func supportsMultiline(c *client.Client) bool {
+	return c.HasCap(cap.Multiline.Name) && c.HasCap(cap.Batch.Name) && c.HasMessageTags()
+}
+
+// unbatch turns a multiline batch into the separate messages that are
+// sent to clients that don't support multiline. Every line, concatenated
+// or not, is sent as its own message, so none of it is lost to the line
+// length limit; blank lines are left out, since they can't be sent on
+// their own. Each message keeps the batch's client-only tags, and the
+// first one takes its msgid.
+func unbatch(group []*msg.Message) []*msg.Message {
+	open := group[0]
+
+	var batchTags []msg.Tag
+	for _, v := range open.Tags() {
+		if v.ClientPrefix {
+			batchTags = append(batchTags, v)
+		}
+	}
+
+	var lines []*msg.Message
+	for _, v := range group[1 : len(group)-1] {
+		line := msg.New(append(append([]msg.Tag(nil), batchTags...), v.Tags()...), v.Nick, v.User, v.Host, v.Command, v.Params, true).Copy()
+		line.RemoveTag("batch")
+		line.RemoveTag(concatTag)
+		lines = append(lines, line)
+	}
+
+	messages := lines[:0]
+	for _, v := range lines {
+		if v.Params[1] != "" {
+			messages = append(messages, v)
+		}
+	}
+	if hasMsgid, msgid := open.HasTag("msgid"); hasMsgid && len(messages) > 0 {
+		messages[0].AddTag("msgid", msgid)
+	}
+	return messages
+}
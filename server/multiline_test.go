@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// readBatch reads a multiline batch, returning the reference that it
+// was opened with and the lines that it contained
+func readBatch(t *testing.T, r *bufio.Reader) (string, []string) {
+	t.Helper()
+
+	start, _ := r.ReadString('\n')
+	fields := strings.Fields(start)
+	if len(fields) < 5 || fields[2] != "BATCH" || fields[4] != "draft/multiline" || !strings.Contains(fields[0], "msgid=") {
+		t.Fatal("expected multiline batch, got", start)
+	}
+	ref := fields[3][1:]
+
+	var lines []string
+	for {
+		line, _ := r.ReadString('\n')
+		if strings.HasSuffix(line, " BATCH -"+ref+"\r\n") {
+			return ref, lines
+		}
+		if !strings.HasPrefix(line, "@batch="+ref) {
+			t.Fatal("expected line in batch, got", line)
+		}
+		lines = append(lines, line[strings.Index(line, " ")+1:])
+	}
+}
+
+func TestMultiline(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	capable := func(nick string) (net.Conn, *bufio.Reader) {
+		c, r := connectAndRegister(nick)
+		c.Write([]byte("CAP REQ :batch message-tags draft/multiline echo-message\r\n"))
+		r.ReadBytes('\n')
+		return c, r
+	}
+
+	a, aResp := capable("a")
+	defer a.Close()
+	b, bResp := capable("b")
+	defer b.Close()
+	c, cResp := connectAndRegister("c")
+	defer c.Close()
+
+	send := func(target string) {
+		a.Write([]byte("BATCH +1 draft/multiline " + target + "\r\n" +
+			"@batch=1 PRIVMSG " + target + " :hello\r\n" +
+			"@batch=1;draft/multiline-concat PRIVMSG " + target + " :, world\r\n" +
+			"@batch=1 PRIVMSG " + target + " :\r\n" +
+			"@batch=1;+draft/reply=x PRIVMSG " + target + " :bye\r\n" +
+			"BATCH -1\r\n"))
+	}
+	expected := []string{
+		":a!a@localhost PRIVMSG b :hello\r\n",
+		":a!a@localhost PRIVMSG b :, world\r\n",
+		":a!a@localhost PRIVMSG b :\r\n",
+		":a!a@localhost PRIVMSG b :bye\r\n",
+	}
+
+	t.Run("Capable", func(t *testing.T) {
+		send("b")
+
+		_, lines := readBatch(t, bResp)
+		if len(lines) != len(expected) {
+			t.Fatal("expected 4 lines, got", lines)
+		}
+		for i := range expected {
+			if lines[i] != expected[i] {
+				t.Errorf("expected %q, got %q", expected[i], lines[i])
+			}
+		}
+
+		// the sender is shown the batch as well
+		_, echoed := readBatch(t, aResp)
+		if len(echoed) != len(expected) {
+			t.Error("expected echo of 4 lines, got", echoed)
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		send("c")
+		_, echoed := readBatch(t, aResp)
+		if len(echoed) != len(expected) {
+			t.Error("expected echo of 4 lines, got", echoed)
+		}
+
+		// every line is sent on its own, and blank lines are left out
+		resp, _ := cResp.ReadBytes('\n')
+		assertResponse(resp, ":a!a@localhost PRIVMSG c :hello\r\n", t)
+		resp, _ = cResp.ReadBytes('\n')
+		assertResponse(resp, ":a!a@localhost PRIVMSG c :, world\r\n", t)
+		resp, _ = cResp.ReadBytes('\n')
+		assertResponse(resp, ":a!a@localhost PRIVMSG c :bye\r\n", t)
+	})
+
+	t.Run("Channel", func(t *testing.T) {
+		a.Write([]byte("JOIN #test\r\n"))
+		readLines(aResp, 3)
+		b.Write([]byte("JOIN #test\r\n"))
+		readLines(bResp, 3)
+		readLines(aResp, 1)
+		c.Write([]byte("JOIN #test\r\n"))
+		readLines(cResp, 3)
+		readLines(aResp, 1)
+		readLines(bResp, 1)
+
+		a.Write([]byte("BATCH +2 draft/multiline #test\r\n@batch=2 PRIVMSG #test :one\r\n@batch=2 PRIVMSG #test :two\r\nBATCH -2\r\n"))
+		_, lines := readBatch(t, bResp)
+		if len(lines) != 2 || lines[0] != ":a!a@localhost PRIVMSG #test :one\r\n" {
+			t.Error("unexpected batch", lines)
+		}
+		resp, _ := readLines(cResp, 2)
+		assertResponse(resp, ":a!a@localhost PRIVMSG #test :two\r\n", t)
+	})
+}
+
+func TestMultilineLimits(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.Limits.Multiline.Bytes = 10
+	conf.Limits.Multiline.Lines = 2
+	// every line of a batch counts towards the flood limit
+	conf.Flood.Burst = 100
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("a")
+	defer c.Close()
+	c.Write([]byte("CAP LS 302\r\nCAP REQ :batch message-tags draft/multiline\r\n"))
+	ls, _ := r.ReadString('\n')
+	if !strings.Contains(ls, " draft/multiline=max-bytes=10,max-lines=2 ") {
+		t.Error("expected multiline limits to be advertised, got", ls)
+	}
+	r.ReadBytes('\n')
+
+	tests := []struct {
+		name, batch, expected string
+	}{
+		{"MaxLines", "@batch=x PRIVMSG a :1\r\n@batch=x PRIVMSG a :2\r\n@batch=x PRIVMSG a :3\r\n", "FAIL BATCH MULTILINE_MAX_LINES 2 :Multiline batch max-lines exceeded\r\n"},
+		{"MaxBytes", "@batch=x PRIVMSG a :123456\r\n@batch=x PRIVMSG a :7890a\r\n", "FAIL BATCH MULTILINE_MAX_BYTES 10 :Multiline batch max-bytes exceeded\r\n"},
+		{"Target", "@batch=x PRIVMSG b :hi\r\n", "FAIL BATCH MULTILINE_INVALID_TARGET a :Every line must be sent to the batch's target\r\n"},
+		{"BlankConcat", "@batch=x;draft/multiline-concat PRIVMSG a :\r\n", "FAIL BATCH MULTILINE_INVALID :Blank lines cannot be concatenated\r\n"},
+		{"Mixed", "@batch=x PRIVMSG a :hi\r\n@batch=x NOTICE a :hi\r\n", "FAIL BATCH MULTILINE_INVALID :Multiline batches can only contain PRIVMSG or NOTICE, but not both\r\n"},
+		{"Empty", "", "FAIL BATCH MULTILINE_INVALID :Multiline batch is empty\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.Write([]byte("BATCH +x draft/multiline a\r\n" + tt.batch + "BATCH -x\r\nPING x\r\n"))
+			resp, _ := r.ReadBytes('\n')
+			assertResponse(resp, tt.expected, t)
+			readUntilPONG(r)
+		})
+	}
+
+	t.Run("MultipleTargets", func(t *testing.T) {
+		c.Write([]byte("BATCH +x draft/multiline a,b\r\n"))
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, "FAIL BATCH MULTILINE_INVALID_TARGET a,b :Multiline batches can only have one target\r\n", t)
+	})
+}
+
+func TestAlwaysOnMultiline(t *testing.T) {
+	s := newAlwaysOnServer(t)
+	defer s.Close()
+
+	// missed messages are kept in the form that alice's last session
+	// understood
+	alice, aliceResp := login("alice", "batch message-tags draft/multiline")
+	alice.Write([]byte("QUIT\r\n"))
+	readLines(aliceResp, 1)
+	alice.Close()
+
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("CAP REQ :batch message-tags draft/multiline\r\n"))
+	bobResp.ReadBytes('\n')
+	bob.Write([]byte("BATCH +1 draft/multiline alice\r\n@batch=1 PRIVMSG alice :one\r\n@batch=1 PRIVMSG alice :two\r\nBATCH -1\r\n"))
+
+	// the batch is replayed whole, inside of the chathistory batch
+	alice, aliceResp = login("alice", "batch message-tags draft/multiline")
+	defer alice.Close()
+
+	start, _ := aliceResp.ReadString('\n')
+	if !strings.HasPrefix(start, "BATCH +") || !strings.HasSuffix(start, " chathistory bob\r\n") {
+		t.Fatal("expected chathistory batch, got", start)
+	}
+	id := strings.Fields(start)[1][1:]
+
+	open, _ := aliceResp.ReadString('\n')
+	if !strings.Contains(open, "batch="+id) || !strings.Contains(open, " BATCH +") {
+		t.Fatal("expected nested multiline batch, got", open)
+	}
+	ref := strings.Fields(open)[3][1:]
+	for _, text := range []string{"one", "two"} {
+		line, _ := aliceResp.ReadString('\n')
+		if !strings.Contains(line, "batch="+ref) || !strings.HasSuffix(line, ":bob!bob@localhost PRIVMSG alice :"+text+"\r\n") {
+			t.Error("unexpected replayed line", line)
+		}
+	}
+	end, _ := aliceResp.ReadString('\n')
+	if !strings.Contains(end, "batch="+id) || !strings.HasSuffix(end, " BATCH -"+ref+"\r\n") {
+		t.Error("expected end of multiline batch, got", end)
+	}
+	end, _ = aliceResp.ReadString('\n')
+	assertResponse([]byte(end), "BATCH -"+id+"\r\n", t)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// Nick enforcement modes
+const (
+	// clients that are not logged in to the nick's account can't use it
+	enforceRefuse = "refuse"
+	// clients that are not logged in to the nick's account are renamed
+	// to a guest nick after a grace period
+	enforceRename = "rename"
+)
+
+// reservedFor returns the account that owns nick if c is not logged in
+// to it. If nick is not owned by an account, or c owns it, this returns
+// "".
+func (s *Server) reservedFor(c *client.Client, nick string) string {
+	owner := s.userAccountForNickExists(nick)
+	if owner == "" || (c.IsAuthenticated && c.SASLMech.Authn() == owner) {
+		return ""
+	}
+	return owner
+}
+
+// enforceNick gives c, who is using a nick that belongs to owner, until
+// the grace period ends to log in. The returned message explains this
+// to c. The rename is done by the goroutine serving c, or the one that
+// owns c if it is always-on.
+func (s *Server) enforceNick(c *client.Client, owner string) msg.Msg {
+	conf := s.Config()
+	nick := c.Nick
+
+	s.nickTimersLock.Lock()
+	if t, ok := s.nickTimers[c]; ok {
+		t.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(conf.NickEnforcement.Grace, func() {
+		s.nickTimersLock.Lock()
+		if s.nickTimers[c] == timer {
+			delete(s.nickTimers, c)
+		}
+		s.nickTimersLock.Unlock()
+
+		rename := func() { s.renameToGuest(c, nick) }
+		if c.IsAlwaysOn() {
+			c.Do(rename)
+		} else {
+			s.conns.queue(c, rename)
+		}
+	})
+	s.nickTimers[c] = timer
+	s.nickTimersLock.Unlock()
+
+	return s.NOTICE(c, fmt.Sprintf("The nick %s belongs to the account %s. If you do not log in within %s, you will be renamed.", nick, owner, conf.NickEnforcement.Grace))
+}
+
+// recheckNick is called when the account of the registered client c
+// changes. If c is no longer logged in to the account that owns its
+// nick, c has until the grace period ends to log back in, whatever the
+// enforcement mode, since it did not take the nick from anyone.
+func (s *Server) recheckNick(c *client.Client) msg.Msg {
+	if owner := s.reservedFor(c, c.Nick); owner != "" {
+		return s.enforceNick(c, owner)
+	}
+	s.stopEnforcing(c)
+	return nil
+}
+
+// stopEnforcing cancels any pending rename of c
+func (s *Server) stopEnforcing(c *client.Client) {
+	s.nickTimersLock.Lock()
+	defer s.nickTimersLock.Unlock()
+
+	if t, ok := s.nickTimers[c]; ok {
+		t.Stop()
+		delete(s.nickTimers, c)
+	}
+}
+
+// renameToGuest gives c a guest nick if it is still using nick without
+// having logged in to the account that owns it
+func (s *Server) renameToGuest(c *client.Client, nick string) {
+	if current, ok := s.getClient(nick); !ok || current != c {
+		// c has since changed nick or disconnected
+		return
+	}
+	if s.reservedFor(c, nick) == "" {
+		return
+	}
+
+	guest, ok := s.guestNick()
+	if !ok {
+		QUIT(s, c, &msg.Message{Params: []string{"You did not log in to the account that owns " + nick}})
+		return
+	}
+	c.WriteMessage(s.NOTICE(c, "You did not log in to the account that owns "+nick+", so your nick has been changed"))
+	NICK(s, c, &msg.Message{Params: []string{guest}})
+}
+
+// how many guest nicks are tried before giving up
+const guestAttempts = 100
+
+// guestNick returns an unused nick that is not owned by any account. The
+// number after the prefix is shortened to keep the nick within the
+// length limit. If no such nick can be found, false is returned.
+func (s *Server) guestNick() (string, bool) {
+	conf := s.Config()
+	prefix := conf.NickEnforcement.GuestPrefix
+	digits := conf.Limits.Nick - len(prefix)
+	if digits > 5 {
+		digits = 5
+	}
+	if digits < 1 {
+		return "", false
+	}
+	n := 1
+	for i := 0; i < digits; i++ {
+		n *= 10
+	}
+
+	for i := 0; i < guestAttempts; i++ {
+		nick := fmt.Sprintf("%s%d", prefix, rand.Intn(n))
+		if !validateNick(nick) || len(nick) > conf.Limits.Nick {
+			continue
+		}
+		if _, ok := s.getClient(nick); ok {
+			continue
+		}
+		if s.userAccountForNickExists(nick) != "" {
+			continue
+		}
+		return nick, true
+	}
+	return "", false
+}
+
+// groupNick makes c's current nick belong to c's account
+func (s *Server) groupNick(c *client.Client) msg.Msg {
+	if !c.IsAuthenticated {
+		return s.NOTICE(c, "You must be logged in to group a nick with your account")
+	}
+
+	switch owner := s.userAccountForNickExists(c.Nick); owner {
+	case "":
+	case c.SASLMech.Authn():
+		return s.NOTICE(c, "Nick already belongs to your account")
+	default:
+		return s.NOTICE(c, "Nick belongs to another account")
+	}
+
+	s.db.Exec("INSERT INTO account_nicks VALUES(?, ?)", strings.ToLower(c.Nick), c.SASLMech.Authn())
+	return s.NOTICE(c, "Registered")
+}
+
+// ungroupNick releases nick from c's account. Only nicks that were
+// grouped with REGISTER GROUP can be released.
+func (s *Server) ungroupNick(c *client.Client, nick string) msg.Msg {
+	if !c.IsAuthenticated {
+		return s.NOTICE(c, "You must be logged in to ungroup a nick from your account")
+	}
+
+	res, err := s.db.Exec("DELETE FROM account_nicks WHERE nick=? AND username=?", strings.ToLower(nick), c.SASLMech.Authn())
+	if err != nil {
+		return s.NOTICE(c, err.Error())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return s.NOTICE(c, "Nick is not grouped with your account")
+	}
+	return s.NOTICE(c, "Unregistered")
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"strconv"
+
 	"github.com/mitchr/gossip/channel"
 	"github.com/mitchr/gossip/client"
 	"github.com/mitchr/gossip/scan/msg"
@@ -85,23 +87,33 @@ var (
 	ERR_ALREADYREGISTRED = msg.New(nil, "", "", "", "462", []string{"%s", "You may not reregister"}, true)
 	ERR_PASSWDMISMATCH   = msg.New(nil, "", "", "", "464", []string{"%s", "Password Incorrect"}, true)
 	ERR_CHANNELISFULL    = msg.New(nil, "", "", "", "471", []string{"%s", "%s", "Cannot join channel (+l)"}, true)
+	ERR_LINKCHANNEL      = msg.New(nil, "", "", "", "470", []string{"%s", "%s", "%s", "Forwarding to another channel"}, true)
 	ERR_UNKNOWNMODE      = msg.New(nil, "", "", "", "472", []string{"%s", "%s", "is unknown mode char to me for %s"}, true)
 	ERR_INVITEONLYCHAN   = msg.New(nil, "", "", "", "473", []string{"%s", "%s", "Cannot join channel (+i)"}, true)
 	ERR_BANNEDFROMCHAN   = msg.New(nil, "", "", "", "474", []string{"%s", "%s", "Cannot join channel (+b)"}, true)
 	ERR_BADCHANNELKEY    = msg.New(nil, "", "", "", "475", []string{"%s", "%s", "Cannot join channel (+k)"}, true)
+	ERR_NEEDREGGEDNICK   = msg.New(nil, "", "", "", "477", []string{"%s", "%s", "Cannot join channel (+R) - you need to be logged into your account"}, true)
+	ERR_BANLISTFULL      = msg.New(nil, "", "", "", "478", []string{"%s", "%s", "%c", "Channel list is full"}, true)
+	ERR_THROTTLE         = msg.New(nil, "", "", "", "480", []string{"%s", "%s", "Cannot join channel (+j) - throttle exceeded, try again later"}, true)
 	ERR_NOPRIVILEGES     = msg.New(nil, "", "", "", "481", []string{"%s", "Permission Denied - You're not an IRC operator"}, true)
 	ERR_CHANOPRIVSNEEDED = msg.New(nil, "", "", "", "482", []string{"%s", "%s", "You're not a channel operator"}, true)
 	ERR_UMODEUNKNOWNFLAG = msg.New(nil, "", "", "", "501", []string{"%s", "Unknown MODE flag"}, true)
 	ERR_USERSDONTMATCH   = msg.New(nil, "", "", "", "502", []string{"%s", "Can't change mode for other users"}, true)
 	ERR_INVALIDKEY       = msg.New(nil, "", "", "", "525", []string{"%s", "%s", "Key is not well-formed"}, true)
+	ERR_INVALIDMODEPARAM = msg.New(nil, "", "", "", "696", []string{"%s", "%s", "%c", "%s", "Invalid mode parameter"}, true)
 	RPL_MONONLINE        = msg.New(nil, "", "", "", "730", []string{"%s", "%s"}, true)
 	RPL_MONOFFLINE       = msg.New(nil, "", "", "", "731", []string{"%s", "%s"}, true)
 	RPL_MONLIST          = msg.New(nil, "", "", "", "732", []string{"%s", "%s"}, true)
 	RPL_ENDOFMONLIST     = msg.New(nil, "", "", "", "733", []string{"%s", "End of MONITOR list"}, true)
 	// ERR_MONLISTFULL      = ":%s 734 %s %v %v :Monitor list is full"
+	RPL_KEYVALUE        = msg.New(nil, "", "", "", "761", []string{"%s", "%s", "%s", "*", "%s"}, true)
+	RPL_KEYNOTSET       = msg.New(nil, "", "", "", "766", []string{"%s", "%s", "%s", "key not set"}, true)
+	RPL_METADATASUBOK   = msg.New(nil, "", "", "", "770", []string{"%s", "%s"}, true)
+	RPL_METADATAUNSUBOK = msg.New(nil, "", "", "", "771", []string{"%s", "%s"}, true)
+	RPL_METADATASUBS    = msg.New(nil, "", "", "", "772", []string{"%s", "%s"}, true)
 
 	RPL_LOGGEDIN    = msg.New(nil, "", "", "", "900", []string{"%s", "%s", "%s", "You are now logged in as %s"}, true)
-	RPL_LOGGEDOUT   = msg.New(nil, "", "", "", "901", []string{"%s", "%s", "You are not logged out"}, true)
+	RPL_LOGGEDOUT   = msg.New(nil, "", "", "", "901", []string{"%s", "%s", "You are now logged out"}, true)
 	ERR_NICKLOCKED  = msg.New(nil, "", "", "", "902", []string{"%s", "You must use a nick assigned to you"}, true)
 	RPL_SASLSUCCESS = msg.New(nil, "", "", "", "903", []string{"%s", "SASL authentication successful"}, true)
 	ERR_SASLFAIL    = msg.New(nil, "", "", "", "904", []string{"%s", "SASL authentication failed"}, true)
@@ -112,7 +124,15 @@ var (
 )
 
 func (s *Server) writeReply(c *client.Client, msg *msg.Message, f ...interface{}) {
-	c.WriteMessage(prepMessage(msg, s.Name, c.Id(), f...))
+	c.WriteMessage(prepMessage(msg, s.Config().Name, c.Id(), f...))
+}
+
+// writeList writes reply to c with items as a comma separated list,
+// split over as many replies as it takes
+func (s *Server) writeList(c *client.Client, reply *msg.Message, items []string) {
+	c.WriteMessage(msg.SplitList(items, ",", 0, func(list string) *msg.Message {
+		return prepMessage(reply, s.Config().Name, c.Id(), list)
+	}))
 }
 
 func prepMessage(m *msg.Message, serverName, nick string, f ...interface{}) *msg.Message {
@@ -136,7 +156,7 @@ func (s *Server) NOTICE(c *client.Client, m string) msg.Msg {
 // invisibles is true, include invisible members in the response; this
 // should only be done if the requesting client is also a member of the
 // channel
-func constructNAMREPLY(ch *channel.Channel, invisibles bool, multiPrefix bool, userhostInNames bool) (symbol string, members string) {
+func constructNAMREPLY(ch *channel.Channel, invisibles bool, multiPrefix bool, userhostInNames bool) (symbol string, members []string) {
 	symbol = "="
 	if ch.Secret {
 		symbol = "@"
@@ -148,64 +168,51 @@ func constructNAMREPLY(ch *channel.Channel, invisibles bool, multiPrefix bool, u
 			return
 		}
 
-		highest := m.HighestPrefix(multiPrefix)
-		if highest != "" {
-			members += highest
-		}
-
 		identifier := m.Nick
 		if userhostInNames {
 			identifier = m.String()
 		}
-		members += identifier + " "
+		members = append(members, m.HighestPrefix(multiPrefix)+identifier)
 	})
-	return symbol, members[:len(members)-1]
+	return symbol, members
 }
 
-var isupportTokens = func() []string {
+// isupportTokens generates the RPL_ISUPPORT parameters for this
+// server's config
+func (s *Server) isupportTokens() []string {
+	l := s.Config().Limits
 	supported := []string{
+		"AWAYLEN=" + strconv.Itoa(l.Away),
 		"BOT=b",
 		"CASEMAPPING=ascii",
 		"CHANLIMIT=#&:",
-		"CHANMODES=beI,k,l,imnst",
+		"CHANMODES=beI,k,jl,imnRst",
+		"CHANNELLEN=" + strconv.Itoa(l.Channel),
 		"ELIST=CMNTU",
+		"HOSTLEN=" + strconv.Itoa(l.Host),
 		"INVEX=I",
+		"KICKLEN=" + strconv.Itoa(l.Kick),
+		"MAXLIST=beI:" + strconv.Itoa(l.List),
 		"MONITOR", // TODO: add a limit?
-		// "STATUSMSG=~&@%+",
+		"NICKLEN=" + strconv.Itoa(l.Nick),
 		"PREFIX=(qaohv)~&@%+",
-		"WHOX",
-		"UTF8ONLY",
+		"STATUSMSG=~&@%+",
 		"TARGMAX=KICK:,NAMES:,PRIVMSG:,WHOIS:,WHOWAS:",
-
-		// TODO: honor the below values
-		"AWAYLEN=200",
-		"CHANNELLEN=64",
-		"HOSTLEN=64",
-		"KICKLEN=200",
-		"MAXLIST=beI:25",
-		"NICKLEN=30",
-		"TOPICLEN=307",
-		"USERLEN=18",
-	}
-
-	// try to get every line below 200 bytes, that seems like a good number
-	lines := []string{}
-	line := supported[0]
-	for i := 1; i < len(supported); i++ {
-		line += " " + supported[i]
-		if len(line) > 200 {
-			lines = append(lines, line)
-			line = ""
-		}
-	}
-
-	// if all supported params fit on one line
-	if len(lines) == 0 {
-		lines = append(lines, line)
+		"TOPICLEN=" + strconv.Itoa(l.Topic),
+		"USERLEN=" + strconv.Itoa(l.User),
+		"UTF8ONLY",
+		"WHOX",
 	}
+	return supported
+}
 
-	return lines
-}()
+// isupport returns the RPL_ISUPPORT lines for c. A line can hold at
+// most 13 tokens.
+func (s *Server) isupport(c *client.Client) *msg.Buffer {
+	return msg.SplitList(s.isupportTokens(), " ", 13, func(list string) *msg.Message {
+		return prepMessage(RPL_ISUPPORT, s.Config().Name, c.Id(), list)
+	})
+}
 
 func whoreplyFlagsForClient(c *client.Client) string {
 	flags := "H"
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	cap "github.com/mitchr/gossip/capability"
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// MARKREAD <target> [timestamp=<timestamp>]
+// https://ircv3.net/specs/extensions/read-marker
+func MARKREAD(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	if len(m.Params) < 1 {
+		s.stdReply(c, FAIL, "MARKREAD", "NEED_MORE_PARAMS", "", "Missing parameters")
+		return nil
+	}
+	if !c.IsAuthenticated {
+		s.stdReply(c, FAIL, "MARKREAD", "ACCOUNT_REQUIRED", "", "You must be logged in to use read markers")
+		return nil
+	}
+	target := m.Params[0]
+	account := c.SASLMech.Authn()
+
+	if len(m.Params) < 2 {
+		return s.readMarker(c, target)
+	}
+
+	v, ok := strings.CutPrefix(m.Params[1], "timestamp=")
+	if !ok {
+		s.stdReply(c, FAIL, "MARKREAD", "INVALID_PARAMS", target, "Timestamp must be of the form timestamp=YYYY-MM-DDThh:mm:ss.sssZ")
+		return nil
+	}
+	read, err := time.Parse(client.TimeFormat, v)
+	if err != nil {
+		s.stdReply(c, FAIL, "MARKREAD", "INVALID_PARAMS", target, "Timestamp must be of the form timestamp=YYYY-MM-DDThh:mm:ss.sssZ")
+		return nil
+	}
+
+	// markers only ever move forward; an older timestamp is answered
+	// with the one that is already stored
+	res, err := s.db.Exec(`INSERT INTO read_markers(username, target, timestamp) VALUES(?, ?, ?)
+		ON CONFLICT(username, target) DO UPDATE SET timestamp=excluded.timestamp
+		WHERE excluded.timestamp > read_markers.timestamp`,
+		strings.ToLower(account), strings.ToLower(target), read.UnixMilli())
+	if err != nil {
+		s.stdReply(c, FAIL, "MARKREAD", "INTERNAL_ERROR", target, "Could not save read marker")
+		return nil
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return s.readMarker(c, target)
+	}
+
+	marker := markread(s.Config().Name, target, read)
+	s.clientLock.RLock()
+	defer s.clientLock.RUnlock()
+	for _, v := range s.clients {
+		if !v.IsAuthenticated || !strings.EqualFold(v.SASLMech.Authn(), account) {
+			continue
+		}
+
+		// every session of an always-on client is told, without the marker
+		// being kept as a missed message
+		sessions := []*client.Client{v}
+		if v.IsAlwaysOn() {
+			sessions = v.Sessions()
+		}
+		for _, session := range sessions {
+			if session.HasCap(cap.ReadMarker.Name) {
+				session.WriteMessage(marker.Copy())
+			}
+		}
+	}
+	return nil
+}
+
+// readMarker returns the read marker that c's account has stored for
+// target. If c has not negotiated draft/read-marker, or is not logged
+// in, this is nil.
+func (s *Server) readMarker(c *client.Client, target string) msg.Msg {
+	conf := s.Config()
+	if !c.HasCap(cap.ReadMarker.Name) || !c.IsAuthenticated {
+		return nil
+	}
+
+	var millis int64
+	err := s.db.QueryRow("SELECT timestamp FROM read_markers WHERE username=? AND target=?",
+		strings.ToLower(c.SASLMech.Authn()), strings.ToLower(target)).Scan(&millis)
+	if err != nil {
+		return msg.New(nil, conf.Name, "", "", "MARKREAD", []string{target, "*"}, false)
+	}
+	return markread(conf.Name, target, time.UnixMilli(millis))
+}
+
+func markread(server, target string, t time.Time) *msg.Message {
+	return msg.New(nil, server, "", "", "MARKREAD", []string{target, "timestamp=" + t.UTC().Format(client.TimeFormat)}, false)
+}
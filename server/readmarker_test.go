@@ -0,0 +1,68 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/mitchr/gossip/sasl/plain"
+)
+
+func TestMARKREAD(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	plainCred := plain.NewCredential("alice", "pass")
+	s.persistPlain(plainCred.Username, "alice", plainCred.Pass)
+
+	alice, aliceResp := login("alice", "draft/read-marker")
+	defer alice.Close()
+	other, otherResp := login("alice2", "draft/read-marker")
+	defer other.Close()
+
+	t.Run("Unset", func(t *testing.T) {
+		alice.Write([]byte("MARKREAD #test\r\n"))
+		resp, _ := aliceResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip MARKREAD #test *\r\n", t)
+	})
+
+	t.Run("Set", func(t *testing.T) {
+		alice.Write([]byte("MARKREAD #test timestamp=2024-01-02T03:04:05.678Z\r\n"))
+		resp, _ := aliceResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip MARKREAD #test timestamp=2024-01-02T03:04:05.678Z\r\n", t)
+		resp, _ = otherResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip MARKREAD #test timestamp=2024-01-02T03:04:05.678Z\r\n", t)
+
+		other.Write([]byte("MARKREAD #TEST\r\n"))
+		resp, _ = otherResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip MARKREAD #TEST timestamp=2024-01-02T03:04:05.678Z\r\n", t)
+	})
+
+	t.Run("Older", func(t *testing.T) {
+		other.Write([]byte("MARKREAD #test timestamp=2023-01-01T00:00:00.000Z\r\n"))
+		resp, _ := otherResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip MARKREAD #test timestamp=2024-01-02T03:04:05.678Z\r\n", t)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		alice.Write([]byte("MARKREAD #test yesterday\r\n"))
+		resp, _ := aliceResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL MARKREAD INVALID_PARAMS #test :Timestamp must be of the form timestamp=YYYY-MM-DDThh:mm:ss.sssZ\r\n", t)
+	})
+
+	t.Run("Join", func(t *testing.T) {
+		alice.Write([]byte("JOIN #test\r\n"))
+		resp, _ := readLines(aliceResp, 2)
+		assertResponse(resp, ":gossip MARKREAD #test timestamp=2024-01-02T03:04:05.678Z\r\n", t)
+	})
+
+	t.Run("AccountRequired", func(t *testing.T) {
+		c, r := connectAndRegister("bob")
+		defer c.Close()
+		c.Write([]byte("MARKREAD #test\r\n"))
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, "FAIL MARKREAD ACCOUNT_REQUIRED :You must be logged in to use read markers\r\n", t)
+	})
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cap "github.com/mitchr/gossip/capability"
+	"github.com/mitchr/gossip/channel"
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// the number of recently sent messages that are remembered, so that
+// they can be redacted or edited
+const trackedMessages = 4096
+
+// A sentMessage records who sent a message, and where it was sent
+type sentMessage struct {
+	from    *client.Client
+	nick    string
+	account string
+
+	// the target that the message was sent to, without any status
+	// prefix
+	target string
+	sent   time.Time
+}
+
+// sentMessages remembers the most recently sent messages by msgid
+type sentMessages struct {
+	sync.Mutex
+	byId map[string]sentMessage
+	// msgids in the order that they were added, used as a ring
+	order []string
+	next  int
+}
+
+// add records that from sent the message msgid to target, which should
+// not have a STATUSMSG prefix
+func (s *sentMessages) add(msgid string, from *client.Client, target string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.byId == nil {
+		s.byId = make(map[string]sentMessage)
+		s.order = make([]string, trackedMessages)
+	}
+
+	// the oldest message is forgotten to make room
+	delete(s.byId, s.order[s.next])
+	s.order[s.next] = msgid
+	s.next = (s.next + 1) % len(s.order)
+
+	account := ""
+	if from.IsAuthenticated {
+		account = from.SASLMech.Authn()
+	}
+	s.byId[msgid] = sentMessage{from, from.Nick, account, target, time.Now()}
+}
+
+func (s *sentMessages) get(msgid string) (sentMessage, bool) {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.byId[msgid]
+	return m, ok
+}
+
+func (s *sentMessages) forget(msgid string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.byId, msgid)
+}
+
+// sentBy returns true if c sent m, either from the same connection or
+// from the same account
+func (m sentMessage) sentBy(c *client.Client) bool {
+	return m.from == c || (m.account != "" && c.IsAuthenticated && strings.EqualFold(m.account, c.SASLMech.Authn()))
+}
+
+// seenFrom returns true if m is part of c's conversation with target
+func (m sentMessage) seenFrom(c *client.Client, target string) bool {
+	if isValidChannelString(target) {
+		return strings.EqualFold(m.target, target)
+	}
+	// a private message is either from c to target, or from target to c
+	return (m.sentBy(c) && strings.EqualFold(m.target, target)) ||
+		(strings.EqualFold(m.target, c.Nick) && strings.EqualFold(m.nick, target))
+}
+
+// mayChange checks that c can change the message msgid that it sees in
+// target, either by redacting it or, if editing, by replacing it. If
+// it can't, the reason is sent to c as a FAIL reply for command.
+func (s *Server) mayChange(c *client.Client, command, target, msgid string, editing bool) bool {
+	action := "REDACT"
+	if editing {
+		action = "EDIT"
+	}
+
+	sent, ok := s.sent.get(msgid)
+	if !ok || !sent.seenFrom(c, target) {
+		s.stdReply(c, FAIL, command, "UNKNOWN_MSGID", target+" "+msgid, "This message does not exist or is too old")
+		return false
+	}
+
+	// server operators, and channel operators in their channel, are not
+	// held to the redaction window, and can take down anyone's messages
+	privileged := c.Is(client.Op)
+	if ch, _ := s.getChannel(target); ch != nil && !privileged {
+		if self, _ := ch.GetMember(c.Nick); self != nil && self.HasRank(channel.Operator) {
+			privileged = true
+		}
+	}
+
+	if sent.sentBy(c) {
+		if window := s.Config().Redaction.Window; window > 0 && time.Since(sent.sent) > window && !privileged {
+			s.stdReply(c, FAIL, command, action+"_WINDOW_EXPIRED", fmt.Sprintf("%s %s %.f", target, msgid, window.Seconds()), "This message is too old to be changed")
+			return false
+		}
+		return true
+	}
+
+	// other people's messages can be taken down, but not rewritten
+	if !editing && privileged {
+		return true
+	}
+
+	s.stdReply(c, FAIL, command, action+"_FORBIDDEN", target+" "+msgid, "You are not allowed to change this message")
+	return false
+}
+
+// REDACT <target> <msgid> [:<reason>]
+// https://ircv3.net/specs/extensions/message-redaction
+func REDACT(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	if len(m.Params) < 2 {
+		return prepMessage(ERR_NEEDMOREPARAMS, s.Config().Name, c.Id(), "REDACT")
+	}
+	target, msgid := m.Params[0], m.Params[1]
+
+	var ch *channel.Channel
+	if isValidChannelString(target) {
+		ch, _ = s.getChannel(target)
+		if ch == nil {
+			s.stdReply(c, FAIL, "REDACT", "INVALID_TARGET", target, "No such channel")
+			return nil
+		}
+	}
+	if !s.mayChange(c, "REDACT", target, msgid, false) {
+		return nil
+	}
+	s.sent.forget(msgid)
+
+	params := []string{target, msgid}
+	if len(m.Params) > 2 {
+		params = append(params, m.Params[2])
+	}
+	redact := msg.New(nil, c.Nick, c.User, c.Host, "REDACT", params, len(m.Params) > 2)
+
+	// the redacted message is removed from the history of everybody that
+	// was sent it
+	send := func(to *client.Client) {
+		to.ForgetMissed(msgid)
+		if to.HasCap(cap.MessageRedaction.Name) {
+			to.WriteMessageFrom(redact.Copy(), c)
+		}
+	}
+	if ch != nil {
+		ch.ForAllMembersExcept(c, func(m *channel.Member) { send(m.Client) })
+	} else if other, ok := s.getClient(target); ok {
+		send(other)
+	}
+
+	if !c.HasCap(cap.MessageRedaction.Name) {
+		return nil
+	}
+	if !c.HasMessageTags() {
+		return redact.RemoveAllTags()
+	}
+	return redact
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// msgidOf returns the msgid tag of a raw message
+func msgidOf(line string) string {
+	for _, tag := range strings.Split(strings.TrimPrefix(strings.Fields(line)[0], "@"), ";") {
+		if v, ok := strings.CutPrefix(tag, "msgid="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func TestREDACT(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.Redaction.Window = time.Minute
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	capable := func(nick string) (net.Conn, *bufio.Reader) {
+		c, r := connectAndRegister(nick)
+		c.Write([]byte("CAP REQ :message-tags echo-message draft/message-redaction\r\n"))
+		r.ReadBytes('\n')
+		return c, r
+	}
+	a, aResp := capable("a")
+	defer a.Close()
+	b, bResp := capable("b")
+	defer b.Close()
+
+	// send has c send text to target, and returns the msgid of its echo
+	send := func(c net.Conn, r *bufio.Reader, target, text string) string {
+		c.Write([]byte("PRIVMSG " + target + " :" + text + "\r\n"))
+		echo, _ := r.ReadString('\n')
+		return msgidOf(echo)
+	}
+
+	t.Run("Own", func(t *testing.T) {
+		id := send(a, aResp, "b", "oops")
+		bResp.ReadString('\n')
+
+		a.Write([]byte("REDACT b " + id + " :typo\r\n"))
+		resp, _ := bResp.ReadString('\n')
+		if !strings.HasSuffix(resp, ":a!a@localhost REDACT b "+id+" :typo\r\n") {
+			t.Error("expected redaction, got", resp)
+		}
+		resp, _ = aResp.ReadString('\n')
+		if !strings.HasSuffix(resp, ":a!a@localhost REDACT b "+id+" :typo\r\n") {
+			t.Error("expected redaction to be echoed, got", resp)
+		}
+
+		// it can't be redacted twice
+		a.Write([]byte("REDACT b " + id + "\r\n"))
+		resp, _ = aResp.ReadString('\n')
+		assertResponse([]byte(resp), "FAIL REDACT UNKNOWN_MSGID b "+id+" :This message does not exist or is too old\r\n", t)
+	})
+
+	t.Run("Forbidden", func(t *testing.T) {
+		id := send(a, aResp, "b", "mine")
+		bResp.ReadString('\n')
+
+		b.Write([]byte("REDACT a " + id + "\r\n"))
+		resp, _ := bResp.ReadString('\n')
+		assertResponse([]byte(resp), "FAIL REDACT REDACT_FORBIDDEN a "+id+" :You are not allowed to change this message\r\n", t)
+	})
+
+	t.Run("ChannelOperator", func(t *testing.T) {
+		a.Write([]byte("JOIN #test\r\n"))
+		readLines(aResp, 3)
+		b.Write([]byte("JOIN #test\r\n"))
+		readLines(bResp, 3)
+		readLines(aResp, 1)
+
+		id := send(b, bResp, "#test", "spam")
+		aResp.ReadString('\n')
+
+		a.Write([]byte("REDACT #test " + id + "\r\n"))
+		resp, _ := bResp.ReadString('\n')
+		if !strings.HasSuffix(resp, ":a!a@localhost REDACT #test "+id+"\r\n") {
+			t.Error("expected channel operator to redact message, got", resp)
+		}
+		aResp.ReadString('\n')
+	})
+
+	t.Run("Edit", func(t *testing.T) {
+		id := send(a, aResp, "b", "helo")
+		bResp.ReadString('\n')
+
+		a.Write([]byte("@+draft/edit=" + id + " PRIVMSG b :hello\r\n"))
+		resp, _ := bResp.ReadString('\n')
+		if !strings.Contains(resp, "+draft/edit="+id) || !strings.HasSuffix(resp, "PRIVMSG b :hello\r\n") {
+			t.Error("expected edit, got", resp)
+		}
+		aResp.ReadString('\n')
+
+		// only the sender can edit a message
+		b.Write([]byte("@+draft/edit=" + id + " PRIVMSG a :hello\r\n"))
+		resp, _ = bResp.ReadString('\n')
+		assertResponse([]byte(resp), "FAIL PRIVMSG EDIT_FORBIDDEN a "+id+" :You are not allowed to change this message\r\n", t)
+	})
+
+	t.Run("WindowExpired", func(t *testing.T) {
+		id := send(a, aResp, "b", "old")
+		bResp.ReadString('\n')
+
+		s.sent.Lock()
+		sent := s.sent.byId[id]
+		sent.sent = sent.sent.Add(-time.Hour)
+		s.sent.byId[id] = sent
+		s.sent.Unlock()
+
+		a.Write([]byte("REDACT b " + id + "\r\n"))
+		resp, _ := aResp.ReadString('\n')
+		assertResponse([]byte(resp), "FAIL REDACT REDACT_WINDOW_EXPIRED b "+id+" 60 :This message is too old to be changed\r\n", t)
+
+		// a is an operator of #test, so isn't limited there
+		id = send(a, aResp, "#test", "old")
+		bResp.ReadString('\n')
+
+		s.sent.Lock()
+		sent = s.sent.byId[id]
+		sent.sent = sent.sent.Add(-time.Hour)
+		s.sent.byId[id] = sent
+		s.sent.Unlock()
+
+		a.Write([]byte("REDACT #test " + id + "\r\n"))
+		resp, _ = bResp.ReadString('\n')
+		if !strings.HasSuffix(resp, ":a!a@localhost REDACT #test "+id+"\r\n") {
+			t.Error("expected channel operator to redact their own old message, got", resp)
+		}
+	})
+}
+
+func TestREDACTRemovesFromHistory(t *testing.T) {
+	s := newAlwaysOnServer(t)
+	defer s.Close()
+
+	alice, aliceResp := login("alice", "")
+	alice.Write([]byte("QUIT\r\n"))
+	readLines(aliceResp, 1)
+	alice.Close()
+
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("CAP REQ :message-tags echo-message\r\nPRIVMSG alice :secret\r\nPRIVMSG alice :hello\r\n"))
+	readLines(bobResp, 1)
+	echo, _ := bobResp.ReadString('\n')
+	bobResp.ReadString('\n')
+	bob.Write([]byte("REDACT alice " + msgidOf(echo) + "\r\nPING x\r\n"))
+	readUntilPONG(bobResp)
+
+	alice, aliceResp = login("alice", "")
+	defer alice.Close()
+	resp, _ := aliceResp.ReadBytes('\n')
+	assertResponse(resp, ":bob!bob@localhost PRIVMSG alice :hello\r\n", t)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"log"
+	"strings"
+
+	cap "github.com/mitchr/gossip/capability"
+	"github.com/mitchr/gossip/channel"
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// RENAME <channel> <new name> [:<reason>]
+// https://ircv3.net/specs/extensions/channel-rename
+func RENAME(s *Server, c *client.Client, m *msg.Message) msg.Msg {
+	conf := s.Config()
+	if len(m.Params) < 2 {
+		return prepMessage(ERR_NEEDMOREPARAMS, conf.Name, c.Id(), "RENAME")
+	}
+	from, to := m.Params[0], m.Params[1]
+
+	ch, ok := s.getChannel(from)
+	if !ok {
+		return prepMessage(ERR_NOSUCHCHANNEL, conf.Name, c.Id(), from)
+	}
+	from = ch.String()
+	if self, _ := ch.GetMember(c.Nick); !c.Is(client.Op) && (self == nil || !self.Is(channel.Founder)) {
+		return prepMessage(ERR_CHANOPRIVSNEEDED, conf.Name, c.Id(), ch)
+	}
+
+	if !isValidChannelString(to) || len(to) > conf.Limits.Channel || to[0] != from[0] {
+		s.stdReply(c, FAIL, "RENAME", "CANNOT_RENAME", from+" "+to, "The channel cannot be given this name")
+		return nil
+	}
+	if !s.renameChannel(ch, to) {
+		s.stdReply(c, FAIL, "RENAME", "CHANNEL_NAME_IN_USE", from+" "+to, "A channel with this name already exists")
+		return nil
+	}
+
+	params := []string{from, to}
+	partReason := "Channel renamed to " + to
+	if len(m.Params) > 2 {
+		params = append(params, m.Params[2])
+		partReason += ": " + m.Params[2]
+	}
+	rename := msg.New(nil, c.Nick, c.User, c.Host, "RENAME", params, len(params) > 2)
+
+	// NAMES needs to read the member list, so members are not written to
+	// while it is held
+	var members []*channel.Member
+	ch.ForAllMembers(func(m *channel.Member) { members = append(members, m) })
+
+	for _, v := range members {
+		if v.HasCap(cap.ChannelRename.Name) {
+			v.WriteMessageFrom(rename.Copy(), c)
+			continue
+		}
+
+		// everyone else is shown leaving the old channel and joining the new
+		// one
+		buff := &msg.Buffer{}
+		buff.AddMsg(msg.New(nil, v.Nick, v.User, v.Host, "PART", []string{from, partReason}, true))
+		if v.HasCap(cap.ExtendedJoin.Name) {
+			buff.AddMsg(msg.New(nil, v.Nick, v.User, v.Host, "JOIN", []string{to, v.SASLMech.Authn(), v.Realname}, false))
+		} else {
+			buff.AddMsg(msg.New(nil, v.Nick, v.User, v.Host, "JOIN", []string{to}, false))
+		}
+		if ch.Topic != "" {
+			buff.AddMsg(TOPIC(s, v.Client, &msg.Message{Params: []string{to}}))
+		}
+		buff.AddMsg(NAMES(s, v.Client, &msg.Message{Params: []string{to}}))
+		v.WriteMessage(buff)
+	}
+
+	if _, ok := ch.GetMember(c.Nick); !ok {
+		return s.NOTICE(c, "Renamed "+from+" to "+to)
+	}
+	return nil
+}
+
+// renameChannel gives ch the name to, and makes joining its old name
+// lead to it. If another channel already has that name, or it belongs
+// to a registered channel, this returns false.
+func (s *Server) renameChannel(ch *channel.Channel, to string) bool {
+	s.chanLock.Lock()
+	defer s.chanLock.Unlock()
+
+	from := strings.ToLower(ch.String())
+	key := strings.ToLower(to)
+	if key != from {
+		if _, ok := s.channels[key]; ok || s.chanAlreadyRegistered(to) {
+			return false
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println("could not rename channel:", err)
+		return false
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE channels SET chan=? WHERE lower(chan)=?", to, from); err != nil {
+		log.Println("could not rename channel:", err)
+		return false
+	}
+	if _, err := tx.Exec("UPDATE channel_state SET chan=? WHERE chan=?", key, from); err != nil {
+		log.Println("could not rename channel:", err)
+		return false
+	}
+	if _, err := tx.Exec("UPDATE OR REPLACE read_markers SET target=? WHERE target=?", key, from); err != nil {
+		log.Println("could not rename channel:", err)
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("could not rename channel:", err)
+		return false
+	}
+
+	delete(s.channels, from)
+	ch.Rename(to[1:])
+	s.channels[key] = ch
+	s.joinThrottle.moveChannel(from, key)
+
+	// anything that led to the old name now leads to the new one
+	for k, v := range s.renamed {
+		if strings.ToLower(v) == from {
+			s.renamed[k] = to
+		}
+	}
+	delete(s.renamed, key)
+	if key != from {
+		s.renamed[from] = to
+	}
+	return true
+}
+
+// renamedTo returns the name that joining ch forwards to, if ch was
+// renamed and no channel has taken its old name since
+func (s *Server) renamedTo(ch string) (string, bool) {
+	s.chanLock.RLock()
+	defer s.chanLock.RUnlock()
+
+	if _, ok := s.channels[strings.ToLower(ch)]; ok {
+		return "", false
+	}
+	to, ok := s.renamed[strings.ToLower(ch)]
+	return to, ok
+}
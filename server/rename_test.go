@@ -0,0 +1,130 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/mitchr/gossip/channel"
+)
+
+func TestRENAME(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	a, aResp := connectAndRegister("a")
+	defer a.Close()
+	a.Write([]byte("CAP REQ draft/channel-rename\r\nJOIN #old\r\n"))
+	readLines(aResp, 4)
+	b, bResp := connectAndRegister("b")
+	defer b.Close()
+	b.Write([]byte("JOIN #old\r\n"))
+	readLines(bResp, 3)
+	readLines(aResp, 1)
+
+	ch, _ := s.getChannel("#old")
+	founder, _ := ch.GetMember("a")
+	founder.Prefix |= channel.Founder
+
+	t.Run("NotFounder", func(t *testing.T) {
+		b.Write([]byte("RENAME #old #new\r\n"))
+		resp, _ := bResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 482 b #old :You're not a channel operator\r\n", t)
+	})
+
+	t.Run("CannotRename", func(t *testing.T) {
+		a.Write([]byte("RENAME #old &new\r\n"))
+		resp, _ := aResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL RENAME CANNOT_RENAME #old &new :The channel cannot be given this name\r\n", t)
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		a.Write([]byte("RENAME #old #new :tidying up\r\n"))
+		resp, _ := aResp.ReadBytes('\n')
+		assertResponse(resp, ":a!a@localhost RENAME #old #new :tidying up\r\n", t)
+
+		// b doesn't support channel-rename
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":b!b@localhost PART #old :Channel renamed to #new: tidying up\r\n", t)
+		resp, _ = bResp.ReadBytes('\n')
+		assertResponse(resp, ":b!b@localhost JOIN #new\r\n", t)
+		readLines(bResp, 2)
+
+		if _, ok := s.getChannel("#old"); ok {
+			t.Error("old channel still exists")
+		}
+		if ch, _ := s.getChannel("#new"); ch.Len() != 2 {
+			t.Error("members were not kept")
+		}
+
+		s.joinThrottle.m.Lock()
+		joins := len(*s.joinThrottle.channelWindow("#new"))
+		s.joinThrottle.m.Unlock()
+		if joins != 2 {
+			t.Errorf("join throttle was not carried over: got %d joins", joins)
+		}
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		c, cResp := connectAndRegister("c")
+		c.Write([]byte("JOIN #old\r\n"))
+		resp, _ := cResp.ReadBytes('\n')
+		assertResponse(resp, ":gossip 470 c #old #new :Forwarding to another channel\r\n", t)
+		resp, _ = cResp.ReadBytes('\n')
+		assertResponse(resp, ":c!c@localhost JOIN #new\r\n", t)
+
+		c.Write([]byte("QUIT\r\n"))
+		c.Close()
+		readLines(aResp, 2) // c joining and quitting
+		readLines(bResp, 2)
+	})
+
+	t.Run("NameInUse", func(t *testing.T) {
+		d, dResp := connectAndRegister("d")
+		defer d.Close()
+		d.Write([]byte("JOIN #taken\r\n"))
+		readLines(dResp, 3)
+
+		a.Write([]byte("RENAME #new #taken\r\n"))
+		resp, _ := aResp.ReadBytes('\n')
+		assertResponse(resp, "FAIL RENAME CHANNEL_NAME_IN_USE #new #taken :A channel with this name already exists\r\n", t)
+	})
+
+	t.Run("RedirectForgotten", func(t *testing.T) {
+		a.Write([]byte("PART #new\r\n"))
+		readLines(aResp, 1)
+		readLines(bResp, 1)
+		// the channel is deleted after the PART is sent; the PONG makes sure
+		// that has happened
+		b.Write([]byte("PART #new\r\nPING x\r\n"))
+		readLines(bResp, 2)
+
+		if _, ok := s.renamedTo("#old"); ok {
+			t.Error("#old still leads to a channel that no longer exists")
+		}
+	})
+}
+
+func TestRenameChannelFails(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ch := channel.New("old", channel.Remote)
+	s.channels["#old"] = ch
+	s.db.Exec("DROP TABLE read_markers")
+
+	if s.renameChannel(ch, "#new") {
+		t.Fatal("expected rename to fail")
+	}
+	if got, ok := s.getChannel("#old"); !ok || got != ch || ch.String() != "#old" {
+		t.Error("channel was renamed anyway")
+	}
+	if _, ok := s.getChannel("#new"); ok {
+		t.Error("channel was added under its new name")
+	}
+}
@@ -8,9 +8,9 @@ import (
 	"errors"
 	"log"
 	"net"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cap "github.com/mitchr/gossip/capability"
@@ -22,14 +22,19 @@ import (
 )
 
 type Server struct {
-	*Config
+	// REHASH replaces the config while clients are being served, so it
+	// is only read through Config
+	config     atomic.Pointer[Config]
+	rehashLock sync.Mutex
 
 	// database used for user account information
 	db *sql.DB
 
 	listener    net.Listener
 	tlsListener net.Listener
-	created     time.Time
+	// the listener underneath tlsListener
+	tlsTCPListener net.Listener
+	created        time.Time
 
 	// nick to underlying client
 	clients    map[string]*client.Client
@@ -37,9 +42,37 @@ type Server struct {
 
 	// ChanType + name to channel
 	channels map[string]*channel.Channel
+	// lowercased names of channels that have been renamed, to the name
+	// that joining them forwards to
+	renamed  map[string]string
 	chanLock sync.RWMutex
 
-	joinLock sync.Mutex
+	// held while JOIN, MODE, and join flood lockdowns change a channel's
+	// members or modes
+	joinLock     sync.Mutex
+	joinThrottle joinThrottle
+	// channels that are locked down after a join flood, to the mode that
+	// the lockdown set; guarded by joinLock
+	lockdowns map[*channel.Channel]byte
+
+	// lowercased account name to the always-on client for that account
+	alwaysOn     map[string]*client.Client
+	alwaysOnLock sync.Mutex
+
+	// clients that are using a nick that belongs to an account, and the
+	// timers that rename them if they don't log in
+	nickTimers     map[*client.Client]*time.Timer
+	nickTimersLock sync.Mutex
+
+	// the multiline batches that each connection has open
+	batches   map[*client.Client]*multiline
+	batchLock sync.Mutex
+
+	// recently sent messages, so that they can be redacted or edited
+	sent sentMessages
+
+	// open connections, used to enforce connection class limits
+	conns connTracker
 
 	// a running count of connected users who are unregistered
 	unknowns statistic
@@ -52,14 +85,44 @@ type Server struct {
 	monitor       monitor
 
 	wg sync.WaitGroup
+
+	// closed once Shutdown has finished
+	stopped  chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+	restart  atomic.Bool
+
+	// set while clients are being handed off to a new process
+	upgrading atomic.Bool
+	// sessions handed to this process by the process it replaced
+	resumed *upgradeState
 }
 
 func New(c *Config) (*Server, error) {
+	c.setDefaults()
+	if err := c.checkJoinThrottle(); err != nil {
+		return nil, err
+	}
+	if err := c.checkNickEnforcement(); err != nil {
+		return nil, err
+	}
+	if err := c.prepareClasses(); err != nil {
+		return nil, err
+	}
+	if err := c.prepareSASL(); err != nil {
+		return nil, err
+	}
+
 	s := &Server{
-		Config:   c,
-		created:  time.Now(),
-		clients:  make(map[string]*client.Client),
-		channels: make(map[string]*channel.Channel),
+		created:   time.Now(),
+		clients:   make(map[string]*client.Client),
+		channels:  make(map[string]*channel.Channel),
+		renamed:   make(map[string]string),
+		lockdowns: make(map[*channel.Channel]byte),
+		alwaysOn:  make(map[string]*client.Client),
+
+		nickTimers: make(map[*client.Client]*time.Timer),
+		batches:    make(map[*client.Client]*multiline),
 		// keep this list sorted alphabetically
 		supportedCaps: []cap.Cap{
 			cap.AccountNotify,
@@ -67,6 +130,11 @@ func New(c *Config) (*Server, error) {
 			cap.AwayNotify,
 			cap.Batch,
 			cap.CapNotify,
+			cap.ChannelRename,
+			cap.MessageRedaction,
+			cap.Metadata,
+			cap.Multiline,
+			cap.ReadMarker,
 			cap.EchoMessage,
 			cap.ExtendedJoin,
 			cap.ExtendedMonitor,
@@ -77,34 +145,46 @@ func New(c *Config) (*Server, error) {
 			cap.SASL,
 			cap.ServerTime,
 			cap.Setname,
+			cap.STS,
 			cap.UserhostInNames,
 		},
 		monitor: monitor{m: make(map[string]map[string]bool)},
+		stopped: make(chan struct{}),
 	}
 
-	err := s.loadDatabase(s.Datasource)
+	s.config.Store(c)
+
+	err := s.loadDatabase(s.Config().Datasource)
 	if err != nil {
 		return nil, err
 	}
-
-	s.listener, err = net.Listen("tcp", c.Port)
+	err = s.loadWhowas()
 	if err != nil {
 		return nil, err
 	}
 
-	if c.TLS.Enabled {
-		s.tlsListener, err = tls.Listen("tcp", c.TLS.Port, c.TLS.Config)
+	// when upgrading, the listeners are taken over from the old process
+	inherited, err := s.inherit()
+	if err != nil {
+		return nil, err
+	}
+	if !inherited {
+		s.listener, err = net.Listen("tcp", c.Port)
 		if err != nil {
 			return nil, err
 		}
-		if c.TLS.STS.Enabled {
-			s.supportedCaps = append(s.supportedCaps, cap.STS)
-			sort.Slice(s.supportedCaps, func(i, j int) bool {
-				return s.supportedCaps[i].Name < s.supportedCaps[j].Name
-			})
+		if c.TLS.Enabled {
+			s.tlsTCPListener, err = net.Listen("tcp", c.TLS.Port)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
+	if c.TLS.Enabled {
+		s.tlsListener = tls.NewListener(s.tlsTCPListener, &tls.Config{GetConfigForClient: s.tlsConfig})
+	}
+
 	return s, nil
 }
 
@@ -140,6 +220,12 @@ func (s *Server) loadDatabase(datasource string) error {
 		clientCert BLOB,
 		PRIMARY KEY(username)
 	);
+
+	CREATE TABLE IF NOT EXISTS sasl_external_certs(
+		username TEXT,
+		fingerprint BLOB,
+		PRIMARY KEY(fingerprint)
+	);
 	
 	CREATE TABLE IF NOT EXISTS sasl_scram(
 		username TEXT,
@@ -151,11 +237,64 @@ func (s *Server) loadDatabase(datasource string) error {
 		PRIMARY KEY(username)
 	);
 	
+	CREATE TABLE IF NOT EXISTS sasl_oauthbearer(
+		username TEXT,
+		nick TEXT,
+		PRIMARY KEY(username)
+	);
+
 	CREATE TABLE IF NOT EXISTS channels(
 		owner TEXT,
 		chan TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS channel_state(
+		chan TEXT,
+		state BLOB,
+		PRIMARY KEY(chan)
+	);
+
+	CREATE TABLE IF NOT EXISTS account_nicks(
+		nick TEXT,
+		username TEXT,
+		PRIMARY KEY(nick)
+	);
+
+	CREATE TABLE IF NOT EXISTS account_settings(
+		username TEXT,
+		alwaysOn INTEGER,
+		PRIMARY KEY(username)
+	);
+
+	CREATE TABLE IF NOT EXISTS account_metadata(
+		username TEXT,
+		key TEXT,
+		value TEXT,
+		PRIMARY KEY(username, key)
+	);
+
+	CREATE TABLE IF NOT EXISTS read_markers(
+		username TEXT,
+		target TEXT,
+		timestamp INTEGER,
+		PRIMARY KEY(username, target)
+	);
+
+	CREATE TABLE IF NOT EXISTS whowas(
+		seq INTEGER PRIMARY KEY,
+		nick TEXT,
+		user TEXT,
+		host TEXT,
+		realname TEXT
 	)`)
+	if err != nil {
+		return err
+	}
 
+	// certificates used to only be kept in sasl_external; move them over
+	// so that each fingerprint is looked up in one place
+	_, err = s.db.Exec(`INSERT OR IGNORE INTO sasl_external_certs
+		SELECT username, clientCert FROM sasl_external WHERE clientCert IS NOT NULL`)
 	return err
 }
 
@@ -166,14 +305,28 @@ func (s *Server) startAccept(ctx context.Context, cancel context.CancelFunc, l n
 			cancel()
 			return
 		}
+		if s.upgrading.Load() {
+			go reject(conn, ErrUpgrading)
+			continue
+		}
 		s.wg.Add(1)
 		go s.handleConn(conn, ctx)
 	}
 }
 
+// Config returns the server's current configuration
+func (s *Server) Config() *Config { return s.config.Load() }
+
 func (s *Server) Serve() {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	if s.resumed != nil {
+		if err := s.resumeSessions(ctx, s.resumed, inheritedFile); err != nil {
+			log.Println("could not resume sessions:", err)
+		}
+		s.resumed = nil
+	}
+
 	go s.startAccept(ctx, cancel, s.listener)
 	if s.tlsListener != nil {
 		go s.startAccept(ctx, cancel, s.tlsListener)
@@ -197,93 +350,186 @@ func (s *Server) Close() error {
 	return nil
 }
 
-func (s *Server) handleConn(u net.Conn, ctx context.Context) {
-	clientCtx, cancel := context.WithCancel(ctx)
+var ErrShutdownTimeout = errors.New("clients were still connected when the shutdown grace period ended")
+
+// Shutdown gracefully stops the server. Every client is sent reason
+// and disconnected, and the server's state is saved. Clients are given
+// ShutdownGrace to receive the rest of their messages; if any are left
+// connected after that, ErrShutdownTimeout is returned and the caller
+// should exit anyway. Calling Shutdown more than once waits for the
+// first call to finish.
+func (s *Server) Shutdown(reason string) error {
+	conf := s.Config()
+	s.stopOnce.Do(func() {
+		defer close(s.stopped)
+		deadline := time.NewTimer(conf.ShutdownGrace)
+		defer deadline.Stop()
+
+		// closing the listeners cancels every client's context, so find out
+		// who is connected first
+		clients := s.conns.all()
+		if err := s.Close(); err != nil {
+			log.Println(err)
+		}
+
+		for _, c := range clients {
+			c.WriteMessage(msg.New(nil, conf.Name, "", "", "NOTICE", []string{c.Id(), "Server is shutting down: " + reason}, true))
+			s.ERROR(c, "Closing Link: "+conf.Name+" ("+reason+")")
+		}
+
+		if err := s.saveState(); err != nil {
+			log.Println("could not save server state:", err)
+		}
 
+		for _, c := range clients {
+			select {
+			case <-c.Flushed():
+			case <-deadline.C:
+				s.stopErr = ErrShutdownTimeout
+				return
+			}
+		}
+	})
+
+	<-s.stopped
+	return s.stopErr
+}
+
+// Stopped is closed once Shutdown has finished.
+func (s *Server) Stopped() <-chan struct{} { return s.stopped }
+
+// RestartRequested returns true if the server was shut down by an
+// operator who asked for it to be started again.
+func (s *Server) RestartRequested() bool { return s.restart.Load() }
+
+func (s *Server) handleConn(u net.Conn, ctx context.Context) {
 	defer s.wg.Done()
-	defer cancel()
 
-	c := client.New(u)
+	class := s.classify(u, "")
+	conn, err := s.admit(u, class)
+	if err != nil {
+		reject(u, err)
+		return
+	}
+
+	c := client.New(u, class.SendQ)
+	if len(c.Host) > s.Config().Limits.Host {
+		c.Host, _, _ = net.SplitHostPort(c.RemoteAddr().String())
+	}
 	s.unknowns.Inc()
 
+	s.serveClient(c, conn, ctx)
+}
+
+// serveClient processes messages from c until it disconnects, or until
+// the server stops or is upgraded.
+func (s *Server) serveClient(c *client.Client, conn connection, ctx context.Context) {
+	clientCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.conns.track(c, conn)
+	defer s.conns.release(c)
+	c.SetFlood(conn.class.Flood)
+	c.FillTokens()
+
+	// messages are executed here rather than by the reader, so that
+	// nothing else that changes c runs at the same time. The reader waits
+	// for each message to be executed before reading the next, since
+	// executing it can change how the next one is read.
+	msgs := make(chan *msg.Message)
+	executed := make(chan struct{})
 	errs := make(chan error)
+	stoppedReading := make(chan struct{})
 
-	go startRegistrationTimer(c, errs)
-	go s.getMessage(c, clientCtx, errs)
+	go func() {
+		s.getMessage(c, clientCtx, msgs, executed, errs)
+		close(stoppedReading)
+	}()
 
-	pingTick := time.NewTicker(time.Minute * 5)  // every 5 minutes, send PING
-	grantTick := time.NewTicker(time.Second * 2) // every 2 seconds, give this client a grant
-	defer pingTick.Stop()
-	defer grantTick.Stop()
+	l := &liveness{connected: time.Now()}
+	timeout := time.NewTimer(0)
+	defer timeout.Stop()
 
 	for {
+		var err error
 		select {
 		case <-clientCtx.Done():
 			return
-		case <-pingTick.C:
-			c.WriteMessage(msg.New(nil, s.Name, "", "", "PING", []string{c.Nick}, false))
-			go waitForPong(c, errs)
-		case <-grantTick.C:
-			c.AddGrant()
-		case err := <-errs:
-			if errors.Is(err, net.ErrClosed) {
-				if _, ok := s.getClient(c.Nick); !ok {
-					// network closed and client was already removed (or never
-					// was added to begin with); no work to be done here
-					return
-				}
-			}
-			QUIT(s, c, &msg.Message{Params: []string{err.Error()}})
+		case <-stoppedReading:
+			// the client is being handed off to a new process
 			return
+		case m := <-msgs:
+			s.executeMessage(m, c)
+			executed <- struct{}{}
+			continue
+		case f := <-conn.queued:
+			f()
+			continue
+		case <-timeout.C:
+			var wait time.Duration
+			if wait, err = s.checkLiveness(c, l); err == nil {
+				timeout.Reset(wait)
+				continue
+			}
+		case err = <-c.WriteErr():
+		case err = <-errs:
 		}
-	}
-}
 
-var (
-	ErrPingTimeout         = errors.New("Closing Link: PING timeout (300 seconds)")
-	ErrRegistrationTimeout = errors.New("Closing Link: Client failed to register in allotted time (10 seconds)")
-)
+		// QUIT changes c, so the reader has to be stopped first
+		cancel()
+		c.StopReading()
+		<-stoppedReading
 
-func waitForPong(c *client.Client, errs chan<- error) {
-	select {
-	case <-c.PONG:
-	case <-time.After(time.Second * 10):
-		errs <- ErrPingTimeout
+		if errors.Is(err, net.ErrClosed) {
+			if _, ok := s.getClient(c.Nick); !ok {
+				// network closed and client was already removed (or never
+				// was added to begin with); no work to be done here
+				return
+			}
+		}
+		s.runSession(c, func() { QUIT(s, c, &msg.Message{Params: []string{err.Error()}}) })
+		return
 	}
 }
 
-// give a small window for client to register before kicking them off
-func startRegistrationTimer(c *client.Client, errs chan<- error) {
-	time.Sleep(time.Second * 10)
-	if !c.Is(client.Registered) {
-		errs <- ErrRegistrationTimeout
+// reportErr hands err to the goroutine that serves the client, unless
+// it has stopped waiting for errors
+func (s *Server) reportErr(ctx context.Context, errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	case <-ctx.Done():
 	}
 }
 
-// fetch a message from the client and parse it
-func (s *Server) getMessage(c *client.Client, ctx context.Context, errs chan<- error) {
+// fetch messages from the client, parse them, and hand them to msgs to
+// be executed
+func (s *Server) getMessage(c *client.Client, ctx context.Context, msgs chan<- *msg.Message, executed <-chan struct{}, errs chan<- error) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			buff, err := c.ReadMsg()
-			if s.Debug && len(buff) != 0 {
+			buff, err := c.ReadMsg(ctx)
+			if s.Config().Debug && len(buff) != 0 {
 				log.Printf("[%s]: %s\n", c.RemoteAddr(), string(bytes.TrimRight(buff, "\r\n")))
 			}
 
 			if err == msg.ErrMsgSizeOverflow {
 				s.writeReply(c, ERR_INPUTTOOLONG)
 				continue
+			} else if err != nil && s.upgrading.Load() {
+				// reading was interrupted so that the connection can be
+				// handed off
+				return
 			} else if err != nil {
-				errs <- err
+				s.reportErr(ctx, errs, err)
 				continue
 			}
 
 			tokens, err := msg.Lex(buff)
 			if err != nil {
 				s.stdReply(c, FAIL, tokens.TryToExtractCommand(), "INVALID_UTF8", "", "Message rejected, your IRC software MUST use UTF-8 encoding on this network")
-				errs <- err
+				s.reportErr(ctx, errs, err)
 				continue
 			}
 
@@ -293,11 +539,16 @@ func (s *Server) getMessage(c *client.Client, ctx context.Context, errs chan<- e
 			} else if errors.Unwrap(err) == msg.ErrParse {
 				// silently ignore parse errors
 			} else if err != nil {
-				errs <- err
+				s.reportErr(ctx, errs, err)
 			}
 
 			if m != nil {
-				s.executeMessage(m, c)
+				select {
+				case msgs <- m:
+					<-executed
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}
@@ -346,7 +597,22 @@ func (s *Server) deleteChannel(k string) {
 	s.chanLock.Lock()
 	defer s.chanLock.Unlock()
 
+	// registered channels keep their state after everyone leaves
+	if ch, ok := s.channels[strings.ToLower(k)]; ok {
+		if err := s.saveChannel(s.db, ch); err != nil {
+			log.Println("could not save channel state:", err)
+		}
+	}
+
 	delete(s.channels, strings.ToLower(k))
+	s.joinThrottle.forgetChannel(k)
+
+	// the channel's old names have nothing left to lead to
+	for from, to := range s.renamed {
+		if strings.EqualFold(to, k) {
+			delete(s.renamed, from)
+		}
+	}
 }
 func (s *Server) channelLen() int {
 	s.chanLock.RLock()
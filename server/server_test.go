@@ -20,6 +20,8 @@ import (
 	"time"
 
 	"github.com/mitchr/gossip/channel"
+	"github.com/mitchr/gossip/client"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func init() {
@@ -45,15 +47,15 @@ func TestTLS(t *testing.T) {
 	t.Run("TestRegisterFromTLSClient", func(t *testing.T) {
 		c.Write([]byte("NICK alice\r\nUSER alice 0 0 :Alice Smith\r\n"))
 		welcome, _ := r.ReadBytes('\n')
-		assertResponse(welcome, fmt.Sprintf(":%s 001 alice :Welcome to the %s IRC Network alice!alice@localhost\r\n", s.Name, s.Network), t)
+		assertResponse(welcome, fmt.Sprintf(":%s 001 alice :Welcome to the %s IRC Network alice!alice@localhost\r\n", s.Config().Name, s.Config().Network), t)
 	})
 
 	t.Run("TestWHOISCERTFP", func(t *testing.T) {
 		c.Write([]byte("WHOIS alice\r\n"))
-		resp, _ := readLines(r, 15)
+		resp, _ := readLines(r, 16)
 
 		sha := sha256.Sum256(clientCert.Certificate[0])
-		assertResponse(resp, fmt.Sprintf(":%s 276 alice alice :has client certificate fingerprint %s\r\n", s.Name, hex.EncodeToString(sha[:])), t)
+		assertResponse(resp, fmt.Sprintf(":%s 276 alice alice :has client certificate fingerprint %s\r\n", s.Config().Name, hex.EncodeToString(sha[:])), t)
 	})
 
 	t.Run("TestPRIVMSGFromInsecureToSecure", func(t *testing.T) {
@@ -82,7 +84,7 @@ func TestMessageSize(t *testing.T) {
 		longMsg := make([]byte, 513)
 		go c.Write(longMsg)
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 417 * :Input line was too long\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 417 * :Input line was too long\r\n", s.Config().Name), t)
 	})
 
 	t.Run("JustRight", func(t *testing.T) {
@@ -121,7 +123,7 @@ func TestMessageSize(t *testing.T) {
 
 		c.Write(tags)
 		resp, _ := r.ReadBytes('\n')
-		assertResponse(resp, prepMessage(ERR_INPUTTOOLONG, s.Name, "d").String(), t)
+		assertResponse(resp, prepMessage(ERR_INPUTTOOLONG, s.Config().Name, "d").String(), t)
 	})
 }
 
@@ -145,6 +147,68 @@ func TestFlooding(t *testing.T) {
 	assertResponse(flood, "ERROR :Flooding\r\n", t)
 }
 
+func TestFloodThrottle(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Flood: client.FloodLimit{Burst: 2, Rate: 100, Throttle: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		c.Write([]byte("NICK\r\n"))
+	}
+	for i := 0; i < 5; i++ {
+		resp, _ := r.ReadBytes('\n')
+		assertResponse(resp, ":gossip 431 alice :No nickname given\r\n", t)
+	}
+}
+
+func TestFloodCost(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Flood: client.FloodLimit{Burst: 4, Rate: 0.001, Cost: map[string]float64{"nick": 3}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+
+	c.Write([]byte("NICK\r\n"))
+	r.ReadBytes('\n')
+	c.Write([]byte("NICK\r\n"))
+	flood, _ := r.ReadBytes('\n')
+	assertResponse(flood, "ERROR :Flooding\r\n", t)
+}
+
+func TestFloodRehash(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	pass, _ := bcrypt.GenerateFromPassword([]byte("adminpass"), bcrypt.MinCost)
+	conf.Ops = map[string][]byte{"admin": pass}
+	conf.configSource = strings.NewReader(`{"name": "gossip", "flood": {"burst": 2, "rate": 0.001}}`)
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+	c.Write([]byte("OPER admin adminpass\r\nREHASH\r\n"))
+	for resp, _ := r.ReadString('\n'); !strings.Contains(resp, " 382 "); resp, _ = r.ReadString('\n') {
+	}
+
+	// the new burst applies to alice, who was already connected
+	c.Write([]byte("NICK\r\nNICK\r\nNICK\r\n"))
+	flood, _ := readLines(r, 3)
+	assertResponse(flood, "ERROR :Flooding\r\n", t)
+}
+
 func TestWriteMultiline(t *testing.T) {
 	s, err := New(&Config{Network: "cafeteria", Name: "gossip", Port: ":6667"})
 	if err != nil {
@@ -159,7 +223,7 @@ func TestWriteMultiline(t *testing.T) {
 	c.Write([]byte("NICK alice\r\nUSER alice 0 0 :Alice\r\n"))
 	resp, _ := r.ReadBytes('\n')
 	alice, _ := s.getClient("alice")
-	assertResponse(resp, fmt.Sprintf(":%s 001 alice :Welcome to the %s IRC Network %s\r\n", s.Name, s.Network, alice.String()), t)
+	assertResponse(resp, fmt.Sprintf(":%s 001 alice :Welcome to the %s IRC Network %s\r\n", s.Config().Name, s.Config().Network, alice.String()), t)
 }
 
 func TestCaseInsensitivity(t *testing.T) {
@@ -178,10 +242,10 @@ func TestCaseInsensitivity(t *testing.T) {
 	t.Run("TestNickCaseInsensitive", func(t *testing.T) {
 		c1.Write([]byte("NICK BOB\r\n"))
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 433 alice BOB :Nickname is already in use\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 433 alice BOB :Nickname is already in use\r\n", s.Config().Name), t)
 		c1.Write([]byte("NICK boB\r\n"))
 		resp, _ = r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 433 alice boB :Nickname is already in use\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 433 alice boB :Nickname is already in use\r\n", s.Config().Name), t)
 	})
 
 	t.Run("TestChanCaseInsensitive", func(t *testing.T) {
@@ -200,7 +264,7 @@ func TestCaseInsensitivity(t *testing.T) {
 		r1.ReadBytes('\n')
 
 		resp, _ := r1.ReadBytes('\n')
-		assertResponse(resp, fmt.Sprintf(":%s 315 alice #test :End of WHO list\r\n", s.Name), t)
+		assertResponse(resp, fmt.Sprintf(":%s 315 alice #test :End of WHO list\r\n", s.Config().Name), t)
 	})
 }
 
@@ -219,7 +283,7 @@ func TestUnicodeNICK(t *testing.T) {
 	resp, _ := r.ReadBytes('\n')
 
 	airplane := s.clients["🛩️"].String()
-	assertResponse(resp, fmt.Sprintf(":%s 001 🛩️ :Welcome to the cafe IRC Network %s\r\n", s.Name, airplane), t)
+	assertResponse(resp, fmt.Sprintf(":%s 001 🛩️ :Welcome to the cafe IRC Network %s\r\n", s.Config().Name, airplane), t)
 }
 
 func TestUnknownCount(t *testing.T) {
@@ -288,6 +352,142 @@ func TestSlowWriter(t *testing.T) {
 	assertResponse(resp, ":a!a@localhost PRIVMSG b :hello!\r\n", t)
 }
 
+func TestSendQExceeded(t *testing.T) {
+	s, _ := New(&Config{Name: "gossip", Port: ":6667", SendQ: 5})
+	defer s.Close()
+	go s.Serve()
+
+	// slow registers, but never reads anything afterwards
+	slow, slowResp, p := connect(s)
+	defer p()
+	slow.Write([]byte("NICK slow\r\nUSER slow 0 0 slow\r\n"))
+	readLines(slowResp, 14)
+
+	c, r := connectAndRegister("a")
+	defer c.Close()
+	c.Write([]byte("JOIN #local\r\n"))
+	readLines(r, 3)
+
+	slowClient, _ := s.getClient("slow")
+	ch, _ := s.getChannel("#local")
+	ch.SetMember(&channel.Member{Client: slowClient})
+
+	for i := 0; i < 10; i++ {
+		c.Write([]byte("PRIVMSG #local :hello\r\n"))
+	}
+
+	quit, _ := r.ReadBytes('\n')
+	assertResponse(quit, ":slow!slow@pipe QUIT :SendQ exceeded\r\n", t)
+	if _, ok := s.getClient("slow"); ok {
+		t.Error("slow client was not disconnected")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+
+	if err := s.Shutdown("maintenance"); err != nil {
+		t.Fatal(err)
+	}
+
+	notice, _ := r.ReadBytes('\n')
+	errResp, _ := r.ReadBytes('\n')
+	assertResponse(notice, ":gossip NOTICE alice :Server is shutting down: maintenance\r\n", t)
+	assertResponse(errResp, "ERROR :Closing Link: gossip (maintenance)\r\n", t)
+
+	if _, err := r.ReadBytes('\n'); err == nil {
+		t.Error("connection was not closed")
+	}
+}
+
+func TestShutdownSavesState(t *testing.T) {
+	conf := &Config{Name: "gossip", Port: ":6667", Datasource: t.TempDir() + "/gossip.db"}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	c.Write([]byte("JOIN #test\r\nREGISTER #test\r\nTOPIC #test :persisted\r\nMODE #test +m\r\n"))
+	readLines(r, 3+2+1+1)
+
+	bob, bobResp := connectAndRegister("bob")
+	bob.Write([]byte("JOIN #test\r\n"))
+	readLines(bobResp, 4)
+
+	// bob's JOIN, then alice's ERROR
+	c.Write([]byte("QUIT\r\n"))
+	readLines(r, 2)
+	c.Close()
+
+	// the channel is still occupied, so its state is saved at shutdown
+	s.Shutdown("restarting")
+	bob.Close()
+
+	s, err = New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	if info := s.whowasHistory.search([]string{"alice"}, 1); len(info) != 1 {
+		t.Error("WHOWAS history was not restored")
+	}
+
+	c, r = connectAndRegister("carol")
+	defer c.Close()
+	c.Write([]byte("JOIN #test\r\n"))
+	r.ReadBytes('\n')
+	topic, _ := r.ReadBytes('\n')
+	assertResponse(topic, ":gossip 332 carol #test :persisted\r\n", t)
+
+	ch, _ := s.getChannel("#test")
+	if !ch.Moderated {
+		t.Error("channel modes were not restored")
+	}
+}
+
+func TestSaveChannelInTransaction(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+	c.Write([]byte("JOIN #test\r\nREGISTER #test\r\n"))
+	readLines(r, 3+2)
+
+	// an in-memory database is only visible to one connection, so the
+	// transaction has to be used for everything
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	ch, _ := s.getChannel("#test")
+	if err := s.saveChannel(tx, ch); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	tx.QueryRow("SELECT count(*) FROM channel_state").Scan(&n)
+	if n != 1 {
+		t.Error("registered channel was not saved")
+	}
+}
+
 func BenchmarkRegistrationSurge(b *testing.B) {
 	s, _ := New(conf)
 	defer s.Close()
@@ -322,7 +522,7 @@ func connectAndRegister(nick string) (net.Conn, *bufio.Reader) {
 	c.Write([]byte("NICK " + nick + "\r\nUSER " + nick + " 0 0 :" + nick + "\r\n"))
 
 	r := bufio.NewReader(c)
-	readLines(r, 13)
+	readLines(r, 14)
 
 	return c, r
 }
@@ -395,6 +595,8 @@ func generateConfig() *Config {
 	c.Name = "gossip"
 	c.Port = ":6667"
 	c.TLS.Config = &tls.Config{ClientAuth: tls.RequestClientCert, Certificates: []tls.Certificate{cert}}
+	cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	c.TLS.certs = &certStore{pairs: []*loadedPair{{cert: &cert}}}
 	c.TLS.Enabled = true
 	c.TLS.Port = ":6697"
 
@@ -425,7 +627,7 @@ func connectSlowWriter(s *Server) context.CancelFunc {
 	s.wg.Add(1)
 	go s.handleConn(slow, ctx)
 	c.Write([]byte("NICK slow\r\nUSER slow 0 0 slow\r\n"))
-	readLines(r, 13)
+	readLines(r, 14)
 	slow.block = true
 
 	return cancel
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/mitchr/gossip/channel"
+	"github.com/mitchr/gossip/client"
+)
+
+// channelState is the part of a channel that outlives its members
+type channelState struct {
+	Name     string           `json:"name"`
+	ChanType channel.ChanType `json:"chanType"`
+
+	CreatedAt time.Time `json:"createdAt"`
+
+	Topic      string    `json:"topic"`
+	TopicSetBy string    `json:"topicSetBy"`
+	TopicSetAt time.Time `json:"topicSetAt"`
+
+	Ban            []string      `json:"ban"`
+	BanExcept      []string      `json:"banExcept"`
+	InviteExcept   []string      `json:"inviteExcept"`
+	Limit          int           `json:"limit"`
+	Invite         bool          `json:"invite"`
+	Key            string        `json:"key"`
+	Moderated      bool          `json:"moderated"`
+	Secret         bool          `json:"secret"`
+	Protected      bool          `json:"protected"`
+	NoExternal     bool          `json:"noExternal"`
+	RegisteredOnly bool          `json:"registeredOnly"`
+	JoinLimit      int           `json:"joinLimit"`
+	JoinPeriod     time.Duration `json:"joinPeriod"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func snapshotChannel(ch *channel.Channel) channelState {
+	st := channelState{
+		Name:           ch.String()[1:],
+		ChanType:       ch.ChanType,
+		CreatedAt:      ch.CreatedAt,
+		Topic:          ch.Topic,
+		TopicSetAt:     ch.TopicSetAt,
+		Ban:            ch.Ban,
+		BanExcept:      ch.BanExcept,
+		InviteExcept:   ch.InviteExcept,
+		Limit:          ch.Limit,
+		Invite:         ch.Invite,
+		Key:            ch.Key,
+		Moderated:      ch.Moderated,
+		Secret:         ch.Secret,
+		Protected:      ch.Protected,
+		NoExternal:     ch.NoExternal,
+		RegisteredOnly: ch.RegisteredOnly,
+		JoinLimit:      ch.JoinLimit,
+		JoinPeriod:     ch.JoinPeriod,
+		Metadata:       ch.Metadata.All(),
+	}
+	if ch.TopicSetBy != nil {
+		st.TopicSetBy = ch.TopicSetBy.Nick
+	}
+	return st
+}
+
+// restore applies st to ch
+func (st channelState) restore(ch *channel.Channel) {
+	ch.CreatedAt = st.CreatedAt
+	ch.Topic = st.Topic
+	ch.TopicSetAt = st.TopicSetAt
+	if st.TopicSetBy != "" {
+		// the client who set the topic is long gone, so only their nick is
+		// remembered
+		ch.TopicSetBy = &client.Client{Nick: st.TopicSetBy}
+	}
+	ch.Ban = st.Ban
+	ch.BanExcept = st.BanExcept
+	ch.InviteExcept = st.InviteExcept
+	ch.Limit = st.Limit
+	ch.Invite = st.Invite
+	ch.Key = st.Key
+	ch.Moderated = st.Moderated
+	ch.Secret = st.Secret
+	ch.Protected = st.Protected
+	ch.NoExternal = st.NoExternal
+	ch.RegisteredOnly = st.RegisteredOnly
+	ch.JoinLimit = st.JoinLimit
+	ch.JoinPeriod = st.JoinPeriod
+	for k, v := range st.Metadata {
+		ch.Metadata.Set(k, v)
+	}
+}
+
+// saveState persists the parts of the server's runtime state that
+// should survive a restart: the state of registered channels, and
+// WHOWAS history.
+func (s *Server) saveState() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	s.chanLock.RLock()
+	for _, ch := range s.channels {
+		if err = s.saveChannel(tx, ch); err != nil {
+			s.chanLock.RUnlock()
+			return err
+		}
+	}
+	s.chanLock.RUnlock()
+
+	if _, err = tx.Exec("DELETE FROM whowas"); err != nil {
+		return err
+	}
+	// entries are stored oldest first so that they can be pushed back
+	// onto the stack in the same order
+	history := s.whowasHistory.all()
+	for i := len(history) - 1; i >= 0; i-- {
+		v := history[i]
+		if _, err = tx.Exec("INSERT INTO whowas(nick, user, host, realname) VALUES(?, ?, ?, ?)", v.nick, v.user, v.host, v.realname); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// saveChannel persists the state of ch if it is registered. db can be
+// a transaction, so the registration is checked through it as well.
+func (s *Server) saveChannel(db interface {
+	Exec(string, ...any) (sql.Result, error)
+	QueryRow(string, ...any) *sql.Row
+}, ch *channel.Channel) error {
+	var name string
+	err := db.QueryRow("SELECT chan FROM channels WHERE lower(chan)=lower(?)", ch.String()).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(snapshotChannel(ch))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO channel_state VALUES(lower(?), ?)", ch.String(), b)
+	return err
+}
+
+// loadWhowas restores the WHOWAS history saved by saveState
+func (s *Server) loadWhowas() error {
+	rows, err := s.db.Query("SELECT nick, user, host, realname FROM whowas ORDER BY seq")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v whowasInfo
+		if err := rows.Scan(&v.nick, &v.user, &v.host, &v.realname); err != nil {
+			return err
+		}
+		s.whowasHistory.push(v.nick, v.user, v.host, v.realname)
+	}
+	return rows.Err()
+}
+
+// restoreChannel applies the saved state of a registered channel to
+// ch, if there is any
+func (s *Server) restoreChannel(ch *channel.Channel) {
+	var b []byte
+	if err := s.db.QueryRow("SELECT state FROM channel_state WHERE chan=lower(?)", ch.String()).Scan(&b); err != nil {
+		return
+	}
+
+	var st channelState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return
+	}
+	st.restore(ch)
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchr/gossip/channel"
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/mode"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// window records when events happened so that the rate of those events
+// over a sliding period of time can be measured
+type window []time.Time
+
+// add records an event at time t, and forgets any events that happened
+// more than horizon ago
+func (w *window) add(t time.Time, horizon time.Duration) {
+	*w = append(*w, t)
+
+	i := 0
+	for i < len(*w) && t.Sub((*w)[i]) > horizon {
+		i++
+	}
+	*w = (*w)[i:]
+}
+
+// count returns the number of events that happened within period of t
+func (w window) count(t time.Time, period time.Duration) int {
+	n := 0
+	for _, v := range w {
+		if t.Sub(v) <= period {
+			n++
+		}
+	}
+	return n
+}
+
+// joinThrottle keeps track of the JOINs made by each client and the
+// JOINs received by each channel
+type joinThrottle struct {
+	m        sync.Mutex
+	clients  map[*client.Client]*window
+	channels map[string]*window
+}
+
+func (j *joinThrottle) clientWindow(c *client.Client) *window {
+	if j.clients == nil {
+		j.clients = make(map[*client.Client]*window)
+	}
+	if j.clients[c] == nil {
+		j.clients[c] = &window{}
+	}
+	return j.clients[c]
+}
+
+func (j *joinThrottle) channelWindow(ch string) *window {
+	ch = strings.ToLower(ch)
+	if j.channels == nil {
+		j.channels = make(map[string]*window)
+	}
+	if j.channels[ch] == nil {
+		j.channels[ch] = &window{}
+	}
+	return j.channels[ch]
+}
+
+// forget removes c from the join throttle
+func (j *joinThrottle) forget(c *client.Client) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	delete(j.clients, c)
+}
+
+// forgetChannel removes ch from the join throttle
+func (j *joinThrottle) forgetChannel(ch string) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	delete(j.channels, strings.ToLower(ch))
+}
+
+// moveChannel carries the JOINs received by from over to to, so that
+// renaming a channel doesn't reset its +j limit
+func (j *joinThrottle) moveChannel(from, to string) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	from, to = strings.ToLower(from), strings.ToLower(to)
+	if w, ok := j.channels[from]; ok {
+		delete(j.channels, from)
+		j.channels[to] = w
+	}
+}
+
+// clientCanJoin returns false if c has already joined the configured
+// number of channels within the configured period.
+func (s *Server) clientCanJoin(c *client.Client) bool {
+	conf := s.Config()
+	if conf.JoinThrottle.Joins == 0 {
+		return true
+	}
+
+	s.joinThrottle.m.Lock()
+	defer s.joinThrottle.m.Unlock()
+
+	w := s.joinThrottle.clientWindow(c)
+	return w.count(time.Now(), conf.JoinThrottle.Period) < conf.JoinThrottle.Joins
+}
+
+// channelCanAdmit returns false if ch is +j and its join limit has been
+// reached.
+func (s *Server) channelCanAdmit(ch *channel.Channel) bool {
+	if ch.JoinLimit == 0 {
+		return true
+	}
+
+	s.joinThrottle.m.Lock()
+	defer s.joinThrottle.m.Unlock()
+
+	w := s.joinThrottle.channelWindow(ch.String())
+	return w.count(time.Now(), ch.JoinPeriod) < ch.JoinLimit
+}
+
+// recordJoin notes that c has been admitted into ch. If this admission
+// means that ch is being flooded, ch will be locked down.
+func (s *Server) recordJoin(c *client.Client, ch *channel.Channel) {
+	conf := s.Config()
+	now := time.Now()
+	flood := conf.JoinThrottle.Flood
+
+	s.joinThrottle.m.Lock()
+	if conf.JoinThrottle.Joins != 0 {
+		s.joinThrottle.clientWindow(c).add(now, conf.JoinThrottle.Period)
+	}
+
+	// only keep as much history as is needed for both the +j limit and
+	// flood detection
+	horizon := ch.JoinPeriod
+	if flood.Period > horizon {
+		horizon = flood.Period
+	}
+	chanWindow := s.joinThrottle.channelWindow(ch.String())
+	chanWindow.add(now, horizon)
+	flooded := flood.Joins != 0 && chanWindow.count(now, flood.Period) > flood.Joins
+	s.joinThrottle.m.Unlock()
+
+	if flooded {
+		s.lockdown(ch)
+	}
+}
+
+// lockdown sets the configured flood mode on ch, and then removes it
+// after the configured duration has passed. Channel operators are sent
+// a NOTICE explaining what happened. The caller must hold s.joinLock.
+func (s *Server) lockdown(ch *channel.Channel) {
+	conf := s.Config()
+	flood := conf.JoinThrottle.Flood
+	m := mode.Mode{ModeChar: flood.Mode[0], Type: mode.Add}
+
+	// channel is already locked down
+	if (m.ModeChar == 'i' && ch.Invite) || (m.ModeChar == 'R' && ch.RegisteredOnly) {
+		return
+	}
+
+	ch.ApplyMode(m)
+	s.lockdowns[ch] = m.ModeChar
+	ch.WriteMessage(msg.New(nil, conf.Name, "", "", "MODE", []string{ch.String(), m.String()}, false))
+	s.noticeOps(ch, fmt.Sprintf("Join flood detected (more than %d joins in %v); channel set %s for %v", flood.Joins, flood.Period, m, flood.Duration))
+
+	time.AfterFunc(flood.Duration, func() {
+		s.joinLock.Lock()
+		defer s.joinLock.Unlock()
+
+		// an operator has changed the mode since, so it is theirs now
+		if s.lockdowns[ch] != m.ModeChar {
+			return
+		}
+		delete(s.lockdowns, ch)
+
+		m.Type = mode.Remove
+		ch.ApplyMode(m)
+		ch.WriteMessage(msg.New(nil, conf.Name, "", "", "MODE", []string{ch.String(), m.String()}, false))
+		s.noticeOps(ch, fmt.Sprintf("Join flood lockdown has expired; channel set %s", m))
+	})
+}
+
+// modeChanged notes that an operator has changed mode m of ch, so a
+// lockdown that set m should leave it alone when it expires. The caller
+// must hold s.joinLock.
+func (s *Server) modeChanged(ch *channel.Channel, m mode.Mode) {
+	if s.lockdowns[ch] == m.ModeChar {
+		delete(s.lockdowns, ch)
+	}
+}
+
+// noticeOps sends a NOTICE from the server to every operator of ch.
+func (s *Server) noticeOps(ch *channel.Channel, text string) {
+	ch.ForAllMembers(func(m *channel.Member) {
+		if m.Is(channel.Operator) {
+			m.WriteMessage(msg.New(nil, s.Config().Name, "", "", "NOTICE", []string{m.Nick, fmt.Sprintf("[%s] %s", ch, text)}, true))
+		}
+	})
+}
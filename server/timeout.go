@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+var (
+	ErrPingTimeout         = errors.New("Closing Link: PING timeout")
+	ErrRegistrationTimeout = errors.New("Closing Link: Client failed to register in allotted time")
+	ErrIdleTimeout         = errors.New("Closing Link: Idle for too long")
+)
+
+// liveness tracks whether a client is still responsive
+type liveness struct {
+	connected time.Time
+	// when the client was sent a PING that it has not yet answered
+	pingSent time.Time
+}
+
+// checkLiveness applies the timeouts of c's class. If c has run out of
+// time, an error explaining why is returned. Otherwise, a client that
+// has been silent for too long is sent a PING, and the time until c
+// should be checked again is returned.
+func (s *Server) checkLiveness(c *client.Client, l *liveness) (time.Duration, error) {
+	t := s.conns.classOf(c).Timeouts
+	now := time.Now()
+
+	if !c.Is(client.Registered) {
+		deadline := l.connected.Add(t.Registration)
+		if !now.Before(deadline) {
+			return 0, fmt.Errorf("%w (%.f seconds)", ErrRegistrationTimeout, t.Registration.Seconds())
+		}
+
+		// check again once registration might have completed, so that
+		// PINGs and idle checks aren't delayed until the registration
+		// deadline
+		wait := deadline.Sub(now)
+		if t.Ping < wait {
+			wait = t.Ping
+		}
+		if t.Idle != 0 && t.Idle < wait {
+			wait = t.Idle
+		}
+		return wait, nil
+	}
+
+	lastRead := c.LastRead()
+	if !l.pingSent.IsZero() {
+		// any message at all means the client is still there
+		if lastRead.After(l.pingSent) {
+			l.pingSent = time.Time{}
+		} else if elapsed := now.Sub(l.pingSent); elapsed >= t.Pong {
+			return 0, fmt.Errorf("%w (%.f seconds)", ErrPingTimeout, now.Sub(lastRead).Seconds())
+		} else {
+			return t.Pong - elapsed, nil
+		}
+	}
+
+	idleLimited := t.Idle != 0 && !(t.IdleExemptOpers != nil && *t.IdleExemptOpers && (c.Is(client.Op) || c.Is(client.LocalOp)))
+	if idleLimited && now.Sub(c.Idle) >= t.Idle {
+		return 0, fmt.Errorf("%w (%.f seconds)", ErrIdleTimeout, t.Idle.Seconds())
+	}
+
+	var wait time.Duration
+	if silent := now.Sub(lastRead); silent >= t.Ping {
+		c.WriteMessage(msg.New(nil, s.Config().Name, "", "", "PING", []string{c.Nick}, false))
+		l.pingSent = now
+		wait = t.Pong
+	} else {
+		wait = t.Ping - silent
+	}
+
+	if idleLimited {
+		if untilIdle := c.Idle.Add(t.Idle).Sub(now); untilIdle < wait {
+			wait = untilIdle
+		}
+	}
+	return wait, nil
+}
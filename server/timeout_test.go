@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPingTimeout(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Timeouts: Timeouts{Ping: time.Millisecond * 50, Pong: time.Millisecond * 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+
+	ping, _ := r.ReadBytes('\n')
+	assertResponse(ping, ":gossip PING alice\r\n", t)
+
+	resp, _ := r.ReadString('\n')
+	if !strings.HasPrefix(resp, "ERROR :Closing Link: PING timeout") {
+		t.Error("expected PING timeout, got", resp)
+	}
+}
+
+func TestRegistrationTimeout(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Timeouts: Timeouts{Registration: time.Millisecond * 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, _ := net.Dial("tcp", ":6667")
+	defer c.Close()
+	c.Write([]byte("NICK alice\r\n"))
+
+	resp, _ := bufio.NewReader(c).ReadString('\n')
+	if !strings.HasPrefix(resp, "ERROR :Closing Link: Client failed to register in allotted time") {
+		t.Error("expected registration timeout, got", resp)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667", Timeouts: Timeouts{Idle: time.Millisecond * 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, r := connectAndRegister("alice")
+	defer c.Close()
+
+	// keepalives should not reset the idle timer
+	c.Write([]byte("PING keepalive\r\n"))
+	r.ReadBytes('\n')
+
+	resp, _ := r.ReadString('\n')
+	if !strings.HasPrefix(resp, "ERROR :Closing Link: Idle for too long") {
+		t.Error("expected idle timeout, got", resp)
+	}
+}
+
+func TestClassIdleExemptOpersOverride(t *testing.T) {
+	exempt, notExempt := true, false
+
+	class := Timeouts{IdleExemptOpers: &notExempt}
+	class.fill(Timeouts{IdleExemptOpers: &exempt})
+	if *class.IdleExemptOpers {
+		t.Error("a class should be able to stop exempting operators")
+	}
+
+	class = Timeouts{}
+	class.fill(Timeouts{IdleExemptOpers: &exempt})
+	if !*class.IdleExemptOpers {
+		t.Error("a class should inherit the default exemption")
+	}
+}
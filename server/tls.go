@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// A KeyPair is the location of a certificate and its private key
+type KeyPair struct {
+	Pubkey  string `json:"pubkey"`
+	Privkey string `json:"privkey"`
+}
+
+// prepareTLS builds the tls.Config that clients are served with
+func (c *Config) prepareTLS() error {
+	pairs := append([]KeyPair{{c.TLS.Pubkey, c.TLS.Privkey}}, c.TLS.SNI...)
+	certs, err := newCertStore(pairs)
+	if err != nil {
+		return err
+	}
+
+	conf := &tls.Config{GetCertificate: certs.getCertificate}
+
+	switch c.TLS.MinVersion {
+	case "", "1.2":
+		conf.MinVersion = tls.VersionTLS12
+	case "1.3":
+		conf.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("unsupported TLS version %s", c.TLS.MinVersion)
+	}
+
+	if len(c.TLS.Ciphers) > 0 {
+		ids := make(map[string]uint16)
+		for _, v := range tls.CipherSuites() {
+			ids[v.Name] = v.ID
+		}
+		for _, name := range c.TLS.Ciphers {
+			id, ok := ids[name]
+			if !ok {
+				return fmt.Errorf("unknown or insecure cipher suite %s", name)
+			}
+			conf.CipherSuites = append(conf.CipherSuites, id)
+		}
+	}
+
+	switch c.TLS.ClientAuth {
+	case "", "request":
+		conf.ClientAuth = tls.RequestClientCert
+	case "verify":
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unsupported clientAuth mode %s", c.TLS.ClientAuth)
+	}
+	if conf.ClientAuth != tls.RequestClientCert {
+		if c.TLS.ClientCA == "" {
+			return errors.New("TLS.ClientCA must be defined to verify client certificates")
+		}
+		b, err := os.ReadFile(c.TLS.ClientCA)
+		if err != nil {
+			return err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %s", c.TLS.ClientCA)
+		}
+	}
+
+	c.TLS.Config = conf
+	c.TLS.certs = certs
+	return nil
+}
+
+// leaf returns the certificate that is served to clients that don't ask
+// for a specific server name, or nil if no certificates were loaded
+func (c *Config) leaf() *x509.Certificate {
+	if c.TLS.certs == nil {
+		return nil
+	}
+	return c.TLS.certs.leaf()
+}
+
+// tlsConfig always serves clients with the current TLS configuration,
+// so that changes made by REHASH apply to the existing listener
+func (s *Server) tlsConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return s.Config().TLS.Config, nil
+}
+
+// how often a certStore checks whether its files have changed
+const certCheckInterval = 5 * time.Second
+
+// A certStore holds the server's certificates, and reloads each one when
+// its files change.
+type certStore struct {
+	sync.RWMutex
+	pairs []*loadedPair
+	// when the files were last checked for changes
+	checked time.Time
+}
+
+type loadedPair struct {
+	KeyPair
+	cert *tls.Certificate
+	// when the files were last modified as of loading them
+	modified time.Time
+	// when the files were last modified as of failing to load them, so
+	// that they aren't tried again until they change
+	failed time.Time
+}
+
+func newCertStore(pairs []KeyPair) (*certStore, error) {
+	s := &certStore{checked: time.Now()}
+	for _, v := range pairs {
+		p := &loadedPair{KeyPair: v}
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+		s.pairs = append(s.pairs, p)
+	}
+	return s, nil
+}
+
+// lastModified returns the time that either of p's files was last
+// changed
+func (p *loadedPair) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{p.Pubkey, p.Privkey} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (p *loadedPair) load() error {
+	modified, err := p.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.Pubkey, p.Privkey)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	p.cert = &cert
+	p.modified = modified
+	return nil
+}
+
+// reload loads any certificates whose files have changed, at most once
+// every certCheckInterval. If a new certificate can't be loaded, perhaps
+// because only one of its files has been written so far, the old one is
+// kept until the files change again.
+func (s *certStore) reload() {
+	s.RLock()
+	due := time.Since(s.checked) >= certCheckInterval
+	s.RUnlock()
+	if !due {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	// another handshake may have gotten here first
+	if time.Since(s.checked) < certCheckInterval {
+		return
+	}
+	s.checked = time.Now()
+
+	for _, p := range s.pairs {
+		modified, err := p.lastModified()
+		if err != nil || modified.Equal(p.modified) || modified.Equal(p.failed) {
+			continue
+		}
+		if err := p.load(); err != nil {
+			p.failed = modified
+			log.Println("could not reload certificate:", err)
+		}
+	}
+}
+
+// getCertificate chooses the certificate that matches the server name
+// that the client asked for, falling back to the default certificate
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.reload()
+
+	s.RLock()
+	defer s.RUnlock()
+	if hello.ServerName != "" {
+		for _, p := range s.pairs {
+			if p.cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return p.cert, nil
+			}
+		}
+	}
+	return s.pairs[0].cert, nil
+}
+
+func (s *certStore) leaf() *x509.Certificate {
+	s.reload()
+
+	s.RLock()
+	defer s.RUnlock()
+	return s.pairs[0].cert.Leaf
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeKeyPair writes a self-signed certificate for names, and its key,
+// to files in dir
+func writeKeyPair(t *testing.T, dir string, names ...string) KeyPair {
+	t.Helper()
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     names,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	certBytes, _ := x509.CreateCertificate(rand.Reader, &template, &template, pub, priv)
+	privBytes, _ := x509.MarshalPKCS8PrivateKey(priv)
+
+	pair := KeyPair{filepath.Join(dir, names[0]+".crt"), filepath.Join(dir, names[0]+".key")}
+	os.WriteFile(pair.Pubkey, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0644)
+	os.WriteFile(pair.Privkey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0644)
+	return pair
+}
+
+func TestSNI(t *testing.T) {
+	dir := t.TempDir()
+	def := writeKeyPair(t, dir, "gossip")
+
+	c := &Config{}
+	c.TLS.Pubkey, c.TLS.Privkey = def.Pubkey, def.Privkey
+	c.TLS.SNI = []KeyPair{writeKeyPair(t, dir, "irc.example.com"), writeKeyPair(t, dir, "*.example.org")}
+	if err := c.prepareTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"", "gossip"},
+		{"irc.example.com", "irc.example.com"},
+		{"chat.example.org", "*.example.org"},
+		{"irc.example.net", "gossip"},
+	}
+	for _, tt := range tests {
+		cert, _ := c.TLS.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if cert.Leaf.DNSNames[0] != tt.expected {
+			t.Errorf("%q: expected certificate for %s, got %s", tt.serverName, tt.expected, cert.Leaf.DNSNames[0])
+		}
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeKeyPair(t, dir, "gossip")
+
+	c := &Config{}
+	c.TLS.Pubkey, c.TLS.Privkey = pair.Pubkey, pair.Privkey
+	if err := c.prepareTLS(); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := c.TLS.GetCertificate(&tls.ClientHelloInfo{})
+
+	// a renewed certificate is written over the old one
+	renewed := writeKeyPair(t, t.TempDir(), "gossip")
+	for _, v := range [][2]string{{renewed.Pubkey, pair.Pubkey}, {renewed.Privkey, pair.Privkey}} {
+		b, _ := os.ReadFile(v[0])
+		os.WriteFile(v[1], b, 0644)
+		later := time.Now().Add(time.Second)
+		os.Chtimes(v[1], later, later)
+	}
+
+	// the files are only checked every so often
+	cert, _ := c.TLS.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.SerialNumber.Cmp(old.Leaf.SerialNumber) != 0 {
+		t.Error("certificate was reloaded before it was due to be checked")
+	}
+
+	c.TLS.certs.checked = time.Time{}
+	cert, _ = c.TLS.GetCertificate(&tls.ClientHelloInfo{})
+	if cert.Leaf.SerialNumber.Cmp(old.Leaf.SerialNumber) == 0 {
+		t.Error("certificate was not reloaded")
+	}
+}
+
+func TestCertificateReloadFailure(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeKeyPair(t, dir, "gossip")
+
+	c := &Config{}
+	c.TLS.Pubkey, c.TLS.Privkey = pair.Pubkey, pair.Privkey
+	if err := c.prepareTLS(); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := c.TLS.GetCertificate(&tls.ClientHelloInfo{})
+
+	// only the certificate has been written so far
+	os.WriteFile(pair.Pubkey, []byte("not a certificate"), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(pair.Pubkey, later, later)
+
+	c.TLS.certs.checked = time.Time{}
+	cert, _ := c.TLS.GetCertificate(&tls.ClientHelloInfo{})
+	if cert != old {
+		t.Error("the old certificate should be kept")
+	}
+	if p := c.TLS.certs.pairs[0]; !p.failed.Equal(later) {
+		t.Error("the broken files should be remembered until they change")
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	dir := t.TempDir()
+	pair := writeKeyPair(t, dir, "gossip")
+
+	conf := &Config{Name: "gossip", Port: ":6667"}
+	conf.TLS.Enabled = true
+	conf.TLS.Port = ":6697"
+	conf.TLS.Pubkey, conf.TLS.Privkey = pair.Pubkey, pair.Privkey
+	conf.TLS.MinVersion = "1.3"
+	conf.TLS.ClientAuth = "require"
+	conf.TLS.ClientCA = pair.Pubkey
+	if err := conf.prepareTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	handshake := func(c *tls.Config) error {
+		c.InsecureSkipVerify = true
+		conn, err := tls.Dial("tcp", ":6697", c)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		// with TLS 1.3, the client finds out that its certificate was
+		// rejected once it reads
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		_, err = conn.Read(make([]byte, 1))
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return nil
+		}
+		return err
+	}
+
+	if handshake(&tls.Config{MaxVersion: tls.VersionTLS12}) == nil {
+		t.Error("expected TLS 1.2 to be rejected")
+	}
+	if handshake(&tls.Config{}) == nil {
+		t.Error("expected client without a certificate to be rejected")
+	}
+
+	clientCert, _ := tls.LoadX509KeyPair(pair.Pubkey, pair.Privkey)
+	if err := handshake(&tls.Config{Certificates: []tls.Certificate{clientCert}}); err != nil {
+		t.Error("expected client with a certificate from the CA to be accepted, got", err)
+	}
+}
+
+func TestREHASHReloadsTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(pair KeyPair) {
+		b, _ := json.Marshal(map[string]interface{}{
+			"name": "gossip",
+			"port": ":6667",
+			"tls":  map[string]interface{}{"enabled": true, "port": ":6697", "pubkey": pair.Pubkey, "privkey": pair.Privkey},
+		})
+		os.WriteFile(filepath.Join(dir, "config.json"), b, 0644)
+	}
+	serial := func() *big.Int {
+		conn, err := tls.Dial("tcp", ":6697", &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+
+	writeConfig(writeKeyPair(t, t.TempDir(), "gossip"))
+	f, _ := os.Open(filepath.Join(dir, "config.json"))
+	defer f.Close()
+	conf, err := NewConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass, _ := bcrypt.GenerateFromPassword([]byte("adminpass"), bcrypt.MinCost)
+	conf.Ops = map[string][]byte{"admin": pass}
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	before := serial()
+	writeConfig(writeKeyPair(t, t.TempDir(), "gossip"))
+
+	c, r := connectAndRegister("a")
+	defer c.Close()
+	c.Write([]byte("OPER admin adminpass\r\nREHASH\r\n"))
+	resp, _ := readLines(r, 3)
+	if !strings.HasPrefix(string(resp), ":gossip 382 a ") {
+		t.Fatal("expected rehash, got", string(resp))
+	}
+
+	if serial().Cmp(before) == 0 {
+		t.Error("certificate was not reloaded")
+	}
+}
@@ -0,0 +1,472 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mitchr/gossip/channel"
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/mode"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// Upgrading hands every connection over to a freshly started copy of
+// the server, so that the binary can be replaced without disconnecting
+// anyone. Always-on clients and the plaintext connections of registered
+// clients are carried over. The state of a TLS session lives inside
+// this process and can't be handed to another one, so TLS clients are
+// told why before they are disconnected, and have to reconnect; the
+// operator that started the upgrade is told how many that affects.
+// Clients that are still registering are asked to reconnect as well.
+
+var (
+	ErrUpgrading           = errors.New("Closing Link: Server is upgrading, please reconnect")
+	ErrUpgradingTLS        = errors.New("Closing Link: Server is upgrading, TLS connections must reconnect")
+	ErrUpgradeUnsupported  = errors.New("upgrading is not supported on this platform")
+	ErrUpgradeInProgress   = errors.New("an upgrade is already in progress")
+	errConnNotTransferable = errors.New("connection cannot be transferred")
+)
+
+// upgradeEnv is set in the environment of the new process
+const upgradeEnv = "GOSSIP_UPGRADE"
+
+// upgradeState is everything that the new process needs to resume the
+// sessions of the process that it replaces. Files are referred to by
+// their index in the new process's inherited files.
+type upgradeState struct {
+	Created time.Time `json:"created"`
+	Max     uint      `json:"max"`
+
+	Listener    int `json:"listener"`
+	TLSListener int `json:"tlsListener"`
+
+	Clients  []upgradeClient            `json:"clients"`
+	Channels []upgradeChannel           `json:"channels"`
+	Monitor  map[string]map[string]bool `json:"monitor"`
+}
+
+type upgradeClient struct {
+	// -1 for an always-on client, which has no connection of its own
+	File int `json:"file"`
+	// input that was received but not yet processed
+	Pending []byte `json:"pending"`
+
+	Nick     string `json:"nick"`
+	User     string `json:"user"`
+	Realname string `json:"realname"`
+	Host     string `json:"host"`
+
+	JoinTime int64       `json:"joinTime"`
+	Idle     time.Time   `json:"idle"`
+	Mode     client.Mode `json:"mode"`
+	AwayMsg  string      `json:"awayMsg"`
+
+	Caps       map[string]bool `json:"caps"`
+	CapVersion int             `json:"capVersion"`
+
+	// empty if the client is not authenticated
+	Account string `json:"account"`
+	// the account of the always-on client that this session is attached
+	// to, if any
+	AttachedTo string `json:"attachedTo"`
+
+	Metadata     map[string]string `json:"metadata"`
+	MetadataSubs []string          `json:"metadataSubs"`
+	// the multiline batch that the client has open, if any
+	Batch *upgradeBatch `json:"batch"`
+
+	AlwaysOn bool   `json:"alwaysOn"`
+	Addr     string `json:"addr"`
+	// the messages that an always-on client has missed, grouped as they
+	// will be replayed
+	Missed [][]string `json:"missed"`
+}
+
+type upgradeBatch struct {
+	ID      string        `json:"id"`
+	Target  string        `json:"target"`
+	Tags    []msg.Tag     `json:"tags"`
+	Command string        `json:"command"`
+	Lines   []upgradeLine `json:"lines"`
+	Bytes   int           `json:"bytes"`
+	// the code, context, and description that the batch will be
+	// rejected with
+	Err []string `json:"err"`
+}
+
+type upgradeLine struct {
+	Tags   []msg.Tag `json:"tags"`
+	Text   string    `json:"text"`
+	Concat bool      `json:"concat"`
+}
+
+type upgradeChannel struct {
+	channelState
+	// nick to the mode letters of that member's prefixes
+	Members map[string]string `json:"members"`
+	Invited []string          `json:"invited"`
+}
+
+// resumedAccount stands in for the SASL mechanism that a client used to
+// authenticate before the upgrade.
+type resumedAccount string
+
+func (a resumedAccount) Next([]byte) ([]byte, error) { return nil, nil }
+func (a resumedAccount) Authn() string               { return string(a) }
+
+// resumedAddr is the address of an always-on client that was resumed
+// after an upgrade
+type resumedAddr string
+
+func (a resumedAddr) Network() string { return "tcp" }
+func (a resumedAddr) String() string  { return string(a) }
+
+// prefixConn replays input that the old process had already read
+// before reading from the connection itself
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (p *prefixConn) Read(b []byte) (int, error) { return p.r.Read(b) }
+
+// detachSessions stops serving every client and gives up their
+// connections. The returned state refers to the returned files by
+// their index in that slice; the client whose connection each file
+// holds is at the same index of the returned clients.
+func (s *Server) detachSessions() (*upgradeState, []*client.Client, []*os.File, error) {
+	if !s.upgrading.CompareAndSwap(false, true) {
+		return nil, nil, nil, ErrUpgradeInProgress
+	}
+
+	clients := s.conns.all()
+	for _, c := range clients {
+		c.StopReading()
+	}
+	for _, c := range clients {
+		<-s.conns.released(c)
+	}
+
+	st := &upgradeState{
+		Created:     s.created,
+		Max:         s.max.Get(),
+		TLSListener: -1,
+		Monitor:     make(map[string]map[string]bool),
+	}
+	var detached []*client.Client
+	var files []*os.File
+
+	for _, c := range clients {
+		if !c.Is(client.Registered) {
+			QUIT(s, c, &msg.Message{Params: []string{ErrUpgrading.Error()}})
+			continue
+		}
+		if c.IsSecure() {
+			c.WriteMessage(s.NOTICE(c, "This server is upgrading. TLS connections can't be handed over to the new process, so please reconnect"))
+			QUIT(s, c, &msg.Message{Params: []string{ErrUpgradingTLS.Error()}})
+			continue
+		}
+
+		f, pending, err := c.Detach()
+		if err != nil {
+			QUIT(s, c, &msg.Message{Params: []string{ErrUpgrading.Error()}})
+			continue
+		}
+
+		uc := s.snapshotClient(c, len(files), pending)
+		if a := c.AttachedTo(); a != nil {
+			uc.AttachedTo = a.SASLMech.Authn()
+		}
+		st.Clients = append(st.Clients, uc)
+		detached = append(detached, c)
+		files = append(files, f)
+	}
+
+	s.alwaysOnLock.Lock()
+	for _, a := range s.alwaysOn {
+		uc := s.snapshotClient(a, -1, nil)
+		uc.AlwaysOn = true
+		uc.Addr = a.RemoteAddr().String()
+		for _, missed := range a.Missed() {
+			lines := make([]string, len(missed))
+			for i, m := range missed {
+				lines[i] = m.String()
+			}
+			uc.Missed = append(uc.Missed, lines)
+		}
+		st.Clients = append(st.Clients, uc)
+	}
+	s.alwaysOnLock.Unlock()
+
+	s.chanLock.RLock()
+	for _, ch := range s.channels {
+		uc := upgradeChannel{
+			channelState: snapshotChannel(ch),
+			Members:      make(map[string]string),
+			Invited:      ch.Invited,
+		}
+		ch.ForAllMembers(func(m *channel.Member) {
+			uc.Members[m.Nick] = m.ModeLetters()
+		})
+		st.Channels = append(st.Channels, uc)
+	}
+	s.chanLock.RUnlock()
+
+	s.monitor.rwLock.RLock()
+	for k, v := range s.monitor.m {
+		st.Monitor[k] = v
+	}
+	s.monitor.rwLock.RUnlock()
+
+	// wait for anything still queued to be sent before handing off
+	deadline := time.After(s.Config().ShutdownGrace)
+	for _, c := range clients {
+		select {
+		case <-c.Flushed():
+		case <-deadline:
+		}
+	}
+
+	return st, detached, files, nil
+}
+
+func (s *Server) snapshotClient(c *client.Client, file int, pending []byte) upgradeClient {
+	uc := upgradeClient{
+		File:         file,
+		Pending:      pending,
+		Nick:         c.Nick,
+		User:         c.User,
+		Realname:     c.Realname,
+		Host:         c.Host,
+		JoinTime:     c.JoinTime,
+		Idle:         c.Idle,
+		Mode:         c.Mode,
+		AwayMsg:      c.AwayMsg,
+		Caps:         c.Caps,
+		CapVersion:   c.CapVersion,
+		Metadata:     c.Metadata.All(),
+		MetadataSubs: c.MetadataSubs.Keys(),
+	}
+	if c.IsAuthenticated {
+		uc.Account = c.SASLMech.Authn()
+	}
+
+	s.batchLock.Lock()
+	if b := s.batches[c]; b != nil {
+		uc.Batch = snapshotBatch(b)
+	}
+	s.batchLock.Unlock()
+	return uc
+}
+
+func snapshotBatch(b *multiline) *upgradeBatch {
+	ub := &upgradeBatch{
+		ID:      b.id,
+		Target:  b.target,
+		Tags:    b.tags,
+		Command: b.command,
+		Bytes:   b.bytes,
+	}
+	for _, l := range b.lines {
+		ub.Lines = append(ub.Lines, upgradeLine{l.tags, l.text, l.concat})
+	}
+	if b.err != nil {
+		ub.Err = []string{b.err.code, b.err.context, b.err.description}
+	}
+	return ub
+}
+
+func (ub *upgradeBatch) restore() *multiline {
+	b := &multiline{
+		id:      ub.ID,
+		target:  ub.Target,
+		tags:    ub.Tags,
+		command: ub.Command,
+		bytes:   ub.Bytes,
+	}
+	for _, l := range ub.Lines {
+		b.lines = append(b.lines, multilineLine{l.Tags, l.Text, l.Concat})
+	}
+	if len(ub.Err) == 3 {
+		b.err = &batchError{ub.Err[0], ub.Err[1], ub.Err[2]}
+	}
+	return b
+}
+
+// restore copies everything but the connection from uc into c
+func (uc *upgradeClient) restore(c *client.Client) {
+	c.Nick = uc.Nick
+	c.User = uc.User
+	c.Realname = uc.Realname
+	c.Host = uc.Host
+	c.JoinTime = uc.JoinTime
+	c.Idle = uc.Idle
+	c.Mode = uc.Mode
+	c.AwayMsg = uc.AwayMsg
+	c.Caps = uc.Caps
+	if c.Caps == nil {
+		c.Caps = make(map[string]bool)
+	}
+	c.CapVersion = uc.CapVersion
+	if uc.Account != "" {
+		c.IsAuthenticated = true
+		c.SASLMech = resumedAccount(uc.Account)
+	}
+}
+
+// restoreMetadata gives c the metadata and subscriptions in uc
+func (uc *upgradeClient) restoreMetadata(c *client.Client) {
+	for k, v := range uc.Metadata {
+		c.Metadata.Set(k, v)
+	}
+	for _, k := range uc.MetadataSubs {
+		c.MetadataSubs.Add(k)
+	}
+}
+
+// resumeAlwaysOn recreates the always-on client described by uc
+func (s *Server) resumeAlwaysOn(uc upgradeClient) {
+	var missed [][]*msg.Message
+	for _, lines := range uc.Missed {
+		var group []*msg.Message
+		for _, l := range lines {
+			tokens, err := msg.Lex([]byte(l))
+			if err != nil {
+				continue
+			}
+			if m, err := msg.Parse(tokens); err == nil {
+				group = append(group, m)
+			}
+		}
+		if len(group) > 0 {
+			missed = append(missed, group)
+		}
+	}
+
+	from := &client.Client{}
+	uc.restore(from)
+	a := client.ResumeAlwaysOn(from, resumedAddr(uc.Addr), s.Config().AlwaysOn.Replay, missed)
+	a.AwayMsg = uc.AwayMsg
+	uc.restoreMetadata(a)
+
+	s.alwaysOnLock.Lock()
+	s.alwaysOn[strings.ToLower(uc.Account)] = a
+	s.alwaysOnLock.Unlock()
+	s.setClient(a)
+}
+
+// resumeSessions picks up the sessions described by st. file returns
+// the inherited file at the given index.
+func (s *Server) resumeSessions(ctx context.Context, st *upgradeState, file func(int) *os.File) error {
+	s.created = st.Created
+	s.max.KeepMax(st.Max)
+
+	type resumed struct {
+		c    *client.Client
+		conn connection
+	}
+	var sessions []resumed
+
+	// always-on clients come first, so that their sessions have
+	// something to attach to
+	for _, uc := range st.Clients {
+		if uc.AlwaysOn {
+			s.resumeAlwaysOn(uc)
+		}
+	}
+
+	for _, uc := range st.Clients {
+		if uc.AlwaysOn {
+			continue
+		}
+
+		f := file(uc.File)
+		u, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if len(uc.Pending) > 0 {
+			u = &prefixConn{u, io.MultiReader(bytes.NewReader(uc.Pending), u)}
+		}
+
+		var a *client.Client
+		if uc.AttachedTo != "" {
+			s.alwaysOnLock.Lock()
+			a = s.alwaysOn[strings.ToLower(uc.AttachedTo)]
+			s.alwaysOnLock.Unlock()
+			if a == nil {
+				reject(u, ErrUpgrading)
+				continue
+			}
+		}
+
+		class := s.classify(u, uc.Account)
+		conn, err := s.admit(u, class)
+		if err != nil {
+			reject(u, err)
+			continue
+		}
+
+		c := client.New(u, class.SendQ)
+		uc.restore(c)
+		uc.restoreMetadata(c)
+		if uc.Batch != nil {
+			s.batchLock.Lock()
+			s.batches[c] = uc.Batch.restore()
+			s.batchLock.Unlock()
+		}
+
+		if a != nil {
+			s.replay(c, a.AttachSession(c))
+		} else {
+			s.setClient(c)
+		}
+		sessions = append(sessions, resumed{c, conn})
+	}
+
+	for _, uc := range st.Channels {
+		ch := channel.New(uc.Name, uc.ChanType)
+		uc.restore(ch)
+		ch.MaxList = s.Config().Limits.List
+		ch.Invited = uc.Invited
+
+		for nick, letters := range uc.Members {
+			c, ok := s.getClient(nick)
+			if !ok {
+				continue
+			}
+			m := &channel.Member{Client: c}
+			for _, l := range []byte(letters) {
+				m.ApplyMode(mode.Mode{ModeChar: l, Type: mode.Add})
+			}
+			ch.SetMember(m)
+		}
+
+		if ch.Len() > 0 {
+			s.setChannel(ch)
+		}
+	}
+
+	s.monitor.rwLock.Lock()
+	for k, v := range st.Monitor {
+		s.monitor.m[k] = v
+	}
+	s.monitor.rwLock.Unlock()
+
+	// only start processing messages once everything is in place
+	for _, r := range sessions {
+		s.wg.Add(1)
+		go func(r resumed) {
+			defer s.wg.Done()
+			s.serveClient(r.c, r.conn, ctx)
+		}(r)
+	}
+	return nil
+}
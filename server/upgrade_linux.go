@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/mitchr/gossip/client"
+	"github.com/mitchr/gossip/scan/msg"
+)
+
+// executable finds the program that Upgrade starts
+var executable = os.Executable
+
+// Upgrade starts a new copy of the server from the current executable
+// and hands it every listener and client connection. Once the new
+// process has started, this server stops.
+func (s *Server) Upgrade() error {
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+
+	// the listeners are handed over too, so that no connections are
+	// refused while the new process starts
+	listeners := []net.Listener{s.listener}
+	if s.tlsTCPListener != nil {
+		listeners = append(listeners, s.tlsTCPListener)
+	}
+	var listenerFiles []*os.File
+	for _, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errConnNotTransferable
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		listenerFiles = append(listenerFiles, f)
+	}
+
+	// anything that can fail is done before the clients are detached,
+	// since they can't be served again afterwards
+	stateFile, err := os.CreateTemp("", "gossip-upgrade")
+	if err != nil {
+		return err
+	}
+	defer stateFile.Close()
+	// the new process inherits the open file, so it doesn't need a name
+	os.Remove(stateFile.Name())
+
+	st, clients, clientFiles, err := s.detachSessions()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range clientFiles {
+			f.Close()
+		}
+	}()
+
+	if err := s.saveState(); err != nil {
+		log.Println("could not save server state:", err)
+	}
+
+	// the state file comes first, followed by the listeners, and then
+	// each client
+	st.Listener = 1
+	if len(listenerFiles) > 1 {
+		st.TLSListener = 2
+	}
+	offset := 1 + len(listenerFiles)
+	for i := range st.Clients {
+		if st.Clients[i].File != -1 {
+			st.Clients[i].File += offset
+		}
+	}
+
+	if err := json.NewEncoder(stateFile).Encode(st); err != nil {
+		s.abandon(clients, clientFiles)
+		return err
+	}
+	if _, err := stateFile.Seek(0, 0); err != nil {
+		s.abandon(clients, clientFiles)
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"=1")
+	cmd.ExtraFiles = append(append([]*os.File{stateFile}, listenerFiles...), clientFiles...)
+	if err := cmd.Start(); err != nil {
+		// the listeners share their files' blocking mode, which starting the
+		// process turned on
+		setNonblock(listeners)
+		s.abandon(clients, clientFiles)
+		return err
+	}
+
+	s.stopOnce.Do(func() {
+		s.Close()
+		close(s.stopped)
+	})
+	return nil
+}
+
+// abandon disconnects clients whose connections were detached for an
+// upgrade that then failed. Nothing serves them anymore, so they quit
+// like any other client that goes away.
+func (s *Server) abandon(clients []*client.Client, files []*os.File) {
+	for i, c := range clients {
+		fmt.Fprintf(files[i], "ERROR :%s\r\n", ErrUpgrading)
+		QUIT(s, c, &msg.Message{Params: []string{ErrUpgrading.Error()}})
+	}
+	s.upgrading.Store(false)
+}
+
+// setNonblock puts each listener back into non-blocking mode, so that
+// it can be polled and closed again
+func setNonblock(listeners []net.Listener) {
+	for _, l := range listeners {
+		sc, ok := l.(syscall.Conn)
+		if !ok {
+			continue
+		}
+		if rc, err := sc.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) { syscall.SetNonblock(int(fd), true) })
+		}
+	}
+}
+
+// inheritedFile returns the file that was passed to this process at
+// index i of exec.Cmd.ExtraFiles
+func inheritedFile(i int) *os.File {
+	return os.NewFile(uintptr(3+i), fmt.Sprintf("inherited-%d", i))
+}
+
+// inherit takes over the listeners and sessions of the process that
+// this one is replacing, if this process was started by Upgrade.
+func (s *Server) inherit() (bool, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return false, nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	stateFile := inheritedFile(0)
+	defer stateFile.Close()
+
+	st := &upgradeState{}
+	if err := json.NewDecoder(stateFile).Decode(st); err != nil {
+		return false, err
+	}
+
+	listen := func(i int) (net.Listener, error) {
+		f := inheritedFile(i)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+
+	var err error
+	s.listener, err = listen(st.Listener)
+	if err != nil {
+		return false, err
+	}
+	if st.TLSListener != -1 {
+		s.tlsTCPListener, err = listen(st.TLSListener)
+		if err != nil {
+			return false, err
+		}
+	} else if s.Config().TLS.Enabled {
+		return false, errors.New("TLS was enabled, but the old process had no TLS listener")
+	}
+
+	s.resumed = st
+	return true, nil
+}
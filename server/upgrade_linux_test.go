@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// When Upgrade starts a new copy of the test binary, it takes over as
+// the server until every client that it was handed has left.
+func TestMain(m *testing.M) {
+	if os.Getenv(upgradeEnv) == "" {
+		os.Exit(m.Run())
+	}
+
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		os.Exit(1)
+	}
+	// resume the sessions before serving, so that they can be counted
+	// from the start
+	if err := s.resumeSessions(context.Background(), s.resumed, inheritedFile); err != nil {
+		os.Exit(1)
+	}
+	s.resumed = nil
+	go s.Serve()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for s.clientLen() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+	os.Exit(0)
+}
+
+func TestUpgradeResumesSessions(t *testing.T) {
+	old, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go old.Serve()
+
+	alice, aliceResp := connectAndRegister("alice")
+	defer alice.Close()
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+
+	alice.Write([]byte("JOIN #test\r\nMODE #test +m\r\n"))
+	readLines(aliceResp, 4)
+	bob.Write([]byte("JOIN #test\r\n"))
+	readLines(bobResp, 3)
+	readLines(aliceResp, 1)
+
+	st, _, files, err := old.detachSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	s, err := New(&Config{Name: "gossip", Port: ":6668"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	err = s.resumeSessions(context.Background(), st, func(i int) *os.File { return files[i] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch, ok := s.getChannel("#test")
+	if !ok {
+		t.Fatal("channel was not resumed")
+	}
+	if !ch.Moderated {
+		t.Error("channel modes were not resumed")
+	}
+	if m, _ := ch.GetMember("alice"); m == nil || m.HighestPrefix(false) != "@" {
+		t.Error("member prefixes were not resumed")
+	}
+
+	// the same connections should now be served by the new server
+	alice.Write([]byte("PRIVMSG #test :still here\r\n"))
+	resp, _ := bobResp.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost PRIVMSG #test :still here\r\n", t)
+}
+
+func TestUpgradeResumesAlwaysOn(t *testing.T) {
+	old := newAlwaysOnServer(t)
+
+	alice, aliceResp := login("alice", "")
+	alice.Write([]byte("JOIN #test\r\nQUIT\r\n"))
+	readLines(aliceResp, 4)
+	alice.Close()
+	a, _ := old.getClient("alice")
+	a.Metadata.Set("avatar", "https://example.com/alice.png")
+
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+	bob.Write([]byte("CAP REQ draft/multiline\r\nPRIVMSG alice :hello\r\nBATCH +b draft/multiline #test\r\n@batch=b PRIVMSG #test :one\r\nPING x\r\n"))
+	readUntilPONG(bobResp)
+
+	st, _, files, err := old.detachSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	s := newAlwaysOnServer(t)
+	defer s.Close()
+	err = s.resumeSessions(context.Background(), st, func(i int) *os.File { return files[i] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, ok := s.getClient("alice")
+	if !ok || !a.IsAlwaysOn() {
+		t.Fatal("always-on client was not resumed")
+	}
+	if v, _ := a.Metadata.Get("avatar"); v != "https://example.com/alice.png" {
+		t.Error("metadata was not resumed, got", v)
+	}
+
+	// bob's batch is still open
+	bob.Write([]byte("@batch=b PRIVMSG #test :two\r\nBATCH -b\r\nPING x\r\n"))
+	readUntilPONG(bobResp)
+
+	alice, aliceResp = login("alice", "")
+	defer alice.Close()
+	join, _ := aliceResp.ReadBytes('\n')
+	assertResponse(join, ":alice!alice@localhost JOIN #test\r\n", t)
+	readLines(aliceResp, 2)
+
+	for _, line := range []string{
+		":bob!bob@localhost PRIVMSG alice :hello\r\n",
+		":bob!bob@localhost PRIVMSG #test :one\r\n",
+		":bob!bob@localhost PRIVMSG #test :two\r\n",
+	} {
+		resp, _ := aliceResp.ReadBytes('\n')
+		assertResponse(resp, line, t)
+	}
+}
+
+func TestUpgradeAnnouncesTLSReconnect(t *testing.T) {
+	s, err := New(generateConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	c, err := tls.Dial("tcp", ":6697", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	c.Write([]byte("NICK alice\r\nUSER alice 0 0 :alice\r\n"))
+	readLines(r, 14)
+
+	st, _, _, err := s.detachSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Clients) != 0 {
+		t.Error("TLS client should not be handed over")
+	}
+
+	notice, _ := r.ReadBytes('\n')
+	assertResponse(notice, "NOTICE :This server is upgrading. TLS connections can't be handed over to the new process, so please reconnect\r\n", t)
+	quit, _ := r.ReadBytes('\n')
+	assertResponse(quit, "ERROR :"+ErrUpgradingTLS.Error()+"\r\n", t)
+}
+
+func TestUpgradeExec(t *testing.T) {
+	old, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go old.Serve()
+
+	alice, aliceResp := connectAndRegister("alice")
+	defer alice.Close()
+	bob, bobResp := connectAndRegister("bob")
+	defer bob.Close()
+
+	alice.Write([]byte("JOIN #test\r\n"))
+	readLines(aliceResp, 3)
+	bob.Write([]byte("JOIN #test\r\n"))
+	readLines(bobResp, 3)
+	readLines(aliceResp, 1)
+
+	if err := old.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connections are now served by the new process
+	alice.Write([]byte("PRIVMSG #test :still here\r\n"))
+	resp, _ := bobResp.ReadBytes('\n')
+	assertResponse(resp, ":alice!alice@localhost PRIVMSG #test :still here\r\n", t)
+
+	alice.Write([]byte("QUIT\r\n"))
+	bob.Write([]byte("QUIT\r\n"))
+	readLines(aliceResp, 1)
+	readLines(bobResp, 2)
+
+	// the new process exits once both clients are gone; wait for it to
+	// give up the port
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		l, err := net.Listen("tcp", ":6667")
+		if err == nil {
+			l.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the new process did not exit")
+}
+
+func TestUpgradeStartFails(t *testing.T) {
+	s, err := New(&Config{Name: "gossip", Port: ":6667"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	executable = func() (string, error) { return "/nonexistent/gossip", nil }
+	defer func() { executable = os.Executable }()
+
+	alice, aliceResp := connectAndRegister("alice")
+	defer alice.Close()
+	alice.Write([]byte("JOIN #test\r\n"))
+	readLines(aliceResp, 3)
+
+	if err := s.Upgrade(); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	resp, _ := aliceResp.ReadBytes('\n')
+	assertResponse(resp, "ERROR :"+ErrUpgrading.Error()+"\r\n", t)
+
+	// nothing of alice is left behind
+	if _, ok := s.getClient("alice"); ok {
+		t.Error("alice was not removed")
+	}
+	if _, ok := s.getChannel("#test"); ok {
+		t.Error("#test still has alice as a member")
+	}
+	again, _ := net.Dial("tcp", ":6667")
+	defer again.Close()
+	again.Write([]byte("NICK alice\r\nUSER alice 0 0 :alice\r\n"))
+	resp, _ = bufio.NewReader(again).ReadBytes('\n')
+	assertResponse(resp, fmt.Sprintf(":gossip 001 alice :Welcome to the %s IRC Network alice!alice@localhost\r\n", s.Config().Network), t)
+}
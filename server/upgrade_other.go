@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import "os"
+
+// Upgrade is only supported on Linux.
+func (s *Server) Upgrade() error { return ErrUpgradeUnsupported }
+
+func inheritedFile(i int) *os.File { return nil }
+
+func (s *Server) inherit() (bool, error) { return false, nil }
@@ -31,6 +31,18 @@ func (l *whowasStack) push(nick, user, host, realname string) {
 	l.size++
 }
 
+// all returns every entry in the stack, most recent first
+func (l *whowasStack) all() []whowasInfo {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	entries := make([]whowasInfo, 0, l.size)
+	for current := l.head; current != nil; current = current.next {
+		entries = append(entries, current.data)
+	}
+	return entries
+}
+
 // search searches the stack for any occurence of any nick in nicks,
 // starting with the most recent entries first. If count > 1, up to a
 // count number of entries will be returned.